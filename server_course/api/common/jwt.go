@@ -2,11 +2,11 @@ package common
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
-	"fmt"
-	"os"
-	"server_course/db"
+	"server_course/entities"
+	"server_course/keyring"
 	"strconv"
 	"strings"
 	"time"
@@ -15,50 +15,114 @@ import (
 	jwt "github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateJWT(userID, expires int) (string, error) {
-	jwtSecret := os.Getenv("JWT_SECRET")
+// Claims is what a valid JWT says about its user.
+type Claims struct {
+	UserID int
+	// Roles are the roles the user had when the token was issued.
+	Roles []string
+	// SessionID is the session the token was issued for.
+	SessionID int
+	// TokenID is the jti the token can be revoked by. Tokens issued before
+	// there were jtis have none, they stay valid until they expire.
+	TokenID string
+	// Version is the token version of the user, bumping it revokes the token.
+	Version   int
+	ExpiresAt time.Time
+}
 
-	now := time.Now().UTC()
-	expiresInSeconds := now.Add(time.Second * time.Duration(expires))
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"iss": "chirpy",
-		"iat": now.Unix(),
-		"exp": expiresInSeconds.Unix(),
-		"sub": strconv.Itoa(userID),
-	})
+type chirpyClaims struct {
+	Roles     []string `json:"roles,omitempty"`
+	SessionID int      `json:"sid,omitempty"`
+	Version   int      `json:"ver"`
+	jwt.RegisteredClaims
+}
+
+// NewClaims starts the claims of a new token valid for expires seconds but at
+// most MaxJWTLifetime, For fills in who it is for.
+func NewClaims(expires int) (Claims, error) {
+	tokenID, err := GetRandomString(16)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	lifetime := time.Second * time.Duration(expires)
+	if lifetime > MaxJWTLifetime {
+		lifetime = MaxJWTLifetime
+	}
+
+	return Claims{TokenID: tokenID, ExpiresAt: time.Now().UTC().Add(lifetime)}, nil
+}
+
+func (c Claims) For(user entities.User, sessionID int) Claims {
+	c.UserID = user.ID
+	c.Roles = user.Roles
+	c.Version = user.TokenVersion
+	c.SessionID = sessionID
+	return c
+}
 
-	return token.SignedString([]byte(jwtSecret))
+// MaxJWTLifetime caps how long a JWT is valid, keys have to be kept around
+// for verification at least that long after they stopped signing.
+const MaxJWTLifetime = 24 * time.Hour
+
+// Tokens issues and checks the JWTs of one issuer for one audience.
+type Tokens struct {
+	Keys     *keyring.Keyring
+	Issuer   string
+	Audience string
 }
 
-func ValidJWT(tokenString string) (int, error) {
-	jwtSecret := os.Getenv("JWT_SECRET")
+func NewTokens(keys *keyring.Keyring, issuer, audience string) *Tokens {
+	return &Tokens{Keys: keys, Issuer: issuer, Audience: audience}
+}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(jwtSecret), nil
+// GenerateJWT signs claims made by NewClaims.
+func (t *Tokens) GenerateJWT(claims Claims) (string, error) {
+	return t.Keys.Sign(chirpyClaims{
+		Roles:     claims.Roles,
+		SessionID: claims.SessionID,
+		Version:   claims.Version,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        claims.TokenID,
+			Issuer:    t.Issuer,
+			Audience:  jwt.ClaimStrings{t.Audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(claims.ExpiresAt),
+			Subject:   strconv.Itoa(claims.UserID),
+		},
 	})
+}
+
+func (t *Tokens) ValidJWT(tokenString string) (Claims, error) {
+	var claims chirpyClaims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, t.Keys.Keyfunc,
+		jwt.WithValidMethods([]string{keyring.AlgRS256, keyring.AlgEdDSA}),
+		jwt.WithIssuer(t.Issuer),
+		jwt.WithAudience(t.Audience),
+		jwt.WithExpirationRequired(),
+	)
 
 	if err != nil {
-		return 0, err
+		return Claims{}, err
 	}
 
 	if !token.Valid {
-		return 0, errors.New("token is not valid")
-	}
-
-	subString, err := token.Claims.GetSubject()
-	if err != nil {
-		return 0, err
+		return Claims{}, errors.New("token is not valid")
 	}
 
-	sub, err := strconv.Atoi(subString)
+	sub, err := strconv.Atoi(claims.Subject)
 	if err != nil {
-		return 0, err
+		return Claims{}, err
 	}
 
-	return sub, nil
+	return Claims{
+		UserID:    sub,
+		Roles:     claims.Roles,
+		SessionID: claims.SessionID,
+		TokenID:   claims.ID,
+		Version:   claims.Version,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
 }
 
 func GetRandomString(length int) (string, error) {
@@ -89,25 +153,20 @@ func GetAuthorizationFromHeader(c *gin.Context) (string, error) {
 	return parts[1], nil
 }
 
-func ValidRefreshToken(userStore *db.DB, refreshToken string) (int, bool, error) {
-	users, err := userStore.GetUsers()
+// NewSecretToken returns a fresh refresh or email token together with the
+// hash that is stored in its place.
+func NewSecretToken() (string, string, error) {
+	token, err := GetRandomString(32)
 	if err != nil {
-		return 0, false, err
-	}
-
-	found := false
-	var userID int
-	for _, user := range users {
-		if strings.EqualFold(user.RefreshToken, refreshToken) {
-			userID = user.ID
-			found = true
-			break
-		}
-	}
-
-	if !found {
-		return 0, false, nil
+		return "", "", err
 	}
+	return token, HashSecretToken(token), nil
+}
 
-	return userID, true, nil
+// HashSecretToken hashes a token made by NewSecretToken for lookups. The
+// tokens are random enough that a plain sha256 cannot be brute forced, so no
+// salt is needed.
+func HashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
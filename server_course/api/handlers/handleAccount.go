@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"server_course/api/common"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/mail"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	verifyTokenLifetime = 48 * time.Hour
+	resetTokenLifetime  = time.Hour
+	// mailTimeout bounds how long sending a token waits for the mailer
+	mailTimeout = 5 * time.Second
+)
+
+// sendEmailToken mails user a new token for purpose, tokens mailed for it
+// before stop working.
+func sendEmailToken(store db.Store, mailer mail.Mailer, user entities.User, purpose string) error {
+	token, hash, err := common.NewSecretToken()
+	if err != nil {
+		return err
+	}
+
+	lifetime := verifyTokenLifetime
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email",
+		Body:    fmt.Sprintf("Welcome to Chirpy! Confirm your email by sending this token to POST /api/verify:\n\n%s\n\nIt is valid for 48 hours.", token),
+	}
+	if purpose == entities.EmailTokenReset {
+		lifetime = resetTokenLifetime
+		msg.Subject = "Reset your Chirpy password"
+		msg.Body = fmt.Sprintf("Someone asked to reset your Chirpy password. Send this token along with a new password to POST /api/password/reset:\n\n%s\n\nIt is valid for an hour. If it was not you, ignore this mail.", token)
+	}
+
+	_, err = store.CreateEmailToken(entities.EmailToken{
+		UserID:    user.ID,
+		Email:     user.Email,
+		Purpose:   purpose,
+		Hash:      hash,
+		ExpiresAt: time.Now().UTC().Add(lifetime),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+	return mailer.Send(ctx, msg)
+}
+
+// PostVerify marks the email of a user verified with the token mailed to it.
+func PostVerify(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostVerify")
+
+	return func(c *gin.Context) {
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		token, err := userStore.UseEmailToken(entities.EmailTokenVerify, common.HashSecretToken(body.Token))
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "token is invalid or expired"})
+				return
+			}
+			logger.Error("failed to UseEmailToken", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if _, err := userStore.UpdateUserVerified(token.UserID, true); err != nil {
+			logger.Error("failed to UpdateUserVerified", slog.Int("userID", token.UserID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// PostVerifyResend mails the user a new verification token.
+func PostVerifyResend(l *slog.Logger, userStore db.Store, mailer mail.Mailer) gin.HandlerFunc {
+	logger := l.With("handler", "PostVerifyResend")
+
+	return func(c *gin.Context) {
+		user, ok := c.Value("user").(entities.User)
+		if !ok {
+			logger.Error("user is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("user is not set"))
+			return
+		}
+		if user.Verified {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "email is already verified"})
+			return
+		}
+
+		if err := sendEmailToken(userStore, mailer, user, entities.EmailTokenVerify); err != nil {
+			logger.Error("failed to send verification", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusAccepted)
+	}
+}
+
+// PostPasswordForgot mails a reset token if there is a user with the email.
+// The token is made and mailed after answering, so neither the answer nor how
+// long it takes tells who signed up.
+func PostPasswordForgot(l *slog.Logger, userStore db.Store, mailer mail.Mailer) gin.HandlerFunc {
+	logger := l.With("handler", "PostPasswordForgot")
+
+	return func(c *gin.Context) {
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		user, err := userStore.GetUserByEmail(body.Email)
+		if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+			logger.Error("failed to GetUserByEmail", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if err == nil {
+			go func() {
+				if err := sendEmailToken(userStore, mailer, user, entities.EmailTokenReset); err != nil {
+					logger.Error("failed to send password reset", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+				}
+			}()
+		}
+
+		c.Status(http.StatusAccepted)
+	}
+}
+
+// PostPasswordReset also verifies the email, logs out everywhere and ends a
+// lockout.
+func PostPasswordReset(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostPasswordReset")
+
+	return func(c *gin.Context) {
+		var body struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		if body.Password == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "no password set"})
+			return
+		}
+
+		// a new password bumps the token version
+		user, err := userStore.ResetPassword(common.HashSecretToken(body.Token), body.Password)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "token is invalid or expired"})
+				return
+			}
+			logger.Error("failed to ResetPassword", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if _, err := userStore.RevokeSessions(user.ID, 0); err != nil {
+			logger.Error("failed to RevokeSessions", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if err := unlockAccount(c, userStore, user.ID, "password reset"); err != nil {
+			logger.Error("failed to unlockAccount", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"server_course/entities"
+	"server_course/mail"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// heldMailer hands messages on only once release is closed, like a slow
+// mail server.
+type heldMailer struct {
+	release chan struct{}
+	sent    chan mail.Message
+}
+
+func (m *heldMailer) Send(ctx context.Context, msg mail.Message) error {
+	select {
+	case <-m.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	m.sent <- msg
+	return nil
+}
+
+func TestPostPasswordForgot(t *testing.T) {
+	store := newTestStore(t)
+	u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+
+	mailer := &heldMailer{release: make(chan struct{}), sent: make(chan mail.Message, 2)}
+	r := gin.New()
+	r.POST("/api/password/forgot", PostPasswordForgot(slog.Default(), store, mailer))
+
+	// the mail is still held, an account is answered as fast as nobody
+	for _, email := range []string{u.Email, "jesse@breakingbad.com"} {
+		start := time.Now()
+		w := serve(r, http.MethodPost, "/api/password/forgot", `{"email":"`+email+`"}`)
+		assert.Less(t, time.Since(start), mailTimeout/5, email)
+		assert.Equal(t, http.StatusAccepted, w.Code, email)
+		assert.Empty(t, w.Body.String(), email)
+	}
+
+	close(mailer.release)
+	select {
+	case msg := <-mailer.sent:
+		assert.Equal(t, u.Email, msg.To)
+		assert.Equal(t, "Reset your Chirpy password", msg.Subject)
+	case <-time.After(mailTimeout):
+		t.Fatal("no reset mail was sent")
+	}
+	select {
+	case msg := <-mailer.sent:
+		t.Fatalf("unexpected mail to %s", msg.To)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,12 +1,14 @@
 package handlers
 
 import (
-	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"server_course/db"
 	"server_course/entities"
+	"server_course/events"
+	"server_course/moderation"
 	"strconv"
 	"strings"
 	"time"
@@ -14,78 +16,161 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func PostValidateChirp(l *slog.Logger) gin.HandlerFunc {
+func PostValidateChirp(l *slog.Logger, moderator *moderation.Moderator) gin.HandlerFunc {
 	logger := l.With("handler", "PostValidateChirp")
 
 	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*250)
-		defer cancel()
-
-		var chrip entities.Chirp
-		problems, err := decodeValid(ctx, c, &chrip)
-		if len(problems) > 0 {
-			c.AbortWithStatusJSON(http.StatusBadRequest, problems)
-			return
-		}
-		if err != nil {
-			c.AbortWithError(http.StatusBadRequest, err)
+		chrip, report, ok := decodeModerated(c, moderator, 0)
+		if !ok {
 			return
 		}
 
 		logger.Debug("new validate_chirp", slog.String("body", chrip.Body))
 
-		c.JSON(http.StatusOK, gin.H{
-			"cleaned_body": chrip.Body,
-		})
+		c.JSON(http.StatusOK, report)
 	}
 }
 
-func GetChirp(l *slog.Logger, chirpStore *db.DB) gin.HandlerFunc {
-	logger := l.With("handler", "GetChirp")
+// decodeModerated decodes a chirp and runs its body through moderator,
+// allowing up to maxLength chars, and replaces it with the cleaned body. It
+// aborts the request and returns false if the chirp is not acceptable.
+func decodeModerated(c *gin.Context, moderator *moderation.Moderator, maxLength int) (entities.Chirp, moderation.Report, bool) {
+	var chrip entities.Chirp
+	if err := decode(c, &chrip); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return chrip, moderation.Report{}, false
+	}
 
-	return func(c *gin.Context) {
-		chirps, err := chirpStore.GetChirpsSlice()
-		if err != nil {
-			logger.Error("failed to GetChirps", slog.String("err", err.Error()))
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
+	report := moderator.CheckLength(chrip.Body, maxLength)
+	if len(report.Problems) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, report.Problems)
+		return chrip, report, false
+	}
+	chrip.Body = report.Body
+
+	return chrip, report, true
+}
+
+// reportFlagged puts a chirp that moderation let through but flagged into the
+// review queue. The chirp is already stored, so failing to file the report is
+// only logged.
+func reportFlagged(logger *slog.Logger, reportStore db.Store, chirpID int, report moderation.Report) {
+	if !report.Flagged {
+		return
+	}
+
+	rules := []string{}
+	for _, f := range report.Fired {
+		if f.Action == moderation.ActionFlag {
+			rules = append(rules, f.Rule)
 		}
+	}
+	logger.Info("chirp flagged for review", slog.Int("chirp_id", chirpID), slog.Any("rules", rules))
+
+	_, err := reportStore.StoreReport(entities.Report{
+		TargetType: entities.ReportTargetChirp,
+		TargetID:   chirpID,
+		Reason:     "flagged by rules: " + strings.Join(rules, ", "),
+	})
+	if err != nil {
+		logger.Error("failed to StoreReport", slog.Int("chirp_id", chirpID), slog.String("err", err.Error()))
+	}
+}
 
-		direction := c.Query("sort")
-		if strings.EqualFold(direction, "desc") {
-			n := len(chirps)
-			temp := make([]entities.Chirp, n)
-			for i := 0; i < n; i++ {
-				temp[n-i-1] = chirps[i]
+// parseAuthorIDs reads author_id, which can be repeated or hold a comma
+// separated list. Ids that are not ints are skipped like they always were.
+func parseAuthorIDs(c *gin.Context) []int {
+	var authorIDs []int
+	for _, list := range c.QueryArray("author_id") {
+		for _, authorIDString := range strings.Split(list, ",") {
+			authorID, err := strconv.Atoi(strings.TrimSpace(authorIDString))
+			if err != nil {
+				continue
 			}
-			chirps = temp
+			authorIDs = append(authorIDs, authorID)
 		}
+	}
+	return authorIDs
+}
 
-		requestedAuthorIDString := c.Query("author_id")
-		if requestedAuthorIDString == "" {
-			c.JSON(http.StatusOK, chirps)
-			return
+func parseChirpQuery(c *gin.Context) (db.ChirpQuery, pageParams, error) {
+	params, err := parsePageParams(c)
+	if err != nil {
+		return db.ChirpQuery{}, params, err
+	}
+
+	q := db.ChirpQuery{
+		After:  params.After,
+		Before: params.Before,
+		Limit:  params.Limit,
+		Desc:   strings.EqualFold(c.Query("sort"), "desc"),
+	}
+
+	q.AuthorIDs = parseAuthorIDs(c)
+
+	if since := c.Query("since"); since != "" {
+		q.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return q, params, errors.New("since has to be a RFC 3339 timestamp")
 		}
+	}
+	if until := c.Query("until"); until != "" {
+		q.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return q, params, errors.New("until has to be a RFC 3339 timestamp")
+		}
+	}
+
+	return q, params, nil
+}
+
+func chirpIDs(chirps []entities.Chirp) []int {
+	ids := make([]int, len(chirps))
+	for i, chirp := range chirps {
+		ids[i] = chirp.ID
+	}
+	return ids
+}
 
-		requestedAuthorID, err := strconv.Atoi(requestedAuthorIDString)
+// GetChirp lists all chirps unless a limit is asked for, clients from before
+// paging expect the complete list.
+func GetChirp(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	return listChirps(l.With("handler", "GetChirp"), chirpStore, func(c *gin.Context, q *db.ChirpQuery) bool {
+		if c.Query("limit") == "" {
+			q.Limit = 0
+		}
+		return true
+	})
+}
+
+// listChirps responds with a page of the chirps matching the query parameters.
+// narrow can restrict the query further, it aborts the request and returns
+// false if it can not.
+func listChirps(logger *slog.Logger, chirpStore db.Store, narrow func(c *gin.Context, q *db.ChirpQuery) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, params, err := parseChirpQuery(c)
 		if err != nil {
-			logger.Debug("user author id is bad", slog.String("err", err.Error()))
-			c.JSON(http.StatusOK, chirps)
+			logger.Debug("bad chirp query", slog.String("err", err.Error()))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if narrow != nil && !narrow(c, &q) {
 			return
 		}
 
-		filteredChirps := []entities.Chirp{}
-		for _, chirp := range chirps {
-			if chirp.AuthorID == requestedAuthorID {
-				filteredChirps = append(filteredChirps, chirp)
-			}
+		page, err := chirpStore.ListChirps(q)
+		if err != nil {
+			logger.Error("failed to ListChirps", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
 		}
 
-		c.JSON(http.StatusOK, filteredChirps)
+		setPageHeaders(c, params, chirpIDs(page.Chirps), page.HasMore)
+		c.JSON(http.StatusOK, page.Chirps)
 	}
 }
 
-func GetChirpByID(l *slog.Logger, chirpStore *db.DB) gin.HandlerFunc {
+func GetChirpByID(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
 	logger := l.With("handler", "GetChirp")
 
 	return func(c *gin.Context) {
@@ -118,21 +203,12 @@ func GetChirpByID(l *slog.Logger, chirpStore *db.DB) gin.HandlerFunc {
 	}
 }
 
-func PostChirp(l *slog.Logger, chirpStore *db.DB) gin.HandlerFunc {
+func PostChirp(l *slog.Logger, chirpStore db.Store, bus *events.Bus, moderator *moderation.Moderator) gin.HandlerFunc {
 	logger := l.With("handler", "PostChirp")
 
 	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*250)
-		defer cancel()
-
-		var chrip entities.Chirp
-		problems, err := decodeValid(ctx, c, &chrip)
-		if len(problems) > 0 {
-			c.AbortWithStatusJSON(http.StatusBadRequest, problems)
-			return
-		}
-		if err != nil {
-			c.AbortWithError(http.StatusBadRequest, err)
+		chrip, report, ok := decodeModerated(c, moderator, entitlements(c).MaxChirpLength)
+		if !ok {
 			return
 		}
 
@@ -145,18 +221,25 @@ func PostChirp(l *slog.Logger, chirpStore *db.DB) gin.HandlerFunc {
 
 		chrip.AuthorID = userID
 
-		chrip, err = chirpStore.StoreChirp(chrip)
+		chrip, err := chirpStore.StoreChirp(chrip)
 		if err != nil {
+			if errors.Is(err, db.ErrInvalidReply) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
 			logger.Error("failed to StoreChirp", slog.String("err", err.Error()))
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
+		reportFlagged(logger, chirpStore, chrip.ID, report)
+		bus.Publish(events.Event{Kind: events.ChirpPosted, ActorID: userID, Chirp: chrip})
 		c.JSON(http.StatusCreated, chrip)
 	}
 }
 
-func DeleteChirp(l *slog.Logger, chirpStore *db.DB) gin.HandlerFunc {
+func DeleteChirp(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
 	logger := l.With("handler", "DeleteChirp")
 
 	return func(c *gin.Context) {
@@ -206,3 +289,173 @@ func DeleteChirp(l *slog.Logger, chirpStore *db.DB) gin.HandlerFunc {
 		c.Status(http.StatusNoContent)
 	}
 }
+
+// paramID reads the int path parameter name.
+func paramID(c *gin.Context, name string) (int, error) {
+	idString := c.Param(name)
+	if idString == "" {
+		return 0, fmt.Errorf("%s not set", name)
+	}
+
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		return 0, fmt.Errorf("%s not an int", name)
+	}
+
+	return id, nil
+}
+
+func PutChirp(l *slog.Logger, chirpStore db.Store, moderator *moderation.Moderator) gin.HandlerFunc {
+	logger := l.With("handler", "PutChirp")
+
+	return func(c *gin.Context) {
+		e := entitlements(c)
+		if !e.EditChirps {
+			logger.Debug("plan does not allow edits", slog.Int("userID", c.GetInt("userID")), slog.String("plan", e.Plan))
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "editing chirps is not part of your plan"})
+			return
+		}
+
+		chirpID, err := paramID(c, "chirpID")
+		if err != nil {
+			logger.Debug("bad chirpID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		chrip, report, ok := decodeModerated(c, moderator, e.MaxChirpLength)
+		if !ok {
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		storedChirp, err := chirpStore.GetChirp(chirpID)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to GetChirp", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if storedChirp.AuthorID != userID {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		chrip.ID = chirpID
+		chrip, err = chirpStore.UpdateChirp(chrip)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to UpdateChirp", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		reportFlagged(logger, chirpStore, chrip.ID, report)
+		c.JSON(http.StatusOK, chrip)
+	}
+}
+
+// GetChirpRevisions lists every body a chirp had, the current one last.
+func GetChirpRevisions(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetChirpRevisions")
+
+	return func(c *gin.Context) {
+		chirpID, err := paramID(c, "chirpID")
+		if err != nil {
+			logger.Debug("bad chirpID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		chirp, err := chirpStore.GetChirp(chirpID)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to GetChirp", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		revisions, err := chirpStore.GetChirpRevisions(chirpID)
+		if err != nil {
+			logger.Error("failed to GetChirpRevisions", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		revisions = append(revisions, entities.ChirpRevision{
+			ChirpID:   chirp.ID,
+			Revision:  len(revisions) + 1,
+			Body:      chirp.Body,
+			CreatedAt: chirp.UpdatedAt,
+		})
+
+		c.JSON(http.StatusOK, revisions)
+	}
+}
+
+type threadNode struct {
+	entities.Chirp
+	Replies []*threadNode `json:"replies"`
+}
+
+// GetChirpThread returns the chain of chirps :chirpID answers and the tree of
+// replies below it.
+func GetChirpThread(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetChirpThread")
+
+	return func(c *gin.Context) {
+		chirpID, err := paramID(c, "chirpID")
+		if err != nil {
+			logger.Debug("bad chirpID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		thread, err := chirpStore.GetThread(chirpID)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to GetThread", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		root := &threadNode{Chirp: thread.Chirp, Replies: []*threadNode{}}
+		nodes := map[int]*threadNode{root.ID: root}
+		// descendants are ordered by id so every parent is seen before its replies
+		for _, reply := range thread.Descendants {
+			node := &threadNode{Chirp: reply, Replies: []*threadNode{}}
+			nodes[reply.ID] = node
+			if parent, exists := nodes[reply.InReplyTo]; exists {
+				parent.Replies = append(parent.Replies, node)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ancestors": thread.Ancestors,
+			"chirp":     root,
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/moderation"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newTestStore(t *testing.T) *db.DB {
+	store, err := db.NewDB(t.TempDir())
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// serve runs one request through r and returns the recorded response.
+func serve(r http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestGetChirp(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i < defaultPageLimit+5; i++ {
+		_, err := store.StoreChirp(entities.Chirp{AuthorID: 1 + i%2, Body: "Say my name"})
+		assert.NoError(t, err)
+	}
+
+	r := gin.New()
+	r.GET("/api/chirps", GetChirp(slog.Default(), store))
+
+	count := func(target string) int {
+		w := serve(r, http.MethodGet, target, "")
+		assert.Equal(t, http.StatusOK, w.Code, target)
+		var chirps []entities.Chirp
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &chirps))
+		return len(chirps)
+	}
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/api/chirps", defaultPageLimit + 5},
+		{"/api/chirps?limit=10", 10},
+		{"/api/chirps?author_id=1", (defaultPageLimit + 6) / 2},
+		{"/api/chirps?author_id=", defaultPageLimit + 5},
+		{"/api/chirps?author_id=walt", defaultPageLimit + 5},
+		{"/api/chirps?author_id=walt,2", (defaultPageLimit + 5) / 2},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, count(tt.target), tt.target)
+	}
+}
+
+func TestPostValidateChirp(t *testing.T) {
+	moderator, err := moderation.NewModerator("../../moderation.json")
+	assert.NoError(t, err)
+	r := gin.New()
+	r.POST("/api/validate_chirp", PostValidateChirp(slog.Default(), moderator))
+
+	w := serve(r, http.MethodPost, "/api/validate_chirp", `{"body":"what a kerfuffles"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report moderation.Report
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, "what a ****s", report.Body)
+
+	w = serve(r, http.MethodPost, "/api/validate_chirp", `{"body":"`+strings.Repeat("a", 141)+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "too long")
+}
+
+func TestPutChirp(t *testing.T) {
+	store := newTestStore(t)
+	moderator, err := moderation.NewModerator("../../moderation.json")
+	assert.NoError(t, err)
+	c, err := store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "Say my name"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		userID   int
+		plan     string
+		wantCode int
+	}{
+		{"free plan", 1, entities.PlanFree, http.StatusForbidden},
+		{"not the author", 2, entities.PlanRed, http.StatusForbidden},
+		{"red plan", 1, entities.PlanRed, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.PUT("/api/chirps/:chirpID", func(c *gin.Context) {
+				c.Set("userID", tt.userID)
+				c.Set("entitlements", entities.PlanEntitlements(tt.plan))
+			}, PutChirp(slog.Default(), store, moderator))
+
+			w := serve(r, http.MethodPut, "/api/chirps/"+strconv.Itoa(c.ID), `{"body":"Heisenberg"}`)
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+
+	got, err := store.GetChirp(c.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Heisenberg", got.Body)
+}
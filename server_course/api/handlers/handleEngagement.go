@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/events"
+
+	"github.com/gin-gonic/gin"
+)
+
+func PostLike(l *slog.Logger, chirpStore db.Store, bus *events.Bus) gin.HandlerFunc {
+	return engage(l.With("handler", "PostLike"), chirpStore.Like, publish(bus, events.ChirpLiked))
+}
+
+func DeleteLike(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	return engage(l.With("handler", "DeleteLike"), chirpStore.Unlike, nil)
+}
+
+func PostRechirp(l *slog.Logger, chirpStore db.Store, bus *events.Bus) gin.HandlerFunc {
+	return engage(l.With("handler", "PostRechirp"), chirpStore.Rechirp, publish(bus, events.ChirpRechirped))
+}
+
+func DeleteRechirp(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	return engage(l.With("handler", "DeleteRechirp"), chirpStore.Unrechirp, nil)
+}
+
+func publish(bus *events.Bus, kind events.Kind) func(userID int, chirp entities.Chirp) {
+	return func(userID int, chirp entities.Chirp) {
+		bus.Publish(events.Event{Kind: kind, ActorID: userID, Chirp: chirp})
+	}
+}
+
+// engage applies change for the logged in user to :chirpID and responds with
+// the chirp and its new counters. changed, if set, is called after a
+// successful change.
+func engage(logger *slog.Logger, change func(userID, chirpID int) (entities.Chirp, error), changed func(userID int, chirp entities.Chirp)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chirpID, err := paramID(c, "chirpID")
+		if err != nil {
+			logger.Debug("bad chirpID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		chirp, err := change(userID, chirpID)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to change engagement", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if changed != nil {
+			changed(userID, chirp)
+		}
+		c.JSON(http.StatusOK, chirp)
+	}
+}
+
+func GetUserLikes(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetUserLikes")
+
+	return func(c *gin.Context) {
+		userID, err := paramID(c, "userID")
+		if err != nil {
+			logger.Debug("bad userID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := chirpStore.GetUser(userID); err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to GetUser", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		chirps, err := chirpStore.GetLikedChirps(userID)
+		if err != nil {
+			logger.Error("failed to GetLikedChirps", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, chirps)
+	}
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/events"
+
+	"github.com/gin-gonic/gin"
+)
+
+func PostFollow(l *slog.Logger, userStore db.Store, bus *events.Bus) gin.HandlerFunc {
+	logger := l.With("handler", "PostFollow")
+
+	return func(c *gin.Context) {
+		followeeID, err := paramID(c, "userID")
+		if err != nil {
+			logger.Debug("bad userID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		if followeeID == userID {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "users can not follow themselves"})
+			return
+		}
+
+		err = userStore.Follow(userID, followeeID)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to Follow", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		bus.Publish(events.Event{Kind: events.UserFollowed, ActorID: userID, UserID: followeeID})
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func DeleteFollow(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "DeleteFollow")
+
+	return func(c *gin.Context) {
+		followeeID, err := paramID(c, "userID")
+		if err != nil {
+			logger.Debug("bad userID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		err = userStore.Unfollow(userID, followeeID)
+		if err != nil {
+			logger.Error("failed to Unfollow", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// GetFollowers lists the users following :userID.
+func GetFollowers(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	return listFollowUsers(l.With("handler", "GetFollowers"), userStore, userStore.GetFollowers)
+}
+
+// GetFollowing lists the users :userID follows.
+func GetFollowing(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	return listFollowUsers(l.With("handler", "GetFollowing"), userStore, userStore.GetFollowing)
+}
+
+func listFollowUsers(logger *slog.Logger, userStore db.Store, list func(userID int) ([]int, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := paramID(c, "userID")
+		if err != nil {
+			logger.Debug("bad userID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := userStore.GetUser(userID); err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to GetUser", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		ids, err := list(userID)
+		if err != nil {
+			logger.Error("failed to list follows", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		users := []entities.PublicUser{}
+		for _, id := range ids {
+			user, err := userStore.GetUser(id)
+			if errors.Is(err, db.ErrDoesNotExist) {
+				continue
+			}
+			if err != nil {
+				logger.Error("failed to GetUser", slog.String("err", err.Error()))
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			users = append(users, user.Public())
+		}
+
+		c.JSON(http.StatusOK, users)
+	}
+}
+
+// GetTimeline pages through the chirps of everyone the user follows, newest
+// first unless sort=asc is given.
+func GetTimeline(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetTimeline")
+
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		params, err := parsePageParams(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		following, err := chirpStore.GetFollowing(userID)
+		if err != nil {
+			logger.Error("failed to GetFollowing", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if len(following) == 0 {
+			c.JSON(http.StatusOK, []entities.Chirp{})
+			return
+		}
+
+		page, err := chirpStore.ListChirps(db.ChirpQuery{
+			AuthorIDs: following,
+			After:     params.After,
+			Before:    params.Before,
+			Limit:     params.Limit,
+			Desc:      c.Query("sort") != "asc",
+		})
+		if err != nil {
+			logger.Error("failed to ListChirps", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		setPageHeaders(c, params, chirpIDs(page.Chirps), page.HasMore)
+		c.JSON(http.StatusOK, page.Chirps)
+	}
+}
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"server_course/api/common"
+	"server_course/db"
+	"server_course/entities"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const webhookSecretBytes = 32
+
+// ownWebhookSubscription answers 404 for others' subscriptions so their ids
+// do not leak.
+func ownWebhookSubscription(c *gin.Context, logger *slog.Logger, hookStore db.Store) (entities.WebhookSubscription, bool) {
+	id, err := paramID(c, "webhookID")
+	if err != nil {
+		logger.Debug("bad webhookID", slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusBadRequest, err)
+		return entities.WebhookSubscription{}, false
+	}
+
+	userID := c.GetInt("userID")
+	if userID == 0 {
+		logger.Error("userID is not set")
+		c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+		return entities.WebhookSubscription{}, false
+	}
+
+	sub, err := hookStore.GetWebhookSubscription(id)
+	if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+		logger.Error("failed to GetWebhookSubscription", slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return entities.WebhookSubscription{}, false
+	}
+	if err != nil || sub.UserID != userID {
+		c.AbortWithError(http.StatusNotFound, db.ErrDoesNotExist)
+		return entities.WebhookSubscription{}, false
+	}
+
+	return sub, true
+}
+
+func publicWebhookSubscriptions(subs []entities.WebhookSubscription) []entities.PublicWebhookSubscription {
+	public := make([]entities.PublicWebhookSubscription, len(subs))
+	for i := range subs {
+		public[i] = subs[i].Public()
+	}
+	return public
+}
+
+func PostWebhookSubscription(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostWebhookSubscription")
+
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*250)
+		defer cancel()
+
+		var sub entities.WebhookSubscription
+		problems, err := decodeValid(ctx, c, &sub)
+		if len(problems) > 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, problems)
+			return
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		existing, err := hookStore.ListWebhookSubscriptions(db.WebhookSubscriptionQuery{UserID: userID})
+		if err != nil {
+			logger.Error("failed to ListWebhookSubscriptions", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if len(existing) >= entities.MaxWebhookSubscriptions {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "you can have up to " + strconv.Itoa(entities.MaxWebhookSubscriptions) + " webhooks"})
+			return
+		}
+
+		sub.Secret, err = common.GetRandomString(webhookSecretBytes)
+		if err != nil {
+			logger.Error("failed to GetRandomString", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		sub.UserID = userID
+		sub.Active = true
+		slices.Sort(sub.Events)
+		sub.Events = slices.Compact(sub.Events)
+
+		sub, err = hookStore.CreateWebhookSubscription(sub)
+		if err != nil {
+			logger.Error("failed to CreateWebhookSubscription", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, struct {
+			entities.PublicWebhookSubscription
+			Secret string `json:"secret"`
+		}{sub.Public(), sub.Secret})
+	}
+}
+
+func GetWebhookSubscriptions(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetWebhookSubscriptions")
+
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		subs, err := hookStore.ListWebhookSubscriptions(db.WebhookSubscriptionQuery{UserID: userID})
+		if err != nil {
+			logger.Error("failed to ListWebhookSubscriptions", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, publicWebhookSubscriptions(subs))
+	}
+}
+
+func GetWebhookSubscription(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetWebhookSubscription")
+
+	return func(c *gin.Context) {
+		sub, ok := ownWebhookSubscription(c, logger, hookStore)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, sub.Public())
+	}
+}
+
+func PutWebhookSubscription(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PutWebhookSubscription")
+
+	return func(c *gin.Context) {
+		sub, ok := ownWebhookSubscription(c, logger, hookStore)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			URL    *string  `json:"url"`
+			Events []string `json:"events"`
+			Active *bool    `json:"active"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if body.URL != nil {
+			sub.URL = *body.URL
+		}
+		if body.Events != nil {
+			sub.Events = body.Events
+		}
+		if body.Active != nil {
+			sub.Active = *body.Active
+		}
+		if problems := sub.Valid(c); len(problems) > 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, problems)
+			return
+		}
+		slices.Sort(sub.Events)
+		sub.Events = slices.Compact(sub.Events)
+
+		sub, err := hookStore.UpdateWebhookSubscription(sub)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to UpdateWebhookSubscription", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, sub.Public())
+	}
+}
+
+func DeleteWebhookSubscription(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "DeleteWebhookSubscription")
+
+	return func(c *gin.Context) {
+		sub, ok := ownWebhookSubscription(c, logger, hookStore)
+		if !ok {
+			return
+		}
+
+		if err := hookStore.DeleteWebhookSubscription(sub.ID); err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+			logger.Error("failed to DeleteWebhookSubscription", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func listWebhookDeliveries(c *gin.Context, logger *slog.Logger, hookStore db.Store, subscriptionID int) {
+	params, err := parsePageParams(c)
+	if err != nil {
+		logger.Debug("bad page params", slog.String("err", err.Error()))
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := hookStore.ListWebhookDeliveries(db.WebhookDeliveryQuery{
+		SubscriptionID: subscriptionID,
+		Status:         c.Query("status"),
+		After:          params.After,
+		Before:         params.Before,
+		Limit:          params.Limit,
+	})
+	if err != nil {
+		logger.Error("failed to ListWebhookDeliveries", slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	ids := make([]int, len(page.Deliveries))
+	for i, d := range page.Deliveries {
+		ids[i] = d.ID
+	}
+	setPageHeaders(c, params, ids, page.HasMore)
+
+	c.JSON(http.StatusOK, page.Deliveries)
+}
+
+func GetWebhookDeliveries(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetWebhookDeliveries")
+
+	return func(c *gin.Context) {
+		sub, ok := ownWebhookSubscription(c, logger, hookStore)
+		if !ok {
+			return
+		}
+
+		listWebhookDeliveries(c, logger, hookStore, sub.ID)
+	}
+}
+
+// retryWebhookDelivery only checks the subscription if subscriptionID is set.
+func retryWebhookDelivery(c *gin.Context, logger *slog.Logger, hookStore db.Store, subscriptionID int) {
+	id, err := paramID(c, "deliveryID")
+	if err != nil {
+		logger.Debug("bad deliveryID", slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	delivery, err := hookStore.GetWebhookDelivery(id)
+	if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+		logger.Error("failed to GetWebhookDelivery", slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err != nil || (subscriptionID != 0 && delivery.SubscriptionID != subscriptionID) {
+		c.AbortWithError(http.StatusNotFound, db.ErrDoesNotExist)
+		return
+	}
+	if delivery.Status == entities.DeliveryDelivered {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "delivery was delivered already"})
+		return
+	}
+
+	delivery.Retry(time.Now().UTC())
+	delivery, err = hookStore.UpdateWebhookDelivery(delivery)
+	if err != nil {
+		if errors.Is(err, db.ErrDoesNotExist) {
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+
+		logger.Error("failed to UpdateWebhookDelivery", slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	logger.Info("retrying delivery", slog.Int("id", id), slog.Int("userID", c.GetInt("userID")))
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+func PostWebhookDeliveryRetry(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostWebhookDeliveryRetry")
+
+	return func(c *gin.Context) {
+		sub, ok := ownWebhookSubscription(c, logger, hookStore)
+		if !ok {
+			return
+		}
+
+		retryWebhookDelivery(c, logger, hookStore, sub.ID)
+	}
+}
+
+func GetAdminWebhookSubscriptions(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetAdminWebhookSubscriptions")
+
+	return func(c *gin.Context) {
+		var userID int
+		if userIDString := c.Query("user_id"); userIDString != "" {
+			var err error
+			userID, err = strconv.Atoi(userIDString)
+			if err != nil || userID <= 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "user_id has to be a positive int"})
+				return
+			}
+		}
+
+		subs, err := hookStore.ListWebhookSubscriptions(db.WebhookSubscriptionQuery{UserID: userID})
+		if err != nil {
+			logger.Error("failed to ListWebhookSubscriptions", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, publicWebhookSubscriptions(subs))
+	}
+}
+
+func GetAdminWebhookDeliveries(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetAdminWebhookDeliveries")
+
+	return func(c *gin.Context) {
+		listWebhookDeliveries(c, logger, hookStore, 0)
+	}
+}
+
+func PostAdminWebhookDeliveryRetry(l *slog.Logger, hookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostAdminWebhookDeliveryRetry")
+
+	return func(c *gin.Context) {
+		retryWebhookDelivery(c, logger, hookStore, 0)
+	}
+}
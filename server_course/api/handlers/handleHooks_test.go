@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"server_course/entities"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSubscription_secret(t *testing.T) {
+	store := newTestStore(t)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("userID", 1) })
+	r.POST("/api/webhooks", PostWebhookSubscription(slog.Default(), store))
+	r.GET("/api/webhooks/:webhookID", GetWebhookSubscription(slog.Default(), store))
+
+	// the secret is only shown when the subscription is created
+	w := serve(r, http.MethodPost, "/api/webhooks", `{"url":"https://example.com/hook","events":["chirp.created"],"secret":"mine"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		ID     int    `json:"id"`
+		Secret string `json:"secret"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Len(t, created.Secret, webhookSecretBytes*2)
+
+	w = serve(r, http.MethodGet, "/api/webhooks/"+strconv.Itoa(created.ID), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "secret")
+
+	sub, err := store.GetWebhookSubscription(created.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, created.Secret, sub.Secret)
+}
+
+func TestPostWebhookDeliveryRetry(t *testing.T) {
+	store := newTestStore(t)
+	sub, err := store.CreateWebhookSubscription(entities.WebhookSubscription{UserID: 1, URL: "https://example.com/hook", Events: []string{entities.HookChirpCreated}, Secret: "s", Active: true})
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("userID", 1) })
+	r.POST("/api/webhooks/:webhookID/deliveries/:deliveryID/retry", PostWebhookDeliveryRetry(slog.Default(), store))
+	retry := func(d entities.WebhookDelivery) int {
+		return serve(r, http.MethodPost, "/api/webhooks/"+strconv.Itoa(sub.ID)+"/deliveries/"+strconv.Itoa(d.ID)+"/retry", "").Code
+	}
+
+	dead, err := store.EnqueueWebhookDelivery(entities.WebhookDelivery{SubscriptionID: sub.ID, EventID: "evt_1", Event: entities.HookChirpCreated, Payload: json.RawMessage(`{}`)})
+	assert.NoError(t, err)
+	for i := 0; i < entities.MaxDeliveryAttempts; i++ {
+		dead.Failed(http.StatusInternalServerError, "receiver answered 500", time.Now())
+	}
+	_, err = store.UpdateWebhookDelivery(dead)
+	assert.NoError(t, err)
+
+	// a dead letter starts over without the outcome of its last attempt
+	assert.Equal(t, http.StatusAccepted, retry(dead))
+	dead, err = store.GetWebhookDelivery(dead.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, entities.DeliveryPending, dead.Status)
+	assert.Zero(t, dead.Attempts)
+	assert.Zero(t, dead.ResponseCode)
+	assert.Empty(t, dead.Error)
+
+	delivered, err := store.EnqueueWebhookDelivery(entities.WebhookDelivery{SubscriptionID: sub.ID, EventID: "evt_2", Event: entities.HookChirpCreated, Payload: json.RawMessage(`{}`)})
+	assert.NoError(t, err)
+	delivered.Succeeded(http.StatusOK, time.Now())
+	_, err = store.UpdateWebhookDelivery(delivered)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, retry(delivered))
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+	"server_course/keyring"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jwksMaxAge is how long verifiers may cache the key set. They should fetch
+// it again early when a token names a key they do not know yet.
+const jwksMaxAge = "300"
+
+// GetJWKS publishes the public keys tokens are signed with.
+func GetJWKS(keys *keyring.Keyring) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age="+jwksMaxAge)
+		c.JSON(http.StatusOK, keys.JWKS())
+	}
+}
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PostReport files a report about a chirp or a user for the admins to review.
+func PostReport(l *slog.Logger, reportStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostReport")
+
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*250)
+		defer cancel()
+
+		var report entities.Report
+		problems, err := decodeValid(ctx, c, &report)
+		if len(problems) > 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, problems)
+			return
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+		report.ReporterID = userID
+
+		if report.TargetType == entities.ReportTargetChirp {
+			_, err = reportStore.GetChirp(report.TargetID)
+		} else {
+			_, err = reportStore.GetUser(report.TargetID)
+		}
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": report.TargetType + " does not exist"})
+				return
+			}
+
+			logger.Error("failed to get report target", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		report, err = reportStore.StoreReport(report)
+		if err != nil {
+			logger.Error("failed to StoreReport", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, report)
+	}
+}
+
+// GetReports lists the review queue, oldest report first. status is open by
+// default and can be resolved or all.
+func GetReports(l *slog.Logger, reportStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetReports")
+
+	return func(c *gin.Context) {
+		params, err := parsePageParams(c)
+		if err != nil {
+			logger.Debug("bad page params", slog.String("err", err.Error()))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		status := c.DefaultQuery("status", entities.ReportOpen)
+		switch status {
+		case entities.ReportOpen, entities.ReportResolved:
+		case "all":
+			status = ""
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "status has to be open, resolved or all"})
+			return
+		}
+
+		page, err := reportStore.ListReports(db.ReportQuery{
+			Status: status,
+			After:  params.After,
+			Before: params.Before,
+			Limit:  params.Limit,
+		})
+		if err != nil {
+			logger.Error("failed to ListReports", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		ids := make([]int, len(page.Reports))
+		for i, r := range page.Reports {
+			ids[i] = r.ID
+		}
+		setPageHeaders(c, params, ids, page.HasMore)
+
+		c.JSON(http.StatusOK, page.Reports)
+	}
+}
+
+// PostReportAction settles a report. Whatever the admin does applies to the
+// target of the report and resolves every open report about it:
+//   - approve keeps the target, a hidden chirp is shown again
+//   - hide hides a chirp
+//   - delete deletes a chirp
+//   - suspend suspends a user or the author of a chirp
+func PostReportAction(l *slog.Logger, moderationStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostReportAction")
+
+	return func(c *gin.Context) {
+		reportID, err := paramID(c, "reportID")
+		if err != nil {
+			logger.Debug("bad reportID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		var body struct {
+			Action string `json:"action"`
+			Note   string `json:"note"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		if len(body.Note) > 500 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "note can only be up to and including 500 chars"})
+			return
+		}
+
+		adminID := c.GetInt("userID")
+		if adminID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		report, err := moderationStore.GetReport(reportID)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to GetReport", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if report.Status != entities.ReportOpen {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "report is already resolved"})
+			return
+		}
+
+		action := entities.ModerationAction{
+			AdminID:    adminID,
+			Action:     body.Action,
+			TargetType: report.TargetType,
+			TargetID:   report.TargetID,
+			ReportID:   report.ID,
+			Note:       body.Note,
+		}
+		status, err := targetModeration(moderationStore, &action)
+		if err != nil {
+			if status == http.StatusInternalServerError {
+				logger.Error("failed to target moderation", slog.String("action", body.Action), slog.String("err", err.Error()))
+				c.AbortWithError(status, err)
+				return
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		// suspending the author of a chirp settles the reports about the chirp
+		// as well as those about the author
+		logged, resolved, err := moderationStore.ApplyModerationAction(action)
+		if err != nil {
+			if errors.Is(err, db.ErrResolved) {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": action.TargetType + " does not exist"})
+				return
+			}
+
+			logger.Error("failed to ApplyModerationAction", slog.String("action", body.Action), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"action":   logged,
+			"resolved": resolved,
+		})
+	}
+}
+
+// targetModeration checks action and points it at the user when a chirp's
+// author gets suspended. The status tells how to answer a failure.
+func targetModeration(moderationStore db.Store, action *entities.ModerationAction) (int, error) {
+	onChirp := action.TargetType == entities.ReportTargetChirp
+
+	var err error
+	switch action.Action {
+	case entities.ModerationApprove:
+	case entities.ModerationHide:
+		if !onChirp {
+			return http.StatusBadRequest, errors.New("only chirps can be hidden")
+		}
+	case entities.ModerationDelete:
+		if !onChirp {
+			return http.StatusBadRequest, errors.New("only chirps can be deleted")
+		}
+	case entities.ModerationSuspend:
+		if onChirp {
+			// the thread is the only place hidden chirps can be looked up
+			var thread db.Thread
+			thread, err = moderationStore.GetThread(action.TargetID)
+			if err != nil {
+				break
+			}
+			action.TargetType = entities.ReportTargetUser
+			action.TargetID = thread.Chirp.AuthorID
+		}
+		if action.TargetID == action.AdminID {
+			return http.StatusBadRequest, errors.New("admins cannot suspend themselves")
+		}
+	default:
+		return http.StatusBadRequest, fmt.Errorf("unknown action %q", action.Action)
+	}
+
+	if errors.Is(err, db.ErrDoesNotExist) {
+		return http.StatusNotFound, fmt.Errorf("%s does not exist", action.TargetType)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// GetModerationActions lists what admins did, newest first.
+func GetModerationActions(l *slog.Logger, moderationStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetModerationActions")
+
+	return func(c *gin.Context) {
+		params, err := parsePageParams(c)
+		if err != nil {
+			logger.Debug("bad page params", slog.String("err", err.Error()))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		page, err := moderationStore.ListModerationActions(db.ModerationActionQuery{
+			After:  params.After,
+			Before: params.Before,
+			Limit:  params.Limit,
+		})
+		if err != nil {
+			logger.Error("failed to ListModerationActions", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		ids := make([]int, len(page.Actions))
+		for i, a := range page.Actions {
+			ids[i] = a.ID
+		}
+		setPageHeaders(c, params, ids, page.HasMore)
+
+		c.JSON(http.StatusOK, page.Actions)
+	}
+}
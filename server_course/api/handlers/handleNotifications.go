@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetNotifications(l *slog.Logger, notificationStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetNotifications")
+
+	return func(c *gin.Context) {
+		params, err := parsePageParams(c)
+		if err != nil {
+			logger.Debug("bad page params", slog.String("err", err.Error()))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		page, err := notificationStore.ListNotifications(db.NotificationQuery{
+			UserID:     userID,
+			UnreadOnly: strings.EqualFold(c.Query("unread"), "true"),
+			After:      params.After,
+			Before:     params.Before,
+			Limit:      params.Limit,
+		})
+		if err != nil {
+			logger.Error("failed to ListNotifications", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		unread, err := notificationStore.CountUnreadNotifications(userID)
+		if err != nil {
+			logger.Error("failed to CountUnreadNotifications", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		ids := make([]int, len(page.Notifications))
+		for i, n := range page.Notifications {
+			ids[i] = n.ID
+		}
+		setPageHeaders(c, params, ids, page.HasMore)
+
+		c.JSON(http.StatusOK, struct {
+			UnreadCount   int                     `json:"unread_count"`
+			Notifications []entities.Notification `json:"notifications"`
+		}{
+			UnreadCount:   unread,
+			Notifications: page.Notifications,
+		})
+	}
+}
+
+// PostNotificationsRead marks the notifications listed in ids read, all of
+// them if there is no body or no ids.
+func PostNotificationsRead(l *slog.Logger, notificationStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostNotificationsRead")
+
+	return func(c *gin.Context) {
+		var body struct {
+			IDs []int `json:"ids"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := decode(c, &body); err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		marked, err := notificationStore.MarkNotificationsRead(userID, body.IDs)
+		if err != nil {
+			logger.Error("failed to MarkNotificationsRead", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		unread, err := notificationStore.CountUnreadNotifications(userID)
+		if err != nil {
+			logger.Error("failed to CountUnreadNotifications", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"marked":       marked,
+			"unread_count": unread,
+		})
+	}
+}
@@ -1,75 +1,271 @@
 package handlers
 
 import (
+	"encoding/json"
 	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"server_course/db"
+	"server_course/entities"
+	"server_course/signature"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	polkaSignatureHeader = "Polka-Signature"
+	// polkaTolerance bounds how long a captured delivery can be replayed
+	polkaTolerance    = 5 * time.Minute
+	maxPolkaBodyBytes = 1 << 20
+)
+
+var (
+	errUnknownPlan    = errors.New("unknown plan")
+	errNoSubscription = errors.New("user has no subscription")
+)
+
 type PolkaWebhookBody struct {
+	ID    string `json:"id"`
 	Event string `json:"event"`
 	Data  struct {
-		UserID int `json:"user_id"`
+		UserID    int       `json:"user_id"`
+		Plan      string    `json:"plan"`
+		PeriodEnd time.Time `json:"period_end"`
 	} `json:"data"`
 }
 
-func PostWebhook(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
+type subscriptionChange func(s *entities.Subscription, body PolkaWebhookBody, now time.Time) error
+
+func requireSubscription(change func(s *entities.Subscription, body PolkaWebhookBody, now time.Time)) subscriptionChange {
+	return func(s *entities.Subscription, body PolkaWebhookBody, now time.Time) error {
+		if s.Plan == entities.PlanFree {
+			return errNoSubscription
+		}
+		change(s, body, now)
+		return nil
+	}
+}
+
+var polkaEvents = map[string]subscriptionChange{
+	"user.upgraded": func(s *entities.Subscription, body PolkaWebhookBody, now time.Time) error {
+		plan := body.Data.Plan
+		if plan == "" {
+			plan = entities.PlanRed
+		}
+		if !entities.ValidPlan(plan) {
+			return errUnknownPlan
+		}
+		s.Start(plan, body.Data.PeriodEnd, now)
+		return nil
+	},
+	"user.downgraded": func(s *entities.Subscription, body PolkaWebhookBody, now time.Time) error {
+		switch {
+		case s.Plan == entities.PlanFree:
+			return errNoSubscription
+		case body.Data.Plan == "" || body.Data.Plan == entities.PlanFree:
+			s.End(now)
+		case !entities.ValidPlan(body.Data.Plan):
+			return errUnknownPlan
+		default:
+			s.Plan = body.Data.Plan
+		}
+		return nil
+	},
+	"subscription.renewed": requireSubscription(func(s *entities.Subscription, body PolkaWebhookBody, now time.Time) {
+		s.Renew(body.Data.PeriodEnd, now)
+	}),
+	"subscription.canceled": requireSubscription(func(s *entities.Subscription, _ PolkaWebhookBody, now time.Time) {
+		s.Cancel(now)
+	}),
+	"payment.failed": requireSubscription(func(s *entities.Subscription, _ PolkaWebhookBody, now time.Time) {
+		s.PaymentFailed(now)
+	}),
+}
+
+func processPolkaEvent(subscriptionStore db.Store, event entities.WebhookEvent, body PolkaWebhookBody) (entities.WebhookEvent, int, error) {
+	change, known := polkaEvents[strings.ToLower(body.Event)]
+	if !known {
+		return event, http.StatusNoContent, nil
+	}
+
+	processed, _, err := subscriptionStore.ProcessWebhookEvent(event.ID, body.Data.UserID, func(s *entities.Subscription) error {
+		return change(s, body, time.Now().UTC())
+	})
+	switch {
+	case err == nil:
+		return processed, http.StatusNoContent, nil
+	case errors.Is(err, db.ErrDoesNotExist), errors.Is(err, errNoSubscription):
+		return event, http.StatusNotFound, err
+	case errors.Is(err, errUnknownPlan):
+		return event, http.StatusBadRequest, err
+	default:
+		return event, http.StatusInternalServerError, err
+	}
+}
+
+func finishPolkaEvent(logger *slog.Logger, userStore db.Store, event entities.WebhookEvent) (entities.WebhookEvent, int, error) {
+	var body PolkaWebhookBody
+	if err := json.Unmarshal(event.Payload, &body); err != nil {
+		return entities.WebhookEvent{}, http.StatusInternalServerError, err
+	}
+
+	event, code, err := processPolkaEvent(userStore, event, body)
+	status, errMsg := entities.WebhookFailed, ""
+	switch {
+	case err != nil:
+		errMsg = err.Error()
+		logger.Debug("failed to process event", slog.String("eventID", event.EventID), slog.String("err", errMsg))
+	case event.Status == entities.WebhookProcessed:
+		return event, code, nil
+	default:
+		status = entities.WebhookIgnored
+	}
+
+	event, finishErr := userStore.FinishWebhookEvent(event.ID, status, errMsg)
+	if finishErr != nil {
+		return entities.WebhookEvent{}, http.StatusInternalServerError, finishErr
+	}
+	return event, code, nil
+}
+
+func PostWebhook(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
 	logger := l.With("handler", "PostWebhook")
-	expectedApiKey := os.Getenv("POLKA_KEY")
+	secret := []byte(os.Getenv("POLKA_KEY"))
+	if len(secret) == 0 {
+		logger.Error("POLKA_KEY is not set, every delivery is refused")
+	}
 
 	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-		if token == "" {
+		// without a key anyone could sign deliveries
+		if len(secret) == 0 {
 			c.Status(http.StatusUnauthorized)
 			return
 		}
 
-		parts := strings.Fields(token)
-		if len(parts) != 2 {
-			c.Status(http.StatusUnauthorized)
+		raw, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxPolkaBodyBytes))
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		if !strings.EqualFold(parts[0], "ApiKey") {
+		if err := signature.Verify(secret, c.GetHeader(polkaSignatureHeader), raw, time.Now(), polkaTolerance); err != nil {
+			logger.Debug("bad signature", slog.String("err", err.Error()))
 			c.Status(http.StatusUnauthorized)
 			return
 		}
 
-		if !strings.EqualFold(parts[1], expectedApiKey) {
-			c.Status(http.StatusUnauthorized)
+		logger.Debug("request has a valid signature")
+
+		var body PolkaWebhookBody
+		if err := json.Unmarshal(raw, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		if body.ID == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "event has no id"})
+			return
+		}
+
+		event, claimed, err := userStore.ReceiveWebhookEvent(entities.WebhookEvent{
+			EventID: body.ID,
+			Event:   body.Event,
+			Payload: raw,
+		})
+		if err != nil {
+			logger.Error("failed to ReceiveWebhookEvent", slog.String("eventID", body.ID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if !claimed {
+			// let Polka retry in case the delivery in flight fails
+			if event.Status == entities.WebhookReceived {
+				c.Status(http.StatusConflict)
+				return
+			}
+			logger.Debug("event was handled already", slog.String("eventID", body.ID), slog.String("status", event.Status))
+			c.Status(http.StatusNoContent)
 			return
 		}
 
-		logger.Debug("request has the correct api key")
+		event, code, err := finishPolkaEvent(logger, userStore, event)
+		if err != nil {
+			logger.Error("failed to finishPolkaEvent", slog.String("eventID", body.ID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
 
-		var body PolkaWebhookBody
-		err := decode(c, &body)
+		logger.Debug("event handled", slog.String("eventID", body.ID), slog.String("status", event.Status))
+		c.Status(code)
+	}
+}
+
+func GetWebhookEvents(l *slog.Logger, webhookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetWebhookEvents")
+
+	return func(c *gin.Context) {
+		params, err := parsePageParams(c)
 		if err != nil {
-			c.AbortWithError(http.StatusBadRequest, err)
+			logger.Debug("bad page params", slog.String("err", err.Error()))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		if !strings.EqualFold(body.Event, "user.upgraded") {
-			c.Status(http.StatusNoContent)
+		page, err := webhookStore.ListWebhookEvents(db.WebhookEventQuery{
+			Status: c.Query("status"),
+			After:  params.After,
+			Before: params.Before,
+			Limit:  params.Limit,
+		})
+		if err != nil {
+			logger.Error("failed to ListWebhookEvents", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		ids := make([]int, len(page.Events))
+		for i, e := range page.Events {
+			ids[i] = e.ID
+		}
+		setPageHeaders(c, params, ids, page.HasMore)
+
+		c.JSON(http.StatusOK, page.Events)
+	}
+}
+
+func PostWebhookEventReplay(l *slog.Logger, webhookStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostWebhookEventReplay")
+
+	return func(c *gin.Context) {
+		id, err := paramID(c, "eventID")
+		if err != nil {
+			logger.Debug("bad eventID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		_, err = userStore.UpdateUserRedStatus(body.Data.UserID, true)
+		event, err := webhookStore.ReplayWebhookEvent(id)
 		if err != nil {
 			if errors.Is(err, db.ErrDoesNotExist) {
-				c.Status(http.StatusNotFound)
+				c.AbortWithError(http.StatusNotFound, err)
 				return
 			}
-			c.AbortWithError(http.StatusBadRequest, err)
+			logger.Error("failed to ReplayWebhookEvent", slog.Int("id", id), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		event, _, err = finishPolkaEvent(logger, webhookStore, event)
+		if err != nil {
+			logger.Error("failed to finishPolkaEvent", slog.Int("id", id), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
-		logger.Debug("user updated", slog.Int("userID", body.Data.UserID))
-		c.Status(http.StatusNoContent)
+		logger.Info("replayed event", slog.Int("id", id), slog.Int("adminID", c.GetInt("userID")), slog.String("status", event.Status))
+		c.JSON(http.StatusOK, event)
 	}
 }
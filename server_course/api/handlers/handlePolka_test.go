@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/signature"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostWebhook(t *testing.T) {
+	store := newTestStore(t)
+	u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+	body := `{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`
+
+	// without a key a signature over the empty secret must not pass
+	t.Setenv("POLKA_KEY", "")
+	r := gin.New()
+	r.POST("/api/polka/webhooks", PostWebhook(slog.Default(), store))
+	w := serve(r, http.MethodPost, "/api/polka/webhooks", body, polkaSignatureHeader, signature.Sign(nil, time.Now(), []byte(body)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	t.Setenv("POLKA_KEY", "not-the-polka-key")
+	r = gin.New()
+	r.POST("/api/polka/webhooks", PostWebhook(slog.Default(), store))
+	sig := signature.Sign([]byte("not-the-polka-key"), time.Now(), []byte(body))
+	w = serve(r, http.MethodPost, "/api/polka/webhooks", body, polkaSignatureHeader, sig)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	page, err := store.ListWebhookEvents(db.WebhookEventQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, page.Events, 1)
+	assert.Equal(t, entities.WebhookProcessed, page.Events[0].Status)
+	u, err = store.GetUser(u.ID)
+	assert.NoError(t, err)
+	assert.True(t, u.IsChirpyRed)
+
+	// a redelivery is a no-op
+	w = serve(r, http.MethodPost, "/api/polka/webhooks", body, polkaSignatureHeader, sig)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	page, err = store.ListWebhookEvents(db.WebhookEventQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, page.Events[0].Attempts)
+}
+
+func TestPostWebhook_events(t *testing.T) {
+	store := newTestStore(t)
+	walt, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+	jesse, err := store.StoreUser(entities.User{Email: "jesse@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+
+	t.Setenv("POLKA_KEY", "not-the-polka-key")
+	r := gin.New()
+	r.POST("/api/polka/webhooks", PostWebhook(slog.Default(), store))
+
+	// in order, each builds on the subscriptions the ones before left
+	tests := []struct {
+		name       string
+		event      string
+		userID     int
+		plan       string
+		wantCode   int
+		wantStatus string
+		wantRed    bool
+	}{
+		{"unknown event", "user.renamed", walt.ID, "", http.StatusNoContent, entities.WebhookIgnored, false},
+		{"unknown user", "user.upgraded", walt.ID + 100, "", http.StatusNotFound, entities.WebhookFailed, false},
+		{"unknown plan", "user.upgraded", walt.ID, "blue", http.StatusBadRequest, entities.WebhookFailed, false},
+		{"renewed without subscription", "subscription.renewed", walt.ID, "", http.StatusNotFound, entities.WebhookFailed, false},
+		{"downgraded without subscription", "user.downgraded", walt.ID, "", http.StatusNotFound, entities.WebhookFailed, false},
+		{"payment failed without subscription", "payment.failed", jesse.ID, "", http.StatusNotFound, entities.WebhookFailed, false},
+		{"upgraded", "User.Upgraded", walt.ID, "", http.StatusNoContent, entities.WebhookProcessed, true},
+		{"downgraded to unknown plan", "user.downgraded", walt.ID, "blue", http.StatusBadRequest, entities.WebhookFailed, true},
+		{"payment failed keeps the plan", "payment.failed", walt.ID, "", http.StatusNoContent, entities.WebhookProcessed, true},
+		{"renewed", "subscription.renewed", walt.ID, "", http.StatusNoContent, entities.WebhookProcessed, true},
+		{"canceled runs out the period", "subscription.canceled", walt.ID, "", http.StatusNoContent, entities.WebhookProcessed, true},
+		{"downgraded", "user.downgraded", walt.ID, "", http.StatusNoContent, entities.WebhookProcessed, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"id":"evt_%d","event":%q,"data":{"user_id":%d,"plan":%q}}`, i, tt.event, tt.userID, tt.plan)
+			sig := signature.Sign([]byte("not-the-polka-key"), time.Now(), []byte(body))
+			w := serve(r, http.MethodPost, "/api/polka/webhooks", body, polkaSignatureHeader, sig)
+			assert.Equal(t, tt.wantCode, w.Code)
+
+			page, err := store.ListWebhookEvents(db.WebhookEventQuery{Limit: 1})
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("evt_%d", i), page.Events[0].EventID)
+			assert.Equal(t, tt.wantStatus, page.Events[0].Status)
+
+			u, err := store.GetUser(walt.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantRed, u.IsChirpyRed)
+		})
+	}
+}
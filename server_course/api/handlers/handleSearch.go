@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/search"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseSearchQuery reads q and sort, and turns the after and before cursors
+// into an offset into the ranked matches.
+func parseSearchQuery(c *gin.Context) (search.Query, error) {
+	query, err := search.ParseQuery(c.Query("q"))
+	if err != nil {
+		return query, err
+	}
+
+	switch strings.ToLower(c.Query("sort")) {
+	case "", "relevance":
+		query.Sort = search.SortRelevance
+	case "recent":
+		query.Sort = search.SortRecent
+	default:
+		return query, errors.New("sort has to be relevance or recent")
+	}
+
+	params, err := parsePageParams(c)
+	if err != nil {
+		return query, err
+	}
+
+	query.Limit = params.Limit
+	switch {
+	case params.After != 0:
+		query.Offset = params.After
+	case params.Before != 0:
+		query.Offset = max(params.Before-params.Limit, 0)
+		query.Limit = params.Before - query.Offset
+	}
+
+	return query, nil
+}
+
+func SearchChirps(l *slog.Logger, chirpStore db.Store, index *search.Index) gin.HandlerFunc {
+	logger := l.With("handler", "SearchChirps")
+
+	return func(c *gin.Context) {
+		query, err := parseSearchQuery(c)
+		if err != nil {
+			logger.Debug("bad search query", slog.String("err", err.Error()))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ids, total := index.Search(query)
+
+		chirps := make([]entities.Chirp, 0, len(ids))
+		for _, id := range ids {
+			chirp, err := chirpStore.GetChirp(id)
+			if err != nil {
+				// deleted between the search and now
+				if errors.Is(err, db.ErrDoesNotExist) {
+					continue
+				}
+
+				logger.Error("failed to GetChirp", slog.String("err", err.Error()))
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			chirps = append(chirps, chirp)
+		}
+
+		links := []string{}
+		if end := query.Offset + len(ids); end < total {
+			cursor := encodeCursor(end)
+			links = append(links, pageLink(c, "next", "after", cursor))
+			c.Header("X-Next-Cursor", cursor)
+		}
+		if query.Offset > 0 {
+			cursor := encodeCursor(query.Offset)
+			links = append(links, pageLink(c, "prev", "before", cursor))
+			c.Header("X-Prev-Cursor", cursor)
+		}
+		if len(links) > 0 {
+			c.Header("Link", strings.Join(links, ", "))
+		}
+		c.Header("X-Total-Count", strconv.Itoa(total))
+
+		c.JSON(http.StatusOK, chirps)
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func accountThrottleKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+func twoFactorThrottleKey(userID int) string {
+	return "2fa:" + strconv.Itoa(userID)
+}
+
+// emailThrottleKey throttles emails nobody signed up with like accounts.
+func emailThrottleKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func allowLogin(c *gin.Context, logger *slog.Logger, store db.Store, key string, policy entities.ThrottlePolicy) bool {
+	throttle, err := store.GetLoginThrottle(key)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		return true
+	}
+	if err != nil {
+		logger.Error("failed to GetLoginThrottle", slog.String("key", key), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	}
+
+	wait := time.Until(policy.BlockedUntil(throttle))
+	if wait <= 0 {
+		return true
+	}
+
+	logger.Debug("login throttled", slog.String("key", key), slog.Int("failures", throttle.Failures))
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if policy.Locked(throttle) {
+		c.AbortWithStatusJSON(http.StatusLocked, gin.H{"error": "account is locked, reset the password or ask an admin to unlock it"})
+		return false
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many failed logins, try again later"})
+	return false
+}
+
+func loginFailed(c *gin.Context, logger *slog.Logger, store db.Store, userID int, eventType, detail string) {
+	ip := c.ClientIP()
+	record := func(e entities.SecurityEvent) {
+		if _, err := store.StoreSecurityEvent(e); err != nil {
+			logger.Error("failed to StoreSecurityEvent", slog.String("type", e.Type), slog.String("err", err.Error()))
+		}
+	}
+
+	if _, err := store.RecordLoginFailure(ipThrottleKey(ip)); err != nil {
+		logger.Error("failed to RecordLoginFailure", slog.String("ip", ip), slog.String("err", err.Error()))
+	}
+	record(entities.SecurityEvent{UserID: userID, Type: eventType, IP: ip, Detail: detail})
+
+	if userID == 0 {
+		return
+	}
+	throttle, err := store.RecordLoginFailure(accountThrottleKey(userID))
+	if err != nil {
+		logger.Error("failed to RecordLoginFailure", slog.Int("userID", userID), slog.String("err", err.Error()))
+		return
+	}
+	if throttle.Failures == entities.AccountThrottle.LockoutAfter {
+		logger.Info("account locked", slog.Int("userID", userID))
+		record(entities.SecurityEvent{
+			UserID: userID,
+			Type:   entities.SecurityAccountLocked,
+			IP:     ip,
+			Detail: fmt.Sprintf("%d failed logins", throttle.Failures),
+		})
+	}
+}
+
+func unlockAccount(c *gin.Context, store db.Store, userID int, detail string) error {
+	key := accountThrottleKey(userID)
+	throttle, err := store.GetLoginThrottle(key)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := store.ClearLoginThrottle(key); err != nil {
+		return err
+	}
+	if !entities.AccountThrottle.Locked(throttle) {
+		return nil
+	}
+	_, err = store.StoreSecurityEvent(entities.SecurityEvent{
+		UserID: userID,
+		Type:   entities.SecurityAccountUnlocked,
+		IP:     c.ClientIP(),
+		Detail: detail,
+	})
+	return err
+}
+
+func PostUnlockUser(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostUnlockUser")
+
+	return func(c *gin.Context) {
+		userID, err := paramID(c, "userID")
+		if err != nil {
+			logger.Debug("bad userID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := userStore.GetUser(userID); err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+			logger.Error("failed to GetUser", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		detail := fmt.Sprintf("by admin %d", c.GetInt("userID"))
+		if err := unlockAccount(c, userStore, userID, detail); err != nil {
+			logger.Error("failed to unlockAccount", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func GetSecurityEvents(l *slog.Logger, securityStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetSecurityEvents")
+
+	return func(c *gin.Context) {
+		params, err := parsePageParams(c)
+		if err != nil {
+			logger.Debug("bad page params", slog.String("err", err.Error()))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		q := db.SecurityEventQuery{
+			After:  params.After,
+			Before: params.Before,
+			Limit:  params.Limit,
+		}
+		if userID := c.Query("user_id"); userID != "" {
+			q.UserID, err = strconv.Atoi(userID)
+			if err != nil || q.UserID <= 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "user_id has to be a positive int"})
+				return
+			}
+		}
+
+		page, err := securityStore.ListSecurityEvents(q)
+		if err != nil {
+			logger.Error("failed to ListSecurityEvents", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		ids := make([]int, len(page.Events))
+		for i, e := range page.Events {
+			ids[i] = e.ID
+		}
+		setPageHeaders(c, params, ids, page.HasMore)
+
+		c.JSON(http.StatusOK, page.Events)
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// refreshTokenLifetime is how long a session lasts after logging in,
+	// rotating its refresh token does not extend it
+	refreshTokenLifetime = 60 * 24 * time.Hour
+	maxDeviceLength      = 200
+)
+
+// deviceName tells the sessions of a user apart in the listing.
+func deviceName(c *gin.Context) string {
+	device := []rune(c.Request.UserAgent())
+	if len(device) > maxDeviceLength {
+		device = device[:maxDeviceLength]
+	}
+	return string(device)
+}
+
+// GetSessions lists the devices the user is logged in on and marks the one
+// the request came from.
+func GetSessions(l *slog.Logger, sessionStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetSessions")
+
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		sessions, err := sessionStore.ListSessions(userID)
+		if err != nil {
+			logger.Error("failed to ListSessions", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		type session struct {
+			entities.Session
+			Current bool `json:"current"`
+		}
+		listed := make([]session, len(sessions))
+		for i, s := range sessions {
+			listed[i] = session{Session: s, Current: s.ID == c.GetInt("sessionID")}
+		}
+
+		c.JSON(http.StatusOK, listed)
+	}
+}
+
+// DeleteSession logs the user out on one device, the tokens issued for it are
+// revoked along with it.
+func DeleteSession(l *slog.Logger, sessionStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "DeleteSession")
+
+	return func(c *gin.Context) {
+		sessionID, err := paramID(c, "sessionID")
+		if err != nil {
+			logger.Debug("bad sessionID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		if err := sessionStore.RevokeSession(userID, sessionID); err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to RevokeSession", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// PostLogout revokes the access token the request came with and ends its
+// session.
+func PostLogout(l *slog.Logger, sessionStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostLogout")
+
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		// a token without a jti cannot be revoked on its own, it expires
+		if tokenID := c.GetString("tokenID"); tokenID != "" {
+			if err := sessionStore.RevokeToken(tokenID, c.GetTime("tokenExpiresAt")); err != nil {
+				logger.Error("failed to RevokeToken", slog.String("err", err.Error()))
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		if sessionID := c.GetInt("sessionID"); sessionID != 0 {
+			err := sessionStore.RevokeSession(userID, sessionID)
+			if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+				logger.Error("failed to RevokeSession", slog.String("err", err.Error()))
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// PostLogoutAll logs the user out everywhere, every token issued so far is
+// revoked and no session can be refreshed anymore.
+func PostLogoutAll(l *slog.Logger, sessionStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostLogoutAll")
+
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		if _, err := sessionStore.BumpTokenVersion(userID); err != nil {
+			logger.Error("failed to BumpTokenVersion", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		revoked, err := sessionStore.RevokeSessions(userID, 0)
+		if err != nil {
+			logger.Error("failed to RevokeSessions", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		logger.Info("logged out everywhere", slog.Int("userID", userID), slog.Int("sessions", revoked))
+
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"server_course/stream"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	streamHeartbeat = 15 * time.Second
+	// streamWriteWait is how long a single write to a stream client may take
+	// before the client is given up on.
+	streamWriteWait = 10 * time.Second
+)
+
+// parseStreamParams reads the author_id filter and where to resume from,
+// the Last-Event-ID header or for websockets the last_event_id parameter.
+func parseStreamParams(c *gin.Context) ([]int, int64, error) {
+	authorIDs := parseAuthorIDs(c)
+
+	lastEventIDString := c.GetHeader("Last-Event-ID")
+	if lastEventIDString == "" {
+		lastEventIDString = c.Query("last_event_id")
+	}
+	if lastEventIDString == "" {
+		return authorIDs, 0, nil
+	}
+
+	lastEventID, err := strconv.ParseInt(lastEventIDString, 10, 64)
+	if err != nil {
+		return nil, 0, errors.New("last event id not an int")
+	}
+	return authorIDs, lastEventID, nil
+}
+
+// StreamChirps pushes chirp events as server-sent events. A client that falls
+// too far behind gets a dropped event and is disconnected, it can reconnect
+// with the id of the last event it got.
+func StreamChirps(l *slog.Logger, broker *stream.Broker) gin.HandlerFunc {
+	logger := l.With("handler", "StreamChirps")
+
+	return func(c *gin.Context) {
+		authorIDs, lastEventID, err := parseStreamParams(c)
+		if err != nil {
+			logger.Debug("bad stream params", slog.String("err", err.Error()))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		sub := broker.Subscribe(authorIDs, lastEventID)
+		defer sub.Close()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+
+		rc := http.NewResponseController(c.Writer)
+		write := func(format string, args ...any) bool {
+			rc.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if _, err := fmt.Fprintf(c.Writer, format, args...); err != nil {
+				logger.Debug("stream client gone", slog.String("err", err.Error()))
+				return false
+			}
+			return rc.Flush() == nil
+		}
+
+		if !write("retry: %d\n\n", (3 * time.Second).Milliseconds()) {
+			return
+		}
+		if sub.Gap && !write("event: gap\ndata: {}\n\n") {
+			return
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case e, ok := <-sub.Events:
+				if !ok {
+					if sub.Dropped() {
+						write("event: dropped\ndata: {}\n\n")
+					}
+					return
+				}
+
+				data, err := json.Marshal(e)
+				if err != nil {
+					logger.Error("failed to marshal event", slog.String("err", err.Error()))
+					return
+				}
+				if !write("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data) {
+					return
+				}
+			case <-heartbeat.C:
+				if !write(": ping\n\n") {
+					return
+				}
+			}
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// the stream only carries public chirps and needs no credentials, so any
+	// site may open it
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// StreamChirpsWS pushes the same events as StreamChirps as json messages over
+// a websocket. A gap is sent as a message of type gap, a client that falls
+// behind is closed with 1013 (try again later).
+func StreamChirpsWS(l *slog.Logger, broker *stream.Broker) gin.HandlerFunc {
+	logger := l.With("handler", "StreamChirpsWS")
+
+	return func(c *gin.Context) {
+		authorIDs, lastEventID, err := parseStreamParams(c)
+		if err != nil {
+			logger.Debug("bad stream params", slog.String("err", err.Error()))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// the upgrader already responded
+			logger.Debug("failed to upgrade", slog.String("err", err.Error()))
+			return
+		}
+		defer conn.Close()
+
+		sub := broker.Subscribe(authorIDs, lastEventID)
+		defer sub.Close()
+
+		// clients only send control frames, reading handles them and notices
+		// when the client is gone
+		gone := make(chan struct{})
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(2 * streamHeartbeat))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * streamHeartbeat))
+		})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		write := func(v any) bool {
+			conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if err := conn.WriteJSON(v); err != nil {
+				logger.Debug("stream client gone", slog.String("err", err.Error()))
+				return false
+			}
+			return true
+		}
+		closeWith := func(code int, reason string) {
+			msg := websocket.FormatCloseMessage(code, reason)
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(streamWriteWait))
+		}
+
+		if sub.Gap && !write(gin.H{"type": "gap"}) {
+			return
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-gone:
+				return
+			case e, ok := <-sub.Events:
+				if !ok {
+					if sub.Dropped() {
+						closeWith(websocket.CloseTryAgainLater, "dropped, too slow")
+					} else {
+						closeWith(websocket.CloseGoingAway, "shutting down")
+					}
+					return
+				}
+				if !write(e) {
+					return
+				}
+			case <-heartbeat.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+
+	"github.com/gin-gonic/gin"
+)
+
+func entitlements(c *gin.Context) entities.Entitlements {
+	if e, ok := c.Value("entitlements").(entities.Entitlements); ok {
+		return e
+	}
+	return entities.PlanEntitlements(entities.PlanFree)
+}
+
+func GetSubscription(l *slog.Logger, subscriptionStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetSubscription")
+
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		var subscription *entities.Subscription
+		s, err := subscriptionStore.GetSubscription(userID)
+		switch {
+		case err == nil:
+			subscription = &s
+		case !errors.Is(err, db.ErrDoesNotExist):
+			logger.Error("failed to GetSubscription", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"subscription": subscription,
+			"entitlements": entitlements(c),
+		})
+	}
+}
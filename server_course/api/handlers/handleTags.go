@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTrendingWindow = 24 * time.Hour
+	maxTrendingWindow     = 30 * 24 * time.Hour
+	defaultTrendingLimit  = 10
+	maxTrendingLimit      = 100
+)
+
+func GetHashtagChirps(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetHashtagChirps")
+
+	return listChirps(logger, chirpStore, func(c *gin.Context, q *db.ChirpQuery) bool {
+		q.Hashtag = entities.NormalizeTag(c.Param("tag"))
+		if q.Hashtag == "" {
+			logger.Debug("tag not set")
+			c.AbortWithError(http.StatusBadRequest, errors.New("tag not set"))
+			return false
+		}
+		return true
+	})
+}
+
+func GetUserMentions(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetUserMentions")
+
+	return listChirps(logger, chirpStore, func(c *gin.Context, q *db.ChirpQuery) bool {
+		userID, err := paramID(c, "userID")
+		if err != nil {
+			logger.Debug("bad userID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
+			return false
+		}
+
+		if _, err := chirpStore.GetUser(userID); err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return false
+			}
+
+			logger.Error("failed to GetUser", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+
+		q.MentionedUserID = userID
+		return true
+	})
+}
+
+// GetTrending ranks the hashtags used in the last window, 24h unless set.
+func GetTrending(l *slog.Logger, chirpStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "GetTrending")
+
+	return func(c *gin.Context) {
+		window := defaultTrendingWindow
+		if windowString := c.Query("window"); windowString != "" {
+			var err error
+			window, err = time.ParseDuration(windowString)
+			if err != nil || window <= 0 || window > maxTrendingWindow {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "window has to be a positive duration of at most 720h"})
+				return
+			}
+		}
+
+		limit := defaultTrendingLimit
+		if limitString := c.Query("limit"); limitString != "" {
+			var err error
+			limit, err = strconv.Atoi(limitString)
+			if err != nil || limit <= 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "limit has to be a positive int"})
+				return
+			}
+			limit = min(limit, maxTrendingLimit)
+		}
+
+		trending, err := chirpStore.TrendingHashtags(time.Now().Add(-window), limit)
+		if err != nil {
+			logger.Error("failed to TrendingHashtags", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, trending)
+	}
+}
@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"log/slog"
+	"net/http"
+	"server_course/api/common"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/totp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	totpIssuer = "Chirpy"
+	// totpSkew accepts codes of the neighbouring periods as well
+	totpSkew          = 1
+	recoveryCodeCount = 10
+	// recoveryCodeSize is 80 bits, 16 characters once encoded
+	recoveryCodeSize = 10
+	// challengeLifetime is how long a login waits for the second factor
+	challengeLifetime = 5 * time.Minute
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// normalizeRecoveryCode drops what users add or change when typing a code off
+// a printout.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// newRecoveryCodes returns fresh codes to show the user once, and the hashes
+// kept in their place.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeSize)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = common.HashSecretToken(code)
+	}
+	return codes, hashes, nil
+}
+
+// checkSecondFactor checks a TOTP code, or a recovery code if no code is
+// given, and uses it up.
+func checkSecondFactor(store db.Store, t entities.TOTP, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		step, ok := totp.Validate(t.Secret, code, time.Now(), totpSkew)
+		if !ok {
+			return false, nil
+		}
+		err := store.UseTOTPStep(t.UserID, step)
+		if errors.Is(err, db.ErrCodeReused) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	if recoveryCode != "" {
+		err := store.UseRecoveryCode(t.UserID, common.HashSecretToken(normalizeRecoveryCode(recoveryCode)))
+		if errors.Is(err, db.ErrDoesNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	return false, nil
+}
+
+// verifySecondFactor checks a code of a logged in user like checkSecondFactor
+// but throttles the guesses like a login challenge and counts a wrong one as
+// a failed login. It answers for the handler and returns false unless the
+// code is right.
+func verifySecondFactor(c *gin.Context, logger *slog.Logger, store db.Store, t entities.TOTP, code, recoveryCode, detail string) bool {
+	key := twoFactorThrottleKey(t.UserID)
+	if !allowLogin(c, logger, store, accountThrottleKey(t.UserID), entities.AccountThrottle) ||
+		!allowLogin(c, logger, store, key, entities.TwoFactorThrottle) {
+		return false
+	}
+
+	ok, err := checkSecondFactor(store, t, code, recoveryCode)
+	if err != nil {
+		logger.Error("failed to checkSecondFactor", slog.Int("userID", t.UserID), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	}
+	if !ok {
+		if _, err := store.RecordLoginFailure(key); err != nil {
+			logger.Error("failed to RecordLoginFailure", slog.Int("userID", t.UserID), slog.String("err", err.Error()))
+		}
+		loginFailed(c, logger, store, t.UserID, entities.SecurityTwoFactorFailed, detail)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return false
+	}
+
+	if err := store.ClearLoginThrottle(key); err != nil {
+		logger.Error("failed to ClearLoginThrottle", slog.Int("userID", t.UserID), slog.String("err", err.Error()))
+	}
+	return true
+}
+
+// confirmedTOTP gets the authenticator of the user and answers for the
+// handler if there is none.
+func confirmedTOTP(c *gin.Context, logger *slog.Logger, store db.Store, userID int) (entities.TOTP, bool) {
+	t, err := store.GetTOTP(userID)
+	if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+		logger.Error("failed to GetTOTP", slog.Int("userID", userID), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return entities.TOTP{}, false
+	}
+	if err != nil || !t.Confirmed {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "two-factor authentication is not enabled"})
+		return entities.TOTP{}, false
+	}
+	return t, true
+}
+
+// challengeLogin answers a correct password of a user with two factors with
+// a challenge to exchange for tokens at PostLogin2FA.
+func challengeLogin(c *gin.Context, logger *slog.Logger, store db.Store, user entities.User, expiresInSeconds int) {
+	token, hash, err := common.NewSecretToken()
+	if err != nil {
+		logger.Error("failed to NewSecretToken", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	challenge, err := store.CreateLoginChallenge(entities.LoginChallenge{
+		UserID:           user.ID,
+		Hash:             hash,
+		ExpiresAt:        time.Now().UTC().Add(challengeLifetime),
+		ExpiresInSeconds: expiresInSeconds,
+	})
+	if err != nil {
+		logger.Error("failed to CreateLoginChallenge", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"two_factor_required": true,
+		"challenge_token":     token,
+		"expires_at":          challenge.ExpiresAt,
+	})
+}
+
+// PostLogin2FA finishes a login that was challenged for a second factor.
+func PostLogin2FA(l *slog.Logger, userStore db.Store, tokens *common.Tokens) gin.HandlerFunc {
+	logger := l.With("handler", "PostLogin2FA")
+
+	return func(c *gin.Context) {
+		var body struct {
+			ChallengeToken string `json:"challenge_token"`
+			Code           string `json:"code"`
+			RecoveryCode   string `json:"recovery_code"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		challenge, err := userStore.GetLoginChallenge(common.HashSecretToken(body.ChallengeToken))
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "challenge is invalid or expired"})
+				return
+			}
+			logger.Error("failed to GetLoginChallenge", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if !allowLogin(c, logger, userStore, accountThrottleKey(challenge.UserID), entities.AccountThrottle) {
+			return
+		}
+
+		t, err := userStore.GetTOTP(challenge.UserID)
+		if err != nil {
+			// two factors were turned off since the password was entered
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "challenge is invalid or expired"})
+				return
+			}
+			logger.Error("failed to GetTOTP", slog.Int("userID", challenge.UserID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		ok, err := checkSecondFactor(userStore, t, body.Code, body.RecoveryCode)
+		if err != nil {
+			logger.Error("failed to checkSecondFactor", slog.Int("userID", challenge.UserID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			if err := userStore.FailLoginChallenge(challenge.ID); err != nil {
+				logger.Error("failed to FailLoginChallenge", slog.Int("challengeID", challenge.ID), slog.String("err", err.Error()))
+			}
+			loginFailed(c, logger, userStore, challenge.UserID, entities.SecurityTwoFactorFailed, "bad code")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+			return
+		}
+
+		if err := userStore.UseLoginChallenge(challenge.ID); err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "challenge is invalid or expired"})
+				return
+			}
+			logger.Error("failed to UseLoginChallenge", slog.Int("challengeID", challenge.ID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		user, err := userStore.GetUser(challenge.UserID)
+		if err != nil {
+			logger.Error("failed to GetUser", slog.Int("userID", challenge.UserID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		// the user may have been suspended since entering the password
+		if user.Suspended {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account is suspended"})
+			return
+		}
+
+		login(c, logger, userStore, tokens, user, challenge.ExpiresInSeconds)
+	}
+}
+
+// Get2FA tells whether the user has two factors and how many recovery codes
+// are left.
+func Get2FA(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "Get2FA")
+
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		t, err := userStore.GetTOTP(userID)
+		if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+			logger.Error("failed to GetTOTP", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		enabled := err == nil && t.Confirmed
+
+		left, err := userStore.CountRecoveryCodes(userID)
+		if err != nil {
+			logger.Error("failed to CountRecoveryCodes", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":             enabled,
+			"recovery_codes_left": left,
+		})
+	}
+}
+
+// PostTOTP starts enrolling an authenticator. It only guards logins once
+// PostTOTPConfirm saw a code of it.
+func PostTOTP(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostTOTP")
+
+	return func(c *gin.Context) {
+		user, ok := c.Value("user").(entities.User)
+		if !ok {
+			logger.Error("user is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("user is not set"))
+			return
+		}
+
+		t, err := userStore.GetTOTP(user.ID)
+		if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+			logger.Error("failed to GetTOTP", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if err == nil && t.Confirmed {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			logger.Error("failed to GenerateSecret", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if err := userStore.SetTOTP(entities.TOTP{UserID: user.ID, Secret: secret}); err != nil {
+			logger.Error("failed to SetTOTP", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"secret":      secret,
+			"otpauth_uri": totp.URI(totpIssuer, user.Email, secret),
+		})
+	}
+}
+
+// PostTOTPConfirm enables two factors with a first code of the enrolled
+// authenticator and hands out the recovery codes.
+func PostTOTPConfirm(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostTOTPConfirm")
+
+	return func(c *gin.Context) {
+		var body struct {
+			Code string `json:"code"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		t, err := userStore.GetTOTP(userID)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "no authenticator is enrolled"})
+				return
+			}
+			logger.Error("failed to GetTOTP", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if t.Confirmed {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+
+		step, ok := totp.Validate(t.Secret, body.Code, time.Now(), totpSkew)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			logger.Error("failed to newRecoveryCodes", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if _, err := userStore.ConfirmTOTP(userID, step, hashes); err != nil {
+			logger.Error("failed to ConfirmTOTP", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
+
+// DeleteTOTP turns two factors off, it takes a code or a recovery code so a
+// stolen access token alone cannot.
+func DeleteTOTP(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "DeleteTOTP")
+
+	return func(c *gin.Context) {
+		var body struct {
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		t, ok := confirmedTOTP(c, logger, userStore, userID)
+		if !ok {
+			return
+		}
+
+		if !verifySecondFactor(c, logger, userStore, t, body.Code, body.RecoveryCode, "bad code to turn off two factors") {
+			return
+		}
+
+		if err := userStore.DeleteTOTP(userID); err != nil {
+			logger.Error("failed to DeleteTOTP", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// PostRecoveryCodes replaces the recovery codes of the user, the old ones stop
+// working.
+func PostRecoveryCodes(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PostRecoveryCodes")
+
+	return func(c *gin.Context) {
+		var body struct {
+			Code string `json:"code"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		userID := c.GetInt("userID")
+		if userID == 0 {
+			logger.Error("userID is not set")
+			c.AbortWithError(http.StatusInternalServerError, errors.New("userID is not set"))
+			return
+		}
+
+		t, ok := confirmedTOTP(c, logger, userStore, userID)
+		if !ok {
+			return
+		}
+
+		// a recovery code cannot vouch for new ones
+		if !verifySecondFactor(c, logger, userStore, t, body.Code, "", "bad code to replace recovery codes") {
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			logger.Error("failed to newRecoveryCodes", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if err := userStore.ReplaceRecoveryCodes(userID, hashes); err != nil {
+			logger.Error("failed to ReplaceRecoveryCodes", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"server_course/api/common"
+	"server_course/entities"
+	"server_course/totp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteTOTP_throttled(t *testing.T) {
+	store := newTestStore(t)
+	u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+	secret, err := totp.GenerateSecret()
+	assert.NoError(t, err)
+	assert.NoError(t, store.SetTOTP(entities.TOTP{UserID: u.ID, Secret: secret}))
+	_, err = store.ConfirmTOTP(u.ID, 0, nil)
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("userID", u.ID) })
+	r.DELETE("/api/2fa/totp", DeleteTOTP(slog.Default(), store))
+
+	wrong := func(want int) {
+		t.Helper()
+		w := serve(r, http.MethodDelete, "/api/2fa/totp", `{"code":"nope"}`)
+		assert.Equal(t, want, w.Code)
+	}
+
+	// wrong codes count as failed logins and back off like them
+	for i := 0; i < entities.AccountThrottle.FreeFailures; i++ {
+		wrong(http.StatusUnauthorized)
+	}
+	wrong(http.StatusTooManyRequests)
+	throttle, err := store.GetLoginThrottle(accountThrottleKey(u.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, entities.AccountThrottle.FreeFailures, throttle.Failures)
+
+	// and there are only as many tries as a login challenge has
+	assert.NoError(t, store.ClearLoginThrottle(accountThrottleKey(u.ID)))
+	for i := entities.AccountThrottle.FreeFailures; i < entities.MaxChallengeAttempts; i++ {
+		wrong(http.StatusUnauthorized)
+	}
+	code, err := totp.Code(secret, time.Now())
+	assert.NoError(t, err)
+	w := serve(r, http.MethodDelete, "/api/2fa/totp", `{"code":"`+code+`"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	_, err = store.GetTOTP(u.ID)
+	assert.NoError(t, err)
+}
+
+func TestPostLogin2FA_totpRemoved(t *testing.T) {
+	store := newTestStore(t)
+	u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+	token, hash, err := common.NewSecretToken()
+	assert.NoError(t, err)
+	_, err = store.CreateLoginChallenge(entities.LoginChallenge{UserID: u.ID, Hash: hash, ExpiresAt: time.Now().Add(time.Minute)})
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.POST("/api/login/2fa", PostLogin2FA(slog.Default(), store, nil))
+
+	w := serve(r, http.MethodPost, "/api/login/2fa", `{"challenge_token":"`+token+`","code":"123456"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
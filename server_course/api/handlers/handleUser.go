@@ -8,13 +8,16 @@ import (
 	"server_course/api/common"
 	"server_course/db"
 	"server_course/entities"
+	"server_course/mail"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func GetUser(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
+func GetUser(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
 	logger := l.With("handler", "GetUser")
 
 	return func(c *gin.Context) {
@@ -29,7 +32,7 @@ func GetUser(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 	}
 }
 
-func GetUserByID(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
+func GetUserByID(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
 	logger := l.With("handler", "GetUser")
 
 	return func(c *gin.Context) {
@@ -62,7 +65,9 @@ func GetUserByID(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 	}
 }
 
-func PostUser(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
+// PostUser signs a user up and mails them a token to verify the email with,
+// they cannot post before that.
+func PostUser(l *slog.Logger, userStore db.Store, mailer mail.Mailer) gin.HandlerFunc {
 	logger := l.With("handler", "PostUser")
 
 	return func(c *gin.Context) {
@@ -87,6 +92,11 @@ func PostUser(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 			return
 		}
 
+		// the user can ask for another mail, no need to fail the sign up
+		if err := sendEmailToken(userStore, mailer, user, entities.EmailTokenVerify); err != nil {
+			logger.Error("failed to send verification", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+		}
+
 		userByte, err := user.MarshalJSONCustom()
 		if err != nil {
 			logger.Error("failed to MarshalJSONCustom", slog.String("err", err.Error()))
@@ -98,7 +108,14 @@ func PostUser(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 	}
 }
 
-func PostUserLogin(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
+// unknownPassword makes checking an unknown email as slow as a real one.
+var unknownPassword = sync.OnceValue(func() string {
+	u := entities.User{Password: "unknown"}
+	encrypted, _ := u.EncryptPassword()
+	return encrypted.Password
+})
+
+func PostUserLogin(l *slog.Logger, userStore db.Store, tokens *common.Tokens) gin.HandlerFunc {
 	logger := l.With("handler", "PostUserLogin")
 
 	return func(c *gin.Context) {
@@ -116,10 +133,32 @@ func PostUserLogin(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 			return
 		}
 
+		if !allowLogin(c, logger, userStore, ipThrottleKey(c.ClientIP()), entities.IPThrottle) {
+			return
+		}
+
+		// logins must not tell who signed up
 		storedUser, err := userStore.GetUserByEmail(user.Email)
+		if errors.Is(err, db.ErrDoesNotExist) {
+			key := emailThrottleKey(user.Email)
+			if !allowLogin(c, logger, userStore, key, entities.AccountThrottle) {
+				return
+			}
+			user.ValidPassword(unknownPassword())
+			if _, err := userStore.RecordLoginFailure(key); err != nil {
+				logger.Error("failed to RecordLoginFailure", slog.String("err", err.Error()))
+			}
+			loginFailed(c, logger, userStore, 0, entities.SecurityLoginFailed, "unknown email")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
 		if err != nil {
-			logger.Error("failed to GetUserByEmail", slog.String("user email", user.Email), slog.String("err", err.Error()))
-			c.AbortWithError(http.StatusBadRequest, err)
+			logger.Error("failed to GetUserByEmail", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		// checked before the password so guesses during a lockout tell nothing
+		if !allowLogin(c, logger, userStore, accountThrottleKey(storedUser.ID), entities.AccountThrottle) {
 			return
 		}
 
@@ -135,48 +174,89 @@ func PostUserLogin(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 		}
 		if !validPassword {
 			logger.Debug("failed to ValidPassword")
+			loginFailed(c, logger, userStore, storedUser.ID, entities.SecurityLoginFailed, "bad password")
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
-
-		if user.ExpiresInSeconds > 0 {
-			storedUser.Token, err = common.GenerateJWT(storedUser.ID, user.ExpiresInSeconds)
-		} else {
-			storedUser.Token, err = common.GenerateJWT(storedUser.ID, 60*60) // 1h
-		}
-
-		if err != nil {
-			logger.Error("failed to GenerateJWT", slog.Int("userID", storedUser.ID), slog.String("err", err.Error()))
-			c.AbortWithError(http.StatusBadRequest, err)
+		if storedUser.Suspended {
+			logger.Debug("user is suspended", slog.Int("userID", storedUser.ID))
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account is suspended"})
 			return
 		}
 
-		refreshToken, err := common.GetRandomString(32)
-		if err != nil {
-			logger.Error("failed to GetRandomString", slog.Int("userID", storedUser.ID), slog.String("err", err.Error()))
-		} else {
-			storedUser.RefreshToken = refreshToken
-			storedUser.RefreshExpiresInSeconds = 60 * 60 * 24 * 60 // 60d
-		}
-
-		_, err = userStore.UpdateUserTokens(storedUser)
-		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+		totp, err := userStore.GetTOTP(storedUser.ID)
+		if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+			logger.Error("failed to GetTOTP", slog.Int("userID", storedUser.ID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
-
-		userByte, err := storedUser.MarshalJSONCustom()
-		if err != nil {
-			logger.Error("failed to MarshalJSONCustom", slog.String("err", err.Error()))
-			c.AbortWithError(http.StatusInternalServerError, err)
+		if err == nil && totp.Confirmed {
+			challengeLogin(c, logger, userStore, storedUser, user.ExpiresInSeconds)
 			return
 		}
 
-		c.Data(http.StatusOK, "application/json", userByte)
+		login(c, logger, userStore, tokens, storedUser, user.ExpiresInSeconds)
 	}
 }
 
-func PutUser(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
+// login forgets failed logins only once every factor passed.
+func login(c *gin.Context, logger *slog.Logger, userStore db.Store, tokens *common.Tokens, user entities.User, expiresInSeconds int) {
+	if err := userStore.ClearLoginThrottle(accountThrottleKey(user.ID)); err != nil {
+		logger.Error("failed to ClearLoginThrottle", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	refreshToken, tokenHash, err := common.NewSecretToken()
+	if err != nil {
+		logger.Error("failed to NewSecretToken", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	expires := 60 * 60 // 1h
+	if expiresInSeconds > 0 {
+		expires = expiresInSeconds
+	}
+	claims, err := common.NewClaims(expires)
+	if err != nil {
+		logger.Error("failed to NewClaims", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	session, err := userStore.CreateSession(entities.Session{
+		UserID:    user.ID,
+		Device:    deviceName(c),
+		IP:        c.ClientIP(),
+		ExpiresAt: time.Now().UTC().Add(refreshTokenLifetime),
+	}, entities.SessionToken{Hash: tokenHash, AccessTokenID: claims.TokenID, AccessExpiresAt: claims.ExpiresAt})
+	if err != nil {
+		logger.Error("failed to CreateSession", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	user.Token, err = tokens.GenerateJWT(claims.For(user, session.ID))
+	if err != nil {
+		logger.Error("failed to GenerateJWT", slog.Int("userID", user.ID), slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	user.RefreshToken = refreshToken
+
+	userByte, err := user.MarshalJSONCustom()
+	if err != nil {
+		logger.Error("failed to MarshalJSONCustom", slog.String("err", err.Error()))
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json", userByte)
+}
+
+func PutUser(l *slog.Logger, userStore db.Store, mailer mail.Mailer) gin.HandlerFunc {
 	logger := l.With("handler", "PutUser")
 
 	return func(c *gin.Context) {
@@ -201,13 +281,29 @@ func PutUser(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 			return
 		}
 		user.ID = userID
+		newPassword := user.Password != ""
 
+		// a new password bumps the token version, so the caller has to refresh
+		// as well, but only the session it came from stays open
 		user, err = userStore.UpdateUser(user)
 		if err != nil {
 			logger.Error("failed to StoreUser", slog.String("err", err.Error()))
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
+		if newPassword {
+			if _, err := userStore.RevokeSessions(userID, c.GetInt("sessionID")); err != nil {
+				logger.Error("failed to RevokeSessions", slog.Int("userID", userID), slog.String("err", err.Error()))
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+		// a new email has to be verified again
+		if previous, ok := c.Value("user").(entities.User); ok && previous.Verified && !user.Verified {
+			if err := sendEmailToken(userStore, mailer, user, entities.EmailTokenVerify); err != nil {
+				logger.Error("failed to send verification", slog.Int("userID", userID), slog.String("err", err.Error()))
+			}
+		}
 
 		userByte, err := user.MarshalJSONCustom()
 		if err != nil {
@@ -220,7 +316,7 @@ func PutUser(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 	}
 }
 
-func PostRefresh(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
+func PostRefresh(l *slog.Logger, userStore db.Store, tokens *common.Tokens) gin.HandlerFunc {
 	logger := l.With("handler", "PostRefresh")
 
 	return func(c *gin.Context) {
@@ -230,30 +326,63 @@ func PostRefresh(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 			return
 		}
 
-		userID, found, err := common.ValidRefreshToken(userStore, refreshToken)
+		nextToken, nextHash, err := common.NewSecretToken()
 		if err != nil {
-			logger.Error("failed to ValidRefreshToken", slog.String("err", err.Error()))
+			logger.Error("failed to NewSecretToken", slog.String("err", err.Error()))
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
-		if !found {
-			c.AbortWithStatus(http.StatusUnauthorized)
+		claims, err := common.NewClaims(60 * 60) // 1h
+		if err != nil {
+			logger.Error("failed to NewClaims", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
-		jwtToken, err := common.GenerateJWT(userID, 60*60) // 1h
+		session, err := userStore.RotateSession(common.HashSecretToken(refreshToken), entities.SessionToken{
+			Hash:            nextHash,
+			AccessTokenID:   claims.TokenID,
+			AccessExpiresAt: claims.ExpiresAt,
+		})
 		if err != nil {
-			logger.Error("failed to GenerateJWT", slog.Int("userID", userID), slog.String("err", err.Error()))
+			switch {
+			case errors.Is(err, db.ErrTokenReused):
+				logger.Warn("refresh token reused, revoked its session", slog.String("ip", c.ClientIP()))
+				c.AbortWithStatus(http.StatusUnauthorized)
+			case errors.Is(err, db.ErrDoesNotExist):
+				c.AbortWithStatus(http.StatusUnauthorized)
+			default:
+				logger.Error("failed to RotateSession", slog.String("err", err.Error()))
+				c.AbortWithError(http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		user, err := userStore.GetUser(session.UserID)
+		if err != nil {
+			logger.Error("failed to GetUser", slog.Int("userID", session.UserID), slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if user.Suspended {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account is suspended"})
+			return
+		}
+
+		jwtToken, err := tokens.GenerateJWT(claims.For(user, session.ID))
+		if err != nil {
+			logger.Error("failed to GenerateJWT", slog.Int("userID", user.ID), slog.String("err", err.Error()))
 			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"token": jwtToken})
+		// the token sent in is used up, only the new one refreshes again
+		c.JSON(http.StatusOK, gin.H{"token": jwtToken, "refresh_token": nextToken})
 	}
 }
 
-func PostRevoke(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
+func PostRevoke(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
 	logger := l.With("handler", "PostRevoke")
 
 	return func(c *gin.Context) {
@@ -263,33 +392,76 @@ func PostRevoke(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 			return
 		}
 
-		userID, found, err := common.ValidRefreshToken(userStore, refreshToken)
+		session, err := userStore.GetSessionByToken(common.HashSecretToken(refreshToken))
+		if err == nil {
+			err = userStore.RevokeSession(session.UserID, session.ID)
+		}
 		if err != nil {
-			logger.Error("failed to ValidRefreshToken", slog.String("err", err.Error()))
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+
+			logger.Error("failed to revoke session", slog.String("err", err.Error()))
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
-		if !found {
-			c.AbortWithStatus(http.StatusUnauthorized)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// PutUserRoles replaces the roles of a user. They show up in the user's
+// tokens once they log in or refresh again.
+func PutUserRoles(l *slog.Logger, userStore db.Store) gin.HandlerFunc {
+	logger := l.With("handler", "PutUserRoles")
+
+	return func(c *gin.Context) {
+		userID, err := paramID(c, "userID")
+		if err != nil {
+			logger.Debug("bad userID", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		storedUser, err := userStore.GetUser(userID)
-		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+		var body struct {
+			Roles []string `json:"roles"`
+		}
+		if err := decode(c, &body); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
 
-		storedUser.RefreshExpiresInSeconds = 0
-		storedUser.RefreshToken = ""
+		roles := []string{}
+		for _, role := range body.Roles {
+			if !entities.ValidRole(role) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown role " + role})
+				return
+			}
+			if !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+
+		// nobody would be left to give the permission back
+		if userID == c.GetInt("userID") && !entities.RolesAllow(roles, entities.PermManageRoles) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "cannot give up managing roles yourself"})
+			return
+		}
 
-		_, err = userStore.UpdateUserTokens(storedUser)
+		user, err := userStore.UpdateUserRoles(userID, roles)
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			if errors.Is(err, db.ErrDoesNotExist) {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			logger.Error("failed to UpdateUserRoles", slog.String("err", err.Error()))
+			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
-		c.Status(http.StatusNoContent)
+		logger.Info("updated roles", slog.Int("userID", userID), slog.Int("by", c.GetInt("userID")), slog.Any("roles", roles))
+		c.JSON(http.StatusOK, gin.H{"id": user.ID, "roles": user.Roles})
 	}
 }
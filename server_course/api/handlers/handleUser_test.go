@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"server_course/db"
+	"server_course/entities"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostUserLogin_throttled(t *testing.T) {
+	store := newTestStore(t)
+	u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.POST("/api/login", PostUserLogin(slog.Default(), store, nil))
+
+	// an unknown email backs off and locks like an account, nobody can tell
+	// them apart
+	for email, key := range map[string]string{
+		u.Email:                 accountThrottleKey(u.ID),
+		"jesse@breakingbad.com": emailThrottleKey("jesse@breakingbad.com"),
+	} {
+		body := `{"email":"` + email + `","password":"wrong"}`
+		for i := 0; i < entities.AccountThrottle.FreeFailures; i++ {
+			w := serve(r, http.MethodPost, "/api/login", body)
+			assert.Equal(t, http.StatusUnauthorized, w.Code, email)
+		}
+		w := serve(r, http.MethodPost, "/api/login", body)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code, email)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"), email)
+
+		for i := entities.AccountThrottle.FreeFailures; i < entities.AccountThrottle.LockoutAfter; i++ {
+			_, err := store.RecordLoginFailure(key)
+			assert.NoError(t, err)
+		}
+		w = serve(r, http.MethodPost, "/api/login", body)
+		assert.Equal(t, http.StatusLocked, w.Code, email)
+		assert.Equal(t, "3600", w.Header().Get("Retry-After"), email)
+	}
+
+	// the security log tells them apart
+	page, err := store.ListSecurityEvents(db.SecurityEventQuery{UserID: u.ID})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, page.Events)
+}
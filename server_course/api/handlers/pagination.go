@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+type pageParams struct {
+	Limit  int
+	After  int
+	Before int
+}
+
+// encodeCursor hides the id behind an opaque token, clients only ever pass it
+// back as after or before.
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("c:" + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("malformed cursor")
+	}
+
+	idString, found := strings.CutPrefix(string(raw), "c:")
+	if !found {
+		return 0, errors.New("malformed cursor")
+	}
+
+	id, err := strconv.Atoi(idString)
+	if err != nil || id <= 0 {
+		return 0, errors.New("malformed cursor")
+	}
+
+	return id, nil
+}
+
+func parsePageParams(c *gin.Context) (pageParams, error) {
+	params := pageParams{Limit: defaultPageLimit}
+
+	if limitString := c.Query("limit"); limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit <= 0 {
+			return params, errors.New("limit has to be a positive int")
+		}
+		params.Limit = min(limit, maxPageLimit)
+	}
+
+	after, before := c.Query("after"), c.Query("before")
+	if after != "" && before != "" {
+		return params, errors.New("only one of after and before can be set")
+	}
+
+	var err error
+	if after != "" {
+		params.After, err = decodeCursor(after)
+	}
+	if before != "" {
+		params.Before, err = decodeCursor(before)
+	}
+
+	return params, err
+}
+
+// pageLink is the current request url with its cursor replaced by param.
+func pageLink(c *gin.Context, rel, param, cursor string) string {
+	u := url.URL{Path: c.Request.URL.Path}
+	query := c.Request.URL.Query()
+	query.Del("after")
+	query.Del("before")
+	query.Set(param, cursor)
+	u.RawQuery = query.Encode()
+
+	return fmt.Sprintf("<%s>; rel=\"%s\"", u.String(), rel)
+}
+
+// setPageHeaders sets the cursors around a page of ids in the X-Next-Cursor
+// and X-Prev-Cursor headers and as Link header relations.
+func setPageHeaders(c *gin.Context, params pageParams, ids []int, hasMore bool) {
+	if len(ids) == 0 {
+		return
+	}
+
+	links := []string{}
+	addLink := func(rel, param, header string, id int) {
+		cursor := encodeCursor(id)
+		links = append(links, pageLink(c, rel, param, cursor))
+		c.Header(header, cursor)
+	}
+
+	// paging back from a cursor means there is always a page after this one
+	if params.Before != 0 || hasMore {
+		addLink("next", "after", "X-Next-Cursor", ids[len(ids)-1])
+	}
+	if params.After != 0 || (params.Before != 0 && hasMore) {
+		addLink("prev", "before", "X-Prev-Cursor", ids[0])
+	}
+
+	if len(links) > 0 {
+		c.Header("Link", strings.Join(links, ", "))
+	}
+}
@@ -5,12 +5,13 @@ import (
 	"log/slog"
 	"server_course/api/common"
 	"server_course/db"
+	"server_course/entities"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func JWTMiddleware(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
+func JWTMiddleware(l *slog.Logger, userStore db.Store, tokens *common.Tokens) gin.HandlerFunc {
 	logger := l.With("middleware", "JWTMiddleware")
 
 	return func(c *gin.Context) {
@@ -19,26 +20,23 @@ func JWTMiddleware(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 		if token == "" {
 			logger.Debug("token not set")
 			c.AbortWithError(401, errors.New("no jwt"))
+			return
 		}
 
 		parts := strings.Fields(token)
-		if !strings.EqualFold(parts[0], "Bearer") {
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
 			logger.Debug("token is bad", slog.String("err", "wrong bearer"))
 			c.AbortWithError(401, errors.New("wrong bearer"))
+			return
 		}
 
-		var userID int
+		var claims common.Claims
 		var err error
 		if len(strings.Split(parts[1], ".")) == 3 {
 			logger.Debug("token is jwt")
-			userID, err = common.ValidJWT(parts[1])
+			claims, err = tokens.ValidJWT(parts[1])
 		} else {
 			logger.Debug("token is refresh token")
-			// var found bool
-			// userID, found, err = common.ValidRefreshToken(userStore, parts[1])
-			// if !found {
-			// 	err = errors.New("user not found")
-			// }
 			err = errors.New("not supported")
 		}
 
@@ -48,8 +46,82 @@ func JWTMiddleware(l *slog.Logger, userStore *db.DB) gin.HandlerFunc {
 			return
 		}
 
+		revoked := false
+		if claims.TokenID != "" {
+			revoked, err = userStore.TokenRevoked(claims.TokenID)
+		}
+		if err != nil {
+			logger.Error("failed to check TokenRevoked", slog.String("err", err.Error()))
+			c.AbortWithError(500, err)
+			return
+		}
+		if revoked {
+			logger.Debug("token is revoked", slog.String("jti", claims.TokenID))
+			c.AbortWithError(401, errors.New("token is revoked"))
+			return
+		}
+
+		userID := claims.UserID
 		logger.Debug("token valid", slog.Int("userID", userID))
 
+		user, err := userStore.GetUser(userID)
+		if err != nil {
+			if errors.Is(err, db.ErrDoesNotExist) {
+				logger.Debug("user of token does not exist", slog.Int("userID", userID))
+				c.AbortWithError(401, err)
+				return
+			}
+			logger.Error("failed to GetUser", slog.String("err", err.Error()))
+			c.AbortWithError(500, err)
+			return
+		}
+		if claims.Version != user.TokenVersion {
+			logger.Debug("token version is outdated", slog.Int("userID", userID))
+			c.AbortWithError(401, errors.New("token is revoked"))
+			return
+		}
+		if user.Suspended {
+			logger.Debug("user is suspended", slog.Int("userID", userID))
+			c.AbortWithStatusJSON(403, gin.H{"error": "account is suspended"})
+			return
+		}
+
 		c.Set("userID", userID)
+		c.Set("user", user)
+		c.Set("roles", claims.Roles)
+		c.Set("sessionID", claims.SessionID)
+		c.Set("tokenID", claims.TokenID)
+		c.Set("tokenExpiresAt", claims.ExpiresAt)
+	}
+}
+
+// RequireVerified only lets users through who verified their email. It has to
+// run after JWTMiddleware.
+func RequireVerified(l *slog.Logger) gin.HandlerFunc {
+	logger := l.With("middleware", "RequireVerified")
+
+	return func(c *gin.Context) {
+		user, ok := c.Value("user").(entities.User)
+		if !ok || !user.Verified {
+			logger.Debug("email is not verified", slog.Int("userID", c.GetInt("userID")))
+			c.AbortWithStatusJSON(403, gin.H{"error": "email is not verified"})
+			return
+		}
+	}
+}
+
+// RequirePermission only lets users through whose token and account both
+// carry a role granting p, so revoking a role takes effect right away while
+// a new role needs a new token. It has to run after JWTMiddleware.
+func RequirePermission(l *slog.Logger, p entities.Permission) gin.HandlerFunc {
+	logger := l.With("middleware", "RequirePermission", "permission", string(p))
+
+	return func(c *gin.Context) {
+		user, ok := c.Value("user").(entities.User)
+		if !ok || !user.Can(p) || !entities.RolesAllow(c.GetStringSlice("roles"), p) {
+			logger.Debug("permission denied", slog.Int("userID", c.GetInt("userID")))
+			c.AbortWithStatusJSON(403, gin.H{"error": "missing permission " + string(p)})
+			return
+		}
 	}
 }
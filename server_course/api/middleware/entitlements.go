@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"errors"
+	"log/slog"
+	"server_course/db"
+	"server_course/entities"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LoadEntitlements has to run after JWTMiddleware.
+func LoadEntitlements(l *slog.Logger, subscriptionStore db.Store) gin.HandlerFunc {
+	logger := l.With("middleware", "LoadEntitlements")
+
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+
+		e := entities.PlanEntitlements(entities.PlanFree)
+		s, err := subscriptionStore.GetSubscription(userID)
+		switch {
+		case err == nil:
+			e = s.Entitlements(time.Now())
+		case !errors.Is(err, db.ErrDoesNotExist):
+			logger.Error("failed to GetSubscription", slog.Int("userID", userID), slog.String("err", err.Error()))
+			c.AbortWithError(500, err)
+			return
+		}
+
+		c.Set("entitlements", e)
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"server_course/db"
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadEntitlements(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store, err := db.NewDB(t.TempDir())
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	free, err := store.StoreUser(entities.User{Email: "jesse@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+	red, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+	_, err = store.UpdateSubscription(red.ID, func(s *entities.Subscription) error {
+		s.Start(entities.PlanRed, time.Time{}, time.Now())
+		return nil
+	})
+	assert.NoError(t, err)
+	lapsed, err := store.StoreUser(entities.User{Email: "gus@lospollos.com", Password: "pw"})
+	assert.NoError(t, err)
+	_, err = store.UpdateSubscription(lapsed.ID, func(s *entities.Subscription) error {
+		s.Start(entities.PlanRed, time.Time{}, time.Now())
+		s.End(time.Now())
+		return nil
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		userID int
+		want   entities.Entitlements
+	}{
+		{"no subscription", free.ID, entities.PlanEntitlements(entities.PlanFree)},
+		{"paid", red.ID, entities.PlanEntitlements(entities.PlanRed)},
+		{"ended", lapsed.ID, entities.PlanEntitlements(entities.PlanFree)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got any
+			r := gin.New()
+			r.GET("/", func(c *gin.Context) { c.Set("userID", tt.userID) }, LoadEntitlements(slog.Default(), store), func(c *gin.Context) {
+				got, _ = c.Get("entitlements")
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -1,17 +1,22 @@
 package middleware
 
-import "log/slog"
+import (
+	"log/slog"
+	"server_course/ratelimit"
+)
 
 type Middleware struct {
 	Metrics metrics
+	Limiter ratelimit.Limiter
 }
 
-func NewMiddleware(l *slog.Logger) Middleware {
+func NewMiddleware(l *slog.Logger, limiter ratelimit.Limiter) Middleware {
 
 	return Middleware{
 		Metrics: metrics{
 			logger:         l.With("middleware", "metrics"),
 			fileserverHits: 0,
 		},
+		Limiter: limiter,
 	}
 }
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"server_course/api/common"
+	"server_course/entities"
+	"server_course/ratelimit"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const limiterTimeout = 100 * time.Millisecond
+
+type KeyFunc func(c *gin.Context) string
+
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByUser has to run after JWTMiddleware, requests without a user are
+// limited by address.
+func ByUser(c *gin.Context) string {
+	if userID := c.GetInt("userID"); userID != 0 {
+		return "user:" + strconv.Itoa(userID)
+	}
+	return ByIP(c)
+}
+
+// ByAPIKey keeps only a hash of the key, requests without one are limited by
+// address.
+func ByAPIKey(c *gin.Context) string {
+	parts := strings.Fields(c.GetHeader("Authorization"))
+	if len(parts) == 2 && strings.EqualFold(parts[0], "ApiKey") {
+		return "key:" + common.HashSecretToken(parts[1])
+	}
+	return ByIP(c)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+type PolicyFunc func(c *gin.Context) ratelimit.Policy
+
+// ByPlan has to run after LoadEntitlements.
+func ByPlan(name string) PolicyFunc {
+	policies := map[string]ratelimit.Policy{}
+	for _, plan := range entities.Plans() {
+		e := entities.PlanEntitlements(plan)
+		policies[plan] = ratelimit.NewPolicy(name+":"+plan, e.ChirpsPerMinute, time.Minute)
+	}
+
+	return func(c *gin.Context) ratelimit.Policy {
+		e, _ := c.Value("entitlements").(entities.Entitlements)
+		if p, known := policies[e.Plan]; known {
+			return p
+		}
+		return policies[entities.PlanFree]
+	}
+}
+
+// RateLimit lets requests through if the limiter fails rather than locking
+// everyone out.
+func (m Middleware) RateLimit(l *slog.Logger, policy ratelimit.Policy, key KeyFunc) gin.HandlerFunc {
+	return m.RateLimitFunc(l, policy.Name, func(*gin.Context) ratelimit.Policy { return policy }, key)
+}
+
+func (m Middleware) RateLimitFunc(l *slog.Logger, name string, policy PolicyFunc, key KeyFunc) gin.HandlerFunc {
+	logger := l.With("middleware", "RateLimit", "policy", name)
+
+	return func(c *gin.Context) {
+		policy := policy(c)
+		policyHeader := fmt.Sprintf("%d;w=%s", policy.Burst, seconds(policy.Window()))
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), limiterTimeout)
+		defer cancel()
+
+		res, err := m.Limiter.Take(ctx, key(c), policy)
+		if err != nil {
+			logger.Error("failed to Take", slog.String("err", err.Error()))
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Policy", policyHeader)
+		c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		c.Header("RateLimit-Reset", seconds(res.Reset))
+
+		if !res.Allowed {
+			logger.Debug("rate limited", slog.String("ip", c.ClientIP()), slog.Duration("retry_after", res.RetryAfter))
+			c.Header("Retry-After", seconds(res.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests"})
+			return
+		}
+
+		c.Next()
+	}
+}
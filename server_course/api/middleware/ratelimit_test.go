@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"server_course/entities"
+	"server_course/ratelimit"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := NewMiddleware(slog.Default(), ratelimit.NewMemory())
+	r := gin.New()
+	r.GET("/", m.RateLimit(slog.Default(), ratelimit.NewPolicy("test", 2, time.Minute), ByIP), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	get := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("192.0.2.1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("RateLimit-Reset"))
+	assert.Empty(t, w.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, get("192.0.2.1").Code)
+
+	w = get("192.0.2.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+
+	// another address has a bucket of its own
+	assert.Equal(t, http.StatusOK, get("192.0.2.2").Code)
+}
+
+func TestByPlan(t *testing.T) {
+	policy := ByPlan("chirps")
+	tests := []struct {
+		name         string
+		entitlements any
+		want         ratelimit.Policy
+	}{
+		{"free", entities.PlanEntitlements(entities.PlanFree), ratelimit.NewPolicy("chirps:free", 30, time.Minute)},
+		{"red", entities.PlanEntitlements(entities.PlanRed), ratelimit.NewPolicy("chirps:red", 120, time.Minute)},
+		{"unknown plan", entities.Entitlements{Plan: "blue"}, ratelimit.NewPolicy("chirps:free", 30, time.Minute)},
+		{"not loaded", nil, ratelimit.NewPolicy("chirps:free", 30, time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			if tt.entitlements != nil {
+				c.Set("entitlements", tt.entitlements)
+			}
+			assert.Equal(t, tt.want, policy(c))
+		})
+	}
+}
+
+func TestByAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	key := func(header string) string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+		c.Request.RemoteAddr = "10.0.0.1:1234"
+		if header != "" {
+			c.Request.Header.Set("Authorization", header)
+		}
+		return ByAPIKey(c)
+	}
+
+	walt := key("ApiKey heisenberg")
+	assert.Equal(t, walt, key("apikey  heisenberg"))
+	assert.NotEqual(t, walt, key("ApiKey pinkman"))
+	assert.NotContains(t, walt, "heisenberg")
+	assert.Equal(t, "ip:10.0.0.1", key(""))
+	assert.Equal(t, "ip:10.0.0.1", key("Bearer heisenberg"))
+}
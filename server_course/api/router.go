@@ -4,14 +4,36 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"server_course/api/common"
 	"server_course/api/handlers"
 	"server_course/api/middleware"
 	"server_course/db"
+	"server_course/entities"
+	"server_course/events"
+	"server_course/mail"
+	"server_course/moderation"
+	"server_course/ratelimit"
+	"server_course/search"
+	"server_course/stream"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func addRoutes(r *gin.Engine, l *slog.Logger, m middleware.Middleware, db *db.DB) {
+func addRoutes(r *gin.Engine, l *slog.Logger, m middleware.Middleware, db db.Store, index *search.Index, bus *events.Bus, broker *stream.Broker, moderator *moderation.Moderator, tokens *common.Tokens, mailer mail.Mailer) {
+	// one bucket covers both steps of a two factor login
+	loginLimit := m.RateLimit(l, ratelimit.NewPolicy("login", 5, time.Minute), middleware.ByIP)
+	signupLimit := m.RateLimit(l, ratelimit.NewPolicy("signup", 5, time.Hour), middleware.ByIP)
+	accountLimit := m.RateLimit(l, ratelimit.NewPolicy("account", 10, time.Hour), middleware.ByIP)
+	tokenLimit := m.RateLimit(l, ratelimit.NewPolicy("tokens", 30, time.Minute), middleware.ByIP)
+	twoFactorLimit := m.RateLimit(l, ratelimit.NewPolicy("2fa", 10, time.Minute), middleware.ByUser)
+	chirpLimit := m.RateLimitFunc(l, "chirps", middleware.ByPlan("chirps"), middleware.ByUser)
+	loadEntitlements := middleware.LoadEntitlements(l, db)
+	webhookLimit := m.RateLimit(l, ratelimit.NewPolicy("webhooks", 60, time.Minute), middleware.ByAPIKey)
+	retryLimit := m.RateLimit(l, ratelimit.NewPolicy("webhook-retries", 10, time.Minute), middleware.ByUser)
+
+	r.GET("/.well-known/jwks.json", handlers.GetJWKS(tokens.Keys))
+
 	app := r.Group("/app")
 	app.Use(m.Metrics.Inc())
 	app.Static("/", "./public")
@@ -20,28 +42,92 @@ func addRoutes(r *gin.Engine, l *slog.Logger, m middleware.Middleware, db *db.DB
 	api.GET("/healthz", func(c *gin.Context) {
 		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte("OK"))
 	})
-	api.GET("/reset", func(c *gin.Context) {
+	api.GET("/reset", middleware.JWTMiddleware(l, db, tokens), middleware.RequirePermission(l, entities.PermReset), func(c *gin.Context) {
 		m.Metrics.Reset()
 		c.Status(http.StatusOK)
 	})
-	api.POST("/validate_chirp", handlers.PostValidateChirp(l))
+	api.POST("/validate_chirp", handlers.PostValidateChirp(l, moderator))
 	api.GET("/chirps", handlers.GetChirp(l, db))
 	api.GET("/chirps/:chirpID", handlers.GetChirpByID(l, db))
-	api.POST("/chirps", middleware.JWTMiddleware(l, db), handlers.PostChirp(l, db))
-	api.DELETE("/chirps/:chirpID", middleware.JWTMiddleware(l, db), handlers.DeleteChirp(l, db))
+	api.GET("/search/chirps", handlers.SearchChirps(l, db, index))
+	api.GET("/hashtags/:tag", handlers.GetHashtagChirps(l, db))
+	api.GET("/trending", handlers.GetTrending(l, db))
+	api.GET("/stream/chirps", handlers.StreamChirps(l, broker))
+	api.GET("/stream/chirps/ws", handlers.StreamChirpsWS(l, broker))
+	api.POST("/chirps", middleware.JWTMiddleware(l, db, tokens), middleware.RequireVerified(l), loadEntitlements, chirpLimit, handlers.PostChirp(l, db, bus, moderator))
+	api.PUT("/chirps/:chirpID", middleware.JWTMiddleware(l, db, tokens), middleware.RequireVerified(l), loadEntitlements, handlers.PutChirp(l, db, moderator))
+	api.PATCH("/chirps/:chirpID", middleware.JWTMiddleware(l, db, tokens), middleware.RequireVerified(l), loadEntitlements, handlers.PutChirp(l, db, moderator))
+	api.DELETE("/chirps/:chirpID", middleware.JWTMiddleware(l, db, tokens), handlers.DeleteChirp(l, db))
+	api.GET("/chirps/:chirpID/revisions", handlers.GetChirpRevisions(l, db))
+	api.GET("/chirps/:chirpID/thread", handlers.GetChirpThread(l, db))
+	api.POST("/chirps/:chirpID/like", middleware.JWTMiddleware(l, db, tokens), handlers.PostLike(l, db, bus))
+	api.DELETE("/chirps/:chirpID/like", middleware.JWTMiddleware(l, db, tokens), handlers.DeleteLike(l, db))
+	api.POST("/chirps/:chirpID/rechirp", middleware.JWTMiddleware(l, db, tokens), handlers.PostRechirp(l, db, bus))
+	api.DELETE("/chirps/:chirpID/rechirp", middleware.JWTMiddleware(l, db, tokens), handlers.DeleteRechirp(l, db))
 
 	api.GET("/users", handlers.GetUser(l, db))
 	api.GET("/users/:userID", handlers.GetUserByID(l, db))
-	api.POST("/users", handlers.PostUser(l, db))
-	api.PUT("/users", middleware.JWTMiddleware(l, db), handlers.PutUser(l, db))
-	api.POST("/login", handlers.PostUserLogin(l, db))
-	api.POST("/refresh", handlers.PostRefresh(l, db))
-	api.POST("/revoke", handlers.PostRevoke(l, db))
+	api.POST("/users", signupLimit, handlers.PostUser(l, db, mailer))
+	api.PUT("/users", middleware.JWTMiddleware(l, db, tokens), handlers.PutUser(l, db, mailer))
+	api.POST("/verify", accountLimit, handlers.PostVerify(l, db))
+	api.POST("/verify/resend", middleware.JWTMiddleware(l, db, tokens), accountLimit, handlers.PostVerifyResend(l, db, mailer))
+	api.POST("/password/forgot", accountLimit, handlers.PostPasswordForgot(l, db, mailer))
+	api.POST("/password/reset", accountLimit, handlers.PostPasswordReset(l, db))
+	api.POST("/users/:userID/follow", middleware.JWTMiddleware(l, db, tokens), handlers.PostFollow(l, db, bus))
+	api.DELETE("/users/:userID/follow", middleware.JWTMiddleware(l, db, tokens), handlers.DeleteFollow(l, db))
+	api.GET("/users/:userID/followers", handlers.GetFollowers(l, db))
+	api.GET("/users/:userID/following", handlers.GetFollowing(l, db))
+	api.GET("/users/:userID/likes", handlers.GetUserLikes(l, db))
+	api.GET("/users/:userID/mentions", handlers.GetUserMentions(l, db))
+	api.GET("/timeline", middleware.JWTMiddleware(l, db, tokens), handlers.GetTimeline(l, db))
+	api.GET("/notifications", middleware.JWTMiddleware(l, db, tokens), handlers.GetNotifications(l, db))
+	api.POST("/notifications/read", middleware.JWTMiddleware(l, db, tokens), handlers.PostNotificationsRead(l, db))
+	api.POST("/login", loginLimit, handlers.PostUserLogin(l, db, tokens))
+	api.POST("/login/2fa", loginLimit, handlers.PostLogin2FA(l, db, tokens))
+	api.POST("/refresh", tokenLimit, handlers.PostRefresh(l, db, tokens))
+	api.POST("/revoke", tokenLimit, handlers.PostRevoke(l, db))
+	api.POST("/logout", middleware.JWTMiddleware(l, db, tokens), handlers.PostLogout(l, db))
+	api.POST("/logout/all", middleware.JWTMiddleware(l, db, tokens), handlers.PostLogoutAll(l, db))
+	api.GET("/sessions", middleware.JWTMiddleware(l, db, tokens), handlers.GetSessions(l, db))
+	api.DELETE("/sessions/:sessionID", middleware.JWTMiddleware(l, db, tokens), handlers.DeleteSession(l, db))
+	api.GET("/2fa", middleware.JWTMiddleware(l, db, tokens), twoFactorLimit, handlers.Get2FA(l, db))
+	api.POST("/2fa/totp", middleware.JWTMiddleware(l, db, tokens), twoFactorLimit, handlers.PostTOTP(l, db))
+	api.POST("/2fa/totp/confirm", middleware.JWTMiddleware(l, db, tokens), twoFactorLimit, handlers.PostTOTPConfirm(l, db))
+	api.DELETE("/2fa/totp", middleware.JWTMiddleware(l, db, tokens), twoFactorLimit, handlers.DeleteTOTP(l, db))
+	api.POST("/2fa/recovery-codes", middleware.JWTMiddleware(l, db, tokens), twoFactorLimit, handlers.PostRecoveryCodes(l, db))
+
+	api.POST("/reports", middleware.JWTMiddleware(l, db, tokens), handlers.PostReport(l, db))
+
+	api.GET("/subscription", middleware.JWTMiddleware(l, db, tokens), loadEntitlements, handlers.GetSubscription(l, db))
+	api.POST("/polka/webhooks", webhookLimit, handlers.PostWebhook(l, db))
 
-	api.POST("/polka/webhooks", handlers.PostWebhook(l, db))
+	hooks := api.Group("/webhooks", middleware.JWTMiddleware(l, db, tokens), middleware.RequireVerified(l))
+	hooks.POST("", handlers.PostWebhookSubscription(l, db))
+	hooks.GET("", handlers.GetWebhookSubscriptions(l, db))
+	hooks.GET("/:webhookID", handlers.GetWebhookSubscription(l, db))
+	hooks.PUT("/:webhookID", handlers.PutWebhookSubscription(l, db))
+	hooks.DELETE("/:webhookID", handlers.DeleteWebhookSubscription(l, db))
+	hooks.GET("/:webhookID/deliveries", handlers.GetWebhookDeliveries(l, db))
+	hooks.POST("/:webhookID/deliveries/:deliveryID/retry", retryLimit, handlers.PostWebhookDeliveryRetry(l, db))
 
 	admin := r.Group("/admin")
-	admin.GET("/metrics", func(c *gin.Context) {
+	admin.Use(middleware.JWTMiddleware(l, db, tokens))
+	moderate := middleware.RequirePermission(l, entities.PermModerate)
+	admin.GET("/reports", moderate, handlers.GetReports(l, db))
+	admin.POST("/reports/:reportID/actions", moderate, handlers.PostReportAction(l, db))
+	admin.GET("/moderation/actions", moderate, handlers.GetModerationActions(l, db))
+	admin.PUT("/users/:userID/roles", middleware.RequirePermission(l, entities.PermManageRoles), handlers.PutUserRoles(l, db))
+	manageAccounts := middleware.RequirePermission(l, entities.PermManageAccounts)
+	admin.POST("/users/:userID/unlock", manageAccounts, handlers.PostUnlockUser(l, db))
+	admin.GET("/security/events", manageAccounts, handlers.GetSecurityEvents(l, db))
+	manageBilling := middleware.RequirePermission(l, entities.PermManageBilling)
+	admin.GET("/webhooks/polka/events", manageBilling, handlers.GetWebhookEvents(l, db))
+	admin.POST("/webhooks/polka/events/:eventID/replay", manageBilling, handlers.PostWebhookEventReplay(l, db))
+	manageWebhooks := middleware.RequirePermission(l, entities.PermManageWebhooks)
+	admin.GET("/webhooks/subscriptions", manageWebhooks, handlers.GetAdminWebhookSubscriptions(l, db))
+	admin.GET("/webhooks/deliveries", manageWebhooks, handlers.GetAdminWebhookDeliveries(l, db))
+	admin.POST("/webhooks/deliveries/:deliveryID/retry", manageWebhooks, handlers.PostAdminWebhookDeliveryRetry(l, db))
+	admin.GET("/metrics", middleware.RequirePermission(l, entities.PermViewMetrics), func(c *gin.Context) {
 		responseText := fmt.Sprintf("<html>\n\n<body>\n\t<h1>Welcome, Chirpy Admin</h1>\n\t<p>Chirpy has been visited %d times!</p>\n</body>\n\n</html>", m.Metrics.Get())
 		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(responseText))
 	})
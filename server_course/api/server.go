@@ -2,19 +2,31 @@ package api
 
 import (
 	"log/slog"
+	"server_course/api/common"
 	"server_course/api/middleware"
 	"server_course/db"
+	"server_course/events"
+	"server_course/mail"
+	"server_course/moderation"
+	"server_course/search"
+	"server_course/stream"
 
 	"github.com/gin-gonic/gin"
 )
 
-func NewServer(l *slog.Logger, m middleware.Middleware, db *db.DB) *gin.Engine {
+func NewServer(l *slog.Logger, m middleware.Middleware, db db.Store, index *search.Index, bus *events.Bus, broker *stream.Broker, moderator *moderation.Moderator, tokens *common.Tokens, mailer mail.Mailer) *gin.Engine {
 	router := gin.Default()
 	addRoutes(
 		router,
 		l,
 		m,
 		db,
+		index,
+		bus,
+		broker,
+		moderator,
+		tokens,
+		mailer,
 	)
 
 	return router
@@ -2,38 +2,321 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"server_course/api"
+	"server_course/api/common"
 	"server_course/api/middleware"
 	"server_course/db"
+	"server_course/entities"
+	"server_course/events"
+	"server_course/keyring"
+	"server_course/mail"
+	"server_course/moderation"
+	"server_course/notifications"
+	"server_course/ratelimit"
+	"server_course/search"
+	"server_course/stream"
+	"server_course/webhooks"
 
 	"github.com/joho/godotenv"
 )
 
-func run(ctx context.Context, l *slog.Logger, debugMode bool) error {
+const (
+	// streamHistorySize events are kept for clients resuming a stream
+	streamHistorySize = 1024
+	// streamBufferSize events can queue up for a slow client before it is dropped
+	streamBufferSize = 64
+	// moderationReloadEvery is how often the moderation config is checked for
+	// changes
+	moderationReloadEvery = 5 * time.Second
+	// pruneEvery is how often whatever ran out is dropped or ended
+	pruneEvery = time.Hour
+	// keyCheckEvery is how often the signing key is checked for its age
+	keyCheckEvery = time.Minute
+	// keyRetention is how long a key verifies after it stopped signing, it
+	// outlasts the tokens it signed
+	keyRetention             = common.MaxJWTLifetime + time.Hour
+	webhookDispatchEvery     = 5 * time.Second
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+type jwtConfig struct {
+	keysDir     string
+	algorithm   string
+	issuer      string
+	audience    string
+	rotateEvery time.Duration
+}
+
+func openStore(backend string) (db.Store, error) {
+	switch backend {
+	case "json":
+		return db.NewDB("./db")
+	case "sqlite":
+		return db.NewSQLiteDB("./db")
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
+
+func openMailer(l *slog.Logger, backend, dir string) (mail.Mailer, error) {
+	switch backend {
+	case "log":
+		return mail.NewLogMailer(l), nil
+	case "file":
+		return mail.NewFileMailer(dir)
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", backend)
+	}
+}
+
+func migrateStore(l *slog.Logger, backend string, dryRun bool) error {
+	var applied []db.Migration
+	var err error
+	switch backend {
+	case "json":
+		applied, err = db.MigrateJSON("./db", dryRun)
+	case "sqlite":
+		applied, err = db.MigrateSQLite("./db", dryRun)
+	default:
+		return fmt.Errorf("unknown store backend %q", backend)
+	}
+
+	for _, m := range applied {
+		l.Info("migrated schema",
+			slog.String("backend", backend),
+			slog.Int("version", m.Version),
+			slog.String("description", m.Description),
+			slog.Bool("dry_run", dryRun),
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s store: %w", backend, err)
+	}
+	if len(applied) == 0 {
+		l.Info("schema is up to date", slog.String("backend", backend))
+	}
+
+	return nil
+}
+
+// changeRole grants or revokes a role given as email=role. It lets ops hand out
+// rights without a token, the first admin cannot be made through the api.
+func changeRole(l *slog.Logger, store db.Store, spec string, grant bool) error {
+	email, role, found := strings.Cut(spec, "=")
+	if !found || !entities.ValidRole(role) {
+		return fmt.Errorf("bad role change %q, expected email=role with a known role", spec)
+	}
+
+	user, err := store.GetUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("failed to find user %q: %w", email, err)
+	}
+
+	roles := slices.DeleteFunc(slices.Clone(user.Roles), func(r string) bool { return r == role })
+	if grant {
+		roles = append(roles, role)
+	}
+	if _, err := store.UpdateUserRoles(user.ID, roles); err != nil {
+		return fmt.Errorf("failed to update roles of user %q: %w", email, err)
+	}
+
+	l.Info("changed roles", slog.Int("userID", user.ID), slog.String("email", email), slog.Any("roles", roles))
+	return nil
+}
+
+type pruneStep struct {
+	name string
+	run  func(now time.Time) (int, error)
+}
+
+func pruneSteps(store db.Store) []pruneStep {
+	return []pruneStep{
+		{"sessions", store.PruneSessions},
+		{"revoked tokens", store.PruneRevokedTokens},
+		{"email tokens", store.PruneEmailTokens},
+		{"login challenges", store.PruneLoginChallenges},
+		{"login throttles", func(now time.Time) (int, error) {
+			return store.PruneLoginThrottles(now.Add(-entities.ForgetLoginFailuresAfter))
+		}},
+		{"security events", func(now time.Time) (int, error) {
+			return store.PruneSecurityEvents(now.Add(-entities.KeepSecurityEventsFor))
+		}},
+		{"subscriptions", func(now time.Time) (int, error) {
+			expired, err := store.ExpireSubscriptions(now)
+			return len(expired), err
+		}},
+		{"webhook deliveries", func(now time.Time) (int, error) {
+			return store.PruneWebhookDeliveries(now.Add(-webhookDeliveryRetention))
+		}},
+	}
+}
+
+// pruneOnce does not let a failing step hold up the others.
+func pruneOnce(l *slog.Logger, steps []pruneStep, now time.Time) {
+	for _, step := range steps {
+		n, err := step.run(now)
+		switch {
+		case err != nil:
+			l.Error("failed to prune", slog.String("step", step.name), slog.String("err", err.Error()))
+		case n > 0:
+			l.Info("pruned", slog.String("step", step.name), slog.Int("count", n))
+		}
+	}
+}
+
+// prune runs every prune step each interval until ctx is done.
+func prune(ctx context.Context, l *slog.Logger, store db.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	steps := pruneSteps(store)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			pruneOnce(l, steps, now)
+		}
+	}
+}
+
+// rotateKeys replaces the signing key once it is older than maxAge until ctx
+// is done.
+func rotateKeys(ctx context.Context, l *slog.Logger, keys *keyring.Keyring, maxAge, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rotateKey(l, keys, maxAge)
+		}
+	}
+}
+
+func rotateKey(l *slog.Logger, keys *keyring.Keyring, maxAge time.Duration) {
+	rotated, dropped, err := keys.Rotate(time.Now(), maxAge, keyRetention)
+	if err != nil {
+		l.Error("failed to rotate signing keys", slog.String("err", err.Error()))
+		return
+	}
+	if rotated {
+		key := keys.Current()
+		l.Info("rotated signing key", slog.String("kid", key.ID), slog.String("alg", key.Algorithm))
+	}
+	for _, key := range dropped {
+		l.Info("dropped signing key", slog.String("kid", key.ID))
+	}
+}
+
+func run(ctx context.Context, l *slog.Logger, debugMode bool, storeBackend string, migrateDryRun bool, moderationConfig string, grantRole, revokeRole string, jwtCfg jwtConfig, mailerBackend, mailDir, trustedProxies string) error {
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
 	defer stop()
 
-	db, err := db.NewDB("./db")
+	err := migrateStore(l, storeBackend, migrateDryRun)
+	if err != nil || migrateDryRun {
+		return err
+	}
+
+	store, err := openStore(storeBackend)
 	if err != nil {
 		return err
 	}
+	defer store.Close()
+	l.Info("opened store", slog.String("backend", storeBackend))
 
-	middleware := middleware.NewMiddleware(l)
+	if grantRole != "" || revokeRole != "" {
+		if grantRole != "" {
+			if err := changeRole(l, store, grantRole, true); err != nil {
+				return err
+			}
+		}
+		if revokeRole != "" {
+			return changeRole(l, store, revokeRole, false)
+		}
+		return nil
+	}
+
+	if jwtCfg.rotateEvery <= 0 {
+		return errors.New("jwt-rotate-every has to be positive")
+	}
+	keys, err := keyring.New(jwtCfg.keysDir, jwtCfg.algorithm)
+	if err != nil {
+		return fmt.Errorf("failed to load signing keys: %w", err)
+	}
+	// a key may have aged while the server was down
+	rotateKey(l, keys, jwtCfg.rotateEvery)
+	go rotateKeys(ctx, l, keys, jwtCfg.rotateEvery, keyCheckEvery)
+	tokens := common.NewTokens(keys, jwtCfg.issuer, jwtCfg.audience)
+	l.Info("loaded signing keys", slog.String("kid", keys.Current().ID), slog.Int("keys", len(keys.Keys())))
 
-	router := api.NewServer(l, middleware, db)
+	indexed, err := search.NewIndexedStore(store)
+	if err != nil {
+		return err
+	}
+	l.Info("indexed chirps", slog.Int("chirps", indexed.Index().Len()))
+
+	broker := stream.NewBroker(streamHistorySize, streamBufferSize)
+	db := webhooks.NewEmittingStore(l, stream.NewPublishingStore(indexed, broker))
+
+	bus := events.NewBus(l)
+	notifications.Subscribe(bus, db)
+
+	moderator, err := moderation.NewModerator(moderationConfig)
+	if err != nil {
+		return fmt.Errorf("failed to load moderation config: %w", err)
+	}
+	go moderator.Watch(ctx, l, moderationReloadEvery)
+
+	mailer, err := openMailer(l, mailerBackend, mailDir)
+	if err != nil {
+		return err
+	}
+
+	middleware := middleware.NewMiddleware(l, ratelimit.NewMemory())
+
+	router := api.NewServer(l, middleware, db, indexed.Index(), bus, broker, moderator, tokens, mailer)
+	// rate limits go by client address, headers anyone can set must not fake it
+	var proxies []string
+	if trustedProxies != "" {
+		proxies = strings.Split(trustedProxies, ",")
+	}
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		return fmt.Errorf("bad trusted proxies: %w", err)
+	}
+
+	// nothing may return early from here on, the store outlives these
+	workers := sync.WaitGroup{}
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		prune(ctx, l, db, pruneEvery)
+	}()
+	go func() {
+		defer workers.Done()
+		webhooks.NewDispatcher(l, db, webhooks.NewClient()).Run(ctx, webhookDispatchEvery)
+	}()
 
 	srv := &http.Server{
 		Addr:    ":8080",
 		Handler: router,
 	}
+	// streams never end on their own
+	srv.RegisterOnShutdown(broker.Close)
 
 	go func() {
 		l.Info("started listening on server", slog.String("addr", srv.Addr))
@@ -54,6 +337,7 @@ func run(ctx context.Context, l *slog.Logger, debugMode bool) error {
 	if err := srv.Shutdown(ctx); err != nil {
 		fmt.Fprintln(os.Stderr, "Server forced to shutdown: ", err)
 	}
+	workers.Wait()
 
 	if debugMode {
 		err := db.Reset()
@@ -73,10 +357,24 @@ func main() {
 	logger := slog.Default()
 
 	dbg := flag.Bool("debug", false, "Enable debug mode")
+	storeBackend := flag.String("store", "json", "Storage backend to use (json or sqlite)")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "Check pending schema migrations without writing them and exit")
+	moderationConfig := flag.String("moderation-config", "./moderation.json", "Moderation rules, reloaded when the file changes")
+	grantRole := flag.String("grant-role", "", "Give a user a role, as email=role, and exit")
+	revokeRole := flag.String("revoke-role", "", "Take a role from a user, as email=role, and exit")
+	var jwtCfg jwtConfig
+	flag.StringVar(&jwtCfg.keysDir, "jwt-keys", "./keys", "Directory holding the JWT signing keys, one is made if it is empty")
+	flag.StringVar(&jwtCfg.algorithm, "jwt-alg", keyring.AlgEdDSA, "Algorithm of new JWT signing keys (RS256 or EdDSA)")
+	flag.StringVar(&jwtCfg.issuer, "jwt-issuer", "chirpy", "Issuer set in and required of JWTs")
+	flag.StringVar(&jwtCfg.audience, "jwt-audience", "chirpy", "Audience set in and required of JWTs")
+	flag.DurationVar(&jwtCfg.rotateEvery, "jwt-rotate-every", 7*24*time.Hour, "How long a key signs JWTs before a new one takes over")
+	mailerBackend := flag.String("mailer", "log", "Where mails go (log or file), the log leaves out bodies and file keeps them for development")
+	mailDir := flag.String("mail-dir", "./mails", "Directory the file mailer writes to")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated addresses or CIDRs of proxies whose X-Forwarded-For is believed")
 	flag.Parse()
 
 	ctx := context.Background()
-	if err := run(ctx, logger, *dbg); err != nil {
+	if err := run(ctx, logger, *dbg, *storeBackend, *migrateDryRun, *moderationConfig, *grantRole, *revokeRole, jwtCfg, *mailerBackend, *mailDir, *trustedProxies); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
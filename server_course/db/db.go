@@ -5,85 +5,361 @@ import (
 	"errors"
 	"os"
 	"server_course/entities"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	ErrDoesNotExist = errors.New("does not exist")
+	ErrInvalidReply = errors.New("chirp replied to does not exist")
+	ErrTokenReused  = errors.New("refresh token was already used")
+	ErrCodeReused   = errors.New("code was already used")
+	ErrResolved     = errors.New("report is already resolved")
 )
 
 type DBStructure struct {
-	Chirps     map[int]entities.Chirp `json:"chirps"`
-	Users      map[int]entities.User  `json:"users"`
-	ChirpIndex int                    `json:"chirp_index"`
-	UserIndex  int                    `json:"user_index"`
+	SchemaVersion            int                                  `json:"schema_version"`
+	Chirps                   map[int]entities.Chirp               `json:"chirps"`
+	ChirpRevisions           map[int][]entities.ChirpRevision     `json:"chirp_revisions"`
+	Users                    map[int]entities.User                `json:"users"`
+	Follows                  map[int][]int                        `json:"follows"`
+	Likes                    map[int][]entities.Engagement        `json:"likes"`
+	Rechirps                 map[int][]entities.Engagement        `json:"rechirps"`
+	Notifications            map[int]entities.Notification        `json:"notifications"`
+	Reports                  map[int]entities.Report              `json:"reports"`
+	ModerationActions        map[int]entities.ModerationAction    `json:"moderation_actions"`
+	Sessions                 map[int]entities.Session             `json:"sessions"`
+	SessionTokens            map[int]entities.SessionToken        `json:"session_tokens"`
+	RevokedTokens            map[int]entities.RevokedToken        `json:"revoked_tokens"`
+	EmailTokens              map[int]entities.EmailToken          `json:"email_tokens"`
+	TOTP                     map[int]entities.TOTP                `json:"totp"`
+	RecoveryCodes            map[int]entities.RecoveryCode        `json:"recovery_codes"`
+	LoginChallenges          map[int]entities.LoginChallenge      `json:"login_challenges"`
+	LoginThrottles           map[int]entities.LoginThrottle       `json:"login_throttles"`
+	SecurityEvents           map[int]entities.SecurityEvent       `json:"security_events"`
+	WebhookEvents            map[int]entities.WebhookEvent        `json:"webhook_events"`
+	Subscriptions            map[int]entities.Subscription        `json:"subscriptions"`
+	WebhookSubscriptions     map[int]entities.WebhookSubscription `json:"webhook_subscriptions"`
+	WebhookDeliveries        map[int]entities.WebhookDelivery     `json:"webhook_deliveries"`
+	ChirpIndex               int                                  `json:"chirp_index"`
+	UserIndex                int                                  `json:"user_index"`
+	NotificationIndex        int                                  `json:"notification_index"`
+	ReportIndex              int                                  `json:"report_index"`
+	ModerationActionIndex    int                                  `json:"moderation_action_index"`
+	SessionIndex             int                                  `json:"session_index"`
+	SessionTokenIndex        int                                  `json:"session_token_index"`
+	RevokedTokenIndex        int                                  `json:"revoked_token_index"`
+	EmailTokenIndex          int                                  `json:"email_token_index"`
+	RecoveryCodeIndex        int                                  `json:"recovery_code_index"`
+	LoginChallengeIndex      int                                  `json:"login_challenge_index"`
+	LoginThrottleIndex       int                                  `json:"login_throttle_index"`
+	SecurityEventIndex       int                                  `json:"security_event_index"`
+	WebhookEventIndex        int                                  `json:"webhook_event_index"`
+	WebhookSubscriptionIndex int                                  `json:"webhook_subscription_index"`
+	WebhookDeliveryIndex     int                                  `json:"webhook_delivery_index"`
 }
 
 type DB struct {
 	store DBStructure
-	path  string
-	mux   *sync.RWMutex
+	// the token indexes are not persisted but rebuilt from the store
+	tokensByHash    map[string]int
+	tokensBySession map[int][]int
+	revokedByJTI    map[string]int
+	throttlesByKey  map[string]int
+	path            string
+	wal             *wal
+	mux             *sync.RWMutex
+}
+
+func newDBStructure() DBStructure {
+	return DBStructure{
+		SchemaVersion:            latestJSONVersion(),
+		Chirps:                   make(map[int]entities.Chirp),
+		ChirpRevisions:           make(map[int][]entities.ChirpRevision),
+		Users:                    make(map[int]entities.User),
+		Follows:                  make(map[int][]int),
+		Likes:                    make(map[int][]entities.Engagement),
+		Rechirps:                 make(map[int][]entities.Engagement),
+		Notifications:            make(map[int]entities.Notification),
+		Reports:                  make(map[int]entities.Report),
+		ModerationActions:        make(map[int]entities.ModerationAction),
+		Sessions:                 make(map[int]entities.Session),
+		SessionTokens:            make(map[int]entities.SessionToken),
+		RevokedTokens:            make(map[int]entities.RevokedToken),
+		EmailTokens:              make(map[int]entities.EmailToken),
+		TOTP:                     make(map[int]entities.TOTP),
+		RecoveryCodes:            make(map[int]entities.RecoveryCode),
+		LoginChallenges:          make(map[int]entities.LoginChallenge),
+		LoginThrottles:           make(map[int]entities.LoginThrottle),
+		SecurityEvents:           make(map[int]entities.SecurityEvent),
+		WebhookEvents:            make(map[int]entities.WebhookEvent),
+		Subscriptions:            make(map[int]entities.Subscription),
+		WebhookSubscriptions:     make(map[int]entities.WebhookSubscription),
+		WebhookDeliveries:        make(map[int]entities.WebhookDelivery),
+		ChirpIndex:               1,
+		UserIndex:                1,
+		NotificationIndex:        1,
+		ReportIndex:              1,
+		ModerationActionIndex:    1,
+		SessionIndex:             1,
+		SessionTokenIndex:        1,
+		RevokedTokenIndex:        1,
+		EmailTokenIndex:          1,
+		RecoveryCodeIndex:        1,
+		LoginChallengeIndex:      1,
+		LoginThrottleIndex:       1,
+		SecurityEventIndex:       1,
+		WebhookEventIndex:        1,
+		WebhookSubscriptionIndex: 1,
+		WebhookDeliveryIndex:     1,
+	}
 }
 
 func NewDB(p string) (*DB, error) {
 	db := &DB{
-		store: DBStructure{
-			Chirps:     make(map[int]entities.Chirp),
-			Users:      make(map[int]entities.User),
-			ChirpIndex: 1,
-			UserIndex:  1,
-		},
-		path: p + "/database.json",
-		mux:  &sync.RWMutex{},
+		store: newDBStructure(),
+		path:  p + "/database.json",
+		mux:   &sync.RWMutex{},
 	}
 
 	return db, db.loadDB()
 }
 
+// commit appends entries to the write-ahead log, the caller has to hold the
+// write lock and only apply the change in memory once commit succeeded.
+func (db *DB) commit(entries ...walEntry) error {
+	// compact before appending, the entries of this commit are not applied
+	// to the in memory store yet and would be lost from the snapshot
+	if db.wal.entries >= walCompactEvery {
+		if err := db.compact(); err != nil {
+			return err
+		}
+	}
+	return db.wal.append(entries...)
+}
+
+func (db *DB) put(table string, id int, v any) error {
+	entry, err := newPut(table, id, v)
+	if err != nil {
+		return err
+	}
+	return db.commit(entry)
+}
+
+// batch collects the log entries of one mutation together with the matching
+// in memory changes, which are only applied once all entries are on disk.
+type batch struct {
+	entries []walEntry
+	apply   []func()
+}
+
+func (b *batch) put(table string, id int, v any, apply func()) error {
+	entry, err := newPut(table, id, v)
+	if err != nil {
+		return err
+	}
+	b.entries = append(b.entries, entry)
+	b.apply = append(b.apply, apply)
+	return nil
+}
+
+func (b *batch) delete(table string, id int, apply func()) {
+	b.entries = append(b.entries, newDelete(table, id))
+	b.apply = append(b.apply, apply)
+}
+
+func (db *DB) commitBatch(b *batch) error {
+	if err := db.commit(b.entries...); err != nil {
+		return err
+	}
+	for _, apply := range b.apply {
+		apply()
+	}
+	return nil
+}
+
 func (db *DB) StoreChirp(c entities.Chirp) (entities.Chirp, error) {
 	db.mux.Lock()
-	c.ID = db.store.ChirpIndex // idk
-	db.store.Chirps[db.store.ChirpIndex] = c
-	db.store.ChirpIndex++
-	db.mux.Unlock() // unlock manual cause writeDB relocks
+	defer db.mux.Unlock()
 
-	return c, db.writeDB()
+	c.ID = db.store.ChirpIndex
+	c.CreatedAt = time.Now().UTC()
+	c.UpdatedAt = c.CreatedAt
+	c.ReplyCount = 0
+	c.LikeCount = 0
+	c.RechirpCount = 0
+	c.Deleted = false
+	c.Hidden = false
+	if err := tagChirp(&c, db.userIDByHandle); err != nil {
+		return entities.Chirp{}, err
+	}
+
+	b := &batch{}
+	if c.InReplyTo != 0 {
+		parent, exists := db.store.Chirps[c.InReplyTo]
+		if !exists || !parent.Visible() {
+			return entities.Chirp{}, ErrInvalidReply
+		}
+		parent.ReplyCount++
+		if err := b.put("chirps", parent.ID, parent, func() { db.store.Chirps[parent.ID] = parent }); err != nil {
+			return entities.Chirp{}, err
+		}
+	}
+
+	err := b.put("chirps", c.ID, c, func() {
+		db.store.Chirps[c.ID] = c
+		db.store.ChirpIndex++
+	})
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+
+	return c, db.commitBatch(b)
 }
 
 func (db *DB) StoreUser(u entities.User) (entities.User, error) {
 	db.mux.Lock()
-	u.ID = db.store.UserIndex // idk
+	defer db.mux.Unlock()
+
+	u.ID = db.store.UserIndex
+	u.Roles = nil
+	u.Token = ""
+	u.RefreshToken = ""
+	u.Suspended = false
+	u.TokenVersion = 0
+	u.Verified = false
+	u.IsChirpyRed = false
 	encryptedUser, err := u.EncryptPassword()
 	if err != nil {
 		return entities.User{}, err
 	}
-	db.store.Users[db.store.UserIndex] = encryptedUser
+	if err := db.put("users", u.ID, encryptedUser); err != nil {
+		return entities.User{}, err
+	}
+	db.store.Users[u.ID] = encryptedUser
 	db.store.UserIndex++
-	db.mux.Unlock() // unlock manual cause writeDB relocks
 
-	return u, db.writeDB()
+	return u, nil
 }
 
 func (db *DB) DeleteChirp(chirpID int) error {
 	db.mux.Lock()
-	delete(db.store.Chirps, chirpID)
-	db.mux.Unlock() // unlock manual cause writeDB relocks
+	defer db.mux.Unlock()
+
+	c, exists := db.store.Chirps[chirpID]
+	if !exists || c.Deleted {
+		return nil
+	}
 
-	return db.writeDB()
+	b := &batch{}
+	if err := db.deleteChirp(b, c); err != nil {
+		return err
+	}
+	return db.commitBatch(b)
+}
+
+// deleteChirp adds deleting c to b, with replies it stays as a tombstone.
+func (db *DB) deleteChirp(b *batch, c entities.Chirp) error {
+	b.delete("chirp_revisions", c.ID, func() { delete(db.store.ChirpRevisions, c.ID) })
+	b.delete("likes", c.ID, func() { delete(db.store.Likes, c.ID) })
+	b.delete("rechirps", c.ID, func() { delete(db.store.Rechirps, c.ID) })
+
+	if c.ReplyCount > 0 {
+		c.Body = ""
+		c.LikeCount = 0
+		c.RechirpCount = 0
+		c.Deleted = true
+		c.Hidden = false
+		c.Hashtags = nil
+		c.Mentions = nil
+		return b.put("chirps", c.ID, c, func() { db.store.Chirps[c.ID] = c })
+	}
+
+	b.delete("chirps", c.ID, func() { delete(db.store.Chirps, c.ID) })
+
+	// walk up the thread, tombstones left without replies go as well
+	for parentID := c.InReplyTo; parentID != 0; {
+		parent, exists := db.store.Chirps[parentID]
+		if !exists {
+			break
+		}
+
+		parent.ReplyCount--
+		if !parent.Deleted || parent.ReplyCount > 0 {
+			if err := b.put("chirps", parent.ID, parent, func() { db.store.Chirps[parent.ID] = parent }); err != nil {
+				return err
+			}
+			break
+		}
+
+		b.delete("chirps", parent.ID, func() { delete(db.store.Chirps, parent.ID) })
+		parentID = parent.InReplyTo
+	}
+
+	return nil
 }
 
 func (db *DB) GetChirp(chirpID int) (entities.Chirp, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
-	if c, exits := db.store.Chirps[chirpID]; exits {
+	if c, exits := db.store.Chirps[chirpID]; exits && c.Visible() {
 		return c, nil
 	} else {
 		return entities.Chirp{}, ErrDoesNotExist
 	}
 }
 
+func (db *DB) UpdateChirp(newChirp entities.Chirp) (entities.Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	chirp, exists := db.store.Chirps[newChirp.ID]
+	if !exists || !chirp.Visible() {
+		return entities.Chirp{}, ErrDoesNotExist
+	}
+
+	revisions := append(slices.Clone(db.store.ChirpRevisions[chirp.ID]), entities.ChirpRevision{
+		ChirpID:   chirp.ID,
+		Revision:  len(db.store.ChirpRevisions[chirp.ID]) + 1,
+		Body:      chirp.Body,
+		CreatedAt: chirp.UpdatedAt,
+	})
+	chirp.Body = newChirp.Body
+	chirp.UpdatedAt = time.Now().UTC()
+	if err := tagChirp(&chirp, db.userIDByHandle); err != nil {
+		return entities.Chirp{}, err
+	}
+
+	chirpEntry, err := newPut("chirps", chirp.ID, chirp)
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	revisionsEntry, err := newPut("chirp_revisions", chirp.ID, revisions)
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	if err := db.commit(chirpEntry, revisionsEntry); err != nil {
+		return entities.Chirp{}, err
+	}
+	db.store.Chirps[chirp.ID] = chirp
+	db.store.ChirpRevisions[chirp.ID] = revisions
+
+	return chirp, nil
+}
+
+// GetChirpRevisions returns the earlier bodies of a chirp, oldest first.
+func (db *DB) GetChirpRevisions(chirpID int) ([]entities.ChirpRevision, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	if c, exists := db.store.Chirps[chirpID]; !exists || !c.Visible() {
+		return nil, ErrDoesNotExist
+	}
+	return append([]entities.ChirpRevision{}, db.store.ChirpRevisions[chirpID]...), nil
+}
+
 func (db *DB) GetUser(userID int) (entities.User, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
@@ -112,7 +388,14 @@ func (db *DB) GetUserByEmail(requestedEmail string) (entities.User, error) {
 func (db *DB) GetChirps() (map[int]entities.Chirp, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
-	return db.store.Chirps, nil
+
+	chirps := make(map[int]entities.Chirp, len(db.store.Chirps))
+	for id, c := range db.store.Chirps {
+		if c.Visible() {
+			chirps[id] = c
+		}
+	}
+	return chirps, nil
 }
 
 func (db *DB) GetUsers() (map[int]entities.User, error) {
@@ -125,11 +408,11 @@ func (db *DB) GetChirpsSlice() ([]entities.Chirp, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
-	chirps := make([]entities.Chirp, len(db.store.Chirps))
-	i := 0
+	chirps := make([]entities.Chirp, 0, len(db.store.Chirps))
 	for _, c := range db.store.Chirps {
-		chirps[i] = c
-		i++
+		if c.Visible() {
+			chirps = append(chirps, c)
+		}
 	}
 
 	sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
@@ -137,6 +420,40 @@ func (db *DB) GetChirpsSlice() ([]entities.Chirp, error) {
 	return chirps, nil
 }
 
+// ListChirps walks the id space from the cursor instead of sorting every
+// chirp, ids are handed out in order so this is the creation order.
+func (db *DB) ListChirps(q ChirpQuery) (ChirpPage, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	id, step := 1, 1
+	if !q.ascending() {
+		id, step = db.store.ChirpIndex-1, -1
+	}
+	if cursor := max(q.After, q.Before); cursor != 0 {
+		id = cursor + step
+	}
+
+	page := ChirpPage{Chirps: []entities.Chirp{}}
+	for ; id > 0 && id < db.store.ChirpIndex; id += step {
+		c, exists := db.store.Chirps[id]
+		if !exists || !q.matches(c) {
+			continue
+		}
+		if q.Limit > 0 && len(page.Chirps) == q.Limit {
+			page.HasMore = true
+			break
+		}
+		page.Chirps = append(page.Chirps, c)
+	}
+
+	if q.Before != 0 {
+		slices.Reverse(page.Chirps)
+	}
+
+	return page, nil
+}
+
 func (db *DB) GetUsersSlice() ([]entities.User, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
@@ -153,113 +470,157 @@ func (db *DB) GetUsersSlice() ([]entities.User, error) {
 	return users, nil
 }
 
-func (db *DB) UpdateUser(newUser entities.User) (entities.User, error) {
+// updateUser lets update modify a copy of the stored user and logs it before
+// it replaces the stored one.
+func (db *DB) updateUser(userID int, update func(u *entities.User) error) (entities.User, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	oldUser, exits := db.store.Users[newUser.ID]
+
+	user, exits := db.store.Users[userID]
 	if !exits {
 		return entities.User{}, ErrDoesNotExist
 	}
 
-	if newUser.Password != "" {
+	if err := update(&user); err != nil {
+		return entities.User{}, err
+	}
+	// only the subscription changes it
+	user.IsChirpyRed = db.store.Users[userID].IsChirpyRed
+
+	if err := db.put("users", userID, user); err != nil {
+		return entities.User{}, err
+	}
+	db.store.Users[userID] = user
+
+	return user, nil
+}
+
+func (db *DB) UpdateUser(newUser entities.User) (entities.User, error) {
+	return db.updateUser(newUser.ID, func(oldUser *entities.User) error {
+		if newUser.Password != "" {
+			encryptedUser, err := newUser.EncryptPassword()
+			if err != nil {
+				return err
+			}
+			oldUser.Password = encryptedUser.Password
+			oldUser.TokenVersion++
+		}
+
+		if !strings.EqualFold(oldUser.Email, newUser.Email) {
+			oldUser.Verified = false
+		}
+		oldUser.Email = newUser.Email
+		return nil
+	})
+}
+
+func (db *DB) UpdateUserEmailAndPassword(newUser entities.User) (entities.User, error) {
+	return db.updateUser(newUser.ID, func(oldUser *entities.User) error {
 		encryptedUser, err := newUser.EncryptPassword()
 		if err != nil {
-			return entities.User{}, err
+			return err
+		}
+		if !strings.EqualFold(oldUser.Email, newUser.Email) {
+			oldUser.Verified = false
 		}
+		oldUser.Email = newUser.Email
 		oldUser.Password = encryptedUser.Password
-	}
-
-	oldUser.Email = newUser.Email
-	oldUser.Token = newUser.Token
-	oldUser.ExpiresInSeconds = newUser.ExpiresInSeconds
-	oldUser.RefreshToken = newUser.RefreshToken
-	oldUser.RefreshExpiresInSeconds = newUser.RefreshExpiresInSeconds
-	db.store.Users[newUser.ID] = oldUser
-	return oldUser, nil
+		oldUser.TokenVersion++
+		return nil
+	})
 }
 
-func (db *DB) UpdateUserTokens(newUser entities.User) (entities.User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	oldUser, exits := db.store.Users[newUser.ID]
-	if !exits {
-		return entities.User{}, ErrDoesNotExist
-	}
+func (db *DB) UpdateUserRoles(userID int, roles []string) (entities.User, error) {
+	return db.updateUser(userID, func(user *entities.User) error {
+		user.Roles = roles
+		return nil
+	})
+}
 
-	oldUser.Token = newUser.Token
-	oldUser.ExpiresInSeconds = newUser.ExpiresInSeconds
-	oldUser.RefreshToken = newUser.RefreshToken
-	oldUser.RefreshExpiresInSeconds = newUser.RefreshExpiresInSeconds
-	db.store.Users[newUser.ID] = oldUser
-	return oldUser, nil
+func (db *DB) UpdateUserSuspended(userID int, suspended bool) (entities.User, error) {
+	return db.updateUser(userID, func(user *entities.User) error {
+		user.Suspended = suspended
+		return nil
+	})
 }
 
-func (db *DB) UpdateUserEmailAndPassword(newUser entities.User) (entities.User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	oldUser, exits := db.store.Users[newUser.ID]
-	if !exits {
-		return entities.User{}, ErrDoesNotExist
-	}
+func (db *DB) UpdateUserVerified(userID int, verified bool) (entities.User, error) {
+	return db.updateUser(userID, func(user *entities.User) error {
+		user.Verified = verified
+		return nil
+	})
+}
 
-	encryptedUser, err := newUser.EncryptPassword()
-	if err != nil {
-		return entities.User{}, err
-	}
-	oldUser.Email = newUser.Email
-	oldUser.Password = encryptedUser.Password
-	return oldUser, nil
+func (db *DB) BumpTokenVersion(userID int) (entities.User, error) {
+	return db.updateUser(userID, func(user *entities.User) error {
+		user.TokenVersion++
+		return nil
+	})
 }
 
-func (db *DB) UpdateUserRedStatus(userID int, status bool) (entities.User, error) {
+func (db *DB) Reset() error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-	user, exits := db.store.Users[userID]
-	if !exits {
-		return entities.User{}, ErrDoesNotExist
+
+	if err := db.wal.truncate(); err != nil {
+		return err
+	}
+	err := os.Remove(db.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
-	user.IsChirpyRed = status
-	db.store.Users[userID] = user
-	return db.store.Users[userID], nil
+	db.store = newDBStructure()
+	db.indexTokens()
+	db.indexThrottles()
+	return nil
 }
 
-func (db *DB) Reset() error {
+// Close folds the write-ahead log into the snapshot and closes it.
+func (db *DB) Close() error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	err := os.Remove(db.path)
-	if err != nil {
+	if err := db.compact(); err != nil {
 		return err
 	}
-	clear(db.store.Chirps)
-	return nil
+	return db.wal.close()
 }
 
+// loadDB recovers the store from the last snapshot and the write-ahead log and
+// compacts both into a fresh snapshot.
 func (db *DB) loadDB() error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	data, err := os.ReadFile(db.path)
+	r, err := recoverJSON(db.path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
 		return err
 	}
+	db.store = r.store
+	db.indexTokens()
+	db.indexThrottles()
 
-	return json.Unmarshal(data, &db.store)
-}
+	db.wal, err = openWAL(db.path+".wal", r.replayed)
+	if err != nil {
+		return err
+	}
 
-func (db *DB) writeDB() error {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+	// always start from an empty log, it may end in a torn entry
+	return db.compact()
+}
 
+// compact writes the in memory store as a new snapshot and empties the log,
+// the caller has to hold the write lock.
+func (db *DB) compact() error {
 	data, err := json.Marshal(db.store)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(db.path, data, 0644)
-	return err
+	if err := writeFileAtomic(db.path, data); err != nil {
+		return err
+	}
+
+	return db.wal.truncate()
 }
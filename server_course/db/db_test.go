@@ -3,28 +3,186 @@ package db
 import (
 	"server_course/entities"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestDB_writeDB(t *testing.T) {
-	db, err := NewDB(".")
+	dir := t.TempDir()
+	db, err := NewDB(dir)
 	assert.NoError(t, err)
 
 	chirp := entities.Chirp{
 		Body: "Hello World",
 	}
-	_, err = db.StoreChirp(chirp)
+	chirp, err = db.StoreChirp(chirp)
 	assert.NoError(t, err)
 
 	chirps, err := db.GetChirps()
 	assert.NoError(t, err)
-	assert.Equal(t, chirps[0], chirp)
+	assert.Equal(t, chirps[chirp.ID], chirp)
 
-	db2, err := NewDB(".")
+	db2, err := NewDB(dir)
 	assert.NoError(t, err)
 	chirps2, err := db2.GetChirps()
 	assert.NoError(t, err)
-	assert.Equal(t, chirps2[0], chirp)
+	assert.Equal(t, chirps2[chirp.ID], chirp)
 	assert.Equal(t, chirps, chirps2)
 }
+
+func TestSQLiteDB(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSQLiteDB(dir)
+	assert.NoError(t, err)
+
+	user, err := db.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "heisenberg"})
+	assert.NoError(t, err)
+
+	chirp, err := db.StoreChirp(entities.Chirp{AuthorID: user.ID, Body: "Hello World"})
+	assert.NoError(t, err)
+
+	session, err := db.CreateSession(entities.Session{UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}, entities.SessionToken{Hash: "abc"})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	db2, err := NewSQLiteDB(dir)
+	assert.NoError(t, err)
+	defer db2.Close()
+
+	storedChirp, err := db2.GetChirp(chirp.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, chirp, storedChirp)
+
+	storedUser, err := db2.GetUserByEmail("WALT@breakingbad.com")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, storedUser.ID)
+
+	storedSession, err := db2.GetSessionByToken("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, session.ID, storedSession.ID)
+	assert.Equal(t, user.ID, storedSession.UserID)
+
+	err = db2.DeleteChirp(chirp.ID)
+	assert.NoError(t, err)
+	_, err = db2.GetChirp(chirp.ID)
+	assert.ErrorIs(t, err, ErrDoesNotExist)
+}
+
+// testStores opens every Store implementation in its own temp dir.
+func testStores(t *testing.T) map[string]Store {
+	jsonDB, err := NewDB(t.TempDir())
+	assert.NoError(t, err)
+	sqliteDB, err := NewSQLiteDB(t.TempDir())
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		jsonDB.Close()
+		sqliteDB.Close()
+	})
+
+	return map[string]Store{"json": jsonDB, "sqlite": sqliteDB}
+}
+
+func TestStore_ListChirps(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 1; i <= 5; i++ {
+				_, err := store.StoreChirp(entities.Chirp{AuthorID: i%2 + 1, Body: "chirp"})
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, store.DeleteChirp(3))
+
+			page, err := store.ListChirps(ChirpQuery{Limit: 2})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{1, 2}, ids(page.Chirps))
+			assert.True(t, page.HasMore)
+
+			page, err = store.ListChirps(ChirpQuery{Limit: 2, After: 2})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{4, 5}, ids(page.Chirps))
+			assert.False(t, page.HasMore)
+
+			page, err = store.ListChirps(ChirpQuery{Limit: 1, Before: 4})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{2}, ids(page.Chirps))
+			assert.True(t, page.HasMore)
+
+			page, err = store.ListChirps(ChirpQuery{Limit: 2, Desc: true, After: 5})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{4, 2}, ids(page.Chirps))
+			assert.True(t, page.HasMore)
+
+			page, err = store.ListChirps(ChirpQuery{Desc: true, Before: 2})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{5, 4}, ids(page.Chirps))
+
+			page, err = store.ListChirps(ChirpQuery{AuthorIDs: []int{2}})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{1, 5}, ids(page.Chirps))
+
+			page, err = store.ListChirps(ChirpQuery{Until: time.Now().Add(-time.Hour)})
+			assert.NoError(t, err)
+			assert.Empty(t, page.Chirps)
+		})
+	}
+}
+
+func TestStore_StoreChirp(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			c, err := store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "chirp", Hidden: true, Deleted: true, LikeCount: 3})
+			assert.NoError(t, err)
+			assert.False(t, c.Hidden)
+			assert.False(t, c.Deleted)
+			assert.Zero(t, c.LikeCount)
+
+			got, err := store.GetChirp(c.ID)
+			assert.NoError(t, err)
+			assert.False(t, got.Hidden)
+		})
+	}
+}
+
+func ids(chirps []entities.Chirp) []int {
+	ids := []int{}
+	for _, c := range chirps {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func TestStore_UpdateChirp(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			chirp, err := store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "first"})
+			assert.NoError(t, err)
+
+			for _, body := range []string{"second", "third"} {
+				chirp.Body = body
+				chirp, err = store.UpdateChirp(chirp)
+				assert.NoError(t, err)
+			}
+			assert.True(t, chirp.UpdatedAt.After(chirp.CreatedAt))
+
+			revisions, err := store.GetChirpRevisions(chirp.ID)
+			assert.NoError(t, err)
+			assert.Len(t, revisions, 2)
+			assert.Equal(t, "first", revisions[0].Body)
+			assert.Equal(t, chirp.CreatedAt, revisions[0].CreatedAt)
+			assert.Equal(t, 2, revisions[1].Revision)
+			assert.Equal(t, "second", revisions[1].Body)
+
+			storedChirp, err := store.GetChirp(chirp.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, "third", storedChirp.Body)
+
+			assert.NoError(t, store.DeleteChirp(chirp.ID))
+			_, err = store.GetChirpRevisions(chirp.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			_, err = store.UpdateChirp(chirp)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+		})
+	}
+}
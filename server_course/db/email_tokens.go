@@ -0,0 +1,250 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"server_course/entities"
+	"strings"
+	"time"
+)
+
+func (db *DB) CreateEmailToken(t entities.EmailToken) (entities.EmailToken, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	now := time.Now().UTC()
+	t.ID = db.store.EmailTokenIndex
+	t.CreatedAt = now
+	t.ExpiresAt = t.ExpiresAt.UTC()
+	t.UsedAt = nil
+
+	b := &batch{}
+	for _, old := range db.store.EmailTokens {
+		if old.UserID != t.UserID || old.Purpose != t.Purpose || !old.Usable(now) {
+			continue
+		}
+		old.UsedAt = &now
+		if err := b.put("email_tokens", old.ID, old, func() { db.store.EmailTokens[old.ID] = old }); err != nil {
+			return entities.EmailToken{}, err
+		}
+	}
+	err := b.put("email_tokens", t.ID, t, func() {
+		db.store.EmailTokens[t.ID] = t
+		db.store.EmailTokenIndex++
+	})
+	if err != nil {
+		return entities.EmailToken{}, err
+	}
+
+	return t, db.commitBatch(b)
+}
+
+// useEmailToken adds using the token to b and returns it together with its
+// user, the caller has to hold the write lock.
+func (db *DB) useEmailToken(b *batch, purpose, hash string, now time.Time) (entities.EmailToken, entities.User, error) {
+	for _, t := range db.store.EmailTokens {
+		if t.Hash != hash || t.Purpose != purpose || !t.Usable(now) {
+			continue
+		}
+		user, exists := db.store.Users[t.UserID]
+		if !exists || !strings.EqualFold(user.Email, t.Email) {
+			break
+		}
+
+		t.UsedAt = &now
+		if err := b.put("email_tokens", t.ID, t, func() { db.store.EmailTokens[t.ID] = t }); err != nil {
+			return entities.EmailToken{}, entities.User{}, err
+		}
+		return t, user, nil
+	}
+
+	return entities.EmailToken{}, entities.User{}, ErrDoesNotExist
+}
+
+func (db *DB) UseEmailToken(purpose, hash string) (entities.EmailToken, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	t, _, err := db.useEmailToken(b, purpose, hash, time.Now().UTC())
+	if err != nil {
+		return entities.EmailToken{}, err
+	}
+	return t, db.commitBatch(b)
+}
+
+func (db *DB) ResetPassword(hash, password string) (entities.User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	_, user, err := db.useEmailToken(b, entities.EmailTokenReset, hash, time.Now().UTC())
+	if err != nil {
+		return entities.User{}, err
+	}
+
+	newUser := entities.User{Password: password}
+	encrypted, err := newUser.EncryptPassword()
+	if err != nil {
+		return entities.User{}, err
+	}
+	user.Password = encrypted.Password
+	user.TokenVersion++
+	user.Verified = true
+	if err := b.put("users", user.ID, user, func() { db.store.Users[user.ID] = user }); err != nil {
+		return entities.User{}, err
+	}
+
+	return user, db.commitBatch(b)
+}
+
+func (db *DB) PruneEmailTokens(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	for _, t := range db.store.EmailTokens {
+		if t.ExpiresAt.Before(before) {
+			b.delete("email_tokens", t.ID, func() { delete(db.store.EmailTokens, t.ID) })
+		}
+	}
+	if len(b.entries) == 0 {
+		return 0, nil
+	}
+
+	return len(b.entries), db.commitBatch(b)
+}
+
+const emailTokenColumns = "id, user_id, email, purpose, hash, created_at, expires_at, used_at"
+
+func scanEmailToken(row scanner) (entities.EmailToken, error) {
+	var t entities.EmailToken
+	var createdAt, expiresAt int64
+	var usedAt sql.NullInt64
+	err := row.Scan(&t.ID, &t.UserID, &t.Email, &t.Purpose, &t.Hash, &createdAt, &expiresAt, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.EmailToken{}, ErrDoesNotExist
+	}
+	t.CreatedAt = time.Unix(0, createdAt).UTC()
+	t.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	if usedAt.Valid {
+		used := time.Unix(0, usedAt.Int64).UTC()
+		t.UsedAt = &used
+	}
+	return t, err
+}
+
+func (db *SQLiteDB) CreateEmailToken(t entities.EmailToken) (entities.EmailToken, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.EmailToken{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	t.CreatedAt = now
+	t.ExpiresAt = t.ExpiresAt.UTC()
+	t.UsedAt = nil
+
+	_, err = tx.Exec(
+		"UPDATE email_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		now.UnixNano(), t.UserID, t.Purpose, now.UnixNano(),
+	)
+	if err != nil {
+		return entities.EmailToken{}, err
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO email_tokens (user_id, email, purpose, hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		t.UserID, t.Email, t.Purpose, t.Hash, now.UnixNano(), t.ExpiresAt.UnixNano(),
+	)
+	if err != nil {
+		return entities.EmailToken{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return entities.EmailToken{}, err
+	}
+	t.ID = int(id)
+
+	return t, tx.Commit()
+}
+
+// useEmailToken marks the token used and returns it together with its user.
+func useEmailToken(tx *sql.Tx, purpose, hash string, now time.Time) (entities.EmailToken, entities.User, error) {
+	t, err := scanEmailToken(tx.QueryRow(
+		"SELECT "+emailTokenColumns+" FROM email_tokens WHERE hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		hash, purpose, now.UnixNano(),
+	))
+	if err != nil {
+		return entities.EmailToken{}, entities.User{}, err
+	}
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", t.UserID))
+	if err != nil {
+		return entities.EmailToken{}, entities.User{}, err
+	}
+	if !strings.EqualFold(user.Email, t.Email) {
+		return entities.EmailToken{}, entities.User{}, ErrDoesNotExist
+	}
+
+	if _, err := tx.Exec("UPDATE email_tokens SET used_at = ? WHERE id = ?", now.UnixNano(), t.ID); err != nil {
+		return entities.EmailToken{}, entities.User{}, err
+	}
+	t.UsedAt = &now
+
+	return t, user, nil
+}
+
+func (db *SQLiteDB) UseEmailToken(purpose, hash string) (entities.EmailToken, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.EmailToken{}, err
+	}
+	defer tx.Rollback()
+
+	t, _, err := useEmailToken(tx, purpose, hash, time.Now().UTC())
+	if err != nil {
+		return entities.EmailToken{}, err
+	}
+	return t, tx.Commit()
+}
+
+func (db *SQLiteDB) ResetPassword(hash, password string) (entities.User, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.User{}, err
+	}
+	defer tx.Rollback()
+
+	_, user, err := useEmailToken(tx, entities.EmailTokenReset, hash, time.Now().UTC())
+	if err != nil {
+		return entities.User{}, err
+	}
+
+	newUser := entities.User{Password: password}
+	encrypted, err := newUser.EncryptPassword()
+	if err != nil {
+		return entities.User{}, err
+	}
+	user.Password = encrypted.Password
+	user.TokenVersion++
+	user.Verified = true
+	_, err = tx.Exec(
+		"UPDATE users SET password = ?, token_version = ?, verified = 1 WHERE id = ?",
+		user.Password, user.TokenVersion, user.ID,
+	)
+	if err != nil {
+		return entities.User{}, err
+	}
+
+	return user, tx.Commit()
+}
+
+func (db *SQLiteDB) PruneEmailTokens(before time.Time) (int, error) {
+	res, err := db.sql.Exec("DELETE FROM email_tokens WHERE expires_at < ?", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	return int(pruned), err
+}
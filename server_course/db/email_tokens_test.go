@@ -0,0 +1,95 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_EmailTokens(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+			assert.NoError(t, err)
+
+			soon := time.Now().Add(time.Hour)
+			_, err = store.CreateEmailToken(entities.EmailToken{UserID: u.ID, Email: u.Email, Purpose: entities.EmailTokenVerify, Hash: "verify-1", ExpiresAt: soon})
+			assert.NoError(t, err)
+			reset, err := store.CreateEmailToken(entities.EmailToken{UserID: u.ID, Email: u.Email, Purpose: entities.EmailTokenReset, Hash: "reset-1", ExpiresAt: soon})
+			assert.NoError(t, err)
+			// a new token replaces the one mailed before
+			_, err = store.CreateEmailToken(entities.EmailToken{UserID: u.ID, Email: u.Email, Purpose: entities.EmailTokenVerify, Hash: "verify-2", ExpiresAt: soon})
+			assert.NoError(t, err)
+			_, err = store.CreateEmailToken(entities.EmailToken{UserID: u.ID, Email: u.Email, Purpose: entities.EmailTokenVerify, Hash: "expired", ExpiresAt: time.Now().Add(-time.Second)})
+			assert.NoError(t, err)
+
+			_, err = store.UseEmailToken(entities.EmailTokenVerify, "verify-1")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			_, err = store.UseEmailToken(entities.EmailTokenVerify, "expired")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			// the purpose has to match
+			_, err = store.UseEmailToken(entities.EmailTokenVerify, "reset-1")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			used, err := store.UseEmailToken(entities.EmailTokenReset, "reset-1")
+			assert.NoError(t, err)
+			assert.Equal(t, reset.ID, used.ID)
+			assert.Equal(t, u.ID, used.UserID)
+			assert.NotNil(t, used.UsedAt)
+			_, err = store.UseEmailToken(entities.EmailTokenReset, "reset-1")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			pruned, err := store.PruneEmailTokens(time.Now())
+			assert.NoError(t, err)
+			assert.Equal(t, 1, pruned)
+
+			// verifying is kept apart from changing the email
+			u, err = store.UpdateUserVerified(u.ID, true)
+			assert.NoError(t, err)
+			assert.True(t, u.Verified)
+			u, err = store.UpdateUser(entities.User{ID: u.ID, Email: "Walt@BreakingBad.com"})
+			assert.NoError(t, err)
+			assert.True(t, u.Verified)
+			u, err = store.UpdateUser(entities.User{ID: u.ID, Email: "heisenberg@breakingbad.com"})
+			assert.NoError(t, err)
+			assert.False(t, u.Verified)
+
+			// a token only works for the address it was mailed to
+			_, err = store.UseEmailToken(entities.EmailTokenVerify, "verify-2")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+		})
+	}
+}
+
+func TestStore_ResetPassword(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+			assert.NoError(t, err)
+			soon := time.Now().Add(time.Hour)
+			_, err = store.CreateEmailToken(entities.EmailToken{UserID: u.ID, Email: u.Email, Purpose: entities.EmailTokenVerify, Hash: "verify", ExpiresAt: soon})
+			assert.NoError(t, err)
+			_, err = store.CreateEmailToken(entities.EmailToken{UserID: u.ID, Email: u.Email, Purpose: entities.EmailTokenReset, Hash: "reset", ExpiresAt: soon})
+			assert.NoError(t, err)
+
+			_, err = store.ResetPassword("verify", "new")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			reset, err := store.ResetPassword("reset", "new")
+			assert.NoError(t, err)
+			assert.True(t, reset.Verified)
+			assert.Equal(t, u.TokenVersion+1, reset.TokenVersion)
+			got, err := store.GetUserByEmail(u.Email)
+			assert.NoError(t, err)
+			attempt := entities.User{Password: "new"}
+			ok, err := attempt.ValidPassword(got.Password)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			_, err = store.ResetPassword("reset", "again")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"fmt"
+	"server_course/entities"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	likesTable    = "likes"
+	rechirpsTable = "rechirps"
+)
+
+func (db *DB) Like(userID, chirpID int) (entities.Chirp, error) {
+	return db.engage(likesTable, userID, chirpID, true)
+}
+
+func (db *DB) Unlike(userID, chirpID int) (entities.Chirp, error) {
+	return db.engage(likesTable, userID, chirpID, false)
+}
+
+func (db *DB) Rechirp(userID, chirpID int) (entities.Chirp, error) {
+	return db.engage(rechirpsTable, userID, chirpID, true)
+}
+
+func (db *DB) Unrechirp(userID, chirpID int) (entities.Chirp, error) {
+	return db.engage(rechirpsTable, userID, chirpID, false)
+}
+
+// engage adds or removes the engagement of userID in table and recounts it on
+// the chirp in the same batch.
+func (db *DB) engage(table string, userID, chirpID int, add bool) (entities.Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	c, exists := db.store.Chirps[chirpID]
+	if !exists || !c.Visible() {
+		return entities.Chirp{}, ErrDoesNotExist
+	}
+
+	engagements := db.store.Likes
+	if table == rechirpsTable {
+		engagements = db.store.Rechirps
+	}
+
+	list := engagements[chirpID]
+	i := slices.IndexFunc(list, func(e entities.Engagement) bool { return e.UserID == userID })
+	if add == (i != -1) {
+		return c, nil
+	}
+
+	if add {
+		list = append(slices.Clone(list), entities.Engagement{UserID: userID, CreatedAt: time.Now().UTC()})
+	} else {
+		list = slices.Delete(slices.Clone(list), i, i+1)
+	}
+
+	if table == rechirpsTable {
+		c.RechirpCount = len(list)
+	} else {
+		c.LikeCount = len(list)
+	}
+
+	b := &batch{}
+	if err := b.put(table, chirpID, list, func() { engagements[chirpID] = list }); err != nil {
+		return entities.Chirp{}, err
+	}
+	if err := b.put("chirps", chirpID, c, func() { db.store.Chirps[chirpID] = c }); err != nil {
+		return entities.Chirp{}, err
+	}
+
+	return c, db.commitBatch(b)
+}
+
+func (db *DB) GetLikedChirps(userID int) ([]entities.Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	type liked struct {
+		chirp entities.Chirp
+		at    time.Time
+	}
+	likes := []liked{}
+	for chirpID, list := range db.store.Likes {
+		c, exists := db.store.Chirps[chirpID]
+		if !exists || !c.Visible() {
+			continue
+		}
+		for _, e := range list {
+			if e.UserID == userID {
+				likes = append(likes, liked{chirp: c, at: e.CreatedAt})
+			}
+		}
+	}
+
+	sort.Slice(likes, func(i, j int) bool { return likes[i].at.After(likes[j].at) })
+
+	chirps := make([]entities.Chirp, len(likes))
+	for i, l := range likes {
+		chirps[i] = l.chirp
+	}
+	return chirps, nil
+}
+
+func (db *SQLiteDB) Like(userID, chirpID int) (entities.Chirp, error) {
+	return db.engage(likesTable, "like_count", userID, chirpID, true)
+}
+
+func (db *SQLiteDB) Unlike(userID, chirpID int) (entities.Chirp, error) {
+	return db.engage(likesTable, "like_count", userID, chirpID, false)
+}
+
+func (db *SQLiteDB) Rechirp(userID, chirpID int) (entities.Chirp, error) {
+	return db.engage(rechirpsTable, "rechirp_count", userID, chirpID, true)
+}
+
+func (db *SQLiteDB) Unrechirp(userID, chirpID int) (entities.Chirp, error) {
+	return db.engage(rechirpsTable, "rechirp_count", userID, chirpID, false)
+}
+
+// engage changes the engagement in table and bumps counter on the chirp, only
+// if the row actually changed so retried requests do not count twice.
+func (db *SQLiteDB) engage(table, counter string, userID, chirpID int, add bool) (entities.Chirp, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	const selectChirp = "SELECT " + chirpColumns + " FROM chirps WHERE id = ? AND " + visibleChirp
+	if _, err := scanChirp(tx.QueryRow(selectChirp, chirpID)); err != nil {
+		return entities.Chirp{}, err
+	}
+
+	stmt, delta := fmt.Sprintf("DELETE FROM %s WHERE chirp_id = ? AND user_id = ?", table), -1
+	args := []any{chirpID, userID}
+	if add {
+		stmt, delta = fmt.Sprintf("INSERT INTO %s (chirp_id, user_id, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", table), 1
+		args = append(args, time.Now().UnixNano())
+	}
+
+	res, err := tx.Exec(stmt, args...)
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	if changed > 0 {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE chirps SET %[1]s = %[1]s + ? WHERE id = ?", counter), delta, chirpID); err != nil {
+			return entities.Chirp{}, err
+		}
+	}
+
+	c, err := scanChirp(tx.QueryRow(selectChirp, chirpID))
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+
+	return c, tx.Commit()
+}
+
+func (db *SQLiteDB) GetLikedChirps(userID int) ([]entities.Chirp, error) {
+	rows, err := db.sql.Query(`
+		SELECT `+chirpColumns+` FROM chirps
+		JOIN (SELECT chirp_id, created_at AS liked_at FROM likes WHERE user_id = ?) ON chirp_id = chirps.id
+		WHERE `+visibleChirp+`
+		ORDER BY liked_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanChirps(rows)
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"server_course/entities"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Engagement(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			users := 10
+			for i := 0; i < users; i++ {
+				_, err := store.StoreUser(entities.User{Email: string(rune('a'+i)) + "@breakingbad.com", Password: "pw"})
+				assert.NoError(t, err)
+			}
+			chirp, err := store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "like me"})
+			assert.NoError(t, err)
+
+			// every user likes twice at the same time, the counter must end up at one each
+			wg := sync.WaitGroup{}
+			for i := 1; i <= users; i++ {
+				for range 2 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := store.Like(i, chirp.ID)
+						assert.NoError(t, err)
+					}()
+				}
+			}
+			wg.Wait()
+
+			chirp, err = store.GetChirp(chirp.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, users, chirp.LikeCount)
+
+			chirp, err = store.Unlike(1, chirp.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, users-1, chirp.LikeCount)
+			chirp, err = store.Unlike(1, chirp.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, users-1, chirp.LikeCount)
+
+			chirp, err = store.Rechirp(2, chirp.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, chirp.RechirpCount)
+
+			liked, err := store.GetLikedChirps(2)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{chirp.ID}, ids(liked))
+			liked, err = store.GetLikedChirps(1)
+			assert.NoError(t, err)
+			assert.Empty(t, liked)
+
+			assert.NoError(t, store.DeleteChirp(chirp.ID))
+			_, err = store.Like(3, chirp.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+		})
+	}
+}
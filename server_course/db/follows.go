@@ -0,0 +1,116 @@
+package db
+
+import (
+	"slices"
+	"time"
+)
+
+func (db *DB) Follow(followerID, followeeID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, exists := db.store.Users[followeeID]; !exists {
+		return ErrDoesNotExist
+	}
+
+	following := db.store.Follows[followerID]
+	if slices.Contains(following, followeeID) {
+		return nil
+	}
+
+	following = append(slices.Clone(following), followeeID)
+	if err := db.put("follows", followerID, following); err != nil {
+		return err
+	}
+	db.store.Follows[followerID] = following
+
+	return nil
+}
+
+func (db *DB) Unfollow(followerID, followeeID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	following := db.store.Follows[followerID]
+	i := slices.Index(following, followeeID)
+	if i == -1 {
+		return nil
+	}
+
+	following = slices.Delete(slices.Clone(following), i, i+1)
+	if err := db.put("follows", followerID, following); err != nil {
+		return err
+	}
+	db.store.Follows[followerID] = following
+
+	return nil
+}
+
+func (db *DB) GetFollowers(userID int) ([]int, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	followers := []int{}
+	for followerID, following := range db.store.Follows {
+		if slices.Contains(following, userID) {
+			followers = append(followers, followerID)
+		}
+	}
+	slices.Sort(followers)
+
+	return followers, nil
+}
+
+func (db *DB) GetFollowing(userID int) ([]int, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	following := append([]int{}, db.store.Follows[userID]...)
+	slices.Sort(following)
+
+	return following, nil
+}
+
+func (db *SQLiteDB) Follow(followerID, followeeID int) error {
+	if _, err := db.GetUser(followeeID); err != nil {
+		return err
+	}
+
+	_, err := db.sql.Exec(
+		"INSERT INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		followerID, followeeID, time.Now().UnixNano(),
+	)
+	return err
+}
+
+func (db *SQLiteDB) Unfollow(followerID, followeeID int) error {
+	_, err := db.sql.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", followerID, followeeID)
+	return err
+}
+
+func (db *SQLiteDB) GetFollowers(userID int) ([]int, error) {
+	return db.queryIDs("SELECT follower_id FROM follows WHERE followee_id = ? ORDER BY follower_id", userID)
+}
+
+func (db *SQLiteDB) GetFollowing(userID int) ([]int, error) {
+	return db.queryIDs("SELECT followee_id FROM follows WHERE follower_id = ? ORDER BY followee_id", userID)
+}
+
+func (db *SQLiteDB) queryIDs(query string, args ...any) ([]int, error) {
+	rows, err := db.sql.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Follow(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"walt@breakingbad.com", "jesse@breakingbad.com", "gale@breakingbad.com"} {
+				_, err := store.StoreUser(entities.User{Email: email, Password: "pw"})
+				assert.NoError(t, err)
+			}
+
+			assert.NoError(t, store.Follow(1, 2))
+			assert.NoError(t, store.Follow(1, 2), "following twice is a no-op")
+			assert.NoError(t, store.Follow(3, 2))
+			assert.NoError(t, store.Follow(1, 3))
+			assert.ErrorIs(t, store.Follow(1, 42), ErrDoesNotExist)
+
+			followers, err := store.GetFollowers(2)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{1, 3}, followers)
+
+			following, err := store.GetFollowing(1)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{2, 3}, following)
+
+			assert.NoError(t, store.Unfollow(1, 2))
+			assert.NoError(t, store.Unfollow(1, 2))
+			following, err = store.GetFollowing(1)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{3}, following)
+		})
+	}
+}
@@ -0,0 +1,495 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"server_course/entities"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (q WebhookSubscriptionQuery) matches(s entities.WebhookSubscription) bool {
+	if q.UserID != 0 && s.UserID != q.UserID {
+		return false
+	}
+	if q.Event != "" && !s.Wants(q.Event) {
+		return false
+	}
+	return true
+}
+
+func (q WebhookDeliveryQuery) matches(d entities.WebhookDelivery) bool {
+	if q.SubscriptionID != 0 && d.SubscriptionID != q.SubscriptionID {
+		return false
+	}
+	if q.Status != "" && d.Status != q.Status {
+		return false
+	}
+	if q.After != 0 && d.ID >= q.After {
+		return false
+	}
+	if q.Before != 0 && d.ID <= q.Before {
+		return false
+	}
+	return true
+}
+
+func (db *DB) CreateWebhookSubscription(s entities.WebhookSubscription) (entities.WebhookSubscription, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	s.ID = db.store.WebhookSubscriptionIndex
+	s.CreatedAt = time.Now().UTC()
+	s.UpdatedAt = s.CreatedAt
+	if err := db.put("webhook_subscriptions", s.ID, s); err != nil {
+		return entities.WebhookSubscription{}, err
+	}
+	db.store.WebhookSubscriptions[s.ID] = s
+	db.store.WebhookSubscriptionIndex++
+
+	return s, nil
+}
+
+func (db *DB) GetWebhookSubscription(id int) (entities.WebhookSubscription, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	s, exists := db.store.WebhookSubscriptions[id]
+	if !exists {
+		return entities.WebhookSubscription{}, ErrDoesNotExist
+	}
+	return s, nil
+}
+
+func (db *DB) ListWebhookSubscriptions(q WebhookSubscriptionQuery) ([]entities.WebhookSubscription, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	subscriptions := []entities.WebhookSubscription{}
+	for _, s := range db.store.WebhookSubscriptions {
+		if q.matches(s) {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].ID < subscriptions[j].ID })
+
+	return subscriptions, nil
+}
+
+func (db *DB) UpdateWebhookSubscription(s entities.WebhookSubscription) (entities.WebhookSubscription, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	stored, exists := db.store.WebhookSubscriptions[s.ID]
+	if !exists {
+		return entities.WebhookSubscription{}, ErrDoesNotExist
+	}
+
+	stored.URL = s.URL
+	stored.Events = s.Events
+	stored.Active = s.Active
+	stored.UpdatedAt = time.Now().UTC()
+	if err := db.put("webhook_subscriptions", stored.ID, stored); err != nil {
+		return entities.WebhookSubscription{}, err
+	}
+	db.store.WebhookSubscriptions[stored.ID] = stored
+
+	return stored, nil
+}
+
+func (db *DB) DeleteWebhookSubscription(id int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, exists := db.store.WebhookSubscriptions[id]; !exists {
+		return ErrDoesNotExist
+	}
+
+	b := &batch{}
+	for _, d := range db.store.WebhookDeliveries {
+		if d.SubscriptionID == id {
+			b.delete("webhook_deliveries", d.ID, func() { delete(db.store.WebhookDeliveries, d.ID) })
+		}
+	}
+	b.delete("webhook_subscriptions", id, func() { delete(db.store.WebhookSubscriptions, id) })
+
+	return db.commitBatch(b)
+}
+
+func (db *DB) EnqueueWebhookDelivery(d entities.WebhookDelivery) (entities.WebhookDelivery, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, exists := db.store.WebhookSubscriptions[d.SubscriptionID]; !exists {
+		return entities.WebhookDelivery{}, ErrDoesNotExist
+	}
+
+	d.ID = db.store.WebhookDeliveryIndex
+	d.Status = entities.DeliveryPending
+	d.Attempts = 0
+	d.CreatedAt = time.Now().UTC()
+	d.NextAttemptAt = d.CreatedAt
+	d.LastAttemptAt = nil
+	d.DeliveredAt = nil
+	if err := db.put("webhook_deliveries", d.ID, d); err != nil {
+		return entities.WebhookDelivery{}, err
+	}
+	db.store.WebhookDeliveries[d.ID] = d
+	db.store.WebhookDeliveryIndex++
+
+	return d, nil
+}
+
+func (db *DB) DueWebhookDeliveries(now time.Time, limit int) ([]entities.WebhookDelivery, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	due := []entities.WebhookDelivery{}
+	for _, d := range db.store.WebhookDeliveries {
+		if d.Status == entities.DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+
+	return due, nil
+}
+
+func (db *DB) GetWebhookDelivery(id int) (entities.WebhookDelivery, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	d, exists := db.store.WebhookDeliveries[id]
+	if !exists {
+		return entities.WebhookDelivery{}, ErrDoesNotExist
+	}
+	return d, nil
+}
+
+func (db *DB) UpdateWebhookDelivery(d entities.WebhookDelivery) (entities.WebhookDelivery, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	stored, exists := db.store.WebhookDeliveries[d.ID]
+	if !exists {
+		return entities.WebhookDelivery{}, ErrDoesNotExist
+	}
+
+	stored.Status = d.Status
+	stored.Attempts = d.Attempts
+	stored.NextAttemptAt = d.NextAttemptAt
+	stored.LastAttemptAt = d.LastAttemptAt
+	stored.ResponseCode = d.ResponseCode
+	stored.Error = d.Error
+	stored.DeliveredAt = d.DeliveredAt
+	if err := db.put("webhook_deliveries", stored.ID, stored); err != nil {
+		return entities.WebhookDelivery{}, err
+	}
+	db.store.WebhookDeliveries[stored.ID] = stored
+
+	return stored, nil
+}
+
+func (db *DB) ListWebhookDeliveries(q WebhookDeliveryQuery) (WebhookDeliveryPage, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	deliveries := []entities.WebhookDelivery{}
+	for _, d := range db.store.WebhookDeliveries {
+		if q.matches(d) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if q.Before != 0 {
+			return deliveries[i].ID < deliveries[j].ID
+		}
+		return deliveries[i].ID > deliveries[j].ID
+	})
+
+	page := WebhookDeliveryPage{Deliveries: deliveries}
+	if q.Limit > 0 && len(deliveries) > q.Limit {
+		page.Deliveries = deliveries[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Deliveries)
+	}
+
+	return page, nil
+}
+
+func (db *DB) PruneWebhookDeliveries(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	for _, d := range db.store.WebhookDeliveries {
+		if d.Status == entities.DeliveryDelivered && d.DeliveredAt != nil && d.DeliveredAt.Before(before) {
+			b.delete("webhook_deliveries", d.ID, func() { delete(db.store.WebhookDeliveries, d.ID) })
+		}
+	}
+	if len(b.entries) == 0 {
+		return 0, nil
+	}
+
+	return len(b.entries), db.commitBatch(b)
+}
+
+const webhookSubscriptionColumns = "id, user_id, url, events, secret, active, created_at, updated_at"
+
+func scanWebhookSubscription(row scanner) (entities.WebhookSubscription, error) {
+	var s entities.WebhookSubscription
+	var events string
+	var createdAt, updatedAt int64
+	err := row.Scan(&s.ID, &s.UserID, &s.URL, &events, &s.Secret, &s.Active, &createdAt, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.WebhookSubscription{}, ErrDoesNotExist
+	}
+	if err != nil {
+		return s, err
+	}
+	s.CreatedAt = time.Unix(0, createdAt).UTC()
+	s.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	return s, json.Unmarshal([]byte(events), &s.Events)
+}
+
+func (db *SQLiteDB) CreateWebhookSubscription(s entities.WebhookSubscription) (entities.WebhookSubscription, error) {
+	events, err := json.Marshal(s.Events)
+	if err != nil {
+		return entities.WebhookSubscription{}, err
+	}
+
+	now := time.Now().UnixNano()
+	return scanWebhookSubscription(db.sql.QueryRow(
+		"INSERT INTO webhook_subscriptions (user_id, url, events, secret, active, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING "+webhookSubscriptionColumns,
+		s.UserID, s.URL, string(events), s.Secret, s.Active, now, now,
+	))
+}
+
+func (db *SQLiteDB) GetWebhookSubscription(id int) (entities.WebhookSubscription, error) {
+	return scanWebhookSubscription(db.sql.QueryRow("SELECT "+webhookSubscriptionColumns+" FROM webhook_subscriptions WHERE id = ?", id))
+}
+
+func (db *SQLiteDB) ListWebhookSubscriptions(q WebhookSubscriptionQuery) ([]entities.WebhookSubscription, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+
+	if q.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, q.UserID)
+	}
+	if q.Event != "" {
+		where = append(where, "active = 1 AND EXISTS (SELECT 1 FROM json_each(events) WHERE value = ?)")
+		args = append(args, q.Event)
+	}
+
+	rows, err := db.sql.Query("SELECT "+webhookSubscriptionColumns+" FROM webhook_subscriptions WHERE "+strings.Join(where, " AND ")+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []entities.WebhookSubscription{}
+	for rows.Next() {
+		s, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+func (db *SQLiteDB) UpdateWebhookSubscription(s entities.WebhookSubscription) (entities.WebhookSubscription, error) {
+	events, err := json.Marshal(s.Events)
+	if err != nil {
+		return entities.WebhookSubscription{}, err
+	}
+
+	return scanWebhookSubscription(db.sql.QueryRow(
+		"UPDATE webhook_subscriptions SET url = ?, events = ?, active = ?, updated_at = ? WHERE id = ? RETURNING "+webhookSubscriptionColumns,
+		s.URL, string(events), s.Active, time.Now().UnixNano(), s.ID,
+	))
+}
+
+func (db *SQLiteDB) DeleteWebhookSubscription(id int) error {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE subscription_id = ?", id); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM webhook_subscriptions WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrDoesNotExist
+	}
+
+	return tx.Commit()
+}
+
+const webhookDeliveryColumns = "id, subscription_id, event_id, event, payload, status, attempts, next_attempt_at, last_attempt_at, response_code, error, created_at, delivered_at"
+
+func scanWebhookDelivery(row scanner) (entities.WebhookDelivery, error) {
+	var d entities.WebhookDelivery
+	var payload string
+	var nextAttemptAt, createdAt int64
+	var lastAttemptAt, deliveredAt sql.NullInt64
+	err := row.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.Event, &payload, &d.Status, &d.Attempts, &nextAttemptAt, &lastAttemptAt, &d.ResponseCode, &d.Error, &createdAt, &deliveredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.WebhookDelivery{}, ErrDoesNotExist
+	}
+	d.Payload = []byte(payload)
+	d.NextAttemptAt = time.Unix(0, nextAttemptAt).UTC()
+	d.LastAttemptAt = timeOrNil(lastAttemptAt)
+	d.CreatedAt = time.Unix(0, createdAt).UTC()
+	d.DeliveredAt = timeOrNil(deliveredAt)
+	return d, err
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]entities.WebhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := []entities.WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (db *SQLiteDB) EnqueueWebhookDelivery(d entities.WebhookDelivery) (entities.WebhookDelivery, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.WebhookDelivery{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := scanWebhookSubscription(tx.QueryRow("SELECT "+webhookSubscriptionColumns+" FROM webhook_subscriptions WHERE id = ?", d.SubscriptionID)); err != nil {
+		return entities.WebhookDelivery{}, err
+	}
+
+	now := time.Now().UnixNano()
+	d, err = scanWebhookDelivery(tx.QueryRow(
+		"INSERT INTO webhook_deliveries (subscription_id, event_id, event, payload, status, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING "+webhookDeliveryColumns,
+		d.SubscriptionID, d.EventID, d.Event, string(d.Payload), entities.DeliveryPending, now, now,
+	))
+	if err != nil {
+		return entities.WebhookDelivery{}, err
+	}
+
+	return d, tx.Commit()
+}
+
+func (db *SQLiteDB) DueWebhookDeliveries(now time.Time, limit int) ([]entities.WebhookDelivery, error) {
+	if limit <= 0 {
+		// no limit for sqlite
+		limit = -1
+	}
+
+	rows, err := db.sql.Query(
+		"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?",
+		entities.DeliveryPending, now.UnixNano(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (db *SQLiteDB) GetWebhookDelivery(id int) (entities.WebhookDelivery, error) {
+	return scanWebhookDelivery(db.sql.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ?", id))
+}
+
+func (db *SQLiteDB) UpdateWebhookDelivery(d entities.WebhookDelivery) (entities.WebhookDelivery, error) {
+	return scanWebhookDelivery(db.sql.QueryRow(
+		`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_attempt_at = ?, response_code = ?, error = ?, delivered_at = ?
+		WHERE id = ? RETURNING `+webhookDeliveryColumns,
+		d.Status, d.Attempts, d.NextAttemptAt.UnixNano(), nullTime(d.LastAttemptAt), d.ResponseCode, d.Error, nullTime(d.DeliveredAt), d.ID,
+	))
+}
+
+func (db *SQLiteDB) ListWebhookDeliveries(q WebhookDeliveryQuery) (WebhookDeliveryPage, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+
+	if q.SubscriptionID != 0 {
+		where = append(where, "subscription_id = ?")
+		args = append(args, q.SubscriptionID)
+	}
+	if q.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, q.Status)
+	}
+
+	order := "DESC"
+	switch {
+	case q.After != 0:
+		where = append(where, "id < ?")
+		args = append(args, q.After)
+	case q.Before != 0:
+		where = append(where, "id > ?")
+		args = append(args, q.Before)
+		order = "ASC"
+	}
+
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE " + strings.Join(where, " AND ") + " ORDER BY id " + order
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := db.sql.Query(query, args...)
+	if err != nil {
+		return WebhookDeliveryPage{}, err
+	}
+	deliveries, err := scanWebhookDeliveries(rows)
+	if err != nil {
+		return WebhookDeliveryPage{}, err
+	}
+
+	page := WebhookDeliveryPage{Deliveries: deliveries}
+	if q.Limit > 0 && len(deliveries) > q.Limit {
+		page.Deliveries = deliveries[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Deliveries)
+	}
+
+	return page, nil
+}
+
+func (db *SQLiteDB) PruneWebhookDeliveries(before time.Time) (int, error) {
+	res, err := db.sql.Exec("DELETE FROM webhook_deliveries WHERE status = ? AND delivered_at < ?", entities.DeliveryDelivered, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	return int(pruned), err
+}
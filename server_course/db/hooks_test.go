@@ -0,0 +1,172 @@
+package db
+
+import (
+	"encoding/json"
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_WebhookSubscriptions(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.StoreUser(entities.User{Email: "hooks@x.com", Password: "pw"})
+			assert.NoError(t, err)
+
+			s, err := store.CreateWebhookSubscription(entities.WebhookSubscription{
+				UserID: user.ID,
+				URL:    "https://example.com/hook",
+				Events: []string{entities.HookChirpCreated, entities.HookChirpDeleted},
+				Secret: "secret",
+				Active: true,
+			})
+			assert.NoError(t, err)
+			assert.NotZero(t, s.ID)
+			assert.False(t, s.CreatedAt.IsZero())
+
+			other, err := store.CreateWebhookSubscription(entities.WebhookSubscription{
+				UserID: user.ID,
+				URL:    "https://example.com/other",
+				Events: []string{entities.HookChirpCreated},
+				Secret: "other",
+			})
+			assert.NoError(t, err)
+
+			got, err := store.GetWebhookSubscription(s.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, "secret", got.Secret)
+			assert.Equal(t, s.Events, got.Events)
+
+			// the inactive one does not want anything
+			subscriptions, err := store.ListWebhookSubscriptions(WebhookSubscriptionQuery{Event: entities.HookChirpCreated})
+			assert.NoError(t, err)
+			assert.Len(t, subscriptions, 1)
+			assert.Equal(t, s.ID, subscriptions[0].ID)
+			subscriptions, err = store.ListWebhookSubscriptions(WebhookSubscriptionQuery{UserID: user.ID})
+			assert.NoError(t, err)
+			assert.Len(t, subscriptions, 2)
+
+			other.Active = true
+			other.Events = []string{entities.HookChirpUpdated}
+			other, err = store.UpdateWebhookSubscription(other)
+			assert.NoError(t, err)
+			assert.True(t, other.Active)
+			assert.Equal(t, "other", other.Secret)
+			subscriptions, err = store.ListWebhookSubscriptions(WebhookSubscriptionQuery{Event: entities.HookChirpUpdated})
+			assert.NoError(t, err)
+			assert.Len(t, subscriptions, 1)
+
+			_, err = store.UpdateWebhookSubscription(entities.WebhookSubscription{ID: other.ID + 100})
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			_, err = store.EnqueueWebhookDelivery(entities.WebhookDelivery{SubscriptionID: other.ID, EventID: "evt_1", Event: entities.HookChirpUpdated, Payload: json.RawMessage(`{}`)})
+			assert.NoError(t, err)
+			assert.NoError(t, store.DeleteWebhookSubscription(other.ID))
+			assert.ErrorIs(t, store.DeleteWebhookSubscription(other.ID), ErrDoesNotExist)
+			page, err := store.ListWebhookDeliveries(WebhookDeliveryQuery{})
+			assert.NoError(t, err)
+			assert.Empty(t, page.Deliveries, "deliveries go with their subscription")
+		})
+	}
+}
+
+func TestStore_WebhookDeliveries(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.StoreUser(entities.User{Email: "hooks@x.com", Password: "pw"})
+			assert.NoError(t, err)
+			s, err := store.CreateWebhookSubscription(entities.WebhookSubscription{UserID: user.ID, URL: "https://example.com", Events: []string{entities.HookChirpCreated}, Secret: "s", Active: true})
+			assert.NoError(t, err)
+
+			_, err = store.EnqueueWebhookDelivery(entities.WebhookDelivery{SubscriptionID: s.ID + 100})
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			payload := json.RawMessage(`{"id":"evt_1"}`)
+			first, err := store.EnqueueWebhookDelivery(entities.WebhookDelivery{SubscriptionID: s.ID, EventID: "evt_1", Event: entities.HookChirpCreated, Payload: payload})
+			assert.NoError(t, err)
+			assert.Equal(t, entities.DeliveryPending, first.Status)
+			assert.Equal(t, 0, first.Attempts)
+			second, err := store.EnqueueWebhookDelivery(entities.WebhookDelivery{SubscriptionID: s.ID, EventID: "evt_2", Event: entities.HookChirpCreated, Payload: payload})
+			assert.NoError(t, err)
+
+			now := time.Now()
+			due, err := store.DueWebhookDeliveries(now, 0)
+			assert.NoError(t, err)
+			assert.Len(t, due, 2)
+			assert.Equal(t, first.ID, due[0].ID)
+			assert.JSONEq(t, string(payload), string(due[0].Payload))
+
+			first.Failed(503, "service unavailable", now)
+			first, err = store.UpdateWebhookDelivery(first)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, first.Attempts)
+			assert.Equal(t, 503, first.ResponseCode)
+			assert.NotNil(t, first.LastAttemptAt)
+			due, err = store.DueWebhookDeliveries(now, 0)
+			assert.NoError(t, err)
+			assert.Len(t, due, 1)
+			assert.Equal(t, second.ID, due[0].ID)
+			due, err = store.DueWebhookDeliveries(now.Add(entities.DeliveryBackoff(1)), 1)
+			assert.NoError(t, err)
+			assert.Len(t, due, 1)
+
+			second.Succeeded(200, now)
+			_, err = store.UpdateWebhookDelivery(second)
+			assert.NoError(t, err)
+			for first.Status != entities.DeliveryDead {
+				first.Failed(0, "connection refused", now)
+			}
+			_, err = store.UpdateWebhookDelivery(first)
+			assert.NoError(t, err)
+			_, err = store.UpdateWebhookDelivery(entities.WebhookDelivery{ID: second.ID + 100})
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			page, err := store.ListWebhookDeliveries(WebhookDeliveryQuery{SubscriptionID: s.ID})
+			assert.NoError(t, err)
+			assert.Len(t, page.Deliveries, 2)
+			assert.Equal(t, second.ID, page.Deliveries[0].ID)
+			page, err = store.ListWebhookDeliveries(WebhookDeliveryQuery{Status: entities.DeliveryDead})
+			assert.NoError(t, err)
+			assert.Len(t, page.Deliveries, 1)
+			assert.Equal(t, entities.MaxDeliveryAttempts, page.Deliveries[0].Attempts)
+			assert.Equal(t, "connection refused", page.Deliveries[0].Error)
+
+			// only what was delivered is pruned, dead letters stay
+			pruned, err := store.PruneWebhookDeliveries(now.Add(time.Second))
+			assert.NoError(t, err)
+			assert.Equal(t, 1, pruned)
+			got, err := store.GetWebhookDelivery(first.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, entities.DeliveryDead, got.Status)
+			_, err = store.GetWebhookDelivery(second.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+		})
+	}
+}
+
+func TestDB_webhookSecretReopen(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	assert.NoError(t, err)
+
+	s, err := db.CreateWebhookSubscription(entities.WebhookSubscription{UserID: 1, URL: "https://example.com/hook", Events: []string{entities.HookChirpCreated}, Secret: "secret"})
+	assert.NoError(t, err)
+
+	// deliveries are signed with the secret, it has to survive the log and
+	// the snapshot
+	recovered, err := NewDB(dir)
+	assert.NoError(t, err)
+	got, err := recovered.GetWebhookSubscription(s.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", got.Secret)
+	assert.NoError(t, recovered.Close())
+
+	reopened, err := NewDB(dir)
+	assert.NoError(t, err)
+	got, err = reopened.GetWebhookSubscription(s.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", got.Secret)
+	assert.NoError(t, reopened.Close())
+}
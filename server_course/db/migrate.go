@@ -0,0 +1,833 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"server_course/entities"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrSchemaTooNew = errors.New("schema is newer than this binary knows")
+)
+
+// Migration upgrades a persisted schema by exactly one version.
+type Migration struct {
+	Version     int
+	Description string
+}
+
+type jsonMigration struct {
+	Migration
+	up func(doc map[string]any) error
+}
+
+type sqliteMigration struct {
+	Migration
+	up func(tx *sql.Tx) error
+}
+
+// jsonMigrations must be ordered by version and never be edited once shipped,
+// add a new step instead.
+var jsonMigrations = []jsonMigration{
+	{
+		Migration: Migration{Version: 1, Description: "version the schema and derive missing id counters"},
+		up: func(doc map[string]any) error {
+			for _, table := range []struct{ key, index string }{{"chirps", "chirp_index"}, {"users", "user_index"}} {
+				if _, exists := doc[table.index]; exists {
+					continue
+				}
+				rows, _ := doc[table.key].(map[string]any)
+				next := 1
+				for key := range rows {
+					id, err := strconv.Atoi(key)
+					if err != nil {
+						return fmt.Errorf("%s: bad id %q: %w", table.key, key, err)
+					}
+					next = max(next, id+1)
+				}
+				doc[table.index] = next
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 2, Description: "add created_at to chirps"},
+		up: func(doc map[string]any) error {
+			// the real creation time is lost, the migration time keeps the id order intact
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			chirps, _ := doc["chirps"].(map[string]any)
+			for _, row := range chirps {
+				if chirp, ok := row.(map[string]any); ok {
+					if _, exists := chirp["created_at"]; !exists {
+						chirp["created_at"] = now
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 3, Description: "add updated_at to chirps"},
+		up: func(doc map[string]any) error {
+			chirps, _ := doc["chirps"].(map[string]any)
+			for _, row := range chirps {
+				if chirp, ok := row.(map[string]any); ok {
+					if _, exists := chirp["updated_at"]; !exists {
+						chirp["updated_at"] = chirp["created_at"]
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 4, Description: "parse hashtags and mentions of chirps"},
+		up: func(doc map[string]any) error {
+			handles := map[string]int{}
+			users, _ := doc["users"].(map[string]any)
+			for key, row := range users {
+				user, _ := row.(map[string]any)
+				email, _ := user["email"].(string)
+				id, err := strconv.Atoi(key)
+				if err != nil {
+					return fmt.Errorf("users: bad id %q: %w", key, err)
+				}
+				handle := entities.EmailHandle(email)
+				if existing, found := handles[handle]; !found || id < existing {
+					handles[handle] = id
+				}
+			}
+
+			chirps, _ := doc["chirps"].(map[string]any)
+			for _, row := range chirps {
+				chirp, ok := row.(map[string]any)
+				if !ok {
+					continue
+				}
+				body, _ := chirp["body"].(string)
+				c := entities.Chirp{Body: body}
+				if err := tagChirp(&c, func(handle string) (int, error) { return handles[handle], nil }); err != nil {
+					return err
+				}
+				if len(c.Hashtags) > 0 {
+					chirp["hashtags"] = c.Hashtags
+				}
+				if len(c.Mentions) > 0 {
+					chirp["mentions"] = c.Mentions
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 5, Description: "replace the admin flag of users with roles"},
+		up: func(doc map[string]any) error {
+			users, _ := doc["users"].(map[string]any)
+			for _, row := range users {
+				user, ok := row.(map[string]any)
+				if !ok {
+					continue
+				}
+				if isAdmin, _ := user["is_admin"].(bool); isAdmin {
+					user["roles"] = []any{entities.RoleAdmin}
+				}
+				delete(user, "is_admin")
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 6, Description: "drop the plaintext tokens of users, sessions replace them"},
+		up: func(doc map[string]any) error {
+			users, _ := doc["users"].(map[string]any)
+			for _, row := range users {
+				user, ok := row.(map[string]any)
+				if !ok {
+					continue
+				}
+				for _, key := range []string{"token", "expires_in_seconds", "refresh_token", "refresh_expires_in_seconds"} {
+					delete(user, key)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 7, Description: "treat users that signed up before verification as verified"},
+		up: func(doc map[string]any) error {
+			users, _ := doc["users"].(map[string]any)
+			for _, row := range users {
+				if user, ok := row.(map[string]any); ok {
+					user["verified"] = true
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 8, Description: "give red users a subscription without a period end"},
+		up: func(doc map[string]any) error {
+			now := time.Now().UTC()
+			users, _ := doc["users"].(map[string]any)
+			subscriptions := map[string]any{}
+			for id, row := range users {
+				user, ok := row.(map[string]any)
+				if !ok {
+					continue
+				}
+				if red, _ := user["is_chirpy_red"].(bool); !red {
+					continue
+				}
+				userID, err := strconv.Atoi(id)
+				if err != nil {
+					return fmt.Errorf("users: bad id %q: %w", id, err)
+				}
+				subscriptions[id] = entities.Subscription{
+					UserID:    userID,
+					Plan:      entities.PlanRed,
+					Status:    entities.SubscriptionActive,
+					StartedAt: now,
+					UpdatedAt: now,
+				}
+			}
+			doc["subscriptions"] = subscriptions
+			return nil
+		},
+	},
+}
+
+// sqliteMigrations must be ordered by version and never be edited once shipped,
+// add a new step instead. The applied version is tracked in PRAGMA user_version.
+var sqliteMigrations = []sqliteMigration{
+	{
+		Migration: Migration{Version: 1, Description: "create users and chirps"},
+		up: execSQL(`
+			CREATE TABLE IF NOT EXISTS users (
+				id                         INTEGER PRIMARY KEY AUTOINCREMENT,
+				email                      TEXT    NOT NULL,
+				password                   TEXT    NOT NULL,
+				is_chirpy_red              INTEGER NOT NULL DEFAULT 0,
+				token                      TEXT    NOT NULL DEFAULT '',
+				expires_in_seconds         INTEGER NOT NULL DEFAULT 0,
+				refresh_token              TEXT    NOT NULL DEFAULT '',
+				refresh_expires_in_seconds INTEGER NOT NULL DEFAULT 0
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users (email COLLATE NOCASE);
+			CREATE INDEX IF NOT EXISTS users_refresh_token ON users (refresh_token);
+
+			CREATE TABLE IF NOT EXISTS chirps (
+				id        INTEGER PRIMARY KEY AUTOINCREMENT,
+				author_id INTEGER NOT NULL,
+				body      TEXT    NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS chirps_author_id ON chirps (author_id);
+		`),
+	},
+	{
+		Migration: Migration{Version: 2, Description: "add created_at to chirps"},
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				ALTER TABLE chirps ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+				CREATE INDEX chirps_author_id_id ON chirps (author_id, id);
+				DROP INDEX chirps_author_id;
+			`)
+			if err != nil {
+				return err
+			}
+			// the real creation time is lost, the migration time keeps the id order intact
+			_, err = tx.Exec("UPDATE chirps SET created_at = ?", time.Now().UnixNano())
+			return err
+		},
+	},
+	{
+		Migration: Migration{Version: 3, Description: "add updated_at and revisions to chirps"},
+		up: execSQL(`
+			ALTER TABLE chirps ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+			UPDATE chirps SET updated_at = created_at;
+
+			CREATE TABLE chirp_revisions (
+				chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+				revision   INTEGER NOT NULL,
+				body       TEXT    NOT NULL,
+				created_at INTEGER NOT NULL,
+				PRIMARY KEY (chirp_id, revision)
+			);
+		`),
+	},
+	{
+		Migration: Migration{Version: 4, Description: "create follows"},
+		up: execSQL(`
+			CREATE TABLE follows (
+				follower_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				followee_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				created_at  INTEGER NOT NULL,
+				PRIMARY KEY (follower_id, followee_id)
+			);
+			CREATE INDEX follows_followee_id ON follows (followee_id);
+		`),
+	},
+	{
+		Migration: Migration{Version: 5, Description: "add replies and tombstones to chirps"},
+		up: execSQL(`
+			ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER REFERENCES chirps (id);
+			ALTER TABLE chirps ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE chirps ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0;
+			CREATE INDEX chirps_in_reply_to ON chirps (in_reply_to);
+		`),
+	},
+	{
+		Migration: Migration{Version: 6, Description: "create likes and rechirps"},
+		up: execSQL(`
+			ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE chirps ADD COLUMN rechirp_count INTEGER NOT NULL DEFAULT 0;
+
+			CREATE TABLE likes (
+				chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+				user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				created_at INTEGER NOT NULL,
+				PRIMARY KEY (chirp_id, user_id)
+			);
+			CREATE INDEX likes_user_id ON likes (user_id, created_at);
+
+			CREATE TABLE rechirps (
+				chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+				user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				created_at INTEGER NOT NULL,
+				PRIMARY KEY (chirp_id, user_id)
+			);
+			CREATE INDEX rechirps_user_id ON rechirps (user_id, created_at);
+		`),
+	},
+	{
+		Migration: Migration{Version: 7, Description: "parse hashtags and mentions of chirps"},
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				ALTER TABLE chirps ADD COLUMN hashtags TEXT;
+				ALTER TABLE chirps ADD COLUMN mentions TEXT;
+
+				CREATE TABLE chirp_hashtags (
+					chirp_id   INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+					tag        TEXT    NOT NULL,
+					created_at INTEGER NOT NULL,
+					PRIMARY KEY (chirp_id, tag)
+				);
+				CREATE INDEX chirp_hashtags_tag ON chirp_hashtags (tag, chirp_id);
+				CREATE INDEX chirp_hashtags_created_at ON chirp_hashtags (created_at);
+
+				CREATE TABLE chirp_mentions (
+					chirp_id INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+					user_id  INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+					PRIMARY KEY (chirp_id, user_id)
+				);
+				CREATE INDEX chirp_mentions_user_id ON chirp_mentions (user_id, chirp_id);
+			`)
+			if err != nil {
+				return err
+			}
+
+			// chirpColumns moves on with later versions, read only what is there now
+			rows, err := tx.Query("SELECT id, body, created_at FROM chirps WHERE deleted = 0")
+			if err != nil {
+				return err
+			}
+			chirps := []entities.Chirp{}
+			for rows.Next() {
+				var c entities.Chirp
+				var createdAt int64
+				if err := rows.Scan(&c.ID, &c.Body, &createdAt); err != nil {
+					rows.Close()
+					return err
+				}
+				c.CreatedAt = time.Unix(0, createdAt).UTC()
+				chirps = append(chirps, c)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			for _, c := range chirps {
+				if err := tagChirpTx(tx, &c); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 8, Description: "create notifications"},
+		up: execSQL(`
+			CREATE TABLE notifications (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				kind       TEXT    NOT NULL,
+				actor_id   INTEGER NOT NULL,
+				chirp_id   INTEGER NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL,
+				read       INTEGER NOT NULL DEFAULT 0
+			);
+			CREATE INDEX notifications_user_id ON notifications (user_id, id);
+			CREATE INDEX notifications_unread ON notifications (user_id, kind, actor_id, chirp_id) WHERE read = 0;
+		`),
+	},
+	{
+		Migration: Migration{Version: 9, Description: "add admins, suspensions, hidden chirps, reports and the moderation log"},
+		up: execSQL(`
+			ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE users ADD COLUMN suspended INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE chirps ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
+			CREATE TABLE reports (
+				id          INTEGER PRIMARY KEY AUTOINCREMENT,
+				reporter_id INTEGER NOT NULL DEFAULT 0,
+				target_type TEXT    NOT NULL,
+				target_id   INTEGER NOT NULL,
+				reason      TEXT    NOT NULL DEFAULT '',
+				status      TEXT    NOT NULL,
+				created_at  INTEGER NOT NULL,
+				resolution  TEXT    NOT NULL DEFAULT '',
+				resolved_by INTEGER NOT NULL DEFAULT 0,
+				resolved_at INTEGER
+			);
+			CREATE INDEX reports_status ON reports (status, id);
+			CREATE INDEX reports_target ON reports (target_type, target_id) WHERE status = 'open';
+			CREATE TABLE moderation_actions (
+				id          INTEGER PRIMARY KEY AUTOINCREMENT,
+				admin_id    INTEGER NOT NULL,
+				action      TEXT    NOT NULL,
+				target_type TEXT    NOT NULL,
+				target_id   INTEGER NOT NULL,
+				report_id   INTEGER NOT NULL DEFAULT 0,
+				note        TEXT    NOT NULL DEFAULT '',
+				created_at  INTEGER NOT NULL
+			);
+		`),
+	},
+	{
+		Migration: Migration{Version: 10, Description: "replace the admin flag of users with roles"},
+		up: execSQL(`
+			ALTER TABLE users ADD COLUMN roles TEXT;
+			UPDATE users SET roles = '["admin"]' WHERE is_admin = 1;
+			ALTER TABLE users DROP COLUMN is_admin;
+		`),
+	},
+	{
+		Migration: Migration{Version: 11, Description: "replace the plaintext tokens of users with sessions"},
+		up: execSQL(`
+			DROP INDEX users_refresh_token;
+			ALTER TABLE users DROP COLUMN token;
+			ALTER TABLE users DROP COLUMN expires_in_seconds;
+			ALTER TABLE users DROP COLUMN refresh_token;
+			ALTER TABLE users DROP COLUMN refresh_expires_in_seconds;
+
+			CREATE TABLE sessions (
+				id           INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id      INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				device       TEXT    NOT NULL DEFAULT '',
+				ip           TEXT    NOT NULL DEFAULT '',
+				created_at   INTEGER NOT NULL,
+				last_used_at INTEGER NOT NULL,
+				expires_at   INTEGER NOT NULL,
+				revoked_at   INTEGER
+			);
+			CREATE INDEX sessions_user_id ON sessions (user_id);
+
+			CREATE TABLE session_tokens (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				session_id INTEGER NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+				hash       TEXT    NOT NULL,
+				created_at INTEGER NOT NULL,
+				used_at    INTEGER
+			);
+			CREATE UNIQUE INDEX session_tokens_hash ON session_tokens (hash);
+			CREATE INDEX session_tokens_session_id ON session_tokens (session_id);
+		`),
+	},
+	{
+		Migration: Migration{Version: 12, Description: "add token versions of users and revoked access tokens"},
+		up: execSQL(`
+			ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE session_tokens ADD COLUMN access_token_id TEXT NOT NULL DEFAULT '';
+			ALTER TABLE session_tokens ADD COLUMN access_expires_at INTEGER NOT NULL DEFAULT 0;
+
+			CREATE TABLE revoked_tokens (
+				jti        TEXT    PRIMARY KEY,
+				expires_at INTEGER NOT NULL
+			);
+			CREATE INDEX revoked_tokens_expires_at ON revoked_tokens (expires_at);
+		`),
+	},
+	{
+		Migration: Migration{Version: 13, Description: "verify emails and reset passwords with mailed tokens"},
+		up: execSQL(`
+			ALTER TABLE users ADD COLUMN verified INTEGER NOT NULL DEFAULT 0;
+			-- users that signed up before verification existed keep posting
+			UPDATE users SET verified = 1;
+
+			CREATE TABLE email_tokens (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				purpose    TEXT    NOT NULL,
+				hash       TEXT    NOT NULL,
+				created_at INTEGER NOT NULL,
+				expires_at INTEGER NOT NULL,
+				used_at    INTEGER
+			);
+			CREATE UNIQUE INDEX email_tokens_hash ON email_tokens (hash);
+			CREATE INDEX email_tokens_user_id ON email_tokens (user_id, purpose);
+		`),
+	},
+	{
+		Migration: Migration{Version: 14, Description: "create totp, recovery codes and login challenges"},
+		up: execSQL(`
+			CREATE TABLE totp (
+				user_id    INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+				secret     TEXT    NOT NULL,
+				confirmed  INTEGER NOT NULL DEFAULT 0,
+				last_step  INTEGER NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL
+			);
+
+			CREATE TABLE recovery_codes (
+				id      INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				hash    TEXT    NOT NULL,
+				used_at INTEGER
+			);
+			CREATE INDEX recovery_codes_user_id ON recovery_codes (user_id, hash);
+
+			CREATE TABLE login_challenges (
+				id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id            INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				hash               TEXT    NOT NULL,
+				created_at         INTEGER NOT NULL,
+				expires_at         INTEGER NOT NULL,
+				attempts           INTEGER NOT NULL DEFAULT 0,
+				used_at            INTEGER,
+				expires_in_seconds INTEGER NOT NULL DEFAULT 0
+			);
+			CREATE UNIQUE INDEX login_challenges_hash ON login_challenges (hash);
+		`),
+	},
+	{
+		Migration: Migration{Version: 15, Description: "create login throttles and security events"},
+		up: execSQL(`
+			CREATE TABLE login_throttles (
+				id             INTEGER PRIMARY KEY AUTOINCREMENT,
+				key            TEXT    NOT NULL UNIQUE,
+				failures       INTEGER NOT NULL,
+				last_failed_at INTEGER NOT NULL
+			);
+
+			CREATE TABLE security_events (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id    INTEGER NOT NULL DEFAULT 0,
+				type       TEXT    NOT NULL,
+				ip         TEXT    NOT NULL DEFAULT '',
+				detail     TEXT    NOT NULL DEFAULT '',
+				created_at INTEGER NOT NULL
+			);
+			CREATE INDEX security_events_user_id ON security_events (user_id);
+		`),
+	},
+	{
+		Migration: Migration{Version: 16, Description: "create webhook events"},
+		up: execSQL(`
+			CREATE TABLE webhook_events (
+				id           INTEGER PRIMARY KEY AUTOINCREMENT,
+				event_id     TEXT    NOT NULL UNIQUE,
+				event        TEXT    NOT NULL,
+				payload      TEXT    NOT NULL,
+				status       TEXT    NOT NULL,
+				error        TEXT    NOT NULL DEFAULT '',
+				attempts     INTEGER NOT NULL DEFAULT 1,
+				received_at  INTEGER NOT NULL,
+				processed_at INTEGER
+			);
+			CREATE INDEX webhook_events_status ON webhook_events (status);
+		`),
+	},
+	{
+		Migration: Migration{Version: 17, Description: "create subscriptions, red users get one without a period end"},
+		up: execSQL(`
+			CREATE TABLE subscriptions (
+				user_id     INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+				plan        TEXT    NOT NULL,
+				status      TEXT    NOT NULL,
+				started_at  INTEGER NOT NULL,
+				period_end  INTEGER NOT NULL DEFAULT 0,
+				grace_until INTEGER,
+				canceled_at INTEGER,
+				ended_at    INTEGER,
+				updated_at  INTEGER NOT NULL
+			);
+
+			INSERT INTO subscriptions (user_id, plan, status, started_at, updated_at)
+			SELECT id, 'red', 'active', CAST(strftime('%s', 'now') AS INTEGER) * 1000000000, CAST(strftime('%s', 'now') AS INTEGER) * 1000000000
+			FROM users WHERE is_chirpy_red = 1;
+		`),
+	},
+	{
+		Migration: Migration{Version: 18, Description: "create webhook subscriptions and deliveries"},
+		up: execSQL(`
+			CREATE TABLE webhook_subscriptions (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				url        TEXT    NOT NULL,
+				events     TEXT    NOT NULL,
+				secret     TEXT    NOT NULL,
+				active     INTEGER NOT NULL DEFAULT 1,
+				created_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL
+			);
+			CREATE INDEX webhook_subscriptions_user_id ON webhook_subscriptions (user_id);
+
+			CREATE TABLE webhook_deliveries (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+				event_id        TEXT    NOT NULL,
+				event           TEXT    NOT NULL,
+				payload         TEXT    NOT NULL,
+				status          TEXT    NOT NULL,
+				attempts        INTEGER NOT NULL DEFAULT 0,
+				next_attempt_at INTEGER NOT NULL,
+				last_attempt_at INTEGER,
+				response_code   INTEGER NOT NULL DEFAULT 0,
+				error           TEXT    NOT NULL DEFAULT '',
+				created_at      INTEGER NOT NULL,
+				delivered_at    INTEGER
+			);
+			CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
+			CREATE INDEX webhook_deliveries_subscription_id ON webhook_deliveries (subscription_id, id);
+		`),
+	},
+	{
+		// tokens mailed before stop working, they are bound to no address
+		Migration: Migration{Version: 19, Description: "bind email tokens to the address they were mailed to"},
+		up:        execSQL(`ALTER TABLE email_tokens ADD COLUMN email TEXT NOT NULL DEFAULT '';`),
+	},
+	{
+		Migration: Migration{Version: 20, Description: "index security events by time for pruning"},
+		up:        execSQL(`CREATE INDEX security_events_created_at ON security_events (created_at);`),
+	},
+	{
+		Migration: Migration{Version: 21, Description: "record when the current attempt of a webhook event started"},
+		up:        execSQL(`ALTER TABLE webhook_events ADD COLUMN claimed_at INTEGER NOT NULL DEFAULT 0;`),
+	},
+}
+
+func execSQL(stmt string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+func latestJSONVersion() int {
+	return jsonMigrations[len(jsonMigrations)-1].Version
+}
+
+func latestSQLiteVersion() int {
+	return sqliteMigrations[len(sqliteMigrations)-1].Version
+}
+
+func checkVersion(current, latest int) error {
+	if current > latest {
+		return fmt.Errorf("%w: found version %d, latest known is %d", ErrSchemaTooNew, current, latest)
+	}
+	return nil
+}
+
+func decodeJSONDoc(data []byte) (map[string]any, error) {
+	doc := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return doc, decoder.Decode(&doc)
+}
+
+// migrateJSON upgrades a decoded DBStructure to the latest schema version in
+// place. Files written before versioning existed are treated as version 0.
+func migrateJSON(doc map[string]any) ([]Migration, error) {
+	current := 0
+	if v, exists := doc["schema_version"]; exists {
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("schema_version is not a number: %v", v)
+		}
+		version, err := n.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("schema_version is not an int: %w", err)
+		}
+		current = int(version)
+	}
+
+	if err := checkVersion(current, latestJSONVersion()); err != nil {
+		return nil, err
+	}
+
+	applied := []Migration{}
+	for _, m := range jsonMigrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := m.up(doc); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		doc["schema_version"] = m.Version
+		applied = append(applied, m.Migration)
+	}
+
+	return applied, nil
+}
+
+type recoveredJSON struct {
+	snapshot []byte
+	store    DBStructure
+	applied  []Migration
+	replayed int
+}
+
+// recoverJSON loads the snapshot in path, replays the write-ahead log on top
+// of it and migrates the result. The log is replayed before migrating since
+// its entries are written in the same schema version as the snapshot.
+func recoverJSON(path string) (recoveredJSON, error) {
+	r := recoveredJSON{}
+
+	snapshot, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return r, err
+	}
+	r.snapshot = snapshot
+	if snapshot == nil {
+		// nothing to recover from, start with an empty store in the latest version
+		snapshot, err = json.Marshal(newDBStructure())
+		if err != nil {
+			return r, err
+		}
+	}
+
+	doc, err := decodeJSONDoc(snapshot)
+	if err != nil {
+		return r, err
+	}
+
+	entries, err := readWAL(path + ".wal")
+	if err != nil {
+		return r, err
+	}
+	if err := applyWAL(doc, entries); err != nil {
+		return r, err
+	}
+	r.replayed = len(entries)
+
+	r.applied, err = migrateJSON(doc)
+	if err != nil {
+		return r, err
+	}
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return r, err
+	}
+
+	r.store = newDBStructure()
+	if err := json.Unmarshal(migrated, &r.store); err != nil {
+		return r, fmt.Errorf("migrated schema does not decode: %w", err)
+	}
+
+	return r, nil
+}
+
+// MigrateJSON upgrades the database.json in directory p to the latest schema
+// version. The original file is kept next to it as a backup. With dryRun set
+// the migrations are run and checked in memory only.
+func MigrateJSON(p string, dryRun bool) ([]Migration, error) {
+	path := p + "/database.json"
+	r, err := recoverJSON(path)
+	if err != nil {
+		return r.applied, err
+	}
+
+	if dryRun || len(r.applied) == 0 {
+		return r.applied, nil
+	}
+
+	if r.snapshot != nil {
+		backupPath := fmt.Sprintf("%s.v%d.bak", path, r.applied[0].Version-1)
+		if err := writeFileAtomic(backupPath, r.snapshot); err != nil {
+			return r.applied, err
+		}
+	}
+
+	data, err := json.Marshal(r.store)
+	if err != nil {
+		return r.applied, err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return r.applied, err
+	}
+
+	// the log is folded into the snapshot now
+	if err := os.Truncate(path+".wal", 0); err != nil && !os.IsNotExist(err) {
+		return r.applied, err
+	}
+
+	return r.applied, nil
+}
+
+// migrateSQLite runs every pending sqlite migration in a single transaction,
+// with dryRun set the transaction is rolled back.
+func migrateSQLite(conn *sql.DB, dryRun bool) ([]Migration, error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var current int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		return nil, err
+	}
+
+	if err := checkVersion(current, latestSQLiteVersion()); err != nil {
+		return nil, err
+	}
+
+	applied := []Migration{}
+	for _, m := range sqliteMigrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := m.up(tx); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		// PRAGMA does not take bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.Version)); err != nil {
+			return applied, err
+		}
+		applied = append(applied, m.Migration)
+	}
+
+	if dryRun {
+		return applied, nil
+	}
+
+	return applied, tx.Commit()
+}
+
+// MigrateSQLite upgrades the database.sqlite in directory p to the latest
+// schema version. With dryRun set nothing is committed.
+func MigrateSQLite(p string, dryRun bool) ([]Migration, error) {
+	conn, err := openSQLite(p)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return migrateSQLite(conn, dryRun)
+}
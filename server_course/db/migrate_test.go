@@ -0,0 +1,93 @@
+package db
+
+import (
+	"os"
+	"server_course/entities"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const legacyDB = `{"chirps":{"1":{"id":1,"author_id":1,"body":"Gale!"},"7":{"id":7,"author_id":1,"body":"Cmon Pinkman #RV @walt"}},"users":{"1":{"id":1,"email":"walt@breakingbad.com","is_admin":true,"is_chirpy_red":true}}}`
+
+func TestMigrateJSON(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/database.json"
+	assert.NoError(t, os.WriteFile(path, []byte(legacyDB), 0644))
+
+	applied, err := MigrateJSON(dir, true)
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(jsonMigrations))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, legacyDB, string(data), "dry run must not touch the file")
+
+	db, err := NewDB(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, latestJSONVersion(), db.store.SchemaVersion)
+	assert.Equal(t, 8, db.store.ChirpIndex)
+	assert.Equal(t, []string{"rv"}, db.store.Chirps[7].Hashtags)
+	assert.Equal(t, []entities.Mention{{Handle: "walt", UserID: 1}}, db.store.Chirps[7].Mentions)
+	assert.Equal(t, []string{entities.RoleAdmin}, db.store.Users[1].Roles)
+	assert.True(t, db.store.Users[1].Verified)
+	assert.Equal(t, entities.PlanRed, db.store.Subscriptions[1].Plan)
+	assert.True(t, db.store.Subscriptions[1].PeriodEnd.IsZero())
+
+	applied, err = MigrateJSON(dir, false)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+}
+
+func TestMigrateJSON_tooNew(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dir+"/database.json", []byte(`{"schema_version":9999}`), 0644))
+
+	_, err := NewDB(dir)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+}
+
+func TestMigrateSQLite_adminFlag(t *testing.T) {
+	dir := t.TempDir()
+	conn, err := openSQLite(dir)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	all := sqliteMigrations
+	sqliteMigrations = all[:9]
+	_, err = migrateSQLite(conn, false)
+	sqliteMigrations = all
+	assert.NoError(t, err)
+	_, err = conn.Exec(`INSERT INTO users (email, password, is_admin) VALUES ('walt@breakingbad.com', 'pw', 1)`)
+	assert.NoError(t, err)
+
+	_, err = migrateSQLite(conn, false)
+	assert.NoError(t, err)
+	var roles string
+	assert.NoError(t, conn.QueryRow("SELECT roles FROM users WHERE id = 1").Scan(&roles))
+	assert.Equal(t, `["admin"]`, roles)
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	dir := t.TempDir()
+
+	applied, err := MigrateSQLite(dir, true)
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(sqliteMigrations))
+
+	applied, err = MigrateSQLite(dir, false)
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(sqliteMigrations))
+
+	applied, err = MigrateSQLite(dir, false)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+
+	conn, err := openSQLite(dir)
+	assert.NoError(t, err)
+	_, err = conn.Exec("PRAGMA user_version = 9999")
+	assert.NoError(t, err)
+	conn.Close()
+
+	_, err = NewSQLiteDB(dir)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+}
@@ -0,0 +1,532 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"server_course/entities"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (q ReportQuery) matches(r entities.Report) bool {
+	if q.Status != "" && r.Status != q.Status {
+		return false
+	}
+	if q.After != 0 && r.ID <= q.After {
+		return false
+	}
+	if q.Before != 0 && r.ID >= q.Before {
+		return false
+	}
+	return true
+}
+
+func (q ModerationActionQuery) matches(a entities.ModerationAction) bool {
+	if q.After != 0 && a.ID >= q.After {
+		return false
+	}
+	if q.Before != 0 && a.ID <= q.Before {
+		return false
+	}
+	return true
+}
+
+func (db *DB) SetChirpHidden(chirpID int, hidden bool) (entities.Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	c, exists := db.store.Chirps[chirpID]
+	if !exists || c.Deleted {
+		return entities.Chirp{}, ErrDoesNotExist
+	}
+	if c.Hidden == hidden {
+		return c, nil
+	}
+
+	c.Hidden = hidden
+	if err := db.put("chirps", c.ID, c); err != nil {
+		return entities.Chirp{}, err
+	}
+	db.store.Chirps[c.ID] = c
+
+	return c, nil
+}
+
+func (db *DB) StoreReport(r entities.Report) (entities.Report, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	for _, existing := range db.store.Reports {
+		if existing.Status == entities.ReportOpen && existing.ReporterID == r.ReporterID &&
+			existing.TargetType == r.TargetType && existing.TargetID == r.TargetID {
+			return existing, nil
+		}
+	}
+
+	r.ID = db.store.ReportIndex
+	r.Status = entities.ReportOpen
+	r.CreatedAt = time.Now().UTC()
+	r.Resolution = ""
+	r.ResolvedBy = 0
+	r.ResolvedAt = nil
+
+	b := &batch{}
+	err := b.put("reports", r.ID, r, func() {
+		db.store.Reports[r.ID] = r
+		db.store.ReportIndex++
+	})
+	if err != nil {
+		return entities.Report{}, err
+	}
+
+	return r, db.commitBatch(b)
+}
+
+func (db *DB) GetReport(reportID int) (entities.Report, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	r, exists := db.store.Reports[reportID]
+	if !exists {
+		return entities.Report{}, ErrDoesNotExist
+	}
+	return r, nil
+}
+
+func (db *DB) ListReports(q ReportQuery) (ReportPage, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	reports := []entities.Report{}
+	for _, r := range db.store.Reports {
+		if q.matches(r) {
+			reports = append(reports, r)
+		}
+	}
+	// oldest first, or newest first when paging back so the limit cuts the
+	// far end
+	sort.Slice(reports, func(i, j int) bool {
+		if q.Before != 0 {
+			return reports[i].ID > reports[j].ID
+		}
+		return reports[i].ID < reports[j].ID
+	})
+
+	page := ReportPage{Reports: reports}
+	if q.Limit > 0 && len(reports) > q.Limit {
+		page.Reports = reports[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Reports)
+	}
+
+	return page, nil
+}
+
+func (db *DB) ApplyModerationAction(a entities.ModerationAction) (entities.ModerationAction, int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	report, exists := db.store.Reports[a.ReportID]
+	if !exists {
+		return entities.ModerationAction{}, 0, ErrDoesNotExist
+	}
+	if report.Status != entities.ReportOpen {
+		return entities.ModerationAction{}, 0, ErrResolved
+	}
+
+	b := &batch{}
+	if err := db.moderate(b, a); err != nil {
+		return entities.ModerationAction{}, 0, err
+	}
+
+	now := time.Now().UTC()
+	resolved := 0
+	for _, r := range db.store.Reports {
+		if r.Status != entities.ReportOpen || !(r.TargetType == report.TargetType && r.TargetID == report.TargetID ||
+			r.TargetType == a.TargetType && r.TargetID == a.TargetID) {
+			continue
+		}
+		r.Status = entities.ReportResolved
+		r.Resolution = a.Action
+		r.ResolvedBy = a.AdminID
+		r.ResolvedAt = &now
+		if err := b.put("reports", r.ID, r, func() { db.store.Reports[r.ID] = r }); err != nil {
+			return entities.ModerationAction{}, 0, err
+		}
+		resolved++
+	}
+
+	a.ID = db.store.ModerationActionIndex
+	a.CreatedAt = now
+	err := b.put("moderation_actions", a.ID, a, func() {
+		db.store.ModerationActions[a.ID] = a
+		db.store.ModerationActionIndex++
+	})
+	if err != nil {
+		return entities.ModerationAction{}, 0, err
+	}
+
+	return a, resolved, db.commitBatch(b)
+}
+
+// moderate adds what a does to its target to b. Showing or deleting a chirp
+// that is gone already is a no-op.
+func (db *DB) moderate(b *batch, a entities.ModerationAction) error {
+	switch a.Action {
+	case entities.ModerationApprove, entities.ModerationHide:
+		if a.TargetType != entities.ReportTargetChirp {
+			return nil
+		}
+		hidden := a.Action == entities.ModerationHide
+		c, exists := db.store.Chirps[a.TargetID]
+		if !exists || c.Deleted {
+			if hidden {
+				return ErrDoesNotExist
+			}
+			return nil
+		}
+		if c.Hidden == hidden {
+			return nil
+		}
+		c.Hidden = hidden
+		return b.put("chirps", c.ID, c, func() { db.store.Chirps[c.ID] = c })
+	case entities.ModerationDelete:
+		c, exists := db.store.Chirps[a.TargetID]
+		if !exists || c.Deleted {
+			return nil
+		}
+		return db.deleteChirp(b, c)
+	case entities.ModerationSuspend:
+		user, exists := db.store.Users[a.TargetID]
+		if !exists {
+			return ErrDoesNotExist
+		}
+		user.Suspended = true
+		return b.put("users", user.ID, user, func() { db.store.Users[user.ID] = user })
+	}
+	return nil
+}
+
+func (db *DB) ListModerationActions(q ModerationActionQuery) (ModerationActionPage, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	actions := []entities.ModerationAction{}
+	for _, a := range db.store.ModerationActions {
+		if q.matches(a) {
+			actions = append(actions, a)
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		if q.Before != 0 {
+			return actions[i].ID < actions[j].ID
+		}
+		return actions[i].ID > actions[j].ID
+	})
+
+	page := ModerationActionPage{Actions: actions}
+	if q.Limit > 0 && len(actions) > q.Limit {
+		page.Actions = actions[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Actions)
+	}
+
+	return page, nil
+}
+
+func (db *SQLiteDB) SetChirpHidden(chirpID int, hidden bool) (entities.Chirp, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE chirps SET hidden = ? WHERE id = ? AND deleted = 0", hidden, chirpID); err != nil {
+		return entities.Chirp{}, err
+	}
+	c, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ? AND deleted = 0", chirpID))
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+
+	return c, tx.Commit()
+}
+
+const reportColumns = "id, reporter_id, target_type, target_id, reason, status, created_at, resolution, resolved_by, resolved_at"
+
+func scanReport(row scanner) (entities.Report, error) {
+	var r entities.Report
+	var createdAt int64
+	var resolvedAt sql.NullInt64
+	err := row.Scan(&r.ID, &r.ReporterID, &r.TargetType, &r.TargetID, &r.Reason, &r.Status,
+		&createdAt, &r.Resolution, &r.ResolvedBy, &resolvedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.Report{}, ErrDoesNotExist
+	}
+	r.CreatedAt = time.Unix(0, createdAt).UTC()
+	if resolvedAt.Valid {
+		t := time.Unix(0, resolvedAt.Int64).UTC()
+		r.ResolvedAt = &t
+	}
+	return r, err
+}
+
+func (db *SQLiteDB) StoreReport(r entities.Report) (entities.Report, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.Report{}, err
+	}
+	defer tx.Rollback()
+
+	existing, err := scanReport(tx.QueryRow(
+		"SELECT "+reportColumns+" FROM reports WHERE status = ? AND reporter_id = ? AND target_type = ? AND target_id = ?",
+		entities.ReportOpen, r.ReporterID, r.TargetType, r.TargetID,
+	))
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, ErrDoesNotExist) {
+		return entities.Report{}, err
+	}
+
+	r.Status = entities.ReportOpen
+	r.CreatedAt = time.Now().UTC()
+	r.Resolution = ""
+	r.ResolvedBy = 0
+	r.ResolvedAt = nil
+	res, err := tx.Exec(
+		"INSERT INTO reports (reporter_id, target_type, target_id, reason, status, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		r.ReporterID, r.TargetType, r.TargetID, r.Reason, r.Status, r.CreatedAt.UnixNano(),
+	)
+	if err != nil {
+		return entities.Report{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return entities.Report{}, err
+	}
+	r.ID = int(id)
+
+	return r, tx.Commit()
+}
+
+func (db *SQLiteDB) GetReport(reportID int) (entities.Report, error) {
+	return scanReport(db.sql.QueryRow("SELECT "+reportColumns+" FROM reports WHERE id = ?", reportID))
+}
+
+func (db *SQLiteDB) ListReports(q ReportQuery) (ReportPage, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+	if q.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, q.Status)
+	}
+
+	order := "ASC"
+	switch {
+	case q.After != 0:
+		where = append(where, "id > ?")
+		args = append(args, q.After)
+	case q.Before != 0:
+		where = append(where, "id < ?")
+		args = append(args, q.Before)
+		order = "DESC"
+	}
+
+	query := "SELECT " + reportColumns + " FROM reports WHERE " + strings.Join(where, " AND ") + " ORDER BY id " + order
+	if q.Limit > 0 {
+		// one extra row tells whether there is another page
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := db.sql.Query(query, args...)
+	if err != nil {
+		return ReportPage{}, err
+	}
+	defer rows.Close()
+
+	reports := []entities.Report{}
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return ReportPage{}, err
+		}
+		reports = append(reports, r)
+	}
+	if err := rows.Err(); err != nil {
+		return ReportPage{}, err
+	}
+
+	page := ReportPage{Reports: reports}
+	if q.Limit > 0 && len(reports) > q.Limit {
+		page.Reports = reports[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Reports)
+	}
+
+	return page, nil
+}
+
+const moderationActionColumns = "id, admin_id, action, target_type, target_id, report_id, note, created_at"
+
+func scanModerationAction(row scanner) (entities.ModerationAction, error) {
+	var a entities.ModerationAction
+	var createdAt int64
+	err := row.Scan(&a.ID, &a.AdminID, &a.Action, &a.TargetType, &a.TargetID, &a.ReportID, &a.Note, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.ModerationAction{}, ErrDoesNotExist
+	}
+	a.CreatedAt = time.Unix(0, createdAt).UTC()
+	return a, err
+}
+
+func (db *SQLiteDB) ApplyModerationAction(a entities.ModerationAction) (entities.ModerationAction, int, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.ModerationAction{}, 0, err
+	}
+	defer tx.Rollback()
+
+	report, err := scanReport(tx.QueryRow("SELECT "+reportColumns+" FROM reports WHERE id = ?", a.ReportID))
+	if err != nil {
+		return entities.ModerationAction{}, 0, err
+	}
+	if report.Status != entities.ReportOpen {
+		return entities.ModerationAction{}, 0, ErrResolved
+	}
+
+	if err := moderate(tx, a); err != nil {
+		return entities.ModerationAction{}, 0, err
+	}
+
+	a.CreatedAt = time.Now().UTC()
+	res, err := tx.Exec(
+		`UPDATE reports SET status = ?, resolution = ?, resolved_by = ?, resolved_at = ?
+			WHERE status = ? AND (target_type = ? AND target_id = ? OR target_type = ? AND target_id = ?)`,
+		entities.ReportResolved, a.Action, a.AdminID, a.CreatedAt.UnixNano(),
+		entities.ReportOpen, report.TargetType, report.TargetID, a.TargetType, a.TargetID,
+	)
+	if err != nil {
+		return entities.ModerationAction{}, 0, err
+	}
+	resolved, err := res.RowsAffected()
+	if err != nil {
+		return entities.ModerationAction{}, 0, err
+	}
+
+	res, err = tx.Exec(
+		`INSERT INTO moderation_actions (admin_id, action, target_type, target_id, report_id, note, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		a.AdminID, a.Action, a.TargetType, a.TargetID, a.ReportID, a.Note, a.CreatedAt.UnixNano(),
+	)
+	if err != nil {
+		return entities.ModerationAction{}, 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return entities.ModerationAction{}, 0, err
+	}
+	a.ID = int(id)
+
+	return a, int(resolved), tx.Commit()
+}
+
+// moderate does what a does to its target. Showing or deleting a chirp that
+// is gone already is a no-op.
+func moderate(tx *sql.Tx, a entities.ModerationAction) error {
+	switch a.Action {
+	case entities.ModerationApprove, entities.ModerationHide:
+		if a.TargetType != entities.ReportTargetChirp {
+			return nil
+		}
+		hidden := a.Action == entities.ModerationHide
+		res, err := tx.Exec("UPDATE chirps SET hidden = ? WHERE id = ? AND deleted = 0", hidden, a.TargetID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 || !hidden {
+			return err
+		}
+		return ErrDoesNotExist
+	case entities.ModerationDelete:
+		c, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ? AND deleted = 0", a.TargetID))
+		if errors.Is(err, ErrDoesNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return deleteChirp(tx, c)
+	case entities.ModerationSuspend:
+		res, err := tx.Exec("UPDATE users SET suspended = 1 WHERE id = ?", a.TargetID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		return ErrDoesNotExist
+	}
+	return nil
+}
+
+func (db *SQLiteDB) ListModerationActions(q ModerationActionQuery) (ModerationActionPage, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+
+	order := "DESC"
+	switch {
+	case q.After != 0:
+		where = append(where, "id < ?")
+		args = append(args, q.After)
+	case q.Before != 0:
+		where = append(where, "id > ?")
+		args = append(args, q.Before)
+		order = "ASC"
+	}
+
+	query := "SELECT " + moderationActionColumns + " FROM moderation_actions WHERE " + strings.Join(where, " AND ") + " ORDER BY id " + order
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := db.sql.Query(query, args...)
+	if err != nil {
+		return ModerationActionPage{}, err
+	}
+	defer rows.Close()
+
+	actions := []entities.ModerationAction{}
+	for rows.Next() {
+		a, err := scanModerationAction(rows)
+		if err != nil {
+			return ModerationActionPage{}, err
+		}
+		actions = append(actions, a)
+	}
+	if err := rows.Err(); err != nil {
+		return ModerationActionPage{}, err
+	}
+
+	page := ModerationActionPage{Actions: actions}
+	if q.Limit > 0 && len(actions) > q.Limit {
+		page.Actions = actions[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Actions)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_HiddenChirps(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "say my name #heisenberg"})
+			assert.NoError(t, err)
+			_, err = store.StoreChirp(entities.Chirp{AuthorID: 2, Body: "heisenberg", InReplyTo: 1})
+			assert.NoError(t, err)
+
+			hidden, err := store.SetChirpHidden(1, true)
+			assert.NoError(t, err)
+			assert.True(t, hidden.Hidden)
+
+			_, err = store.GetChirp(1)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			page, err := store.ListChirps(ChirpQuery{})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{2}, ids(page.Chirps))
+			_, err = store.Like(3, 1)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			_, err = store.StoreChirp(entities.Chirp{AuthorID: 2, Body: "again", InReplyTo: 1})
+			assert.ErrorIs(t, err, ErrInvalidReply)
+			trending, err := store.TrendingHashtags(time.Time{}, 10)
+			assert.NoError(t, err)
+			assert.Empty(t, trending)
+
+			// threads keep the hidden chirp in place without its content
+			thread, err := store.GetThread(2)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{1}, ids(thread.Ancestors))
+			assert.True(t, thread.Ancestors[0].Hidden)
+			assert.Empty(t, thread.Ancestors[0].Body)
+			assert.Empty(t, thread.Ancestors[0].Hashtags)
+			assert.Equal(t, 1, thread.Ancestors[0].AuthorID)
+
+			shown, err := store.SetChirpHidden(1, false)
+			assert.NoError(t, err)
+			assert.False(t, shown.Hidden)
+			c, err := store.GetChirp(1)
+			assert.NoError(t, err)
+			assert.Equal(t, "say my name #heisenberg", c.Body)
+
+			assert.NoError(t, store.DeleteChirp(2))
+			assert.NoError(t, store.DeleteChirp(1))
+			_, err = store.SetChirpHidden(1, true)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+		})
+	}
+}
+
+func TestStore_Reports(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			chirpReport, err := store.StoreReport(entities.Report{ReporterID: 2, TargetType: entities.ReportTargetChirp, TargetID: 1, Reason: "spam"})
+			assert.NoError(t, err)
+			assert.Equal(t, entities.ReportOpen, chirpReport.Status)
+			userReport, err := store.StoreReport(entities.Report{ReporterID: 2, TargetType: entities.ReportTargetUser, TargetID: 1})
+			assert.NoError(t, err)
+			flagged, err := store.StoreReport(entities.Report{TargetType: entities.ReportTargetChirp, TargetID: 1, Reason: "flagged by rules"})
+			assert.NoError(t, err)
+
+			// an open report from the same reporter about the same target is kept
+			again, err := store.StoreReport(entities.Report{ReporterID: 2, TargetType: entities.ReportTargetChirp, TargetID: 1, Reason: "more spam"})
+			assert.NoError(t, err)
+			assert.Equal(t, chirpReport, again)
+
+			got, err := store.GetReport(userReport.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, userReport, got)
+			_, err = store.GetReport(42)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			page, err := store.ListReports(ReportQuery{Status: entities.ReportOpen, Limit: 2})
+			assert.NoError(t, err)
+			assert.Equal(t, []entities.Report{chirpReport, userReport}, page.Reports)
+			assert.True(t, page.HasMore)
+
+			page, err = store.ListReports(ReportQuery{Before: flagged.ID, Limit: 1})
+			assert.NoError(t, err)
+			assert.Equal(t, []entities.Report{userReport}, page.Reports)
+			assert.True(t, page.HasMore)
+
+			// the chirp does not exist, there is nothing to show again
+			_, resolved, err := store.ApplyModerationAction(entities.ModerationAction{AdminID: 3, Action: entities.ModerationApprove, TargetType: entities.ReportTargetChirp, TargetID: 1, ReportID: chirpReport.ID})
+			assert.NoError(t, err)
+			assert.Equal(t, 2, resolved)
+			_, _, err = store.ApplyModerationAction(entities.ModerationAction{AdminID: 3, Action: entities.ModerationHide, TargetType: entities.ReportTargetChirp, TargetID: 1, ReportID: flagged.ID})
+			assert.ErrorIs(t, err, ErrResolved)
+			_, _, err = store.ApplyModerationAction(entities.ModerationAction{AdminID: 3, Action: entities.ModerationApprove, ReportID: 42})
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			page, err = store.ListReports(ReportQuery{Status: entities.ReportOpen})
+			assert.NoError(t, err)
+			assert.Equal(t, []entities.Report{userReport}, page.Reports)
+
+			page, err = store.ListReports(ReportQuery{Status: entities.ReportResolved})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{chirpReport.ID, flagged.ID}, []int{page.Reports[0].ID, page.Reports[1].ID})
+			assert.Equal(t, entities.ModerationApprove, page.Reports[0].Resolution)
+			assert.Equal(t, 3, page.Reports[0].ResolvedBy)
+			assert.NotNil(t, page.Reports[0].ResolvedAt)
+
+			// once resolved the same reporter can report the target again
+			reopened, err := store.StoreReport(entities.Report{ReporterID: 2, TargetType: entities.ReportTargetChirp, TargetID: 1})
+			assert.NoError(t, err)
+			assert.NotEqual(t, chirpReport.ID, reopened.ID)
+		})
+	}
+}
+
+func TestStore_ModerationActions(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			author, err := store.StoreUser(entities.User{Email: "jesse@breakingbad.com", Password: "pw"})
+			assert.NoError(t, err)
+			c, err := store.StoreChirp(entities.Chirp{AuthorID: author.ID, Body: "yo"})
+			assert.NoError(t, err)
+			chirpReport, err := store.StoreReport(entities.Report{ReporterID: 9, TargetType: entities.ReportTargetChirp, TargetID: c.ID})
+			assert.NoError(t, err)
+			userReport, err := store.StoreReport(entities.Report{ReporterID: 9, TargetType: entities.ReportTargetUser, TargetID: author.ID})
+			assert.NoError(t, err)
+
+			// nothing happens when hiding fails
+			_, _, err = store.ApplyModerationAction(entities.ModerationAction{AdminID: 1, Action: entities.ModerationHide, TargetType: entities.ReportTargetChirp, TargetID: 42, ReportID: chirpReport.ID})
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			got, err := store.GetReport(chirpReport.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, entities.ReportOpen, got.Status)
+
+			hide, resolved, err := store.ApplyModerationAction(entities.ModerationAction{AdminID: 1, Action: entities.ModerationHide, TargetType: entities.ReportTargetChirp, TargetID: c.ID, ReportID: chirpReport.ID})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, resolved)
+			_, err = store.GetChirp(c.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			// suspending the author settles the reports about the author
+			suspend, resolved, err := store.ApplyModerationAction(entities.ModerationAction{AdminID: 1, Action: entities.ModerationSuspend, TargetType: entities.ReportTargetUser, TargetID: author.ID, ReportID: userReport.ID, Note: "repeat offender"})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, resolved)
+			u, err := store.GetUser(author.ID)
+			assert.NoError(t, err)
+			assert.True(t, u.Suspended)
+
+			page, err := store.ListModerationActions(ModerationActionQuery{Limit: 1})
+			assert.NoError(t, err)
+			assert.Equal(t, []entities.ModerationAction{suspend}, page.Actions)
+			assert.True(t, page.HasMore)
+
+			page, err = store.ListModerationActions(ModerationActionQuery{After: suspend.ID})
+			assert.NoError(t, err)
+			assert.Equal(t, []entities.ModerationAction{hide}, page.Actions)
+			assert.False(t, page.HasMore)
+		})
+	}
+}
+
+func TestStore_RolesAndSuspended(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// neither can be set when signing up
+			u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw", Roles: []string{entities.RoleAdmin}, Suspended: true})
+			assert.NoError(t, err)
+			assert.Empty(t, u.Roles)
+			assert.False(t, u.Suspended)
+
+			_, err = store.UpdateUserRoles(u.ID, []string{entities.RoleModerator})
+			assert.NoError(t, err)
+			_, err = store.UpdateUserSuspended(u.ID, true)
+			assert.NoError(t, err)
+
+			got, err := store.GetUser(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{entities.RoleModerator}, got.Roles)
+			assert.True(t, got.Suspended)
+
+			_, err = store.UpdateUserRoles(u.ID, nil)
+			assert.NoError(t, err)
+			got, err = store.GetUser(u.ID)
+			assert.NoError(t, err)
+			assert.Empty(t, got.Roles)
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"server_course/entities"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+func sameNotification(a, b entities.Notification) bool {
+	return a.UserID == b.UserID && a.Kind == b.Kind && a.ActorID == b.ActorID && a.ChirpID == b.ChirpID
+}
+
+func (q NotificationQuery) matches(n entities.Notification) bool {
+	if n.UserID != q.UserID || (q.UnreadOnly && n.Read) {
+		return false
+	}
+	if q.After != 0 && n.ID >= q.After {
+		return false
+	}
+	if q.Before != 0 && n.ID <= q.Before {
+		return false
+	}
+	return true
+}
+
+func (db *DB) StoreNotification(n entities.Notification) (entities.Notification, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	for _, existing := range db.store.Notifications {
+		if !existing.Read && sameNotification(existing, n) {
+			return existing, nil
+		}
+	}
+
+	n.ID = db.store.NotificationIndex
+	n.CreatedAt = time.Now().UTC()
+	n.Read = false
+
+	b := &batch{}
+	err := b.put("notifications", n.ID, n, func() {
+		db.store.Notifications[n.ID] = n
+		db.store.NotificationIndex++
+	})
+	if err != nil {
+		return entities.Notification{}, err
+	}
+
+	return n, db.commitBatch(b)
+}
+
+func (db *DB) ListNotifications(q NotificationQuery) (NotificationPage, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	notifications := []entities.Notification{}
+	for _, n := range db.store.Notifications {
+		if q.matches(n) {
+			notifications = append(notifications, n)
+		}
+	}
+	// newest first, or oldest first when paging back so the limit cuts the
+	// far end
+	sort.Slice(notifications, func(i, j int) bool {
+		if q.Before != 0 {
+			return notifications[i].ID < notifications[j].ID
+		}
+		return notifications[i].ID > notifications[j].ID
+	})
+
+	page := NotificationPage{Notifications: notifications}
+	if q.Limit > 0 && len(notifications) > q.Limit {
+		page.Notifications = notifications[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Notifications)
+	}
+
+	return page, nil
+}
+
+func (db *DB) CountUnreadNotifications(userID int) (int, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	unread := 0
+	for _, n := range db.store.Notifications {
+		if n.UserID == userID && !n.Read {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+func (db *DB) MarkNotificationsRead(userID int, ids []int) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	for _, n := range db.store.Notifications {
+		if n.UserID != userID || n.Read || (len(ids) > 0 && !slices.Contains(ids, n.ID)) {
+			continue
+		}
+		n.Read = true
+		if err := b.put("notifications", n.ID, n, func() { db.store.Notifications[n.ID] = n }); err != nil {
+			return 0, err
+		}
+	}
+	if len(b.entries) == 0 {
+		return 0, nil
+	}
+
+	return len(b.entries), db.commitBatch(b)
+}
+
+const notificationColumns = "id, user_id, kind, actor_id, chirp_id, created_at, read"
+
+func scanNotification(row scanner) (entities.Notification, error) {
+	var n entities.Notification
+	var createdAt int64
+	err := row.Scan(&n.ID, &n.UserID, &n.Kind, &n.ActorID, &n.ChirpID, &createdAt, &n.Read)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.Notification{}, ErrDoesNotExist
+	}
+	n.CreatedAt = time.Unix(0, createdAt).UTC()
+	return n, err
+}
+
+func (db *SQLiteDB) StoreNotification(n entities.Notification) (entities.Notification, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.Notification{}, err
+	}
+	defer tx.Rollback()
+
+	existing, err := scanNotification(tx.QueryRow(
+		"SELECT "+notificationColumns+" FROM notifications WHERE user_id = ? AND kind = ? AND actor_id = ? AND chirp_id = ? AND read = 0",
+		n.UserID, n.Kind, n.ActorID, n.ChirpID,
+	))
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, ErrDoesNotExist) {
+		return entities.Notification{}, err
+	}
+
+	n.CreatedAt = time.Now().UTC()
+	n.Read = false
+	res, err := tx.Exec(
+		"INSERT INTO notifications (user_id, kind, actor_id, chirp_id, created_at) VALUES (?, ?, ?, ?, ?)",
+		n.UserID, n.Kind, n.ActorID, n.ChirpID, n.CreatedAt.UnixNano(),
+	)
+	if err != nil {
+		return entities.Notification{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return entities.Notification{}, err
+	}
+	n.ID = int(id)
+
+	return n, tx.Commit()
+}
+
+func (db *SQLiteDB) ListNotifications(q NotificationQuery) (NotificationPage, error) {
+	where := []string{"user_id = ?"}
+	args := []any{q.UserID}
+	if q.UnreadOnly {
+		where = append(where, "read = 0")
+	}
+
+	order := "DESC"
+	switch {
+	case q.After != 0:
+		where = append(where, "id < ?")
+		args = append(args, q.After)
+	case q.Before != 0:
+		where = append(where, "id > ?")
+		args = append(args, q.Before)
+		order = "ASC"
+	}
+
+	query := "SELECT " + notificationColumns + " FROM notifications WHERE " + strings.Join(where, " AND ") + " ORDER BY id " + order
+	if q.Limit > 0 {
+		// one extra row tells whether there is another page
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := db.sql.Query(query, args...)
+	if err != nil {
+		return NotificationPage{}, err
+	}
+	defer rows.Close()
+
+	notifications := []entities.Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return NotificationPage{}, err
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		return NotificationPage{}, err
+	}
+
+	page := NotificationPage{Notifications: notifications}
+	if q.Limit > 0 && len(notifications) > q.Limit {
+		page.Notifications = notifications[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Notifications)
+	}
+
+	return page, nil
+}
+
+func (db *SQLiteDB) CountUnreadNotifications(userID int) (int, error) {
+	var unread int
+	err := db.sql.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read = 0", userID).Scan(&unread)
+	return unread, err
+}
+
+func (db *SQLiteDB) MarkNotificationsRead(userID int, ids []int) (int, error) {
+	query := "UPDATE notifications SET read = 1 WHERE user_id = ? AND read = 0"
+	args := []any{userID}
+	if len(ids) > 0 {
+		query += " AND id IN (" + placeholders(len(ids)) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+
+	res, err := db.sql.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	marked, err := res.RowsAffected()
+	return int(marked), err
+}
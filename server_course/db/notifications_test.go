@@ -0,0 +1,75 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Notifications(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"walt@breakingbad.com", "jesse@breakingbad.com"} {
+				_, err := store.StoreUser(entities.User{Email: email, Password: "pw"})
+				assert.NoError(t, err)
+			}
+
+			follow, err := store.StoreNotification(entities.Notification{UserID: 1, Kind: entities.NotificationFollow, ActorID: 2})
+			assert.NoError(t, err)
+			like, err := store.StoreNotification(entities.Notification{UserID: 1, Kind: entities.NotificationLike, ActorID: 2, ChirpID: 4})
+			assert.NoError(t, err)
+			_, err = store.StoreNotification(entities.Notification{UserID: 2, Kind: entities.NotificationLike, ActorID: 1, ChirpID: 4})
+			assert.NoError(t, err)
+
+			// unread duplicates collapse into the existing notification
+			again, err := store.StoreNotification(entities.Notification{UserID: 1, Kind: entities.NotificationLike, ActorID: 2, ChirpID: 4})
+			assert.NoError(t, err)
+			assert.Equal(t, like, again)
+
+			unread, err := store.CountUnreadNotifications(1)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, unread)
+
+			page, err := store.ListNotifications(NotificationQuery{UserID: 1, Limit: 1})
+			assert.NoError(t, err)
+			assert.Equal(t, []entities.Notification{like}, page.Notifications)
+			assert.True(t, page.HasMore)
+
+			page, err = store.ListNotifications(NotificationQuery{UserID: 1, After: like.ID})
+			assert.NoError(t, err)
+			assert.Equal(t, []entities.Notification{follow}, page.Notifications)
+			assert.False(t, page.HasMore)
+
+			page, err = store.ListNotifications(NotificationQuery{UserID: 1, Before: follow.ID})
+			assert.NoError(t, err)
+			assert.Equal(t, []entities.Notification{like}, page.Notifications)
+
+			marked, err := store.MarkNotificationsRead(1, []int{follow.ID})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, marked)
+
+			page, err = store.ListNotifications(NotificationQuery{UserID: 1, UnreadOnly: true})
+			assert.NoError(t, err)
+			assert.Equal(t, []entities.Notification{like}, page.Notifications)
+
+			marked, err = store.MarkNotificationsRead(1, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, marked)
+
+			unread, err = store.CountUnreadNotifications(1)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, unread)
+			unread, err = store.CountUnreadNotifications(2)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, unread, "other users are not touched")
+
+			// once read the same thing notifies again
+			_, err = store.StoreNotification(entities.Notification{UserID: 1, Kind: entities.NotificationLike, ActorID: 2, ChirpID: 4})
+			assert.NoError(t, err)
+			unread, err = store.CountUnreadNotifications(1)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, unread)
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"server_course/entities"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (q SecurityEventQuery) matches(e entities.SecurityEvent) bool {
+	if q.UserID != 0 && e.UserID != q.UserID {
+		return false
+	}
+	if q.After != 0 && e.ID >= q.After {
+		return false
+	}
+	if q.Before != 0 && e.ID <= q.Before {
+		return false
+	}
+	return true
+}
+
+// indexThrottles has to be called holding the write lock.
+func (db *DB) indexThrottles() {
+	db.throttlesByKey = make(map[string]int, len(db.store.LoginThrottles))
+	for _, t := range db.store.LoginThrottles {
+		db.throttlesByKey[t.Key] = t.ID
+	}
+}
+
+func (db *DB) deleteLoginThrottle(t entities.LoginThrottle) {
+	delete(db.store.LoginThrottles, t.ID)
+	delete(db.throttlesByKey, t.Key)
+}
+
+// loginThrottle has to be called holding the lock.
+func (db *DB) loginThrottle(key string) (entities.LoginThrottle, bool) {
+	id, exists := db.throttlesByKey[key]
+	if !exists {
+		return entities.LoginThrottle{}, false
+	}
+	return db.store.LoginThrottles[id], true
+}
+
+func (db *DB) RecordLoginFailure(key string) (entities.LoginThrottle, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	now := time.Now().UTC()
+	t, exists := db.loginThrottle(key)
+	if !exists {
+		t = entities.LoginThrottle{ID: db.store.LoginThrottleIndex, Key: key}
+	}
+	if now.Sub(t.LastFailedAt) > entities.ForgetLoginFailuresAfter {
+		t.Failures = 0
+	}
+	t.Failures++
+	t.LastFailedAt = now
+
+	if err := db.put("login_throttles", t.ID, t); err != nil {
+		return entities.LoginThrottle{}, err
+	}
+	db.store.LoginThrottles[t.ID] = t
+	db.throttlesByKey[t.Key] = t.ID
+	if !exists {
+		db.store.LoginThrottleIndex++
+	}
+
+	return t, nil
+}
+
+func (db *DB) GetLoginThrottle(key string) (entities.LoginThrottle, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	t, exists := db.loginThrottle(key)
+	if !exists {
+		return entities.LoginThrottle{}, ErrDoesNotExist
+	}
+	return t, nil
+}
+
+func (db *DB) ClearLoginThrottle(key string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	t, exists := db.loginThrottle(key)
+	if !exists {
+		return nil
+	}
+
+	b := &batch{}
+	b.delete("login_throttles", t.ID, func() { db.deleteLoginThrottle(t) })
+	return db.commitBatch(b)
+}
+
+func (db *DB) PruneLoginThrottles(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	for _, t := range db.store.LoginThrottles {
+		if t.LastFailedAt.Before(before) {
+			b.delete("login_throttles", t.ID, func() { db.deleteLoginThrottle(t) })
+		}
+	}
+	if len(b.entries) == 0 {
+		return 0, nil
+	}
+
+	return len(b.entries), db.commitBatch(b)
+}
+
+func (db *DB) StoreSecurityEvent(e entities.SecurityEvent) (entities.SecurityEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	e.ID = db.store.SecurityEventIndex
+	e.CreatedAt = time.Now().UTC()
+	if err := db.put("security_events", e.ID, e); err != nil {
+		return entities.SecurityEvent{}, err
+	}
+	db.store.SecurityEvents[e.ID] = e
+	db.store.SecurityEventIndex++
+
+	return e, nil
+}
+
+func (db *DB) PruneSecurityEvents(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	for _, e := range db.store.SecurityEvents {
+		if e.CreatedAt.Before(before) {
+			b.delete("security_events", e.ID, func() { delete(db.store.SecurityEvents, e.ID) })
+		}
+	}
+	if len(b.entries) == 0 {
+		return 0, nil
+	}
+
+	return len(b.entries), db.commitBatch(b)
+}
+
+func (db *DB) ListSecurityEvents(q SecurityEventQuery) (SecurityEventPage, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	events := []entities.SecurityEvent{}
+	for _, e := range db.store.SecurityEvents {
+		if q.matches(e) {
+			events = append(events, e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if q.Before != 0 {
+			return events[i].ID < events[j].ID
+		}
+		return events[i].ID > events[j].ID
+	})
+
+	page := SecurityEventPage{Events: events}
+	if q.Limit > 0 && len(events) > q.Limit {
+		page.Events = events[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Events)
+	}
+
+	return page, nil
+}
+
+const loginThrottleColumns = "id, key, failures, last_failed_at"
+
+func scanLoginThrottle(row scanner) (entities.LoginThrottle, error) {
+	var t entities.LoginThrottle
+	var lastFailedAt int64
+	err := row.Scan(&t.ID, &t.Key, &t.Failures, &lastFailedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.LoginThrottle{}, ErrDoesNotExist
+	}
+	t.LastFailedAt = time.Unix(0, lastFailedAt).UTC()
+	return t, err
+}
+
+func (db *SQLiteDB) RecordLoginFailure(key string) (entities.LoginThrottle, error) {
+	now := time.Now().UTC()
+	forgetBefore := now.Add(-entities.ForgetLoginFailuresAfter)
+
+	return scanLoginThrottle(db.sql.QueryRow(
+		`INSERT INTO login_throttles (key, failures, last_failed_at) VALUES (?, 1, ?)
+			ON CONFLICT (key) DO UPDATE SET
+				failures = CASE WHEN last_failed_at < ? THEN 1 ELSE failures + 1 END,
+				last_failed_at = excluded.last_failed_at
+			RETURNING `+loginThrottleColumns,
+		key, now.UnixNano(), forgetBefore.UnixNano(),
+	))
+}
+
+func (db *SQLiteDB) GetLoginThrottle(key string) (entities.LoginThrottle, error) {
+	return scanLoginThrottle(db.sql.QueryRow("SELECT "+loginThrottleColumns+" FROM login_throttles WHERE key = ?", key))
+}
+
+func (db *SQLiteDB) ClearLoginThrottle(key string) error {
+	_, err := db.sql.Exec("DELETE FROM login_throttles WHERE key = ?", key)
+	return err
+}
+
+func (db *SQLiteDB) PruneLoginThrottles(before time.Time) (int, error) {
+	res, err := db.sql.Exec("DELETE FROM login_throttles WHERE last_failed_at < ?", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	return int(pruned), err
+}
+
+const securityEventColumns = "id, user_id, type, ip, detail, created_at"
+
+func scanSecurityEvent(row scanner) (entities.SecurityEvent, error) {
+	var e entities.SecurityEvent
+	var createdAt int64
+	err := row.Scan(&e.ID, &e.UserID, &e.Type, &e.IP, &e.Detail, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.SecurityEvent{}, ErrDoesNotExist
+	}
+	e.CreatedAt = time.Unix(0, createdAt).UTC()
+	return e, err
+}
+
+func (db *SQLiteDB) StoreSecurityEvent(e entities.SecurityEvent) (entities.SecurityEvent, error) {
+	e.CreatedAt = time.Now().UTC()
+
+	res, err := db.sql.Exec(
+		"INSERT INTO security_events (user_id, type, ip, detail, created_at) VALUES (?, ?, ?, ?, ?)",
+		e.UserID, e.Type, e.IP, e.Detail, e.CreatedAt.UnixNano(),
+	)
+	if err != nil {
+		return entities.SecurityEvent{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return entities.SecurityEvent{}, err
+	}
+	e.ID = int(id)
+
+	return e, nil
+}
+
+func (db *SQLiteDB) PruneSecurityEvents(before time.Time) (int, error) {
+	res, err := db.sql.Exec("DELETE FROM security_events WHERE created_at < ?", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	return int(pruned), err
+}
+
+func (db *SQLiteDB) ListSecurityEvents(q SecurityEventQuery) (SecurityEventPage, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+
+	if q.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, q.UserID)
+	}
+
+	order := "DESC"
+	switch {
+	case q.After != 0:
+		where = append(where, "id < ?")
+		args = append(args, q.After)
+	case q.Before != 0:
+		where = append(where, "id > ?")
+		args = append(args, q.Before)
+		order = "ASC"
+	}
+
+	query := "SELECT " + securityEventColumns + " FROM security_events WHERE " + strings.Join(where, " AND ") + " ORDER BY id " + order
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := db.sql.Query(query, args...)
+	if err != nil {
+		return SecurityEventPage{}, err
+	}
+	defer rows.Close()
+
+	events := []entities.SecurityEvent{}
+	for rows.Next() {
+		e, err := scanSecurityEvent(rows)
+		if err != nil {
+			return SecurityEventPage{}, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return SecurityEventPage{}, err
+	}
+
+	page := SecurityEventPage{Events: events}
+	if q.Limit > 0 && len(events) > q.Limit {
+		page.Events = events[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Events)
+	}
+
+	return page, nil
+}
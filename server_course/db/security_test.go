@@ -0,0 +1,92 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_LoginThrottles(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.GetLoginThrottle("user:1")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			for i := 1; i <= 3; i++ {
+				throttle, err := store.RecordLoginFailure("user:1")
+				assert.NoError(t, err)
+				assert.Equal(t, i, throttle.Failures)
+				assert.WithinDuration(t, time.Now(), throttle.LastFailedAt, time.Second)
+			}
+			_, err = store.RecordLoginFailure("ip:1.2.3.4")
+			assert.NoError(t, err)
+
+			throttle, err := store.GetLoginThrottle("user:1")
+			assert.NoError(t, err)
+			assert.Equal(t, 3, throttle.Failures)
+
+			assert.NoError(t, store.ClearLoginThrottle("user:1"))
+			assert.NoError(t, store.ClearLoginThrottle("user:1"))
+			_, err = store.GetLoginThrottle("user:1")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			// counting starts over once cleared
+			throttle, err = store.RecordLoginFailure("user:1")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, throttle.Failures)
+
+			pruned, err := store.PruneLoginThrottles(time.Now().Add(time.Second))
+			assert.NoError(t, err)
+			assert.Equal(t, 2, pruned)
+			_, err = store.GetLoginThrottle("ip:1.2.3.4")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+		})
+	}
+}
+
+func TestStore_SecurityEvents(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, e := range []entities.SecurityEvent{
+				{Type: entities.SecurityLoginFailed, IP: "1.2.3.4", Detail: "unknown email"},
+				{UserID: 1, Type: entities.SecurityLoginFailed, IP: "1.2.3.4"},
+				{UserID: 2, Type: entities.SecurityLoginFailed, IP: "5.6.7.8"},
+				{UserID: 1, Type: entities.SecurityAccountLocked, IP: "1.2.3.4"},
+			} {
+				stored, err := store.StoreSecurityEvent(e)
+				assert.NoError(t, err)
+				assert.NotZero(t, stored.ID)
+				assert.False(t, stored.CreatedAt.IsZero())
+			}
+
+			page, err := store.ListSecurityEvents(SecurityEventQuery{})
+			assert.NoError(t, err)
+			assert.Len(t, page.Events, 4)
+			assert.Equal(t, entities.SecurityAccountLocked, page.Events[0].Type)
+			assert.Equal(t, "unknown email", page.Events[3].Detail)
+
+			page, err = store.ListSecurityEvents(SecurityEventQuery{UserID: 1, Limit: 1})
+			assert.NoError(t, err)
+			assert.Len(t, page.Events, 1)
+			assert.True(t, page.HasMore)
+			assert.Equal(t, entities.SecurityAccountLocked, page.Events[0].Type)
+
+			page, err = store.ListSecurityEvents(SecurityEventQuery{UserID: 1, After: page.Events[0].ID})
+			assert.NoError(t, err)
+			assert.Len(t, page.Events, 1)
+			assert.False(t, page.HasMore)
+			assert.Equal(t, "1.2.3.4", page.Events[0].IP)
+
+			pruned, err := store.PruneSecurityEvents(time.Now().Add(-time.Hour))
+			assert.NoError(t, err)
+			assert.Zero(t, pruned)
+			pruned, err = store.PruneSecurityEvents(time.Now().Add(time.Second))
+			assert.NoError(t, err)
+			assert.Equal(t, 4, pruned)
+			page, err = store.ListSecurityEvents(SecurityEventQuery{})
+			assert.NoError(t, err)
+			assert.Empty(t, page.Events)
+		})
+	}
+}
@@ -0,0 +1,558 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"server_course/entities"
+	"slices"
+	"sort"
+	"time"
+)
+
+// ended reports whether the session was over before then.
+func ended(s entities.Session, before time.Time) bool {
+	if s.RevokedAt != nil {
+		return s.RevokedAt.Before(before)
+	}
+	return s.ExpiresAt.Before(before)
+}
+
+func (db *DB) CreateSession(s entities.Session, token entities.SessionToken) (entities.Session, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	now := time.Now().UTC()
+	s.ID = db.store.SessionIndex
+	s.CreatedAt = now
+	s.LastUsedAt = now
+	s.RevokedAt = nil
+	token.ID = db.store.SessionTokenIndex
+	token.SessionID = s.ID
+	token.CreatedAt = now
+	token.UsedAt = nil
+
+	b := &batch{}
+	err := b.put("sessions", s.ID, s, func() {
+		db.store.Sessions[s.ID] = s
+		db.store.SessionIndex++
+	})
+	if err != nil {
+		return entities.Session{}, err
+	}
+	err = b.put("session_tokens", token.ID, token, func() {
+		db.setSessionToken(token)
+		db.store.SessionTokenIndex++
+	})
+	if err != nil {
+		return entities.Session{}, err
+	}
+
+	return s, db.commitBatch(b)
+}
+
+// indexTokens rebuilds the token indexes, the caller has to hold the write
+// lock.
+func (db *DB) indexTokens() {
+	db.tokensByHash = make(map[string]int, len(db.store.SessionTokens))
+	db.tokensBySession = make(map[int][]int)
+	for _, token := range db.store.SessionTokens {
+		db.tokensByHash[token.Hash] = token.ID
+		db.tokensBySession[token.SessionID] = append(db.tokensBySession[token.SessionID], token.ID)
+	}
+	db.revokedByJTI = make(map[string]int, len(db.store.RevokedTokens))
+	for _, revoked := range db.store.RevokedTokens {
+		db.revokedByJTI[revoked.TokenID] = revoked.ID
+	}
+}
+
+// setSessionToken stores token in memory, the caller has to hold the write
+// lock.
+func (db *DB) setSessionToken(token entities.SessionToken) {
+	if _, exists := db.store.SessionTokens[token.ID]; !exists {
+		db.tokensBySession[token.SessionID] = append(db.tokensBySession[token.SessionID], token.ID)
+	}
+	db.store.SessionTokens[token.ID] = token
+	db.tokensByHash[token.Hash] = token.ID
+}
+
+func (db *DB) deleteSessionToken(token entities.SessionToken) {
+	delete(db.store.SessionTokens, token.ID)
+	delete(db.tokensByHash, token.Hash)
+	ids := slices.DeleteFunc(db.tokensBySession[token.SessionID], func(id int) bool { return id == token.ID })
+	if len(ids) == 0 {
+		delete(db.tokensBySession, token.SessionID)
+	} else {
+		db.tokensBySession[token.SessionID] = ids
+	}
+}
+
+func (db *DB) setRevokedToken(revoked entities.RevokedToken) {
+	db.store.RevokedTokens[revoked.ID] = revoked
+	db.revokedByJTI[revoked.TokenID] = revoked.ID
+}
+
+func (db *DB) deleteRevokedToken(revoked entities.RevokedToken) {
+	delete(db.store.RevokedTokens, revoked.ID)
+	if db.revokedByJTI[revoked.TokenID] == revoked.ID {
+		delete(db.revokedByJTI, revoked.TokenID)
+	}
+}
+
+// sessionOfToken finds a token and its session as long as the session is
+// active, the caller has to hold the lock.
+func (db *DB) sessionOfToken(tokenHash string, now time.Time) (entities.SessionToken, entities.Session, error) {
+	token, exists := db.store.SessionTokens[db.tokensByHash[tokenHash]]
+	if !exists {
+		return entities.SessionToken{}, entities.Session{}, ErrDoesNotExist
+	}
+	s, exists := db.store.Sessions[token.SessionID]
+	if !exists || !s.Active(now) {
+		return entities.SessionToken{}, entities.Session{}, ErrDoesNotExist
+	}
+
+	return token, s, nil
+}
+
+// revokeSessions ends sessions and revokes the access tokens issued for them
+// that are still valid, the caller has to hold the write lock.
+func (db *DB) revokeSessions(b *batch, sessions []entities.Session, now time.Time) error {
+	revokedID := db.store.RevokedTokenIndex
+	for _, s := range sessions {
+		s.RevokedAt = &now
+		if err := b.put("sessions", s.ID, s, func() { db.store.Sessions[s.ID] = s }); err != nil {
+			return err
+		}
+
+		for _, id := range db.tokensBySession[s.ID] {
+			token := db.store.SessionTokens[id]
+			if token.AccessTokenID == "" || !token.AccessExpiresAt.After(now) {
+				continue
+			}
+			revoked := entities.RevokedToken{ID: revokedID, TokenID: token.AccessTokenID, ExpiresAt: token.AccessExpiresAt}
+			revokedID++
+			err := b.put("revoked_tokens", revoked.ID, revoked, func() {
+				db.setRevokedToken(revoked)
+				db.store.RevokedTokenIndex++
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) RotateSession(tokenHash string, next entities.SessionToken) (entities.Session, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	now := time.Now().UTC()
+	token, s, err := db.sessionOfToken(tokenHash, now)
+	if err != nil {
+		return entities.Session{}, err
+	}
+
+	b := &batch{}
+	if token.UsedAt != nil {
+		// someone holds a copy of an old token, nobody can tell who is who
+		if err := db.revokeSessions(b, []entities.Session{s}, now); err != nil {
+			return entities.Session{}, err
+		}
+		if err := db.commitBatch(b); err != nil {
+			return entities.Session{}, err
+		}
+		return entities.Session{}, ErrTokenReused
+	}
+
+	token.UsedAt = &now
+	s.LastUsedAt = now
+	next.ID = db.store.SessionTokenIndex
+	next.SessionID = s.ID
+	next.CreatedAt = now
+	next.UsedAt = nil
+
+	if err := b.put("session_tokens", token.ID, token, func() { db.setSessionToken(token) }); err != nil {
+		return entities.Session{}, err
+	}
+	err = b.put("session_tokens", next.ID, next, func() {
+		db.setSessionToken(next)
+		db.store.SessionTokenIndex++
+	})
+	if err != nil {
+		return entities.Session{}, err
+	}
+	if err := b.put("sessions", s.ID, s, func() { db.store.Sessions[s.ID] = s }); err != nil {
+		return entities.Session{}, err
+	}
+
+	return s, db.commitBatch(b)
+}
+
+func (db *DB) GetSessionByToken(tokenHash string) (entities.Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	token, s, err := db.sessionOfToken(tokenHash, time.Now().UTC())
+	if err != nil {
+		return entities.Session{}, err
+	}
+	if token.UsedAt != nil {
+		return entities.Session{}, ErrDoesNotExist
+	}
+	return s, nil
+}
+
+func (db *DB) ListSessions(userID int) ([]entities.Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	now := time.Now().UTC()
+	sessions := []entities.Session{}
+	for _, s := range db.store.Sessions {
+		if s.UserID == userID && s.Active(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+
+	return sessions, nil
+}
+
+func (db *DB) RevokeSession(userID, sessionID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	now := time.Now().UTC()
+	s, exists := db.store.Sessions[sessionID]
+	if !exists || s.UserID != userID || !s.Active(now) {
+		return ErrDoesNotExist
+	}
+
+	b := &batch{}
+	if err := db.revokeSessions(b, []entities.Session{s}, now); err != nil {
+		return err
+	}
+	return db.commitBatch(b)
+}
+
+func (db *DB) RevokeSessions(userID, except int) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	now := time.Now().UTC()
+	sessions := []entities.Session{}
+	for _, s := range db.store.Sessions {
+		if s.UserID == userID && s.ID != except && s.Active(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	if len(sessions) == 0 {
+		return 0, nil
+	}
+
+	b := &batch{}
+	if err := db.revokeSessions(b, sessions, now); err != nil {
+		return 0, err
+	}
+	return len(sessions), db.commitBatch(b)
+}
+
+func (db *DB) PruneSessions(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	pruned := 0
+	for _, s := range db.store.Sessions {
+		if !ended(s, before) {
+			continue
+		}
+		pruned++
+		b.delete("sessions", s.ID, func() { delete(db.store.Sessions, s.ID) })
+		for _, id := range db.tokensBySession[s.ID] {
+			token := db.store.SessionTokens[id]
+			b.delete("session_tokens", token.ID, func() { db.deleteSessionToken(token) })
+		}
+	}
+	if pruned == 0 {
+		return 0, nil
+	}
+
+	return pruned, db.commitBatch(b)
+}
+
+func (db *DB) RevokeToken(tokenID string, expiresAt time.Time) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	revoked := entities.RevokedToken{ID: db.store.RevokedTokenIndex, TokenID: tokenID, ExpiresAt: expiresAt.UTC()}
+	if err := db.put("revoked_tokens", revoked.ID, revoked); err != nil {
+		return err
+	}
+	db.setRevokedToken(revoked)
+	db.store.RevokedTokenIndex++
+
+	return nil
+}
+
+func (db *DB) TokenRevoked(tokenID string) (bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	_, revoked := db.revokedByJTI[tokenID]
+	return revoked, nil
+}
+
+func (db *DB) PruneRevokedTokens(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	for _, revoked := range db.store.RevokedTokens {
+		if revoked.ExpiresAt.Before(before) {
+			b.delete("revoked_tokens", revoked.ID, func() { db.deleteRevokedToken(revoked) })
+		}
+	}
+	if len(b.entries) == 0 {
+		return 0, nil
+	}
+
+	return len(b.entries), db.commitBatch(b)
+}
+
+const sessionColumns = "id, user_id, device, ip, created_at, last_used_at, expires_at, revoked_at"
+
+// scanSession scans sessionColumns followed by any extra columns into extra.
+func scanSession(row scanner, extra ...any) (entities.Session, error) {
+	var s entities.Session
+	var createdAt, lastUsedAt, expiresAt int64
+	var revokedAt sql.NullInt64
+	dest := append([]any{&s.ID, &s.UserID, &s.Device, &s.IP, &createdAt, &lastUsedAt, &expiresAt, &revokedAt}, extra...)
+	err := row.Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.Session{}, ErrDoesNotExist
+	}
+	s.CreatedAt = time.Unix(0, createdAt).UTC()
+	s.LastUsedAt = time.Unix(0, lastUsedAt).UTC()
+	s.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	if revokedAt.Valid {
+		t := time.Unix(0, revokedAt.Int64).UTC()
+		s.RevokedAt = &t
+	}
+	return s, err
+}
+
+// activeSession selects sessions that are neither revoked nor expired at the
+// time given as its argument.
+const activeSession = "revoked_at IS NULL AND expires_at > ?"
+
+// insertSessionToken adds token as the current refresh token of sessionID.
+func insertSessionToken(tx *sql.Tx, sessionID int, token entities.SessionToken, now time.Time) error {
+	_, err := tx.Exec(
+		"INSERT INTO session_tokens (session_id, hash, created_at, access_token_id, access_expires_at) VALUES (?, ?, ?, ?, ?)",
+		sessionID, token.Hash, now.UnixNano(), token.AccessTokenID, token.AccessExpiresAt.UnixNano(),
+	)
+	return err
+}
+
+// revokeSessions ends the active sessions matching where and revokes the
+// access tokens issued for them that are still valid.
+func revokeSessions(tx *sql.Tx, now time.Time, where string, args ...any) (int, error) {
+	sessions := "SELECT id FROM sessions WHERE " + where + " AND " + activeSession
+	_, err := tx.Exec(
+		`INSERT OR IGNORE INTO revoked_tokens (jti, expires_at)
+			SELECT access_token_id, access_expires_at FROM session_tokens
+			WHERE access_token_id != '' AND access_expires_at > ? AND session_id IN (`+sessions+`)`,
+		append(append([]any{now.UnixNano()}, args...), now.UnixNano())...,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(
+		"UPDATE sessions SET revoked_at = ? WHERE "+where+" AND "+activeSession,
+		append(append([]any{now.UnixNano()}, args...), now.UnixNano())...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := res.RowsAffected()
+	return int(revoked), err
+}
+
+func (db *SQLiteDB) CreateSession(s entities.Session, token entities.SessionToken) (entities.Session, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.Session{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	s.CreatedAt = now
+	s.LastUsedAt = now
+	s.RevokedAt = nil
+	res, err := tx.Exec(
+		"INSERT INTO sessions (user_id, device, ip, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		s.UserID, s.Device, s.IP, now.UnixNano(), now.UnixNano(), s.ExpiresAt.UnixNano(),
+	)
+	if err != nil {
+		return entities.Session{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return entities.Session{}, err
+	}
+	s.ID = int(id)
+
+	if err := insertSessionToken(tx, s.ID, token, now); err != nil {
+		return entities.Session{}, err
+	}
+
+	return s, tx.Commit()
+}
+
+func (db *SQLiteDB) RotateSession(tokenHash string, next entities.SessionToken) (entities.Session, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.Session{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var tokenID int
+	var usedAt sql.NullInt64
+	s, err := scanSession(tx.QueryRow(
+		`SELECT sessions.id, user_id, device, ip, sessions.created_at, last_used_at, expires_at, revoked_at, session_tokens.id, used_at
+			FROM session_tokens JOIN sessions ON sessions.id = session_tokens.session_id
+			WHERE hash = ? AND `+activeSession,
+		tokenHash, now.UnixNano(),
+	), &tokenID, &usedAt)
+	if err != nil {
+		return entities.Session{}, err
+	}
+
+	if usedAt.Valid {
+		// someone holds a copy of an old token, nobody can tell who is who
+		if _, err := revokeSessions(tx, now, "id = ?", s.ID); err != nil {
+			return entities.Session{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return entities.Session{}, err
+		}
+		return entities.Session{}, ErrTokenReused
+	}
+
+	if _, err := tx.Exec("UPDATE session_tokens SET used_at = ? WHERE id = ?", now.UnixNano(), tokenID); err != nil {
+		return entities.Session{}, err
+	}
+	if err := insertSessionToken(tx, s.ID, next, now); err != nil {
+		return entities.Session{}, err
+	}
+	if _, err := tx.Exec("UPDATE sessions SET last_used_at = ? WHERE id = ?", now.UnixNano(), s.ID); err != nil {
+		return entities.Session{}, err
+	}
+	s.LastUsedAt = now
+
+	return s, tx.Commit()
+}
+
+func (db *SQLiteDB) GetSessionByToken(tokenHash string) (entities.Session, error) {
+	return scanSession(db.sql.QueryRow(
+		`SELECT `+sessionColumns+` FROM sessions
+			WHERE id = (SELECT session_id FROM session_tokens WHERE hash = ? AND used_at IS NULL) AND `+activeSession,
+		tokenHash, time.Now().UnixNano(),
+	))
+}
+
+func (db *SQLiteDB) ListSessions(userID int) ([]entities.Session, error) {
+	rows, err := db.sql.Query(
+		"SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND "+activeSession+" ORDER BY last_used_at DESC, id DESC",
+		userID, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []entities.Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (db *SQLiteDB) RevokeSession(userID, sessionID int) error {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	revoked, err := revokeSessions(tx, time.Now().UTC(), "id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return ErrDoesNotExist
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) RevokeSessions(userID, except int) (int, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	revoked, err := revokeSessions(tx, time.Now().UTC(), "user_id = ? AND id != ?", userID, except)
+	if err != nil {
+		return 0, err
+	}
+	return revoked, tx.Commit()
+}
+
+func (db *SQLiteDB) PruneSessions(before time.Time) (int, error) {
+	// the tokens go with their session
+	res, err := db.sql.Exec(
+		"DELETE FROM sessions WHERE COALESCE(revoked_at, expires_at) < ?",
+		before.UnixNano(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	return int(pruned), err
+}
+
+func (db *SQLiteDB) RevokeToken(tokenID string, expiresAt time.Time) error {
+	_, err := db.sql.Exec("INSERT OR IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)", tokenID, expiresAt.UnixNano())
+	return err
+}
+
+func (db *SQLiteDB) TokenRevoked(tokenID string) (bool, error) {
+	var revoked bool
+	err := db.sql.QueryRow("SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)", tokenID).Scan(&revoked)
+	return revoked, err
+}
+
+func (db *SQLiteDB) PruneRevokedTokens(before time.Time) (int, error) {
+	res, err := db.sql.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	return int(pruned), err
+}
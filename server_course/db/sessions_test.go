@@ -0,0 +1,182 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Sessions(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"walt@breakingbad.com", "jesse@breakingbad.com"} {
+				_, err := store.StoreUser(entities.User{Email: email, Password: "pw"})
+				assert.NoError(t, err)
+			}
+
+			expires := time.Now().Add(time.Hour)
+			phone, err := store.CreateSession(entities.Session{UserID: 1, Device: "phone", ExpiresAt: expires}, entities.SessionToken{Hash: "phone-1"})
+			assert.NoError(t, err)
+			laptop, err := store.CreateSession(entities.Session{UserID: 1, Device: "laptop", ExpiresAt: expires}, entities.SessionToken{Hash: "laptop-1"})
+			assert.NoError(t, err)
+			_, err = store.CreateSession(entities.Session{UserID: 2, ExpiresAt: expires}, entities.SessionToken{Hash: "other-1"})
+			assert.NoError(t, err)
+
+			rotated, err := store.RotateSession("phone-1", entities.SessionToken{Hash: "phone-2"})
+			assert.NoError(t, err)
+			assert.Equal(t, phone.ID, rotated.ID)
+			assert.True(t, rotated.LastUsedAt.After(phone.LastUsedAt))
+
+			_, err = store.GetSessionByToken("phone-1")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			s, err := store.GetSessionByToken("phone-2")
+			assert.NoError(t, err)
+			assert.Equal(t, phone.ID, s.ID)
+
+			sessions, err := store.ListSessions(1)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{phone.ID, laptop.ID}, []int{sessions[0].ID, sessions[1].ID})
+
+			// replaying a rotated token ends the session for everybody
+			_, err = store.RotateSession("phone-1", entities.SessionToken{Hash: "phone-3"})
+			assert.ErrorIs(t, err, ErrTokenReused)
+			_, err = store.RotateSession("phone-2", entities.SessionToken{Hash: "phone-3"})
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			_, err = store.RotateSession("unknown", entities.SessionToken{Hash: "phone-3"})
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			assert.ErrorIs(t, store.RevokeSession(2, laptop.ID), ErrDoesNotExist)
+			assert.NoError(t, store.RevokeSession(1, laptop.ID))
+			assert.ErrorIs(t, store.RevokeSession(1, laptop.ID), ErrDoesNotExist)
+
+			sessions, err = store.ListSessions(1)
+			assert.NoError(t, err)
+			assert.Empty(t, sessions)
+
+			pruned, err := store.PruneSessions(time.Now())
+			assert.NoError(t, err)
+			assert.Equal(t, 2, pruned)
+			sessions, err = store.ListSessions(2)
+			assert.NoError(t, err)
+			assert.Len(t, sessions, 1)
+		})
+	}
+}
+
+func TestStore_SessionsExpire(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+			assert.NoError(t, err)
+
+			_, err = store.CreateSession(entities.Session{UserID: 1, ExpiresAt: time.Now().Add(-time.Second)}, entities.SessionToken{Hash: "old"})
+			assert.NoError(t, err)
+
+			_, err = store.GetSessionByToken("old")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			_, err = store.RotateSession("old", entities.SessionToken{Hash: "new"})
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			sessions, err := store.ListSessions(1)
+			assert.NoError(t, err)
+			assert.Empty(t, sessions)
+		})
+	}
+}
+
+func TestStore_RevokedTokens(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+			assert.NoError(t, err)
+
+			soon := time.Now().Add(time.Hour)
+			phone, err := store.CreateSession(entities.Session{UserID: u.ID, ExpiresAt: soon}, entities.SessionToken{Hash: "phone-1", AccessTokenID: "phone-a", AccessExpiresAt: soon})
+			assert.NoError(t, err)
+			_, err = store.RotateSession("phone-1", entities.SessionToken{Hash: "phone-2", AccessTokenID: "phone-b", AccessExpiresAt: soon})
+			assert.NoError(t, err)
+			laptop, err := store.CreateSession(entities.Session{UserID: u.ID, ExpiresAt: soon}, entities.SessionToken{Hash: "laptop-1", AccessTokenID: "laptop-a", AccessExpiresAt: soon})
+			assert.NoError(t, err)
+			_, err = store.CreateSession(entities.Session{UserID: u.ID, ExpiresAt: soon}, entities.SessionToken{Hash: "tablet-1", AccessTokenID: "tablet-a", AccessExpiresAt: soon})
+			assert.NoError(t, err)
+
+			// every access token of a revoked session is revoked with it
+			assert.NoError(t, store.RevokeSession(u.ID, phone.ID))
+			for jti, want := range map[string]bool{"phone-a": true, "phone-b": true, "laptop-a": false, "tablet-a": false} {
+				revoked, err := store.TokenRevoked(jti)
+				assert.NoError(t, err)
+				assert.Equal(t, want, revoked, jti)
+			}
+
+			revokedSessions, err := store.RevokeSessions(u.ID, laptop.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, revokedSessions)
+			revoked, err := store.TokenRevoked("tablet-a")
+			assert.NoError(t, err)
+			assert.True(t, revoked)
+			sessions, err := store.ListSessions(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{laptop.ID}, []int{sessions[0].ID})
+
+			assert.NoError(t, store.RevokeToken("laptop-a", soon))
+			assert.NoError(t, store.RevokeToken("old", time.Now().Add(-time.Minute)))
+			pruned, err := store.PruneRevokedTokens(time.Now())
+			assert.NoError(t, err)
+			assert.Equal(t, 1, pruned)
+			revoked, err = store.TokenRevoked("old")
+			assert.NoError(t, err)
+			assert.False(t, revoked)
+			revoked, err = store.TokenRevoked("laptop-a")
+			assert.NoError(t, err)
+			assert.True(t, revoked)
+		})
+	}
+}
+
+func TestStore_TokenVersion(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw", TokenVersion: 5})
+			assert.NoError(t, err)
+			assert.Zero(t, u.TokenVersion)
+
+			u, err = store.BumpTokenVersion(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, u.TokenVersion)
+
+			// only a new password logs the user out
+			u, err = store.UpdateUser(entities.User{ID: u.ID, Email: "heisenberg@breakingbad.com"})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, u.TokenVersion)
+			_, err = store.UpdateUser(entities.User{ID: u.ID, Email: "heisenberg@breakingbad.com", Password: "new"})
+			assert.NoError(t, err)
+			u, err = store.GetUser(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, u.TokenVersion)
+		})
+	}
+}
+
+func TestDB_sessionTokensReopen(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	assert.NoError(t, err)
+
+	expires := time.Now().Add(time.Hour)
+	s, err := db.CreateSession(entities.Session{UserID: 1, ExpiresAt: expires}, entities.SessionToken{Hash: "phone-1"})
+	assert.NoError(t, err)
+	_, err = db.RotateSession("phone-1", entities.SessionToken{Hash: "phone-2"})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	// the tokens are found by their hash again after a restart
+	reopened, err := NewDB(dir)
+	assert.NoError(t, err)
+	got, err := reopened.GetSessionByToken("phone-2")
+	assert.NoError(t, err)
+	assert.Equal(t, s.ID, got.ID)
+	_, err = reopened.GetSessionByToken("phone-1")
+	assert.ErrorIs(t, err, ErrDoesNotExist)
+	assert.NoError(t, reopened.Close())
+}
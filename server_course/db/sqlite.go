@@ -0,0 +1,572 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"server_course/entities"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB is a Store backed by an embedded SQLite database.
+type SQLiteDB struct {
+	sql  *sql.DB
+	path string
+}
+
+func openSQLite(p string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", p+"/database.sqlite?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows one writer, serialize in the pool instead of on SQLITE_BUSY
+	conn.SetMaxOpenConns(1)
+	return conn, nil
+}
+
+func NewSQLiteDB(p string) (*SQLiteDB, error) {
+	conn, err := openSQLite(p)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &SQLiteDB{
+		sql:  conn,
+		path: p + "/database.sqlite",
+	}
+
+	if _, err := migrateSQLite(conn, false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+const userColumns = "id, email, password, is_chirpy_red, roles, suspended, verified, token_version"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row scanner) (entities.User, error) {
+	var u entities.User
+	var roles sql.NullString
+	err := row.Scan(&u.ID, &u.Email, &u.Password, &u.IsChirpyRed, &roles, &u.Suspended, &u.Verified, &u.TokenVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.User{}, ErrDoesNotExist
+	}
+	if err != nil {
+		return u, err
+	}
+	if roles.Valid {
+		err = json.Unmarshal([]byte(roles.String), &u.Roles)
+	}
+	return u, err
+}
+
+const chirpColumns = "id, author_id, body, created_at, updated_at, in_reply_to, reply_count, like_count, rechirp_count, deleted, hidden, hashtags, mentions"
+
+// visibleChirp selects the chirps that may be shown on their own.
+const visibleChirp = "deleted = 0 AND hidden = 0"
+
+func scanChirp(row scanner) (entities.Chirp, error) {
+	var c entities.Chirp
+	var createdAt, updatedAt int64
+	var inReplyTo sql.NullInt64
+	var hashtags, mentions sql.NullString
+	err := row.Scan(&c.ID, &c.AuthorID, &c.Body, &createdAt, &updatedAt, &inReplyTo, &c.ReplyCount, &c.LikeCount, &c.RechirpCount, &c.Deleted, &c.Hidden, &hashtags, &mentions)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.Chirp{}, ErrDoesNotExist
+	}
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	c.CreatedAt = time.Unix(0, createdAt).UTC()
+	c.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	c.InReplyTo = int(inReplyTo.Int64)
+
+	if hashtags.Valid {
+		if err := json.Unmarshal([]byte(hashtags.String), &c.Hashtags); err != nil {
+			return entities.Chirp{}, err
+		}
+	}
+	if mentions.Valid {
+		if err := json.Unmarshal([]byte(mentions.String), &c.Mentions); err != nil {
+			return entities.Chirp{}, err
+		}
+	}
+	return c, nil
+}
+
+func scanChirps(rows *sql.Rows) ([]entities.Chirp, error) {
+	defer rows.Close()
+
+	chirps := []entities.Chirp{}
+	for rows.Next() {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, c)
+	}
+
+	return chirps, rows.Err()
+}
+
+func (db *SQLiteDB) StoreChirp(c entities.Chirp) (entities.Chirp, error) {
+	c.CreatedAt = time.Now().UTC()
+	c.UpdatedAt = c.CreatedAt
+	c.ReplyCount = 0
+	c.LikeCount = 0
+	c.RechirpCount = 0
+	c.Deleted = false
+	c.Hidden = false
+
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	var inReplyTo sql.NullInt64
+	if c.InReplyTo != 0 {
+		res, err := tx.Exec("UPDATE chirps SET reply_count = reply_count + 1 WHERE id = ? AND "+visibleChirp, c.InReplyTo)
+		if err != nil {
+			return entities.Chirp{}, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return entities.Chirp{}, ErrInvalidReply
+		}
+		inReplyTo = sql.NullInt64{Int64: int64(c.InReplyTo), Valid: true}
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO chirps (author_id, body, created_at, updated_at, in_reply_to) VALUES (?, ?, ?, ?, ?)",
+		c.AuthorID, c.Body, c.CreatedAt.UnixNano(), c.UpdatedAt.UnixNano(), inReplyTo,
+	)
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	c.ID = int(id)
+
+	if err := tagChirpTx(tx, &c); err != nil {
+		return entities.Chirp{}, err
+	}
+
+	return c, tx.Commit()
+}
+
+func (db *SQLiteDB) StoreUser(u entities.User) (entities.User, error) {
+	u.Roles = nil
+	u.Suspended = false
+	u.TokenVersion = 0
+	u.Verified = false
+	u.IsChirpyRed = false
+	encryptedUser, err := u.EncryptPassword()
+	if err != nil {
+		return entities.User{}, err
+	}
+
+	res, err := db.sql.Exec(
+		"INSERT INTO users (email, password) VALUES (?, ?)",
+		encryptedUser.Email, encryptedUser.Password,
+	)
+	if err != nil {
+		return entities.User{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return entities.User{}, err
+	}
+	u.ID = int(id)
+
+	return u, nil
+}
+
+func (db *SQLiteDB) DeleteChirp(chirpID int) error {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	c, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ? AND deleted = 0", chirpID))
+	if err != nil {
+		if errors.Is(err, ErrDoesNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if err := deleteChirp(tx, c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteChirp deletes c, with replies it stays as a tombstone.
+func deleteChirp(tx *sql.Tx, c entities.Chirp) error {
+	for _, table := range []string{"chirp_revisions", "likes", "rechirps", "chirp_hashtags", "chirp_mentions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE chirp_id = ?", c.ID); err != nil {
+			return err
+		}
+	}
+
+	if c.ReplyCount > 0 {
+		_, err := tx.Exec("UPDATE chirps SET body = '', like_count = 0, rechirp_count = 0, deleted = 1, hidden = 0, hashtags = NULL, mentions = NULL WHERE id = ?", c.ID)
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM chirps WHERE id = ?", c.ID); err != nil {
+		return err
+	}
+
+	// walk up the thread, tombstones left without replies go as well
+	for parentID := c.InReplyTo; parentID != 0; {
+		parent, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", parentID))
+		if errors.Is(err, ErrDoesNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if !parent.Deleted || parent.ReplyCount > 1 {
+			if _, err := tx.Exec("UPDATE chirps SET reply_count = reply_count - 1 WHERE id = ?", parent.ID); err != nil {
+				return err
+			}
+			break
+		}
+
+		if _, err := tx.Exec("DELETE FROM chirps WHERE id = ?", parent.ID); err != nil {
+			return err
+		}
+		parentID = parent.InReplyTo
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) GetChirp(chirpID int) (entities.Chirp, error) {
+	return scanChirp(db.sql.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ? AND "+visibleChirp, chirpID))
+}
+
+func (db *SQLiteDB) UpdateChirp(newChirp entities.Chirp) (entities.Chirp, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ? AND "+visibleChirp, newChirp.ID))
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO chirp_revisions (chirp_id, revision, body, created_at)
+			SELECT ?, COUNT(*) + 1, ?, ? FROM chirp_revisions WHERE chirp_id = ?`,
+		chirp.ID, chirp.Body, chirp.UpdatedAt.UnixNano(), chirp.ID,
+	)
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+
+	chirp.Body = newChirp.Body
+	chirp.UpdatedAt = time.Now().UTC()
+	_, err = tx.Exec("UPDATE chirps SET body = ?, updated_at = ? WHERE id = ?", chirp.Body, chirp.UpdatedAt.UnixNano(), chirp.ID)
+	if err != nil {
+		return entities.Chirp{}, err
+	}
+	if err := tagChirpTx(tx, &chirp); err != nil {
+		return entities.Chirp{}, err
+	}
+
+	return chirp, tx.Commit()
+}
+
+func (db *SQLiteDB) GetChirpRevisions(chirpID int) ([]entities.ChirpRevision, error) {
+	if _, err := db.GetChirp(chirpID); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.sql.Query("SELECT chirp_id, revision, body, created_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY revision", chirpID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []entities.ChirpRevision{}
+	for rows.Next() {
+		var r entities.ChirpRevision
+		var createdAt int64
+		if err := rows.Scan(&r.ChirpID, &r.Revision, &r.Body, &createdAt); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = time.Unix(0, createdAt).UTC()
+		revisions = append(revisions, r)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (db *SQLiteDB) GetUser(userID int) (entities.User, error) {
+	return scanUser(db.sql.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userID))
+}
+
+func (db *SQLiteDB) GetUserByEmail(requestedEmail string) (entities.User, error) {
+	return scanUser(db.sql.QueryRow("SELECT "+userColumns+" FROM users WHERE email = ? COLLATE NOCASE", requestedEmail))
+}
+
+func (db *SQLiteDB) GetChirps() (map[int]entities.Chirp, error) {
+	chirps, err := db.GetChirpsSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	chirpsMap := make(map[int]entities.Chirp, len(chirps))
+	for _, c := range chirps {
+		chirpsMap[c.ID] = c
+	}
+	return chirpsMap, nil
+}
+
+func (db *SQLiteDB) GetUsers() (map[int]entities.User, error) {
+	users, err := db.GetUsersSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	usersMap := make(map[int]entities.User, len(users))
+	for _, u := range users {
+		usersMap[u.ID] = u
+	}
+	return usersMap, nil
+}
+
+func (db *SQLiteDB) GetChirpsSlice() ([]entities.Chirp, error) {
+	rows, err := db.sql.Query("SELECT " + chirpColumns + " FROM chirps WHERE " + visibleChirp + " ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return scanChirps(rows)
+}
+
+func (db *SQLiteDB) ListChirps(q ChirpQuery) (ChirpPage, error) {
+	where := []string{visibleChirp}
+	args := []any{}
+
+	if len(q.AuthorIDs) > 0 {
+		where = append(where, "author_id IN ("+placeholders(len(q.AuthorIDs))+")")
+		for _, id := range q.AuthorIDs {
+			args = append(args, id)
+		}
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.Until.UnixNano())
+	}
+	if q.Hashtag != "" {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_hashtags WHERE tag = ?)")
+		args = append(args, q.Hashtag)
+	}
+	if q.MentionedUserID != 0 {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)")
+		args = append(args, q.MentionedUserID)
+	}
+
+	order := "ASC"
+	if !q.ascending() {
+		order = "DESC"
+	}
+	if cursor := max(q.After, q.Before); cursor != 0 {
+		if q.ascending() {
+			where = append(where, "id > ?")
+		} else {
+			where = append(where, "id < ?")
+		}
+		args = append(args, cursor)
+	}
+
+	query := "SELECT " + chirpColumns + " FROM chirps WHERE " + strings.Join(where, " AND ") + " ORDER BY id " + order
+	if q.Limit > 0 {
+		// one extra row tells whether there is another page
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := db.sql.Query(query, args...)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	chirps, err := scanChirps(rows)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	page := ChirpPage{Chirps: chirps}
+	if q.Limit > 0 && len(chirps) > q.Limit {
+		page.Chirps = chirps[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Chirps)
+	}
+
+	return page, nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (db *SQLiteDB) GetUsersSlice() ([]entities.User, error) {
+	rows, err := db.sql.Query("SELECT " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []entities.User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// updateUser loads the user inside a transaction, lets update modify it and
+// writes all columns back.
+func (db *SQLiteDB) updateUser(userID int, update func(u *entities.User) error) (entities.User, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userID))
+	if err != nil {
+		return entities.User{}, err
+	}
+
+	if err := update(&user); err != nil {
+		return entities.User{}, err
+	}
+	roles, err := jsonColumn(user.Roles, len(user.Roles))
+	if err != nil {
+		return entities.User{}, err
+	}
+
+	// is_chirpy_red is left to putSubscription
+	_, err = tx.Exec(
+		"UPDATE users SET email = ?, password = ?, roles = ?, suspended = ?, verified = ?, token_version = ? WHERE id = ?",
+		user.Email, user.Password, roles, user.Suspended, user.Verified, user.TokenVersion, user.ID,
+	)
+	if err != nil {
+		return entities.User{}, err
+	}
+
+	return user, tx.Commit()
+}
+
+func (db *SQLiteDB) UpdateUser(newUser entities.User) (entities.User, error) {
+	return db.updateUser(newUser.ID, func(oldUser *entities.User) error {
+		if newUser.Password != "" {
+			encryptedUser, err := newUser.EncryptPassword()
+			if err != nil {
+				return err
+			}
+			oldUser.Password = encryptedUser.Password
+			oldUser.TokenVersion++
+		}
+
+		if !strings.EqualFold(oldUser.Email, newUser.Email) {
+			oldUser.Verified = false
+		}
+		oldUser.Email = newUser.Email
+		return nil
+	})
+}
+
+func (db *SQLiteDB) UpdateUserEmailAndPassword(newUser entities.User) (entities.User, error) {
+	return db.updateUser(newUser.ID, func(oldUser *entities.User) error {
+		encryptedUser, err := newUser.EncryptPassword()
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(oldUser.Email, newUser.Email) {
+			oldUser.Verified = false
+		}
+		oldUser.Email = newUser.Email
+		oldUser.Password = encryptedUser.Password
+		oldUser.TokenVersion++
+		return nil
+	})
+}
+
+func (db *SQLiteDB) UpdateUserRoles(userID int, roles []string) (entities.User, error) {
+	return db.updateUser(userID, func(user *entities.User) error {
+		user.Roles = roles
+		return nil
+	})
+}
+
+func (db *SQLiteDB) UpdateUserSuspended(userID int, suspended bool) (entities.User, error) {
+	return db.updateUser(userID, func(user *entities.User) error {
+		user.Suspended = suspended
+		return nil
+	})
+}
+
+func (db *SQLiteDB) UpdateUserVerified(userID int, verified bool) (entities.User, error) {
+	return db.updateUser(userID, func(user *entities.User) error {
+		user.Verified = verified
+		return nil
+	})
+}
+
+func (db *SQLiteDB) BumpTokenVersion(userID int) (entities.User, error) {
+	return db.updateUser(userID, func(user *entities.User) error {
+		user.TokenVersion++
+		return nil
+	})
+}
+
+func (db *SQLiteDB) Reset() error {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"webhook_deliveries", "webhook_subscriptions", "subscriptions", "webhook_events", "security_events", "login_throttles", "login_challenges", "recovery_codes", "totp", "email_tokens", "revoked_tokens", "session_tokens", "sessions", "moderation_actions", "reports", "notifications", "chirp_hashtags", "chirp_mentions", "likes", "rechirps", "follows", "chirp_revisions", "chirps", "users"} {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) Close() error {
+	return db.sql.Close()
+}
@@ -0,0 +1,409 @@
+package db
+
+import (
+	"server_course/entities"
+	"slices"
+	"time"
+)
+
+// ChirpStore persists chirps.
+type ChirpStore interface {
+	// StoreChirp fails with ErrInvalidReply if InReplyTo is not a chirp. The
+	// counters, Deleted and Hidden of c are ignored.
+	StoreChirp(c entities.Chirp) (entities.Chirp, error)
+	// DeleteChirp leaves a tombstone behind if the chirp has replies so its
+	// thread stays intact. Tombstones are only returned by GetThread.
+	DeleteChirp(chirpID int) error
+	GetChirp(chirpID int) (entities.Chirp, error)
+	GetChirps() (map[int]entities.Chirp, error)
+	GetChirpsSlice() ([]entities.Chirp, error)
+	ListChirps(q ChirpQuery) (ChirpPage, error)
+	// UpdateChirp replaces the body and keeps the previous one as a revision.
+	UpdateChirp(c entities.Chirp) (entities.Chirp, error)
+	GetChirpRevisions(chirpID int) ([]entities.ChirpRevision, error)
+	GetThread(chirpID int) (Thread, error)
+}
+
+// UserStore persists users.
+type UserStore interface {
+	StoreUser(u entities.User) (entities.User, error)
+	GetUser(userID int) (entities.User, error)
+	GetUserByEmail(requestedEmail string) (entities.User, error)
+	GetUsers() (map[int]entities.User, error)
+	GetUsersSlice() ([]entities.User, error)
+	// UpdateUser changes the email and, if set, the password. A new password
+	// bumps the token version, a new email has to be verified again.
+	UpdateUser(newUser entities.User) (entities.User, error)
+	UpdateUserEmailAndPassword(newUser entities.User) (entities.User, error)
+	// UpdateUserRoles replaces the roles of the user.
+	UpdateUserRoles(userID int, roles []string) (entities.User, error)
+	UpdateUserSuspended(userID int, suspended bool) (entities.User, error)
+	UpdateUserVerified(userID int, verified bool) (entities.User, error)
+	// BumpTokenVersion invalidates every access token issued to the user.
+	BumpTokenVersion(userID int) (entities.User, error)
+}
+
+// SessionStore persists the sessions of users and the hashes of their refresh
+// tokens. Sessions that are revoked or expired are treated as if they did not
+// exist.
+type SessionStore interface {
+	// CreateSession starts a session whose first refresh token is token.
+	CreateSession(s entities.Session, token entities.SessionToken) (entities.Session, error)
+	// RotateSession swaps the current refresh token of a session for next.
+	// Presenting a token that was already rotated away revokes the session
+	// and fails with ErrTokenReused.
+	RotateSession(tokenHash string, next entities.SessionToken) (entities.Session, error)
+	// GetSessionByToken finds the session a current refresh token belongs to.
+	GetSessionByToken(tokenHash string) (entities.Session, error)
+	// ListSessions returns the active sessions of userID, latest used first.
+	ListSessions(userID int) ([]entities.Session, error)
+	// RevokeSession ends a session and revokes the access tokens issued for it
+	// that have not expired yet.
+	RevokeSession(userID, sessionID int) error
+	// RevokeSessions does the same for all sessions of userID but except.
+	RevokeSessions(userID, except int) (int, error)
+	// PruneSessions drops sessions, and their tokens, that ended before then.
+	PruneSessions(before time.Time) (int, error)
+	// RevokeToken adds the access token with the jti tokenID to the
+	// revocation list until it expires.
+	RevokeToken(tokenID string, expiresAt time.Time) error
+	TokenRevoked(tokenID string) (bool, error)
+	// PruneRevokedTokens forgets revoked tokens that expired before then.
+	PruneRevokedTokens(before time.Time) (int, error)
+}
+
+// FollowStore persists who follows whom.
+type FollowStore interface {
+	// Follow is a no-op if followerID already follows followeeID.
+	Follow(followerID, followeeID int) error
+	Unfollow(followerID, followeeID int) error
+	GetFollowers(userID int) ([]int, error)
+	GetFollowing(userID int) ([]int, error)
+}
+
+// EngagementStore persists likes and rechirps and keeps the counters on the
+// chirps in step. Adding twice or removing what is not there is a no-op, all
+// methods return the chirp with its updated counters.
+type EngagementStore interface {
+	Like(userID, chirpID int) (entities.Chirp, error)
+	Unlike(userID, chirpID int) (entities.Chirp, error)
+	Rechirp(userID, chirpID int) (entities.Chirp, error)
+	Unrechirp(userID, chirpID int) (entities.Chirp, error)
+	// GetLikedChirps returns the chirps userID likes, latest like first.
+	GetLikedChirps(userID int) ([]entities.Chirp, error)
+}
+
+// TagStore answers questions about the hashtags and mentions parsed from
+// chirps. Mentions are resolved to users when a chirp is written.
+type TagStore interface {
+	// TrendingHashtags counts the hashtags of chirps created since then and
+	// returns the limit most used ones.
+	TrendingHashtags(since time.Time, limit int) ([]HashtagCount, error)
+}
+
+// NotificationStore persists the notifications of users.
+type NotificationStore interface {
+	// StoreNotification is a no-op returning the existing notification if the
+	// user has an unread one of the same kind from the same actor about the
+	// same chirp.
+	StoreNotification(n entities.Notification) (entities.Notification, error)
+	ListNotifications(q NotificationQuery) (NotificationPage, error)
+	CountUnreadNotifications(userID int) (int, error)
+	// MarkNotificationsRead marks the given notifications of userID read, all
+	// of them if ids is empty, and returns how many were unread.
+	MarkNotificationsRead(userID int, ids []int) (int, error)
+}
+
+// ModerationStore persists reports, what admins did about them and the chirps
+// they hid.
+type ModerationStore interface {
+	// SetChirpHidden hides a chirp from everything but threads, where it shows
+	// up redacted, or shows it again. Deleted chirps do not exist.
+	SetChirpHidden(chirpID int, hidden bool) (entities.Chirp, error)
+	// StoreReport is a no-op returning the existing report if the reporter
+	// already has an open one about the same target.
+	StoreReport(r entities.Report) (entities.Report, error)
+	GetReport(reportID int) (entities.Report, error)
+	// ListReports returns reports oldest first so the queue is worked through
+	// in the order it filled up.
+	ListReports(q ReportQuery) (ReportPage, error)
+	// ApplyModerationAction carries out a, resolves every open report about
+	// the target of its report and about the target of a, and logs a, all at
+	// once. It returns the logged action and how many reports it resolved. A
+	// report that is no longer open fails with ErrResolved.
+	ApplyModerationAction(a entities.ModerationAction) (entities.ModerationAction, int, error)
+	// ListModerationActions returns the log newest first.
+	ListModerationActions(q ModerationActionQuery) (ModerationActionPage, error)
+}
+
+// EmailTokenStore persists the hashes of the tokens mailed to users.
+type EmailTokenStore interface {
+	// CreateEmailToken stores t, tokens of the user for the same purpose that
+	// were not used yet stop working.
+	CreateEmailToken(t entities.EmailToken) (entities.EmailToken, error)
+	// UseEmailToken marks the token for purpose hashing to hash as used. It
+	// fails with ErrDoesNotExist if there is no such token, it was used or
+	// expired already or its user changed the email since.
+	UseEmailToken(purpose, hash string) (entities.EmailToken, error)
+	// ResetPassword uses the reset token hashing to hash like UseEmailToken
+	// and, at once, sets the password of its user and marks the email
+	// verified.
+	ResetPassword(hash, password string) (entities.User, error)
+	// PruneEmailTokens drops tokens that expired before then.
+	PruneEmailTokens(before time.Time) (int, error)
+}
+
+// TwoFactorStore persists the second factors of users and the login
+// challenges waiting for them.
+type TwoFactorStore interface {
+	// SetTOTP starts enrolling t, replacing an enrollment that was not
+	// confirmed yet.
+	SetTOTP(t entities.TOTP) error
+	GetTOTP(userID int) (entities.TOTP, error)
+	// ConfirmTOTP turns the enrolled TOTP on with the code of step accepted
+	// and replaces the recovery codes with ones hashing to recoveryHashes.
+	ConfirmTOTP(userID int, step int64, recoveryHashes []string) (entities.TOTP, error)
+	// UseTOTPStep accepts a code of step. It fails with ErrCodeReused unless
+	// step comes after the last accepted one.
+	UseTOTPStep(userID int, step int64) error
+	// DeleteTOTP turns the second factor off and drops the recovery codes.
+	DeleteTOTP(userID int) error
+	ReplaceRecoveryCodes(userID int, hashes []string) error
+	// UseRecoveryCode fails with ErrDoesNotExist unless the user has an
+	// unused code hashing to hash.
+	UseRecoveryCode(userID int, hash string) error
+	// CountRecoveryCodes returns how many unused codes the user has left.
+	CountRecoveryCodes(userID int) (int, error)
+	CreateLoginChallenge(c entities.LoginChallenge) (entities.LoginChallenge, error)
+	// GetLoginChallenge finds an active challenge by the hash of its token.
+	GetLoginChallenge(hash string) (entities.LoginChallenge, error)
+	// FailLoginChallenge counts a wrong code against the challenge.
+	FailLoginChallenge(challengeID int) error
+	// UseLoginChallenge ends the challenge. It fails with ErrDoesNotExist
+	// if it is not active anymore, so a challenge is only exchanged once.
+	UseLoginChallenge(challengeID int) error
+	// PruneLoginChallenges drops challenges that expired before then.
+	PruneLoginChallenges(before time.Time) (int, error)
+}
+
+// SecurityStore persists failed logins and the security log.
+type SecurityStore interface {
+	// RecordLoginFailure starts the count over after
+	// entities.ForgetLoginFailuresAfter.
+	RecordLoginFailure(key string) (entities.LoginThrottle, error)
+	GetLoginThrottle(key string) (entities.LoginThrottle, error)
+	ClearLoginThrottle(key string) error
+	PruneLoginThrottles(before time.Time) (int, error)
+	StoreSecurityEvent(e entities.SecurityEvent) (entities.SecurityEvent, error)
+	ListSecurityEvents(q SecurityEventQuery) (SecurityEventPage, error)
+	PruneSecurityEvents(before time.Time) (int, error)
+}
+
+// WebhookStore is the ledger of events received from Polka.
+type WebhookStore interface {
+	// ReceiveWebhookEvent returns true if e is new or its last attempt failed
+	// or stalled, and false with the stored event otherwise.
+	ReceiveWebhookEvent(e entities.WebhookEvent) (entities.WebhookEvent, bool, error)
+	ReplayWebhookEvent(id int) (entities.WebhookEvent, error)
+	FinishWebhookEvent(id int, status, errMsg string) (entities.WebhookEvent, error)
+	// ProcessWebhookEvent updates the subscription and marks the event
+	// processed, both or neither.
+	ProcessWebhookEvent(id, userID int, update func(s *entities.Subscription) error) (entities.WebhookEvent, entities.Subscription, error)
+	GetWebhookEvent(id int) (entities.WebhookEvent, error)
+	ListWebhookEvents(q WebhookEventQuery) (WebhookEventPage, error)
+}
+
+// SubscriptionStore is the only writer of IsChirpyRed. The flag is set when
+// a subscription is written, a plan that lapsed keeps it until
+// ExpireSubscriptions ran, so access goes by Entitlements.
+type SubscriptionStore interface {
+	GetSubscription(userID int) (entities.Subscription, error)
+	// UpdateSubscription starts from a free one if the user never had one.
+	UpdateSubscription(userID int, update func(s *entities.Subscription) error) (entities.Subscription, error)
+	ExpireSubscriptions(now time.Time) ([]entities.Subscription, error)
+}
+
+// HookStore persists webhook subscriptions and their deliveries.
+type HookStore interface {
+	CreateWebhookSubscription(s entities.WebhookSubscription) (entities.WebhookSubscription, error)
+	GetWebhookSubscription(id int) (entities.WebhookSubscription, error)
+	ListWebhookSubscriptions(q WebhookSubscriptionQuery) ([]entities.WebhookSubscription, error)
+	UpdateWebhookSubscription(s entities.WebhookSubscription) (entities.WebhookSubscription, error)
+	DeleteWebhookSubscription(id int) error
+	EnqueueWebhookDelivery(d entities.WebhookDelivery) (entities.WebhookDelivery, error)
+	DueWebhookDeliveries(now time.Time, limit int) ([]entities.WebhookDelivery, error)
+	GetWebhookDelivery(id int) (entities.WebhookDelivery, error)
+	UpdateWebhookDelivery(d entities.WebhookDelivery) (entities.WebhookDelivery, error)
+	ListWebhookDeliveries(q WebhookDeliveryQuery) (WebhookDeliveryPage, error)
+	// PruneWebhookDeliveries keeps dead deliveries.
+	PruneWebhookDeliveries(before time.Time) (int, error)
+}
+
+// Store is everything the api needs from a storage backend.
+type Store interface {
+	ChirpStore
+	UserStore
+	SessionStore
+	FollowStore
+	EngagementStore
+	TagStore
+	NotificationStore
+	ModerationStore
+	EmailTokenStore
+	TwoFactorStore
+	SecurityStore
+	WebhookStore
+	SubscriptionStore
+	HookStore
+
+	// Reset drops all persisted data.
+	Reset() error
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
+
+// ChirpQuery selects one page of chirps ordered by id. After and Before are
+// cursors holding the id of a chirp and are relative to the sort order, so
+// After continues towards the end and Before goes back towards the start.
+type ChirpQuery struct {
+	AuthorIDs []int
+	Since     time.Time
+	Until     time.Time
+	// Hashtag is normalized, without the leading #.
+	Hashtag         string
+	MentionedUserID int
+	After           int
+	Before          int
+	Limit           int
+	Desc            bool
+}
+
+// NotificationQuery selects one page of a user's notifications, newest first.
+// After and Before are cursors like in ChirpQuery.
+type NotificationQuery struct {
+	UserID     int
+	UnreadOnly bool
+	After      int
+	Before     int
+	Limit      int
+}
+
+type NotificationPage struct {
+	Notifications []entities.Notification
+	HasMore       bool
+}
+
+// ReportQuery selects one page of reports, oldest first, with an empty Status
+// matching all of them. After and Before are cursors like in ChirpQuery.
+type ReportQuery struct {
+	Status string
+	After  int
+	Before int
+	Limit  int
+}
+
+type ReportPage struct {
+	Reports []entities.Report
+	HasMore bool
+}
+
+// ModerationActionQuery selects one page of the moderation log, newest first.
+type ModerationActionQuery struct {
+	After  int
+	Before int
+	Limit  int
+}
+
+type ModerationActionPage struct {
+	Actions []entities.ModerationAction
+	HasMore bool
+}
+
+type SecurityEventQuery struct {
+	UserID int
+	After  int
+	Before int
+	Limit  int
+}
+
+type SecurityEventPage struct {
+	Events  []entities.SecurityEvent
+	HasMore bool
+}
+
+type WebhookEventQuery struct {
+	Status string
+	After  int
+	Before int
+	Limit  int
+}
+
+type WebhookEventPage struct {
+	Events  []entities.WebhookEvent
+	HasMore bool
+}
+
+type WebhookSubscriptionQuery struct {
+	UserID int
+	// Event only matches active subscriptions
+	Event string
+}
+
+type WebhookDeliveryQuery struct {
+	SubscriptionID int
+	Status         string
+	After          int
+	Before         int
+	Limit          int
+}
+
+type WebhookDeliveryPage struct {
+	Deliveries []entities.WebhookDelivery
+	HasMore    bool
+}
+
+type HashtagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+type ChirpPage struct {
+	Chirps []entities.Chirp
+	// HasMore is set if further chirps match past the end of the page in the
+	// direction that was paged in.
+	HasMore bool
+}
+
+func (q ChirpQuery) matches(c entities.Chirp) bool {
+	if !c.Visible() {
+		return false
+	}
+	if len(q.AuthorIDs) > 0 && !slices.Contains(q.AuthorIDs, c.AuthorID) {
+		return false
+	}
+	if !q.Since.IsZero() && c.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !c.CreatedAt.Before(q.Until) {
+		return false
+	}
+	if q.Hashtag != "" && !slices.Contains(c.Hashtags, q.Hashtag) {
+		return false
+	}
+	if q.MentionedUserID != 0 && !slices.ContainsFunc(c.Mentions, func(m entities.Mention) bool {
+		return m.UserID == q.MentionedUserID
+	}) {
+		return false
+	}
+	return true
+}
+
+// ascending reports whether the page is read walking up the ids. Paging
+// Before a cursor walks back from it and is flipped once the page is full.
+func (q ChirpQuery) ascending() bool {
+	return q.Desc == (q.Before != 0)
+}
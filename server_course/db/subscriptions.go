@@ -0,0 +1,240 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"server_course/entities"
+	"time"
+)
+
+func (db *DB) GetSubscription(userID int) (entities.Subscription, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	s, exists := db.store.Subscriptions[userID]
+	if !exists {
+		return entities.Subscription{}, ErrDoesNotExist
+	}
+	return s, nil
+}
+
+// putSubscription has to be called holding the write lock.
+func (db *DB) putSubscription(b *batch, s entities.Subscription, user entities.User, now time.Time) error {
+	err := b.put("subscriptions", s.UserID, s, func() { db.store.Subscriptions[s.UserID] = s })
+	if err != nil {
+		return err
+	}
+
+	paid := s.Paid(now)
+	if user.IsChirpyRed == paid {
+		return nil
+	}
+	user.IsChirpyRed = paid
+	return b.put("users", user.ID, user, func() { db.store.Users[user.ID] = user })
+}
+
+// updateSubscription has to be called holding the write lock.
+func (db *DB) updateSubscription(b *batch, userID int, update func(s *entities.Subscription) error, now time.Time) (entities.Subscription, error) {
+	user, exists := db.store.Users[userID]
+	if !exists {
+		return entities.Subscription{}, ErrDoesNotExist
+	}
+
+	s, exists := db.store.Subscriptions[userID]
+	if !exists {
+		s = entities.Subscription{UserID: userID, Plan: entities.PlanFree}
+	}
+	if err := update(&s); err != nil {
+		return entities.Subscription{}, err
+	}
+	s.UserID = userID
+	s.UpdatedAt = now
+
+	if err := db.putSubscription(b, s, user, now); err != nil {
+		return entities.Subscription{}, err
+	}
+	return s, nil
+}
+
+func (db *DB) UpdateSubscription(userID int, update func(s *entities.Subscription) error) (entities.Subscription, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	s, err := db.updateSubscription(b, userID, update, time.Now().UTC())
+	if err != nil {
+		return entities.Subscription{}, err
+	}
+	if err := db.commitBatch(b); err != nil {
+		return entities.Subscription{}, err
+	}
+
+	return s, nil
+}
+
+func (db *DB) ExpireSubscriptions(now time.Time) ([]entities.Subscription, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	expired := []entities.Subscription{}
+	for _, s := range db.store.Subscriptions {
+		if s.Status == entities.SubscriptionExpired || s.Paid(now) {
+			continue
+		}
+		s.End(now)
+		s.UpdatedAt = now
+		if err := db.putSubscription(b, s, db.store.Users[s.UserID], now); err != nil {
+			return nil, err
+		}
+		expired = append(expired, s)
+	}
+	if len(expired) == 0 {
+		return expired, nil
+	}
+
+	if err := db.commitBatch(b); err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+const subscriptionColumns = "user_id, plan, status, started_at, period_end, grace_until, canceled_at, ended_at, updated_at"
+
+func nullTime(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+func timeOrNil(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := time.Unix(0, n.Int64).UTC()
+	return &t
+}
+
+func scanSubscription(row scanner) (entities.Subscription, error) {
+	var s entities.Subscription
+	var startedAt, periodEnd, updatedAt int64
+	var graceUntil, canceledAt, endedAt sql.NullInt64
+	err := row.Scan(&s.UserID, &s.Plan, &s.Status, &startedAt, &periodEnd, &graceUntil, &canceledAt, &endedAt, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.Subscription{}, ErrDoesNotExist
+	}
+	s.StartedAt = time.Unix(0, startedAt).UTC()
+	if periodEnd != 0 {
+		s.PeriodEnd = time.Unix(0, periodEnd).UTC()
+	}
+	s.GraceUntil = timeOrNil(graceUntil)
+	s.CanceledAt = timeOrNil(canceledAt)
+	s.EndedAt = timeOrNil(endedAt)
+	s.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	return s, err
+}
+
+func putSubscription(tx *sql.Tx, s entities.Subscription, now time.Time) error {
+	var periodEnd int64
+	if !s.PeriodEnd.IsZero() {
+		periodEnd = s.PeriodEnd.UnixNano()
+	}
+
+	_, err := tx.Exec(
+		`INSERT INTO subscriptions (`+subscriptionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET plan = excluded.plan, status = excluded.status, started_at = excluded.started_at,
+			period_end = excluded.period_end, grace_until = excluded.grace_until, canceled_at = excluded.canceled_at,
+			ended_at = excluded.ended_at, updated_at = excluded.updated_at`,
+		s.UserID, s.Plan, s.Status, s.StartedAt.UnixNano(), periodEnd,
+		nullTime(s.GraceUntil), nullTime(s.CanceledAt), nullTime(s.EndedAt), s.UpdatedAt.UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE users SET is_chirpy_red = ? WHERE id = ?", s.Paid(now), s.UserID)
+	return err
+}
+
+func (db *SQLiteDB) GetSubscription(userID int) (entities.Subscription, error) {
+	return scanSubscription(db.sql.QueryRow("SELECT "+subscriptionColumns+" FROM subscriptions WHERE user_id = ?", userID))
+}
+
+func updateSubscription(tx *sql.Tx, userID int, update func(s *entities.Subscription) error, now time.Time) (entities.Subscription, error) {
+	if _, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userID)); err != nil {
+		return entities.Subscription{}, err
+	}
+
+	s, err := scanSubscription(tx.QueryRow("SELECT "+subscriptionColumns+" FROM subscriptions WHERE user_id = ?", userID))
+	if errors.Is(err, ErrDoesNotExist) {
+		s, err = entities.Subscription{UserID: userID, Plan: entities.PlanFree}, nil
+	}
+	if err != nil {
+		return entities.Subscription{}, err
+	}
+
+	if err := update(&s); err != nil {
+		return entities.Subscription{}, err
+	}
+	s.UserID = userID
+	s.UpdatedAt = now
+
+	if err := putSubscription(tx, s, now); err != nil {
+		return entities.Subscription{}, err
+	}
+	return s, nil
+}
+
+func (db *SQLiteDB) UpdateSubscription(userID int, update func(s *entities.Subscription) error) (entities.Subscription, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.Subscription{}, err
+	}
+	defer tx.Rollback()
+
+	s, err := updateSubscription(tx, userID, update, time.Now().UTC())
+	if err != nil {
+		return entities.Subscription{}, err
+	}
+	return s, tx.Commit()
+}
+
+func (db *SQLiteDB) ExpireSubscriptions(now time.Time) ([]entities.Subscription, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT "+subscriptionColumns+" FROM subscriptions WHERE status != ?", entities.SubscriptionExpired)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lapsed := []entities.Subscription{}
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !s.Paid(now) {
+			lapsed = append(lapsed, s)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range lapsed {
+		lapsed[i].End(now)
+		lapsed[i].UpdatedAt = now
+		if err := putSubscription(tx, lapsed[i], now); err != nil {
+			return nil, err
+		}
+	}
+
+	return lapsed, tx.Commit()
+}
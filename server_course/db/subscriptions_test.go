@@ -0,0 +1,102 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Subscriptions(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.StoreUser(entities.User{Email: "red@x.com", Password: "pw"})
+			assert.NoError(t, err)
+
+			_, err = store.GetSubscription(user.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			_, err = store.UpdateSubscription(user.ID+100, func(s *entities.Subscription) error { return nil })
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			now := time.Now().UTC()
+			s, err := store.UpdateSubscription(user.ID, func(s *entities.Subscription) error {
+				assert.Equal(t, entities.PlanFree, s.Plan)
+				s.Start(entities.PlanRed, time.Time{}, now)
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, entities.SubscriptionActive, s.Status)
+			assert.WithinDuration(t, now.Add(entities.DefaultBillingPeriod), s.PeriodEnd, time.Millisecond)
+			assert.Equal(t, entities.PlanRed, s.Entitlements(now).Plan)
+
+			user, err = store.GetUser(user.ID)
+			assert.NoError(t, err)
+			assert.True(t, user.IsChirpyRed)
+
+			// only the subscription changes it
+			stale := user
+			stale.IsChirpyRed = false
+			stale.Password = ""
+			_, err = store.UpdateUser(stale)
+			assert.NoError(t, err)
+			user, err = store.GetUser(user.ID)
+			assert.NoError(t, err)
+			assert.True(t, user.IsChirpyRed)
+
+			s, err = store.UpdateSubscription(user.ID, func(s *entities.Subscription) error {
+				s.PaymentFailed(now)
+				return nil
+			})
+			assert.NoError(t, err)
+			got, err := store.GetSubscription(user.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, entities.SubscriptionPastDue, got.Status)
+			assert.WithinDuration(t, *s.GraceUntil, *got.GraceUntil, time.Millisecond)
+			assert.Nil(t, got.CanceledAt)
+
+			// nothing lapsed yet
+			expired, err := store.ExpireSubscriptions(now)
+			assert.NoError(t, err)
+			assert.Empty(t, expired)
+
+			expired, err = store.ExpireSubscriptions(now.Add(entities.PaymentGracePeriod + time.Second))
+			assert.NoError(t, err)
+			assert.Len(t, expired, 1)
+			assert.Equal(t, user.ID, expired[0].UserID)
+			got, err = store.GetSubscription(user.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, entities.SubscriptionExpired, got.Status)
+			assert.NotNil(t, got.EndedAt)
+			assert.Equal(t, entities.PlanFree, got.Entitlements(now).Plan)
+			user, err = store.GetUser(user.ID)
+			assert.NoError(t, err)
+			assert.False(t, user.IsChirpyRed)
+
+			// a canceled subscription runs until the period ends
+			_, err = store.UpdateSubscription(user.ID, func(s *entities.Subscription) error {
+				s.Start(entities.PlanRed, now.Add(time.Hour), now)
+				s.Cancel(now)
+				return nil
+			})
+			assert.NoError(t, err)
+			got, err = store.GetSubscription(user.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, entities.SubscriptionCanceled, got.Status)
+			assert.True(t, got.Paid(now))
+			assert.False(t, got.Paid(now.Add(time.Hour)))
+
+			// the red flag lags behind until the lapsed plan is expired
+			user, err = store.GetUser(user.ID)
+			assert.NoError(t, err)
+			assert.True(t, user.IsChirpyRed)
+			assert.Equal(t, entities.PlanFree, got.Entitlements(now.Add(time.Hour)).Plan)
+			expired, err = store.ExpireSubscriptions(now.Add(time.Hour))
+			assert.NoError(t, err)
+			assert.Len(t, expired, 1)
+			user, err = store.GetUser(user.ID)
+			assert.NoError(t, err)
+			assert.False(t, user.IsChirpyRed)
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"server_course/entities"
+	"sort"
+	"time"
+)
+
+// tagChirp parses the hashtags and mentions of c's body, lookup resolves a
+// handle to a user id or 0.
+func tagChirp(c *entities.Chirp, lookup func(handle string) (int, error)) error {
+	hashtags, handles := entities.ParseTags(c.Body)
+
+	var mentions []entities.Mention
+	for _, handle := range handles {
+		userID, err := lookup(handle)
+		if err != nil {
+			return err
+		}
+		mentions = append(mentions, entities.Mention{Handle: handle, UserID: userID})
+	}
+
+	c.Hashtags = hashtags
+	c.Mentions = mentions
+	return nil
+}
+
+// sortHashtagCounts orders by count, most used first, and cuts after limit.
+func sortHashtagCounts(counts map[string]int, limit int) []HashtagCount {
+	trending := make([]HashtagCount, 0, len(counts))
+	for tag, count := range counts {
+		trending = append(trending, HashtagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(trending, func(i, j int) bool {
+		if trending[i].Count != trending[j].Count {
+			return trending[i].Count > trending[j].Count
+		}
+		return trending[i].Tag < trending[j].Tag
+	})
+
+	if limit > 0 && len(trending) > limit {
+		trending = trending[:limit]
+	}
+	return trending
+}
+
+// userIDByHandle returns the user with handle, the oldest one if several users
+// share it. Callers hold the lock.
+func (db *DB) userIDByHandle(handle string) (int, error) {
+	userID := 0
+	for id, u := range db.store.Users {
+		if u.Handle() == handle && (userID == 0 || id < userID) {
+			userID = id
+		}
+	}
+	return userID, nil
+}
+
+func (db *DB) TrendingHashtags(since time.Time, limit int) ([]HashtagCount, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	counts := map[string]int{}
+	for _, c := range db.store.Chirps {
+		if !c.Visible() || c.CreatedAt.Before(since) {
+			continue
+		}
+		for _, tag := range c.Hashtags {
+			counts[tag]++
+		}
+	}
+
+	return sortHashtagCounts(counts, limit), nil
+}
+
+// tagChirpTx tags c and writes its tags to the chirp row and the lookup tables.
+func tagChirpTx(tx *sql.Tx, c *entities.Chirp) error {
+	err := tagChirp(c, func(handle string) (int, error) {
+		var userID int
+		err := tx.QueryRow(
+			`SELECT id FROM users WHERE lower(CASE WHEN instr(email, '@') > 0 THEN substr(email, 1, instr(email, '@') - 1) ELSE email END) = ?
+				ORDER BY id LIMIT 1`,
+			handle,
+		).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return userID, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"chirp_hashtags", "chirp_mentions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE chirp_id = ?", c.ID); err != nil {
+			return err
+		}
+	}
+	for _, tag := range c.Hashtags {
+		if _, err := tx.Exec("INSERT INTO chirp_hashtags (chirp_id, tag, created_at) VALUES (?, ?, ?)", c.ID, tag, c.CreatedAt.UnixNano()); err != nil {
+			return err
+		}
+	}
+	for _, m := range c.Mentions {
+		if m.UserID == 0 {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO chirp_mentions (chirp_id, user_id) VALUES (?, ?)", c.ID, m.UserID); err != nil {
+			return err
+		}
+	}
+
+	hashtags, err := jsonColumn(c.Hashtags, len(c.Hashtags))
+	if err != nil {
+		return err
+	}
+	mentions, err := jsonColumn(c.Mentions, len(c.Mentions))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE chirps SET hashtags = ?, mentions = ? WHERE id = ?", hashtags, mentions, c.ID)
+	return err
+}
+
+// jsonColumn encodes a list of n elements for a TEXT column, NULL if empty.
+func jsonColumn(v any, n int) (sql.NullString, error) {
+	if n == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func (db *SQLiteDB) TrendingHashtags(since time.Time, limit int) ([]HashtagCount, error) {
+	if limit <= 0 {
+		// no limit for sqlite
+		limit = -1
+	}
+
+	rows, err := db.sql.Query(
+		`SELECT tag, COUNT(*) AS uses FROM chirp_hashtags
+			WHERE created_at >= ? AND chirp_id NOT IN (SELECT id FROM chirps WHERE hidden = 1)
+			GROUP BY tag ORDER BY uses DESC, tag LIMIT ?`,
+		since.UnixNano(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trending := []HashtagCount{}
+	for rows.Next() {
+		var h HashtagCount
+		if err := rows.Scan(&h.Tag, &h.Count); err != nil {
+			return nil, err
+		}
+		trending = append(trending, h)
+	}
+
+	return trending, rows.Err()
+}
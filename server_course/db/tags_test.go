@@ -0,0 +1,63 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Tags(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			walt, err := store.StoreUser(entities.User{Email: "Walt@breakingbad.com", Password: "pw"})
+			assert.NoError(t, err)
+			_, err = store.StoreUser(entities.User{Email: "jesse.pinkman@breakingbad.com", Password: "pw"})
+			assert.NoError(t, err)
+
+			first, err := store.StoreChirp(entities.Chirp{AuthorID: 2, Body: "Yo @walt, #Science! #science @jesse.pinkman. mail me at x@y.com @nobody"})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"science"}, first.Hashtags)
+			assert.Equal(t, []entities.Mention{{Handle: "walt", UserID: walt.ID}, {Handle: "jesse.pinkman", UserID: 2}, {Handle: "nobody"}}, first.Mentions)
+
+			stored, err := store.GetChirp(first.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, first, stored)
+
+			second, err := store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "#science #rv"})
+			assert.NoError(t, err)
+			_, err = store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "#rv"})
+			assert.NoError(t, err)
+
+			page, err := store.ListChirps(ChirpQuery{Hashtag: "science"})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{first.ID, second.ID}, ids(page.Chirps))
+
+			page, err = store.ListChirps(ChirpQuery{MentionedUserID: walt.ID})
+			assert.NoError(t, err)
+			assert.Equal(t, []int{first.ID}, ids(page.Chirps))
+
+			trending, err := store.TrendingHashtags(time.Now().Add(-time.Hour), 10)
+			assert.NoError(t, err)
+			assert.Equal(t, []HashtagCount{{"rv", 2}, {"science", 2}}, trending)
+
+			trending, err = store.TrendingHashtags(time.Now().Add(time.Hour), 10)
+			assert.NoError(t, err)
+			assert.Empty(t, trending)
+
+			// edits retag, deletes untag
+			_, err = store.UpdateChirp(entities.Chirp{ID: first.ID, Body: "never mind"})
+			assert.NoError(t, err)
+			assert.NoError(t, store.DeleteChirp(second.ID))
+
+			trending, err = store.TrendingHashtags(time.Now().Add(-time.Hour), 1)
+			assert.NoError(t, err)
+			assert.Equal(t, []HashtagCount{{"rv", 1}}, trending)
+
+			page, err = store.ListChirps(ChirpQuery{MentionedUserID: walt.ID})
+			assert.NoError(t, err)
+			assert.Empty(t, page.Chirps)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"server_course/entities"
+)
+
+// Thread is the conversation around a chirp. Deleted chirps that still have
+// replies show up as tombstones, hidden chirps with their content redacted.
+type Thread struct {
+	// Ancestors goes from the root of the thread down to the direct parent.
+	Ancestors []entities.Chirp
+	Chirp     entities.Chirp
+	// Descendants holds every reply below Chirp, ordered by id.
+	Descendants []entities.Chirp
+}
+
+// redact strips the content of hidden chirps so they only keep their place in
+// the thread.
+func (t *Thread) redact() {
+	redact := func(c *entities.Chirp) {
+		if c.Hidden {
+			c.Body = ""
+			c.Hashtags = nil
+			c.Mentions = nil
+		}
+	}
+
+	for i := range t.Ancestors {
+		redact(&t.Ancestors[i])
+	}
+	redact(&t.Chirp)
+	for i := range t.Descendants {
+		redact(&t.Descendants[i])
+	}
+}
+
+func (db *DB) GetThread(chirpID int) (Thread, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	c, exists := db.store.Chirps[chirpID]
+	if !exists {
+		return Thread{}, ErrDoesNotExist
+	}
+	thread := Thread{Ancestors: []entities.Chirp{}, Chirp: c, Descendants: []entities.Chirp{}}
+
+	for parentID := c.InReplyTo; parentID != 0; {
+		parent, exists := db.store.Chirps[parentID]
+		if !exists {
+			break
+		}
+		thread.Ancestors = append([]entities.Chirp{parent}, thread.Ancestors...)
+		parentID = parent.InReplyTo
+	}
+
+	// replies always have a higher id than what they answer
+	inThread := map[int]bool{c.ID: true}
+	for id := c.ID + 1; id < db.store.ChirpIndex; id++ {
+		reply, exists := db.store.Chirps[id]
+		if exists && inThread[reply.InReplyTo] {
+			inThread[id] = true
+			thread.Descendants = append(thread.Descendants, reply)
+		}
+	}
+
+	thread.redact()
+	return thread, nil
+}
+
+func (db *SQLiteDB) GetThread(chirpID int) (Thread, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return Thread{}, err
+	}
+	defer tx.Rollback()
+
+	c, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", chirpID))
+	if err != nil {
+		return Thread{}, err
+	}
+	thread := Thread{Chirp: c}
+
+	rows, err := tx.Query(`
+		WITH RECURSIVE ancestors (id) AS (
+			SELECT in_reply_to FROM chirps WHERE id = ?
+			UNION ALL
+			SELECT chirps.in_reply_to FROM chirps JOIN ancestors ON chirps.id = ancestors.id
+		)
+		SELECT `+chirpColumns+` FROM chirps WHERE id IN ancestors ORDER BY id`, chirpID)
+	if err != nil {
+		return Thread{}, err
+	}
+	thread.Ancestors, err = scanChirps(rows)
+	if err != nil {
+		return Thread{}, err
+	}
+
+	rows, err = tx.Query(`
+		WITH RECURSIVE descendants (id) AS (
+			SELECT id FROM chirps WHERE in_reply_to = ?
+			UNION ALL
+			SELECT chirps.id FROM chirps JOIN descendants ON chirps.in_reply_to = descendants.id
+		)
+		SELECT `+chirpColumns+` FROM chirps WHERE id IN descendants ORDER BY id`, chirpID)
+	if err != nil {
+		return Thread{}, err
+	}
+	thread.Descendants, err = scanChirps(rows)
+	if err != nil {
+		return Thread{}, err
+	}
+
+	thread.redact()
+	return thread, nil
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Thread(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			root, err := store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "root"})
+			assert.NoError(t, err)
+			reply, err := store.StoreChirp(entities.Chirp{AuthorID: 2, Body: "reply", InReplyTo: root.ID})
+			assert.NoError(t, err)
+			nested, err := store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "nested", InReplyTo: reply.ID})
+			assert.NoError(t, err)
+			_, err = store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "orphan", InReplyTo: 42})
+			assert.ErrorIs(t, err, ErrInvalidReply)
+
+			thread, err := store.GetThread(reply.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{root.ID}, ids(thread.Ancestors))
+			assert.Equal(t, 1, thread.Chirp.ReplyCount)
+			assert.Equal(t, []int{nested.ID}, ids(thread.Descendants))
+
+			// the reply still has an answer and turns into a tombstone
+			assert.NoError(t, store.DeleteChirp(reply.ID))
+			_, err = store.GetChirp(reply.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			thread, err = store.GetThread(nested.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{root.ID, reply.ID}, ids(thread.Ancestors))
+			assert.True(t, thread.Ancestors[1].Deleted)
+			assert.Empty(t, thread.Ancestors[1].Body)
+
+			_, err = store.StoreChirp(entities.Chirp{AuthorID: 1, Body: "late", InReplyTo: reply.ID})
+			assert.ErrorIs(t, err, ErrInvalidReply)
+
+			// removing the last answer prunes the tombstone
+			assert.NoError(t, store.DeleteChirp(nested.ID))
+			_, err = store.GetThread(reply.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			root, err = store.GetChirp(root.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, root.ReplyCount)
+		})
+	}
+}
@@ -0,0 +1,481 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"server_course/entities"
+	"time"
+)
+
+func (db *DB) SetTOTP(t entities.TOTP) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	t.Confirmed = false
+	t.LastStep = 0
+	t.CreatedAt = time.Now().UTC()
+	if err := db.put("totp", t.UserID, t); err != nil {
+		return err
+	}
+	db.store.TOTP[t.UserID] = t
+
+	return nil
+}
+
+func (db *DB) GetTOTP(userID int) (entities.TOTP, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	t, exists := db.store.TOTP[userID]
+	if !exists {
+		return entities.TOTP{}, ErrDoesNotExist
+	}
+	return t, nil
+}
+
+// putRecoveryCodes replaces the recovery codes of userID, the caller has to
+// hold the write lock.
+func (db *DB) putRecoveryCodes(b *batch, userID int, hashes []string) error {
+	for _, code := range db.store.RecoveryCodes {
+		if code.UserID == userID {
+			b.delete("recovery_codes", code.ID, func() { delete(db.store.RecoveryCodes, code.ID) })
+		}
+	}
+	for i, hash := range hashes {
+		code := entities.RecoveryCode{ID: db.store.RecoveryCodeIndex + i, UserID: userID, Hash: hash}
+		err := b.put("recovery_codes", code.ID, code, func() {
+			db.store.RecoveryCodes[code.ID] = code
+			db.store.RecoveryCodeIndex++
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) ConfirmTOTP(userID int, step int64, recoveryHashes []string) (entities.TOTP, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	t, exists := db.store.TOTP[userID]
+	if !exists {
+		return entities.TOTP{}, ErrDoesNotExist
+	}
+	t.Confirmed = true
+	t.LastStep = step
+
+	b := &batch{}
+	if err := b.put("totp", t.UserID, t, func() { db.store.TOTP[t.UserID] = t }); err != nil {
+		return entities.TOTP{}, err
+	}
+	if err := db.putRecoveryCodes(b, userID, recoveryHashes); err != nil {
+		return entities.TOTP{}, err
+	}
+
+	return t, db.commitBatch(b)
+}
+
+func (db *DB) UseTOTPStep(userID int, step int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	t, exists := db.store.TOTP[userID]
+	if !exists {
+		return ErrDoesNotExist
+	}
+	if step <= t.LastStep {
+		return ErrCodeReused
+	}
+
+	t.LastStep = step
+	if err := db.put("totp", t.UserID, t); err != nil {
+		return err
+	}
+	db.store.TOTP[t.UserID] = t
+
+	return nil
+}
+
+func (db *DB) DeleteTOTP(userID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, exists := db.store.TOTP[userID]; !exists {
+		return ErrDoesNotExist
+	}
+
+	b := &batch{}
+	b.delete("totp", userID, func() { delete(db.store.TOTP, userID) })
+	if err := db.putRecoveryCodes(b, userID, nil); err != nil {
+		return err
+	}
+	return db.commitBatch(b)
+}
+
+func (db *DB) ReplaceRecoveryCodes(userID int, hashes []string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	if err := db.putRecoveryCodes(b, userID, hashes); err != nil {
+		return err
+	}
+	return db.commitBatch(b)
+}
+
+func (db *DB) UseRecoveryCode(userID int, hash string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	for _, code := range db.store.RecoveryCodes {
+		if code.UserID != userID || code.Hash != hash || code.UsedAt != nil {
+			continue
+		}
+
+		now := time.Now().UTC()
+		code.UsedAt = &now
+		if err := db.put("recovery_codes", code.ID, code); err != nil {
+			return err
+		}
+		db.store.RecoveryCodes[code.ID] = code
+		return nil
+	}
+
+	return ErrDoesNotExist
+}
+
+func (db *DB) CountRecoveryCodes(userID int) (int, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	count := 0
+	for _, code := range db.store.RecoveryCodes {
+		if code.UserID == userID && code.UsedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (db *DB) CreateLoginChallenge(c entities.LoginChallenge) (entities.LoginChallenge, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	c.ID = db.store.LoginChallengeIndex
+	c.CreatedAt = time.Now().UTC()
+	c.ExpiresAt = c.ExpiresAt.UTC()
+	c.Attempts = 0
+	c.UsedAt = nil
+	if err := db.put("login_challenges", c.ID, c); err != nil {
+		return entities.LoginChallenge{}, err
+	}
+	db.store.LoginChallenges[c.ID] = c
+	db.store.LoginChallengeIndex++
+
+	return c, nil
+}
+
+func (db *DB) GetLoginChallenge(hash string) (entities.LoginChallenge, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	now := time.Now().UTC()
+	for _, c := range db.store.LoginChallenges {
+		if c.Hash == hash && c.Active(now) {
+			return c, nil
+		}
+	}
+	return entities.LoginChallenge{}, ErrDoesNotExist
+}
+
+func (db *DB) FailLoginChallenge(challengeID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	c, exists := db.store.LoginChallenges[challengeID]
+	if !exists {
+		return ErrDoesNotExist
+	}
+
+	c.Attempts++
+	if err := db.put("login_challenges", c.ID, c); err != nil {
+		return err
+	}
+	db.store.LoginChallenges[c.ID] = c
+
+	return nil
+}
+
+func (db *DB) UseLoginChallenge(challengeID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	now := time.Now().UTC()
+	c, exists := db.store.LoginChallenges[challengeID]
+	if !exists || !c.Active(now) {
+		return ErrDoesNotExist
+	}
+
+	c.UsedAt = &now
+	if err := db.put("login_challenges", c.ID, c); err != nil {
+		return err
+	}
+	db.store.LoginChallenges[c.ID] = c
+
+	return nil
+}
+
+func (db *DB) PruneLoginChallenges(before time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	b := &batch{}
+	for _, c := range db.store.LoginChallenges {
+		if c.ExpiresAt.Before(before) {
+			b.delete("login_challenges", c.ID, func() { delete(db.store.LoginChallenges, c.ID) })
+		}
+	}
+	if len(b.entries) == 0 {
+		return 0, nil
+	}
+
+	return len(b.entries), db.commitBatch(b)
+}
+
+func (db *SQLiteDB) SetTOTP(t entities.TOTP) error {
+	_, err := db.sql.Exec(
+		`INSERT INTO totp (user_id, secret, confirmed, last_step, created_at) VALUES (?, ?, 0, 0, ?)
+			ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, confirmed = 0, last_step = 0, created_at = excluded.created_at`,
+		t.UserID, t.Secret, time.Now().UnixNano(),
+	)
+	return err
+}
+
+func scanTOTP(row scanner) (entities.TOTP, error) {
+	var t entities.TOTP
+	var createdAt int64
+	err := row.Scan(&t.UserID, &t.Secret, &t.Confirmed, &t.LastStep, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.TOTP{}, ErrDoesNotExist
+	}
+	t.CreatedAt = time.Unix(0, createdAt).UTC()
+	return t, err
+}
+
+const totpColumns = "user_id, secret, confirmed, last_step, created_at"
+
+func (db *SQLiteDB) GetTOTP(userID int) (entities.TOTP, error) {
+	return scanTOTP(db.sql.QueryRow("SELECT "+totpColumns+" FROM totp WHERE user_id = ?", userID))
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, hashes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, hash) VALUES (?, ?)", userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDB) ConfirmTOTP(userID int, step int64, recoveryHashes []string) (entities.TOTP, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.TOTP{}, err
+	}
+	defer tx.Rollback()
+
+	t, err := scanTOTP(tx.QueryRow(
+		"UPDATE totp SET confirmed = 1, last_step = ? WHERE user_id = ? RETURNING "+totpColumns,
+		step, userID,
+	))
+	if err != nil {
+		return entities.TOTP{}, err
+	}
+	if err := replaceRecoveryCodes(tx, userID, recoveryHashes); err != nil {
+		return entities.TOTP{}, err
+	}
+
+	return t, tx.Commit()
+}
+
+func (db *SQLiteDB) UseTOTPStep(userID int, step int64) error {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	t, err := scanTOTP(tx.QueryRow("SELECT "+totpColumns+" FROM totp WHERE user_id = ?", userID))
+	if err != nil {
+		return err
+	}
+	if step <= t.LastStep {
+		return ErrCodeReused
+	}
+	if _, err := tx.Exec("UPDATE totp SET last_step = ? WHERE user_id = ?", step, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) DeleteTOTP(userID int) error {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM totp WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrDoesNotExist
+	}
+	if err := replaceRecoveryCodes(tx, userID, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) ReplaceRecoveryCodes(userID int, hashes []string) error {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, hashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) UseRecoveryCode(userID int, hash string) error {
+	res, err := db.sql.Exec(
+		"UPDATE recovery_codes SET used_at = ? WHERE id = (SELECT id FROM recovery_codes WHERE user_id = ? AND hash = ? AND used_at IS NULL LIMIT 1)",
+		time.Now().UnixNano(), userID, hash,
+	)
+	if err != nil {
+		return err
+	}
+	used, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if used == 0 {
+		return ErrDoesNotExist
+	}
+	return nil
+}
+
+func (db *SQLiteDB) CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := db.sql.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+const loginChallengeColumns = "id, user_id, hash, created_at, expires_at, attempts, used_at, expires_in_seconds"
+
+// activeChallenge selects challenges that can still be exchanged at the time
+// given as its argument.
+const activeChallenge = "used_at IS NULL AND attempts < ? AND expires_at > ?"
+
+func scanLoginChallenge(row scanner) (entities.LoginChallenge, error) {
+	var c entities.LoginChallenge
+	var createdAt, expiresAt int64
+	var usedAt sql.NullInt64
+	err := row.Scan(&c.ID, &c.UserID, &c.Hash, &createdAt, &expiresAt, &c.Attempts, &usedAt, &c.ExpiresInSeconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.LoginChallenge{}, ErrDoesNotExist
+	}
+	c.CreatedAt = time.Unix(0, createdAt).UTC()
+	c.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	if usedAt.Valid {
+		used := time.Unix(0, usedAt.Int64).UTC()
+		c.UsedAt = &used
+	}
+	return c, err
+}
+
+func (db *SQLiteDB) CreateLoginChallenge(c entities.LoginChallenge) (entities.LoginChallenge, error) {
+	c.CreatedAt = time.Now().UTC()
+	c.ExpiresAt = c.ExpiresAt.UTC()
+	c.Attempts = 0
+	c.UsedAt = nil
+
+	res, err := db.sql.Exec(
+		"INSERT INTO login_challenges (user_id, hash, created_at, expires_at, expires_in_seconds) VALUES (?, ?, ?, ?, ?)",
+		c.UserID, c.Hash, c.CreatedAt.UnixNano(), c.ExpiresAt.UnixNano(), c.ExpiresInSeconds,
+	)
+	if err != nil {
+		return entities.LoginChallenge{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return entities.LoginChallenge{}, err
+	}
+	c.ID = int(id)
+
+	return c, nil
+}
+
+func (db *SQLiteDB) GetLoginChallenge(hash string) (entities.LoginChallenge, error) {
+	return scanLoginChallenge(db.sql.QueryRow(
+		"SELECT "+loginChallengeColumns+" FROM login_challenges WHERE hash = ? AND "+activeChallenge,
+		hash, entities.MaxChallengeAttempts, time.Now().UnixNano(),
+	))
+}
+
+func (db *SQLiteDB) FailLoginChallenge(challengeID int) error {
+	res, err := db.sql.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE id = ?", challengeID)
+	if err != nil {
+		return err
+	}
+	failed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if failed == 0 {
+		return ErrDoesNotExist
+	}
+	return nil
+}
+
+func (db *SQLiteDB) UseLoginChallenge(challengeID int) error {
+	now := time.Now().UnixNano()
+	res, err := db.sql.Exec(
+		"UPDATE login_challenges SET used_at = ? WHERE id = ? AND "+activeChallenge,
+		now, challengeID, entities.MaxChallengeAttempts, now,
+	)
+	if err != nil {
+		return err
+	}
+	used, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if used == 0 {
+		return ErrDoesNotExist
+	}
+	return nil
+}
+
+func (db *SQLiteDB) PruneLoginChallenges(before time.Time) (int, error) {
+	res, err := db.sql.Exec("DELETE FROM login_challenges WHERE expires_at < ?", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	return int(pruned), err
+}
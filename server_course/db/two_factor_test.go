@@ -0,0 +1,111 @@
+package db
+
+import (
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_TOTP(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+			assert.NoError(t, err)
+
+			_, err = store.GetTOTP(u.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			assert.NoError(t, store.SetTOTP(entities.TOTP{UserID: u.ID, Secret: "first"}))
+			// enrolling again before confirming replaces the secret
+			assert.NoError(t, store.SetTOTP(entities.TOTP{UserID: u.ID, Secret: "second"}))
+			totp, err := store.GetTOTP(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, "second", totp.Secret)
+			assert.False(t, totp.Confirmed)
+
+			totp, err = store.ConfirmTOTP(u.ID, 100, []string{"a", "b", "c"})
+			assert.NoError(t, err)
+			assert.True(t, totp.Confirmed)
+			assert.Equal(t, int64(100), totp.LastStep)
+
+			// a step is only good once
+			assert.ErrorIs(t, store.UseTOTPStep(u.ID, 100), ErrCodeReused)
+			assert.ErrorIs(t, store.UseTOTPStep(u.ID, 99), ErrCodeReused)
+			assert.NoError(t, store.UseTOTPStep(u.ID, 101))
+			totp, err = store.GetTOTP(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(101), totp.LastStep)
+
+			left, err := store.CountRecoveryCodes(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, left)
+			assert.NoError(t, store.UseRecoveryCode(u.ID, "b"))
+			assert.ErrorIs(t, store.UseRecoveryCode(u.ID, "b"), ErrDoesNotExist)
+			assert.ErrorIs(t, store.UseRecoveryCode(u.ID+1, "a"), ErrDoesNotExist)
+			left, err = store.CountRecoveryCodes(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, left)
+
+			// new codes replace all old ones, used or not
+			assert.NoError(t, store.ReplaceRecoveryCodes(u.ID, []string{"d", "e"}))
+			assert.ErrorIs(t, store.UseRecoveryCode(u.ID, "a"), ErrDoesNotExist)
+			left, err = store.CountRecoveryCodes(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, left)
+
+			assert.NoError(t, store.DeleteTOTP(u.ID))
+			assert.ErrorIs(t, store.DeleteTOTP(u.ID), ErrDoesNotExist)
+			_, err = store.GetTOTP(u.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			left, err = store.CountRecoveryCodes(u.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, left)
+		})
+	}
+}
+
+func TestStore_LoginChallenges(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			u, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+			assert.NoError(t, err)
+
+			soon := time.Now().Add(time.Minute)
+			c, err := store.CreateLoginChallenge(entities.LoginChallenge{UserID: u.ID, Hash: "c1", ExpiresAt: soon, ExpiresInSeconds: 60})
+			assert.NoError(t, err)
+			_, err = store.CreateLoginChallenge(entities.LoginChallenge{UserID: u.ID, Hash: "expired", ExpiresAt: time.Now().Add(-time.Second)})
+			assert.NoError(t, err)
+
+			got, err := store.GetLoginChallenge("c1")
+			assert.NoError(t, err)
+			assert.Equal(t, c.ID, got.ID)
+			assert.Equal(t, u.ID, got.UserID)
+			assert.Equal(t, 60, got.ExpiresInSeconds)
+			_, err = store.GetLoginChallenge("expired")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			assert.NoError(t, store.UseLoginChallenge(c.ID))
+			assert.ErrorIs(t, store.UseLoginChallenge(c.ID), ErrDoesNotExist)
+			_, err = store.GetLoginChallenge("c1")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			// too many wrong codes use a challenge up
+			c, err = store.CreateLoginChallenge(entities.LoginChallenge{UserID: u.ID, Hash: "c2", ExpiresAt: soon})
+			assert.NoError(t, err)
+			for i := 0; i < entities.MaxChallengeAttempts; i++ {
+				_, err = store.GetLoginChallenge("c2")
+				assert.NoError(t, err)
+				assert.NoError(t, store.FailLoginChallenge(c.ID))
+			}
+			_, err = store.GetLoginChallenge("c2")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			assert.ErrorIs(t, store.UseLoginChallenge(c.ID), ErrDoesNotExist)
+
+			pruned, err := store.PruneLoginChallenges(time.Now())
+			assert.NoError(t, err)
+			assert.Equal(t, 1, pruned)
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// walCompactEvery is the number of logged mutations after which the log is
+// folded into a fresh snapshot.
+const walCompactEvery = 1000
+
+var errWALClosed = errors.New("wal is closed")
+
+const (
+	walPut    = "put"
+	walDelete = "delete"
+)
+
+// walTables maps every table that can be logged to the index counter that has
+// to stay ahead of its ids, or "" if the table has none.
+var walTables = map[string]string{
+	"chirps":                "chirp_index",
+	"email_tokens":          "email_token_index",
+	"chirp_revisions":       "",
+	"follows":               "",
+	"likes":                 "",
+	"login_challenges":      "login_challenge_index",
+	"login_throttles":       "login_throttle_index",
+	"moderation_actions":    "moderation_action_index",
+	"notifications":         "notification_index",
+	"rechirps":              "",
+	"recovery_codes":        "recovery_code_index",
+	"reports":               "report_index",
+	"revoked_tokens":        "revoked_token_index",
+	"security_events":       "security_event_index",
+	"sessions":              "session_index",
+	"session_tokens":        "session_token_index",
+	"subscriptions":         "",
+	"totp":                  "",
+	"users":                 "user_index",
+	"webhook_deliveries":    "webhook_delivery_index",
+	"webhook_events":        "webhook_event_index",
+	"webhook_subscriptions": "webhook_subscription_index",
+}
+
+// walEntry is one line of the write-ahead log. Puts always carry the full row
+// so replaying an entry twice is harmless.
+type walEntry struct {
+	Op    string          `json:"op"`
+	Table string          `json:"table"`
+	ID    int             `json:"id"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func newPut(table string, id int, v any) (walEntry, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return walEntry{}, err
+	}
+	return walEntry{Op: walPut, Table: table, ID: id, Value: value}, nil
+}
+
+func newDelete(table string, id int) walEntry {
+	return walEntry{Op: walDelete, Table: table, ID: id}
+}
+
+// readWAL returns every complete entry in the log. A torn last line is what a
+// crash during an append leaves behind and is dropped, anything else that does
+// not decode means the log is corrupt.
+func readWAL(path string) ([]walEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	entries := []walEntry{}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry walEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("corrupt wal entry on line %d: %w", i+1, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// applyWAL replays entries onto a raw, not yet migrated, snapshot document.
+func applyWAL(doc map[string]any, entries []walEntry) error {
+	for _, entry := range entries {
+		indexKey, known := walTables[entry.Table]
+		if !known {
+			return fmt.Errorf("wal entry for unknown table %q", entry.Table)
+		}
+
+		rows, _ := doc[entry.Table].(map[string]any)
+		if rows == nil {
+			rows = map[string]any{}
+			doc[entry.Table] = rows
+		}
+		key := strconv.Itoa(entry.ID)
+
+		switch entry.Op {
+		case walPut:
+			var value any
+			decoder := json.NewDecoder(bytes.NewReader(entry.Value))
+			decoder.UseNumber()
+			if err := decoder.Decode(&value); err != nil {
+				return err
+			}
+			rows[key] = value
+
+			if indexKey != "" {
+				index := 0
+				if n, ok := doc[indexKey].(json.Number); ok {
+					i, _ := n.Int64()
+					index = int(i)
+				}
+				if entry.ID >= index {
+					doc[indexKey] = json.Number(strconv.Itoa(entry.ID + 1))
+				}
+			}
+		case walDelete:
+			delete(rows, key)
+		default:
+			return fmt.Errorf("wal entry with unknown op %q", entry.Op)
+		}
+	}
+
+	return nil
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either the
+// old or the new content on disk, never a mix.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+type walFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+type wal struct {
+	file    walFile
+	size    int64
+	entries int
+	// broken is set if a failed append could not be undone, anything
+	// appended after the torn entry would be unreadable
+	broken error
+}
+
+func openWAL(path string, entries int) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wal{file: f, size: info.Size(), entries: entries}, nil
+}
+
+// append writes entries as one batch and only returns once they are on disk.
+// A batch that fails is cut off again so the log never holds a torn entry
+// before a complete one.
+func (w *wal) append(entries ...walEntry) error {
+	if w.file == nil {
+		return errWALClosed
+	}
+	if w.broken != nil {
+		return w.broken
+	}
+
+	var data bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data.Write(line)
+		data.WriteByte('\n')
+	}
+
+	_, err := w.file.Write(data.Bytes())
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		if terr := w.file.Truncate(w.size); terr != nil {
+			w.broken = fmt.Errorf("wal is broken: %w", errors.Join(err, terr))
+			return w.broken
+		}
+		return err
+	}
+
+	w.size += int64(data.Len())
+	w.entries += len(entries)
+	return nil
+}
+
+func (w *wal) truncate() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.size = 0
+	w.entries = 0
+	w.broken = nil
+	return w.file.Sync()
+}
+
+func (w *wal) close() error {
+	if w == nil || w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
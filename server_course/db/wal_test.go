@@ -0,0 +1,109 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"server_course/entities"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_recoverWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	assert.NoError(t, err)
+
+	first, err := db.StoreChirp(entities.Chirp{AuthorID: 1, Body: "I'm the one who knocks!"})
+	assert.NoError(t, err)
+	second, err := db.StoreChirp(entities.Chirp{AuthorID: 1, Body: "Gale!"})
+	assert.NoError(t, err)
+	assert.NoError(t, db.DeleteChirp(first.ID))
+
+	// crash without Close, the snapshot is still empty and a write was torn
+	f, err := os.OpenFile(dir+"/database.json.wal", os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"op":"put","table":"chirps","id":3,"val`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	recovered, err := NewDB(dir)
+	assert.NoError(t, err)
+	chirps, err := recovered.GetChirpsSlice()
+	assert.NoError(t, err)
+	assert.Equal(t, []entities.Chirp{second}, chirps)
+
+	third, err := recovered.StoreChirp(entities.Chirp{AuthorID: 1, Body: "Cmon Pinkman"})
+	assert.NoError(t, err)
+	assert.Equal(t, second.ID+1, third.ID)
+	assert.NoError(t, recovered.Close())
+
+	wal, err := os.ReadFile(dir + "/database.json.wal")
+	assert.NoError(t, err)
+	assert.Empty(t, wal, "close compacts the log into the snapshot")
+}
+
+func TestDB_compactWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	assert.NoError(t, err)
+
+	for i := 0; i <= walCompactEvery+1; i++ {
+		_, err := db.StoreChirp(entities.Chirp{AuthorID: 1, Body: "Say my name"})
+		assert.NoError(t, err)
+	}
+
+	// crash without Close, every write has to be in the snapshot or the log
+	recovered, err := NewDB(dir)
+	assert.NoError(t, err)
+	chirps, err := recovered.GetChirpsSlice()
+	assert.NoError(t, err)
+	assert.Len(t, chirps, walCompactEvery+2)
+}
+
+func TestReadWAL_corrupt(t *testing.T) {
+	path := t.TempDir() + "/database.json.wal"
+	assert.NoError(t, os.WriteFile(path, []byte("{\"op\":\"put\"\n{\"op\":\"delete\",\"table\":\"chirps\",\"id\":1}\n"), 0644))
+
+	_, err := readWAL(path)
+	assert.Error(t, err)
+}
+
+// shortFile fails its next write after writing half of it, like a full disk.
+type shortFile struct {
+	*os.File
+	fail bool
+}
+
+func (f *shortFile) Write(p []byte) (int, error) {
+	if !f.fail {
+		return f.File.Write(p)
+	}
+	f.fail = false
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestDB_walShortWrite(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	assert.NoError(t, err)
+
+	first, err := db.StoreChirp(entities.Chirp{AuthorID: 1, Body: "I'm the one who knocks!"})
+	assert.NoError(t, err)
+
+	file := &shortFile{File: db.wal.file.(*os.File), fail: true}
+	db.wal.file = file
+	_, err = db.StoreChirp(entities.Chirp{AuthorID: 1, Body: "Gale!"})
+	assert.Error(t, err)
+
+	third, err := db.StoreChirp(entities.Chirp{AuthorID: 1, Body: "Cmon Pinkman"})
+	assert.NoError(t, err)
+
+	// crash without Close, the failed write must not hide the one after it
+	recovered, err := NewDB(dir)
+	assert.NoError(t, err)
+	chirps, err := recovered.GetChirpsSlice()
+	assert.NoError(t, err)
+	assert.Equal(t, []entities.Chirp{first, third}, chirps)
+}
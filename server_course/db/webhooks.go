@@ -0,0 +1,329 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"server_course/entities"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (q WebhookEventQuery) matches(e entities.WebhookEvent) bool {
+	if q.Status != "" && e.Status != q.Status {
+		return false
+	}
+	if q.After != 0 && e.ID >= q.After {
+		return false
+	}
+	if q.Before != 0 && e.ID <= q.Before {
+		return false
+	}
+	return true
+}
+
+// claimWebhookEvent has to be called holding the write lock.
+func (db *DB) claimWebhookEvent(e entities.WebhookEvent) (entities.WebhookEvent, error) {
+	e.Status = entities.WebhookReceived
+	e.Error = ""
+	e.Attempts++
+	e.ClaimedAt = time.Now().UTC()
+	e.ProcessedAt = nil
+	if err := db.put("webhook_events", e.ID, e); err != nil {
+		return entities.WebhookEvent{}, err
+	}
+	db.store.WebhookEvents[e.ID] = e
+
+	return e, nil
+}
+
+func (db *DB) ReceiveWebhookEvent(e entities.WebhookEvent) (entities.WebhookEvent, bool, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	for _, existing := range db.store.WebhookEvents {
+		if existing.EventID != e.EventID {
+			continue
+		}
+		if !existing.Claimable(time.Now()) {
+			return existing, false, nil
+		}
+		claimed, err := db.claimWebhookEvent(existing)
+		return claimed, err == nil, err
+	}
+
+	e.ID = db.store.WebhookEventIndex
+	e.Status = entities.WebhookReceived
+	e.Error = ""
+	e.Attempts = 1
+	e.ReceivedAt = time.Now().UTC()
+	e.ClaimedAt = e.ReceivedAt
+	e.ProcessedAt = nil
+	if err := db.put("webhook_events", e.ID, e); err != nil {
+		return entities.WebhookEvent{}, false, err
+	}
+	db.store.WebhookEvents[e.ID] = e
+	db.store.WebhookEventIndex++
+
+	return e, true, nil
+}
+
+func (db *DB) ReplayWebhookEvent(id int) (entities.WebhookEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	e, exists := db.store.WebhookEvents[id]
+	if !exists {
+		return entities.WebhookEvent{}, ErrDoesNotExist
+	}
+	return db.claimWebhookEvent(e)
+}
+
+func (db *DB) FinishWebhookEvent(id int, status, errMsg string) (entities.WebhookEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	e, exists := db.store.WebhookEvents[id]
+	if !exists {
+		return entities.WebhookEvent{}, ErrDoesNotExist
+	}
+
+	now := time.Now().UTC()
+	e.Status = status
+	e.Error = errMsg
+	e.ProcessedAt = &now
+	if err := db.put("webhook_events", e.ID, e); err != nil {
+		return entities.WebhookEvent{}, err
+	}
+	db.store.WebhookEvents[e.ID] = e
+
+	return e, nil
+}
+
+func (db *DB) ProcessWebhookEvent(id, userID int, update func(s *entities.Subscription) error) (entities.WebhookEvent, entities.Subscription, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	e, exists := db.store.WebhookEvents[id]
+	if !exists {
+		return entities.WebhookEvent{}, entities.Subscription{}, ErrDoesNotExist
+	}
+
+	now := time.Now().UTC()
+	b := &batch{}
+	s, err := db.updateSubscription(b, userID, update, now)
+	if err != nil {
+		return entities.WebhookEvent{}, entities.Subscription{}, err
+	}
+	e.Status = entities.WebhookProcessed
+	e.Error = ""
+	e.ProcessedAt = &now
+	if err := b.put("webhook_events", e.ID, e, func() { db.store.WebhookEvents[e.ID] = e }); err != nil {
+		return entities.WebhookEvent{}, entities.Subscription{}, err
+	}
+	if err := db.commitBatch(b); err != nil {
+		return entities.WebhookEvent{}, entities.Subscription{}, err
+	}
+
+	return e, s, nil
+}
+
+func (db *DB) GetWebhookEvent(id int) (entities.WebhookEvent, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	e, exists := db.store.WebhookEvents[id]
+	if !exists {
+		return entities.WebhookEvent{}, ErrDoesNotExist
+	}
+	return e, nil
+}
+
+func (db *DB) ListWebhookEvents(q WebhookEventQuery) (WebhookEventPage, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	events := []entities.WebhookEvent{}
+	for _, e := range db.store.WebhookEvents {
+		if q.matches(e) {
+			events = append(events, e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if q.Before != 0 {
+			return events[i].ID < events[j].ID
+		}
+		return events[i].ID > events[j].ID
+	})
+
+	page := WebhookEventPage{Events: events}
+	if q.Limit > 0 && len(events) > q.Limit {
+		page.Events = events[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Events)
+	}
+
+	return page, nil
+}
+
+const webhookEventColumns = "id, event_id, event, payload, status, error, attempts, received_at, claimed_at, processed_at"
+
+func scanWebhookEvent(row scanner) (entities.WebhookEvent, error) {
+	var e entities.WebhookEvent
+	var payload string
+	var receivedAt, claimedAt int64
+	var processedAt sql.NullInt64
+	err := row.Scan(&e.ID, &e.EventID, &e.Event, &payload, &e.Status, &e.Error, &e.Attempts, &receivedAt, &claimedAt, &processedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.WebhookEvent{}, ErrDoesNotExist
+	}
+	e.Payload = []byte(payload)
+	e.ReceivedAt = time.Unix(0, receivedAt).UTC()
+	e.ClaimedAt = time.Unix(0, claimedAt).UTC()
+	if processedAt.Valid {
+		processed := time.Unix(0, processedAt.Int64).UTC()
+		e.ProcessedAt = &processed
+	}
+	return e, err
+}
+
+func claimWebhookEvent(tx *sql.Tx, id int) (entities.WebhookEvent, error) {
+	return scanWebhookEvent(tx.QueryRow(
+		"UPDATE webhook_events SET status = ?, error = '', attempts = attempts + 1, claimed_at = ?, processed_at = NULL WHERE id = ? RETURNING "+webhookEventColumns,
+		entities.WebhookReceived, time.Now().UnixNano(), id,
+	))
+}
+
+func (db *SQLiteDB) ReceiveWebhookEvent(e entities.WebhookEvent) (entities.WebhookEvent, bool, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.WebhookEvent{}, false, err
+	}
+	defer tx.Rollback()
+
+	existing, err := scanWebhookEvent(tx.QueryRow("SELECT "+webhookEventColumns+" FROM webhook_events WHERE event_id = ?", e.EventID))
+	switch {
+	case err == nil && !existing.Claimable(time.Now()):
+		return existing, false, nil
+	case err == nil:
+		e, err = claimWebhookEvent(tx, existing.ID)
+	case errors.Is(err, ErrDoesNotExist):
+		now := time.Now().UnixNano()
+		e, err = scanWebhookEvent(tx.QueryRow(
+			"INSERT INTO webhook_events (event_id, event, payload, status, received_at, claimed_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING "+webhookEventColumns,
+			e.EventID, e.Event, string(e.Payload), entities.WebhookReceived, now, now,
+		))
+	}
+	if err != nil {
+		return entities.WebhookEvent{}, false, err
+	}
+
+	return e, true, tx.Commit()
+}
+
+func (db *SQLiteDB) ReplayWebhookEvent(id int) (entities.WebhookEvent, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.WebhookEvent{}, err
+	}
+	defer tx.Rollback()
+
+	e, err := claimWebhookEvent(tx, id)
+	if err != nil {
+		return entities.WebhookEvent{}, err
+	}
+	return e, tx.Commit()
+}
+
+func (db *SQLiteDB) FinishWebhookEvent(id int, status, errMsg string) (entities.WebhookEvent, error) {
+	return scanWebhookEvent(db.sql.QueryRow(
+		"UPDATE webhook_events SET status = ?, error = ?, processed_at = ? WHERE id = ? RETURNING "+webhookEventColumns,
+		status, errMsg, time.Now().UnixNano(), id,
+	))
+}
+
+func (db *SQLiteDB) ProcessWebhookEvent(id, userID int, update func(s *entities.Subscription) error) (entities.WebhookEvent, entities.Subscription, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return entities.WebhookEvent{}, entities.Subscription{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	s, err := updateSubscription(tx, userID, update, now)
+	if err != nil {
+		return entities.WebhookEvent{}, entities.Subscription{}, err
+	}
+	e, err := scanWebhookEvent(tx.QueryRow(
+		"UPDATE webhook_events SET status = ?, error = '', processed_at = ? WHERE id = ? RETURNING "+webhookEventColumns,
+		entities.WebhookProcessed, now.UnixNano(), id,
+	))
+	if err != nil {
+		return entities.WebhookEvent{}, entities.Subscription{}, err
+	}
+
+	return e, s, tx.Commit()
+}
+
+func (db *SQLiteDB) GetWebhookEvent(id int) (entities.WebhookEvent, error) {
+	return scanWebhookEvent(db.sql.QueryRow("SELECT "+webhookEventColumns+" FROM webhook_events WHERE id = ?", id))
+}
+
+func (db *SQLiteDB) ListWebhookEvents(q WebhookEventQuery) (WebhookEventPage, error) {
+	where := []string{"1 = 1"}
+	args := []any{}
+
+	if q.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, q.Status)
+	}
+
+	order := "DESC"
+	switch {
+	case q.After != 0:
+		where = append(where, "id < ?")
+		args = append(args, q.After)
+	case q.Before != 0:
+		where = append(where, "id > ?")
+		args = append(args, q.Before)
+		order = "ASC"
+	}
+
+	query := "SELECT " + webhookEventColumns + " FROM webhook_events WHERE " + strings.Join(where, " AND ") + " ORDER BY id " + order
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := db.sql.Query(query, args...)
+	if err != nil {
+		return WebhookEventPage{}, err
+	}
+	defer rows.Close()
+
+	events := []entities.WebhookEvent{}
+	for rows.Next() {
+		e, err := scanWebhookEvent(rows)
+		if err != nil {
+			return WebhookEventPage{}, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return WebhookEventPage{}, err
+	}
+
+	page := WebhookEventPage{Events: events}
+	if q.Limit > 0 && len(events) > q.Limit {
+		page.Events = events[:q.Limit]
+		page.HasMore = true
+	}
+	if q.Before != 0 {
+		slices.Reverse(page.Events)
+	}
+
+	return page, nil
+}
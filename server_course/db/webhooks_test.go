@@ -0,0 +1,120 @@
+package db
+
+import (
+	"encoding/json"
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_WebhookEvents(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			payload := json.RawMessage(`{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`)
+			e, created, err := store.ReceiveWebhookEvent(entities.WebhookEvent{EventID: "evt_1", Event: "user.upgraded", Payload: payload})
+			assert.NoError(t, err)
+			assert.True(t, created)
+			assert.Equal(t, entities.WebhookReceived, e.Status)
+			assert.Equal(t, 1, e.Attempts)
+			assert.Nil(t, e.ProcessedAt)
+
+			// a redelivery while or after processing is not claimed
+			again, created, err := store.ReceiveWebhookEvent(entities.WebhookEvent{EventID: "evt_1", Event: "user.upgraded", Payload: payload})
+			assert.NoError(t, err)
+			assert.False(t, created)
+			assert.Equal(t, e.ID, again.ID)
+
+			e, err = store.FinishWebhookEvent(e.ID, entities.WebhookFailed, "user does not exist")
+			assert.NoError(t, err)
+			assert.Equal(t, entities.WebhookFailed, e.Status)
+			assert.NotNil(t, e.ProcessedAt)
+
+			// one that failed is tried again
+			again, created, err = store.ReceiveWebhookEvent(entities.WebhookEvent{EventID: "evt_1", Event: "user.upgraded", Payload: payload})
+			assert.NoError(t, err)
+			assert.True(t, created)
+			assert.Equal(t, e.ID, again.ID)
+			assert.Equal(t, 2, again.Attempts)
+			assert.Equal(t, entities.WebhookReceived, again.Status)
+			assert.Empty(t, again.Error)
+			assert.JSONEq(t, string(payload), string(again.Payload))
+
+			_, err = store.FinishWebhookEvent(e.ID, entities.WebhookProcessed, "")
+			assert.NoError(t, err)
+			again, created, err = store.ReceiveWebhookEvent(entities.WebhookEvent{EventID: "evt_1", Event: "user.upgraded", Payload: payload})
+			assert.NoError(t, err)
+			assert.False(t, created)
+			assert.Equal(t, entities.WebhookProcessed, again.Status)
+
+			replayed, err := store.ReplayWebhookEvent(e.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, replayed.Attempts)
+			assert.Equal(t, entities.WebhookReceived, replayed.Status)
+			_, err = store.ReplayWebhookEvent(e.ID + 100)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			_, err = store.FinishWebhookEvent(e.ID+100, entities.WebhookProcessed, "")
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			other, _, err := store.ReceiveWebhookEvent(entities.WebhookEvent{EventID: "evt_2", Event: "user.downgraded", Payload: json.RawMessage(`{}`)})
+			assert.NoError(t, err)
+			_, err = store.FinishWebhookEvent(other.ID, entities.WebhookIgnored, "")
+			assert.NoError(t, err)
+
+			got, err := store.GetWebhookEvent(other.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, "evt_2", got.EventID)
+
+			page, err := store.ListWebhookEvents(WebhookEventQuery{})
+			assert.NoError(t, err)
+			assert.Len(t, page.Events, 2)
+			assert.Equal(t, "evt_2", page.Events[0].EventID)
+
+			page, err = store.ListWebhookEvents(WebhookEventQuery{Status: entities.WebhookReceived})
+			assert.NoError(t, err)
+			assert.Len(t, page.Events, 1)
+			assert.Equal(t, "evt_1", page.Events[0].EventID)
+		})
+	}
+}
+
+func TestStore_ProcessWebhookEvent(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.StoreUser(entities.User{Email: "red@x.com", Password: "pw"})
+			assert.NoError(t, err)
+			e, _, err := store.ReceiveWebhookEvent(entities.WebhookEvent{EventID: "evt_1", Event: "user.upgraded", Payload: json.RawMessage(`{}`)})
+			assert.NoError(t, err)
+
+			// a change that fails records nothing
+			_, _, err = store.ProcessWebhookEvent(e.ID, user.ID+100, func(s *entities.Subscription) error { return nil })
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+			_, _, err = store.ProcessWebhookEvent(e.ID, user.ID, func(s *entities.Subscription) error {
+				s.Start(entities.PlanRed, time.Time{}, time.Now())
+				return assert.AnError
+			})
+			assert.ErrorIs(t, err, assert.AnError)
+			got, err := store.GetWebhookEvent(e.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, entities.WebhookReceived, got.Status)
+			_, err = store.GetSubscription(user.ID)
+			assert.ErrorIs(t, err, ErrDoesNotExist)
+
+			processed, s, err := store.ProcessWebhookEvent(e.ID, user.ID, func(s *entities.Subscription) error {
+				s.Start(entities.PlanRed, time.Time{}, time.Now())
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, entities.WebhookProcessed, processed.Status)
+			assert.NotNil(t, processed.ProcessedAt)
+			assert.Equal(t, entities.PlanRed, s.Plan)
+			got, err = store.GetWebhookEvent(e.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, processed.Status, got.Status)
+			user, err = store.GetUser(user.ID)
+			assert.NoError(t, err)
+			assert.True(t, user.IsChirpyRed)
+		})
+	}
+}
@@ -1,28 +1,43 @@
 package entities
 
-import (
-	"context"
-	"regexp"
-)
+import "time"
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
+	ID        int       `json:"id"`
+	AuthorID  int       `json:"author_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// InReplyTo is the id of the chirp this one answers, 0 if it starts a thread.
+	InReplyTo    int  `json:"in_reply_to,omitempty"`
+	ReplyCount   int  `json:"reply_count"`
+	LikeCount    int  `json:"like_count"`
+	RechirpCount int  `json:"rechirp_count"`
+	Deleted      bool `json:"deleted,omitempty"`
+	// Hidden chirps were hidden by an admin and are only shown in threads,
+	// without their body.
+	Hidden bool `json:"hidden,omitempty"`
+	// Hashtags and Mentions are parsed from the body whenever it is written.
+	Hashtags []string  `json:"hashtags,omitempty"`
+	Mentions []Mention `json:"mentions,omitempty"`
 }
 
-var profaneWords = []string{"kerfuffle", "sharbert", "fornax"}
-
-func (c *Chirp) Valid(ctx context.Context) map[string]string {
-	problems := make(map[string]string)
-	if len(c.Body) > 140 {
-		problems["too long"] = "message can only be up to and including 140 chars"
-	}
+// Engagement records a user liking or rechirping a chirp.
+type Engagement struct {
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
 
-	for _, profaneWord := range profaneWords {
-		r := regexp.MustCompile("(?i)" + profaneWord)
-		c.Body = r.ReplaceAllString(c.Body, "****")
-	}
+// ChirpRevision is one body a chirp had, valid from CreatedAt until the next
+// revision.
+type ChirpRevision struct {
+	ChirpID   int       `json:"chirp_id"`
+	Revision  int       `json:"revision"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
 
-	return problems
+// Visible reports whether the chirp may be shown on its own.
+func (c *Chirp) Visible() bool {
+	return !c.Deleted && !c.Hidden
 }
@@ -0,0 +1,27 @@
+package entities
+
+import "time"
+
+const (
+	EmailTokenVerify = "verify_email"
+	EmailTokenReset  = "reset_password"
+)
+
+// EmailToken is a single use token mailed to a user to prove they own the
+// address. Only its hash is kept.
+type EmailToken struct {
+	ID     int `json:"id"`
+	UserID int `json:"user_id"`
+	// Email is the address the token was mailed to, it only works as long
+	// as the user still has it.
+	Email     string     `json:"email"`
+	Purpose   string     `json:"purpose"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+func (t *EmailToken) Usable(now time.Time) bool {
+	return t.UsedAt == nil && now.Before(t.ExpiresAt)
+}
@@ -0,0 +1,22 @@
+package entities
+
+import "time"
+
+const (
+	NotificationMention = "mention"
+	NotificationReply   = "reply"
+	NotificationFollow  = "follow"
+	NotificationLike    = "like"
+	NotificationRechirp = "rechirp"
+)
+
+// Notification tells UserID that ActorID did something involving them.
+type Notification struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Kind      string    `json:"kind"`
+	ActorID   int       `json:"actor_id"`
+	ChirpID   int       `json:"chirp_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
@@ -0,0 +1,172 @@
+package entities
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const (
+	HookChirpCreated   = "chirp.created"
+	HookChirpUpdated   = "chirp.updated"
+	HookChirpDeleted   = "chirp.deleted"
+	HookUserUpgraded   = "user.upgraded"
+	HookUserDowngraded = "user.downgraded"
+)
+
+// hookEvents maps every event to whether it only goes to its own user and to
+// billing managers.
+var hookEvents = map[string]bool{
+	HookChirpCreated:   false,
+	HookChirpUpdated:   false,
+	HookChirpDeleted:   false,
+	HookUserUpgraded:   true,
+	HookUserDowngraded: true,
+}
+
+func ValidHookEvent(event string) bool {
+	_, known := hookEvents[event]
+	return known
+}
+
+func PrivateHookEvent(event string) bool {
+	return hookEvents[event]
+}
+
+const (
+	MaxWebhookSubscriptions = 10
+	maxWebhookURLLength     = 2000
+)
+
+type WebhookSubscription struct {
+	ID     int      `json:"id"`
+	UserID int      `json:"user_id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret is only shown on creation, responses use Public
+	Secret    string    `json:"secret"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type PublicWebhookSubscription struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s *WebhookSubscription) Public() PublicWebhookSubscription {
+	return PublicWebhookSubscription{
+		ID:        s.ID,
+		UserID:    s.UserID,
+		URL:       s.URL,
+		Events:    s.Events,
+		Active:    s.Active,
+		CreatedAt: s.CreatedAt,
+		UpdatedAt: s.UpdatedAt,
+	}
+}
+
+func (s *WebhookSubscription) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+	if len(s.URL) > maxWebhookURLLength {
+		problems["url"] = "url can only be up to and including 2000 chars"
+	} else if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems["url"] = "url has to be an absolute http or https url"
+	}
+	if len(s.Events) == 0 {
+		problems["events"] = "events has to name at least one event"
+	}
+	for _, event := range s.Events {
+		if !ValidHookEvent(event) {
+			problems["events"] = "unknown event " + event
+			break
+		}
+	}
+
+	return problems
+}
+
+func (s *WebhookSubscription) Wants(event string) bool {
+	return s.Active && slices.Contains(s.Events, event)
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+const (
+	MaxDeliveryAttempts = 8
+	deliveryBackoff     = 30 * time.Second
+	maxDeliveryBackoff  = 6 * time.Hour
+)
+
+// DeliveryBackoff doubles with every failed attempt up to maxDeliveryBackoff.
+func DeliveryBackoff(attempt int) time.Duration {
+	backoff := deliveryBackoff
+	for i := 1; i < attempt && backoff < maxDeliveryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxDeliveryBackoff)
+}
+
+type WebhookDelivery struct {
+	ID             int `json:"id"`
+	SubscriptionID int `json:"subscription_id"`
+	// EventID is shared by all deliveries of an event, for dropping duplicates
+	EventID       string          `json:"event_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastAttemptAt *time.Time      `json:"last_attempt_at,omitempty"`
+	ResponseCode  int             `json:"response_code,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+}
+
+func (d *WebhookDelivery) Succeeded(code int, now time.Time) {
+	d.Attempts++
+	d.Status = DeliveryDelivered
+	d.LastAttemptAt = &now
+	d.ResponseCode = code
+	d.Error = ""
+	d.DeliveredAt = &now
+}
+
+func (d *WebhookDelivery) Failed(code int, errMsg string, now time.Time) {
+	d.Attempts++
+	d.LastAttemptAt = &now
+	d.ResponseCode = code
+	d.Error = errMsg
+	if d.Attempts >= MaxDeliveryAttempts {
+		d.Status = DeliveryDead
+		return
+	}
+	d.NextAttemptAt = now.Add(DeliveryBackoff(d.Attempts))
+}
+
+func (d *WebhookDelivery) Abandon(errMsg string) {
+	d.Status = DeliveryDead
+	d.Error = errMsg
+}
+
+func (d *WebhookDelivery) Retry(now time.Time) {
+	d.Status = DeliveryPending
+	d.Attempts = 0
+	d.NextAttemptAt = now
+	d.ResponseCode = 0
+	d.Error = ""
+	d.DeliveredAt = nil
+}
@@ -0,0 +1,63 @@
+package entities
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	ReportTargetChirp = "chirp"
+	ReportTargetUser  = "user"
+
+	ReportOpen     = "open"
+	ReportResolved = "resolved"
+)
+
+// Report asks the admins to look at a chirp or a user. Reports filed by the
+// moderation rules have no reporter.
+type Report struct {
+	ID         int        `json:"id"`
+	ReporterID int        `json:"reporter_id,omitempty"`
+	TargetType string     `json:"target_type"`
+	TargetID   int        `json:"target_id"`
+	Reason     string     `json:"reason"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Resolution string     `json:"resolution,omitempty"`
+	ResolvedBy int        `json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+func (r *Report) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+	if r.TargetType != ReportTargetChirp && r.TargetType != ReportTargetUser {
+		problems["target_type"] = "target_type has to be chirp or user"
+	}
+	if r.TargetID <= 0 {
+		problems["target_id"] = "target_id has to be set"
+	}
+	if len(r.Reason) > 500 {
+		problems["reason"] = "reason can only be up to and including 500 chars"
+	}
+
+	return problems
+}
+
+const (
+	ModerationApprove = "approve"
+	ModerationHide    = "hide"
+	ModerationDelete  = "delete"
+	ModerationSuspend = "suspend"
+)
+
+// ModerationAction is one entry of the log of what admins did.
+type ModerationAction struct {
+	ID         int       `json:"id"`
+	AdminID    int       `json:"admin_id"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"target_type"`
+	TargetID   int       `json:"target_id"`
+	ReportID   int       `json:"report_id,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
@@ -0,0 +1,46 @@
+package entities
+
+import "slices"
+
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+// Permission is something only some roles are allowed to do.
+type Permission string
+
+const (
+	PermModerate       Permission = "moderate"
+	PermViewMetrics    Permission = "view_metrics"
+	PermReset          Permission = "reset"
+	PermManageRoles    Permission = "manage_roles"
+	PermManageAccounts Permission = "manage_accounts"
+	PermManageBilling  Permission = "manage_billing"
+	PermManageWebhooks Permission = "manage_webhooks"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:     {PermModerate, PermViewMetrics, PermReset, PermManageRoles, PermManageAccounts, PermManageBilling, PermManageWebhooks},
+	RoleModerator: {PermModerate},
+}
+
+func ValidRole(role string) bool {
+	_, known := rolePermissions[role]
+	return known
+}
+
+// RolesAllow reports whether any of roles grants p. Unknown roles grant
+// nothing.
+func RolesAllow(roles []string, p Permission) bool {
+	for _, role := range roles {
+		if slices.Contains(rolePermissions[role], p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) Can(p Permission) bool {
+	return RolesAllow(u.Roles, p)
+}
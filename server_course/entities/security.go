@@ -0,0 +1,86 @@
+package entities
+
+import "time"
+
+const (
+	SecurityLoginFailed     = "login_failed"
+	SecurityTwoFactorFailed = "two_factor_failed"
+	SecurityAccountLocked   = "account_locked"
+	SecurityAccountUnlocked = "account_unlocked"
+)
+
+type SecurityEvent struct {
+	ID int `json:"id"`
+	// UserID is 0 if no user could be told
+	UserID    int       `json:"user_id,omitempty"`
+	Type      string    `json:"type"`
+	IP        string    `json:"ip,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	ForgetLoginFailuresAfter = 24 * time.Hour
+	KeepSecurityEventsFor    = 90 * 24 * time.Hour
+)
+
+type LoginThrottle struct {
+	ID           int       `json:"id"`
+	Key          string    `json:"key"`
+	Failures     int       `json:"failures"`
+	LastFailedAt time.Time `json:"last_failed_at"`
+}
+
+// ThrottlePolicy doubles the wait with every failure past FreeFailures up to
+// MaxDelay and locks for LockoutFor from LockoutAfter failures on.
+type ThrottlePolicy struct {
+	FreeFailures int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	// LockoutAfter is 0 if the policy never locks
+	LockoutAfter int
+	LockoutFor   time.Duration
+}
+
+var (
+	AccountThrottle = ThrottlePolicy{
+		FreeFailures: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: 10,
+		LockoutFor:   time.Hour,
+	}
+	// IPThrottle never locks, many users may share an address
+	IPThrottle = ThrottlePolicy{
+		FreeFailures: 10,
+		BaseDelay:    time.Second,
+		MaxDelay:     15 * time.Minute,
+	}
+	// TwoFactorThrottle gives a logged in user as many tries at a code as a
+	// login challenge, then makes them wait as long as a challenge lives.
+	TwoFactorThrottle = ThrottlePolicy{
+		FreeFailures: MaxChallengeAttempts,
+		BaseDelay:    5 * time.Minute,
+		MaxDelay:     5 * time.Minute,
+	}
+)
+
+func (p ThrottlePolicy) Locked(t LoginThrottle) bool {
+	return p.LockoutAfter > 0 && t.Failures >= p.LockoutAfter
+}
+
+func (p ThrottlePolicy) BlockedUntil(t LoginThrottle) time.Time {
+	if p.Locked(t) {
+		return t.LastFailedAt.Add(p.LockoutFor)
+	}
+	if t.Failures < p.FreeFailures {
+		return time.Time{}
+	}
+
+	delay := p.MaxDelay
+	// the shift overflows long before that many failures
+	if shift := t.Failures - p.FreeFailures; shift < 32 {
+		delay = min(p.BaseDelay<<shift, p.MaxDelay)
+	}
+	return t.LastFailedAt.Add(delay)
+}
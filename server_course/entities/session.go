@@ -0,0 +1,42 @@
+package entities
+
+import "time"
+
+// Session is one device a user is logged in on. It lives as long as its
+// refresh tokens keep being rotated before ExpiresAt and nobody revokes it.
+type Session struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Device     string     `json:"device"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// SessionToken is a refresh token handed out for a session. Only its hash is
+// kept, and a token stays around once used so reusing it can be told apart
+// from a token that never existed. It also remembers the access token issued
+// along with it, which is revoked together with the session.
+type SessionToken struct {
+	ID              int        `json:"id"`
+	SessionID       int        `json:"session_id"`
+	Hash            string     `json:"hash"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UsedAt          *time.Time `json:"used_at,omitempty"`
+	AccessTokenID   string     `json:"access_token_id,omitempty"`
+	AccessExpiresAt time.Time  `json:"access_expires_at"`
+}
+
+// RevokedToken is an access token that must not be accepted anymore. It only
+// has to be remembered until the token expires on its own.
+type RevokedToken struct {
+	ID        int       `json:"id"`
+	TokenID   string    `json:"jti"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -0,0 +1,151 @@
+package entities
+
+import "time"
+
+const (
+	PlanFree = "free"
+	PlanRed  = "red"
+)
+
+const (
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionCanceled = "canceled"
+	SubscriptionExpired  = "expired"
+)
+
+const (
+	// DefaultBillingPeriod is used when Polka sends no period end
+	DefaultBillingPeriod = 30 * 24 * time.Hour
+	PaymentGracePeriod   = 7 * 24 * time.Hour
+	RenewalGracePeriod   = 3 * 24 * time.Hour
+)
+
+// Entitlements is what a plan unlocks, handlers check these and not plans.
+type Entitlements struct {
+	Plan string `json:"plan"`
+	// MaxChirpLength is 0 if the limit of the moderation config applies
+	MaxChirpLength  int  `json:"max_chirp_length,omitempty"`
+	EditChirps      bool `json:"edit_chirps"`
+	ChirpsPerMinute int  `json:"chirps_per_minute"`
+}
+
+var plans = map[string]Entitlements{
+	PlanFree: {Plan: PlanFree, ChirpsPerMinute: 30},
+	PlanRed:  {Plan: PlanRed, MaxChirpLength: 280, EditChirps: true, ChirpsPerMinute: 120},
+}
+
+func Plans() []string {
+	names := make([]string, 0, len(plans))
+	for name := range plans {
+		names = append(names, name)
+	}
+	return names
+}
+
+func ValidPlan(plan string) bool {
+	_, known := plans[plan]
+	return known && plan != PlanFree
+}
+
+func PlanEntitlements(plan string) Entitlements {
+	if e, known := plans[plan]; known {
+		return e
+	}
+	return plans[PlanFree]
+}
+
+type Subscription struct {
+	UserID    int       `json:"user_id"`
+	Plan      string    `json:"plan"`
+	Status    string    `json:"status"`
+	StartedAt time.Time `json:"started_at"`
+	// PeriodEnd is zero for subscriptions from before periods were tracked
+	PeriodEnd  time.Time  `json:"period_end,omitempty"`
+	GraceUntil *time.Time `json:"grace_until,omitempty"`
+	CanceledAt *time.Time `json:"canceled_at,omitempty"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func (s *Subscription) Paid(now time.Time) bool {
+	switch s.Status {
+	case SubscriptionActive:
+		return s.PeriodEnd.IsZero() || now.Before(s.PeriodEnd.Add(RenewalGracePeriod))
+	case SubscriptionPastDue:
+		return s.GraceUntil != nil && now.Before(*s.GraceUntil)
+	case SubscriptionCanceled:
+		return now.Before(s.PeriodEnd)
+	default:
+		return false
+	}
+}
+
+func (s *Subscription) Entitlements(now time.Time) Entitlements {
+	if !s.Paid(now) {
+		return PlanEntitlements(PlanFree)
+	}
+	return PlanEntitlements(s.Plan)
+}
+
+func periodEnd(reported, start time.Time) time.Time {
+	if !reported.IsZero() {
+		return reported.UTC()
+	}
+	return start.Add(DefaultBillingPeriod)
+}
+
+func (s *Subscription) Start(plan string, reportedEnd, now time.Time) {
+	if !s.Paid(now) || s.StartedAt.IsZero() {
+		s.StartedAt = now
+	}
+	s.Plan = plan
+	s.Status = SubscriptionActive
+	s.PeriodEnd = periodEnd(reportedEnd, now)
+	s.GraceUntil = nil
+	s.CanceledAt = nil
+	s.EndedAt = nil
+}
+
+// Renew continues from the paid period, or from now if it ran out.
+func (s *Subscription) Renew(reportedEnd, now time.Time) {
+	start := now
+	if s.Paid(now) && s.PeriodEnd.After(now) {
+		start = s.PeriodEnd
+	}
+	s.Status = SubscriptionActive
+	s.PeriodEnd = periodEnd(reportedEnd, start)
+	s.GraceUntil = nil
+	s.CanceledAt = nil
+	s.EndedAt = nil
+}
+
+// PaymentFailed does not extend the grace of a subscription past due.
+func (s *Subscription) PaymentFailed(now time.Time) {
+	if s.Status == SubscriptionPastDue {
+		return
+	}
+	grace := now.Add(PaymentGracePeriod)
+	s.Status = SubscriptionPastDue
+	s.GraceUntil = &grace
+}
+
+// Cancel keeps the plan until the paid period ends. Without a tracked period
+// it renews every DefaultBillingPeriod since it started.
+func (s *Subscription) Cancel(now time.Time) {
+	s.Status = SubscriptionCanceled
+	s.CanceledAt = &now
+	switch {
+	case s.PeriodEnd.IsZero() && !s.StartedAt.IsZero() && !s.StartedAt.After(now):
+		periods := now.Sub(s.StartedAt)/DefaultBillingPeriod + 1
+		s.PeriodEnd = s.StartedAt.Add(periods * DefaultBillingPeriod)
+	case s.PeriodEnd.IsZero() || s.PeriodEnd.Before(now):
+		s.PeriodEnd = now
+	}
+}
+
+func (s *Subscription) End(now time.Time) {
+	s.Status = SubscriptionExpired
+	s.GraceUntil = nil
+	s.EndedAt = &now
+}
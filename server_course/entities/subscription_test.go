@@ -0,0 +1,165 @@
+package entities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscription_Start(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	grace := now.Add(time.Hour)
+	tests := []struct {
+		name        string
+		sub         Subscription
+		reportedEnd time.Time
+		wantStarted time.Time
+		wantEnd     time.Time
+	}{
+		{
+			name:        "new",
+			sub:         Subscription{Plan: PlanFree},
+			wantStarted: now,
+			wantEnd:     now.Add(DefaultBillingPeriod),
+		},
+		{
+			name:        "reported end",
+			sub:         Subscription{Plan: PlanFree},
+			reportedEnd: now.Add(time.Hour),
+			wantStarted: now,
+			wantEnd:     now.Add(time.Hour),
+		},
+		{
+			name:        "paid keeps its start",
+			sub:         Subscription{Plan: PlanRed, Status: SubscriptionPastDue, StartedAt: now.Add(-time.Hour), GraceUntil: &grace},
+			wantStarted: now.Add(-time.Hour),
+			wantEnd:     now.Add(DefaultBillingPeriod),
+		},
+		{
+			name:        "lapsed starts over",
+			sub:         Subscription{Plan: PlanRed, Status: SubscriptionExpired, StartedAt: now.Add(-time.Hour), EndedAt: &now},
+			wantStarted: now,
+			wantEnd:     now.Add(DefaultBillingPeriod),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.sub
+			s.Start(PlanRed, tt.reportedEnd, now)
+			assert.Equal(t, PlanRed, s.Plan)
+			assert.Equal(t, SubscriptionActive, s.Status)
+			assert.Equal(t, tt.wantStarted, s.StartedAt)
+			assert.Equal(t, tt.wantEnd, s.PeriodEnd)
+			assert.Nil(t, s.GraceUntil)
+			assert.Nil(t, s.CanceledAt)
+			assert.Nil(t, s.EndedAt)
+		})
+	}
+}
+
+func TestSubscription_Renew(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		sub         Subscription
+		reportedEnd time.Time
+		wantEnd     time.Time
+	}{
+		{
+			name:    "early continues the period",
+			sub:     Subscription{Plan: PlanRed, Status: SubscriptionActive, PeriodEnd: now.Add(time.Hour)},
+			wantEnd: now.Add(time.Hour + DefaultBillingPeriod),
+		},
+		{
+			name:    "late within the grace starts now",
+			sub:     Subscription{Plan: PlanRed, Status: SubscriptionActive, PeriodEnd: now.Add(-time.Hour)},
+			wantEnd: now.Add(DefaultBillingPeriod),
+		},
+		{
+			name:    "after expiry starts now",
+			sub:     Subscription{Plan: PlanRed, Status: SubscriptionExpired, PeriodEnd: now.Add(time.Hour)},
+			wantEnd: now.Add(DefaultBillingPeriod),
+		},
+		{
+			name:        "reported end wins",
+			sub:         Subscription{Plan: PlanRed, Status: SubscriptionActive, PeriodEnd: now.Add(time.Hour)},
+			reportedEnd: now.Add(2 * time.Hour),
+			wantEnd:     now.Add(2 * time.Hour),
+		},
+		{
+			name:    "canceled is active again",
+			sub:     Subscription{Plan: PlanRed, Status: SubscriptionCanceled, PeriodEnd: now.Add(time.Hour), CanceledAt: &now},
+			wantEnd: now.Add(time.Hour + DefaultBillingPeriod),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.sub
+			s.Renew(tt.reportedEnd, now)
+			assert.Equal(t, SubscriptionActive, s.Status)
+			assert.Equal(t, tt.wantEnd, s.PeriodEnd)
+			assert.Nil(t, s.CanceledAt)
+			assert.True(t, s.Paid(now))
+		})
+	}
+}
+
+func TestSubscription_Cancel(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		sub      Subscription
+		wantEnd  time.Time
+		wantPaid bool
+	}{
+		{
+			name:     "runs until the period ends",
+			sub:      Subscription{Plan: PlanRed, Status: SubscriptionActive, PeriodEnd: now.Add(time.Hour)},
+			wantEnd:  now.Add(time.Hour),
+			wantPaid: true,
+		},
+		{
+			name:    "period over ends now",
+			sub:     Subscription{Plan: PlanRed, Status: SubscriptionActive, PeriodEnd: now.Add(-time.Hour)},
+			wantEnd: now,
+		},
+		{
+			name:     "without a period runs until the current one ends",
+			sub:      Subscription{Plan: PlanRed, Status: SubscriptionActive, StartedAt: now.Add(-DefaultBillingPeriod - time.Hour)},
+			wantEnd:  now.Add(DefaultBillingPeriod - time.Hour),
+			wantPaid: true,
+		},
+		{
+			name:    "without a period or start ends now",
+			sub:     Subscription{Plan: PlanRed, Status: SubscriptionActive},
+			wantEnd: now,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.sub
+			s.Cancel(now)
+			assert.Equal(t, SubscriptionCanceled, s.Status)
+			assert.Equal(t, &now, s.CanceledAt)
+			assert.Equal(t, tt.wantEnd, s.PeriodEnd)
+			assert.Equal(t, tt.wantPaid, s.Paid(now))
+			assert.False(t, s.Paid(s.PeriodEnd))
+		})
+	}
+}
+
+func TestSubscription_PaymentFailed(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := Subscription{Plan: PlanRed, Status: SubscriptionActive, PeriodEnd: now}
+
+	s.PaymentFailed(now)
+	assert.Equal(t, SubscriptionPastDue, s.Status)
+	assert.Equal(t, now.Add(PaymentGracePeriod), *s.GraceUntil)
+
+	// failing again does not extend the grace
+	s.PaymentFailed(now.Add(time.Hour))
+	assert.Equal(t, now.Add(PaymentGracePeriod), *s.GraceUntil)
+	assert.Equal(t, PlanRed, s.Entitlements(now.Add(PaymentGracePeriod-time.Second)).Plan)
+	assert.Equal(t, PlanFree, s.Entitlements(now.Add(PaymentGracePeriod)).Plan)
+}
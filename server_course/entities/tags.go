@@ -0,0 +1,67 @@
+package entities
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Mention is a @handle named in a chirp. UserID is the user that had the
+// handle when the chirp was written, 0 if nobody did.
+type Mention struct {
+	Handle string `json:"handle"`
+	UserID int    `json:"user_id,omitempty"`
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// NormalizeTag lowercases a hashtag or handle and drops its marker.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimLeft(tag, "#@"))
+}
+
+// ParseTags returns the distinct hashtags and mentioned handles in body in the
+// order they first appear, normalized by NormalizeTag. A marker only counts at
+// the start of a word so mail addresses are not taken for mentions.
+func ParseTags(body string) (hashtags, handles []string) {
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		marker := runes[i]
+		if marker != '#' && marker != '@' {
+			continue
+		}
+		if i > 0 && isTagRune(runes[i-1]) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(runes) && (isTagRune(runes[end]) ||
+			// handles are mail local parts which may hold dots and dashes
+			(marker == '@' && (runes[end] == '.' || runes[end] == '-') && end+1 < len(runes) && isTagRune(runes[end+1]))) {
+			end++
+		}
+		if end == i+1 {
+			continue
+		}
+
+		tag := NormalizeTag(string(runes[i:end]))
+		if marker == '#' {
+			hashtags = appendDistinct(hashtags, tag)
+		} else {
+			handles = appendDistinct(handles, tag)
+		}
+		i = end - 1
+	}
+
+	return hashtags, handles
+}
+
+func appendDistinct(tags []string, tag string) []string {
+	for _, t := range tags {
+		if t == tag {
+			return tags
+		}
+	}
+	return append(tags, tag)
+}
@@ -0,0 +1,46 @@
+package entities
+
+import "time"
+
+// MaxChallengeAttempts is how many wrong codes a login challenge takes before
+// the password has to be entered again.
+const MaxChallengeAttempts = 5
+
+// TOTP is the authenticator a user enrolled. It only guards logins once the
+// user confirmed it with a first code.
+type TOTP struct {
+	UserID    int    `json:"user_id"`
+	Secret    string `json:"secret"`
+	Confirmed bool   `json:"confirmed"`
+	// LastStep is the time step of the last accepted code, codes of it and
+	// earlier steps are not accepted again.
+	LastStep  int64     `json:"last_step"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RecoveryCode stands in for a TOTP code once, for users who lost their
+// authenticator. Only its hash is kept.
+type RecoveryCode struct {
+	ID     int        `json:"id"`
+	UserID int        `json:"user_id"`
+	Hash   string     `json:"hash"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+// LoginChallenge is handed out for a correct password when the user has two
+// factors, it is exchanged for tokens along with a code.
+type LoginChallenge struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	Attempts  int        `json:"attempts"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	// ExpiresInSeconds is what the login asked for its access token.
+	ExpiresInSeconds int `json:"expires_in_seconds,omitempty"`
+}
+
+func (c *LoginChallenge) Active(now time.Time) bool {
+	return c.UsedAt == nil && c.Attempts < MaxChallengeAttempts && now.Before(c.ExpiresAt)
+}
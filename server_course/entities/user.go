@@ -4,21 +4,57 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"net/mail"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	ID                      int    `json:"id"`
-	Email                   string `json:"email"`
-	Password                string `json:"password,omitempty"`
-	IsChirpyRed             bool   `json:"is_chirpy_red"`
+	ID          int      `json:"id"`
+	Email       string   `json:"email"`
+	Password    string   `json:"password,omitempty"`
+	IsChirpyRed bool     `json:"is_chirpy_red"`
+	Roles       []string `json:"roles,omitempty"`
+	Suspended   bool     `json:"suspended"`
+	// Verified is set once the user proved to own the email.
+	Verified bool `json:"verified"`
+	// TokenVersion is bumped to invalidate every access token of the user.
+	TokenVersion            int    `json:"token_version,omitempty"`
 	Token                   string `json:"token"`
 	ExpiresInSeconds        int    `json:"expires_in_seconds,omitempty"`
 	RefreshToken            string `json:"refresh_token"`
 	RefreshExpiresInSeconds int    `json:"refresh_expires_in_seconds,omitempty"`
 }
 
+// PublicUser is what other users get to see of a user.
+type PublicUser struct {
+	ID          int    `json:"id"`
+	Email       string `json:"email"`
+	Handle      string `json:"handle"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+}
+
+func (u *User) Public() PublicUser {
+	return PublicUser{
+		ID:          u.ID,
+		Email:       u.Email,
+		Handle:      u.Handle(),
+		IsChirpyRed: u.IsChirpyRed,
+	}
+}
+
+// Handle is what other users @mention this user by, the local part of the
+// email.
+func (u *User) Handle() string {
+	return EmailHandle(u.Email)
+}
+
+func EmailHandle(email string) string {
+	local, _, _ := strings.Cut(email, "@")
+	return strings.ToLower(local)
+}
+
 func (u *User) Valid(ctx context.Context) map[string]string {
 	problems := make(map[string]string)
 	if len(u.Email) > 100 {
@@ -26,6 +62,8 @@ func (u *User) Valid(ctx context.Context) map[string]string {
 	}
 	if u.Email == "" {
 		problems["no email"] = "no email set"
+	} else if addr, err := mail.ParseAddress(u.Email); err != nil || addr.Address != u.Email {
+		problems["bad email"] = "email has to be a plain address like walt@breakingbad.com"
 	}
 
 	return problems
@@ -48,6 +86,7 @@ func (u *User) MarshalJSONCustom() ([]byte, error) {
 	copyUser.Password = ""
 	copyUser.ExpiresInSeconds = 0
 	copyUser.RefreshExpiresInSeconds = 0
+	copyUser.TokenVersion = 0
 	return json.Marshal(copyUser)
 }
 
@@ -0,0 +1,39 @@
+package entities
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	WebhookReceived  = "received"
+	WebhookProcessed = "processed"
+	WebhookIgnored   = "ignored"
+	WebhookFailed    = "failed"
+)
+
+// WebhookClaimTimeout lets a redelivery take over an attempt that crashed.
+const WebhookClaimTimeout = 5 * time.Minute
+
+type WebhookEvent struct {
+	ID          int             `json:"id"`
+	EventID     string          `json:"event_id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ClaimedAt   time.Time       `json:"claimed_at"`
+	ProcessedAt *time.Time      `json:"processed_at,omitempty"`
+}
+
+func (e WebhookEvent) Claimable(now time.Time) bool {
+	switch e.Status {
+	case WebhookFailed:
+		return true
+	case WebhookReceived:
+		return now.Sub(e.ClaimedAt) > WebhookClaimTimeout
+	}
+	return false
+}
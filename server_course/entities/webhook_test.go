@@ -0,0 +1,28 @@
+package entities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookEvent_Claimable(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		event WebhookEvent
+		want  bool
+	}{
+		{"failed", WebhookEvent{Status: WebhookFailed, ClaimedAt: now}, true},
+		{"in flight", WebhookEvent{Status: WebhookReceived, ClaimedAt: now.Add(-time.Minute)}, false},
+		{"stalled", WebhookEvent{Status: WebhookReceived, ClaimedAt: now.Add(-WebhookClaimTimeout - time.Second)}, true},
+		{"processed", WebhookEvent{Status: WebhookProcessed, ClaimedAt: now.Add(-time.Hour)}, false},
+		{"ignored", WebhookEvent{Status: WebhookIgnored}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.event.Claimable(now))
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"fmt"
+	"log/slog"
+	"server_course/entities"
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	ChirpPosted    Kind = "chirp.posted"
+	ChirpLiked     Kind = "chirp.liked"
+	ChirpRechirped Kind = "chirp.rechirped"
+	UserFollowed   Kind = "user.followed"
+)
+
+// Event is something a user did. Chirp is set for the chirp events and UserID
+// for the ones aimed at another user.
+type Event struct {
+	Kind    Kind
+	ActorID int
+	Chirp   entities.Chirp
+	UserID  int
+	At      time.Time
+}
+
+// Handler reacts to an event. Errors are logged by the bus, they never fail
+// the request that published the event.
+type Handler func(e Event) error
+
+// Bus hands every published event to the handlers subscribed to its kind, in
+// the order they subscribed.
+type Bus struct {
+	logger   *slog.Logger
+	mux      sync.RWMutex
+	handlers map[Kind][]Handler
+}
+
+func NewBus(l *slog.Logger) *Bus {
+	return &Bus{
+		logger:   l.With("component", "events"),
+		handlers: make(map[Kind][]Handler),
+	}
+}
+
+func (b *Bus) Subscribe(kind Kind, h Handler) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.handlers[kind] = append(b.handlers[kind], h)
+}
+
+// Publish delivers e before returning so handlers see events in the order
+// they happened.
+func (b *Bus) Publish(e Event) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+
+	b.mux.RLock()
+	handlers := b.handlers[e.Kind]
+	b.mux.RUnlock()
+
+	for _, h := range handlers {
+		if err := b.deliver(h, e); err != nil {
+			b.logger.Error("failed to handle event", slog.String("kind", string(e.Kind)), slog.String("err", err.Error()))
+		}
+	}
+}
+
+func (b *Bus) deliver(h Handler, e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return h(e)
+}
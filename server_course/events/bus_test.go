@@ -0,0 +1,34 @@
+package events
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus_Publish(t *testing.T) {
+	bus := NewBus(slog.Default())
+
+	got := []string{}
+	bus.Subscribe(ChirpPosted, func(e Event) error {
+		got = append(got, "first")
+		return errors.New("broken handler")
+	})
+	bus.Subscribe(ChirpPosted, func(e Event) error {
+		panic("worse handler")
+	})
+	bus.Subscribe(ChirpPosted, func(e Event) error {
+		assert.False(t, e.At.IsZero())
+		got = append(got, "last")
+		return nil
+	})
+	bus.Subscribe(UserFollowed, func(e Event) error {
+		got = append(got, "follow")
+		return nil
+	})
+
+	bus.Publish(Event{Kind: ChirpPosted, ActorID: 1})
+	assert.Equal(t, []string{"first", "last"}, got)
+}
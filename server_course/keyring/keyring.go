@@ -0,0 +1,250 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+
+	rsaKeyBits = 2048
+)
+
+// Key is a private key tokens are signed with. Its public half stays around
+// for verification after a newer key took over.
+type Key struct {
+	ID        string
+	Algorithm string
+	Created   time.Time
+	signer    crypto.Signer
+}
+
+func (k Key) Method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+func (k Key) Public() crypto.PublicKey {
+	return k.signer.Public()
+}
+
+// Keyring holds the keys in a directory, one PEM file per key. The newest key
+// signs, all of them verify.
+type Keyring struct {
+	dir string
+	alg string
+
+	mux sync.RWMutex
+	// keys are sorted oldest first
+	keys []Key
+}
+
+// New loads the keys in dir and makes a key with alg if there is none. Keys
+// of the other algorithm keep verifying until they are rotated out.
+func New(dir, alg string) (*Keyring, error) {
+	if alg != AlgRS256 && alg != AlgEdDSA {
+		return nil, fmt.Errorf("unknown signing algorithm %q, expected %s or %s", alg, AlgRS256, AlgEdDSA)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{dir: dir, alg: alg}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		key, err := readKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %w", path, err)
+		}
+		k.keys = append(k.keys, key)
+	}
+	sort.Slice(k.keys, func(i, j int) bool { return k.keys[i].Created.Before(k.keys[j].Created) })
+
+	if len(k.keys) == 0 {
+		key, err := k.generate(time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, key)
+	}
+
+	return k, nil
+}
+
+// Current is the key new tokens are signed with.
+func (k *Keyring) Current() Key {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	return k.keys[len(k.keys)-1]
+}
+
+// Lookup finds a key that is still good for verifying.
+func (k *Keyring) Lookup(kid string) (Key, bool) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// Keys lists all keys, oldest first.
+func (k *Keyring) Keys() []Key {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	return append([]Key(nil), k.keys...)
+}
+
+// Sign signs claims with the current key and names it in the kid header.
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key := k.Current()
+
+	token := jwt.NewWithClaims(key.Method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signer)
+}
+
+// Keyfunc hands the public key named by a token's kid to the jwt parser.
+func (k *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.Lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("key %s is for %s, not %s", kid, key.Algorithm, token.Method.Alg())
+	}
+	return key.Public(), nil
+}
+
+// Rotate makes a new signing key once the current one is older than maxAge
+// or of another algorithm than configured, and drops keys that stopped
+// signing more than retain ago. retain has to outlast the tokens signed by a
+// key, otherwise they stop verifying early.
+func (k *Keyring) Rotate(now time.Time, maxAge, retain time.Duration) (rotated bool, dropped []Key, err error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	current := k.keys[len(k.keys)-1]
+	if now.Sub(current.Created) >= maxAge || current.Algorithm != k.alg {
+		key, err := k.generate(now)
+		if err != nil {
+			return false, nil, err
+		}
+		k.keys = append(k.keys, key)
+		rotated = true
+	}
+
+	// a key retires when the next one is made
+	kept := []Key{}
+	for i, key := range k.keys {
+		if i < len(k.keys)-1 && now.Sub(k.keys[i+1].Created) > retain {
+			if err := os.Remove(k.path(key.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return rotated, dropped, err
+			}
+			dropped = append(dropped, key)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	k.keys = kept
+
+	return rotated, dropped, nil
+}
+
+func (k *Keyring) path(kid string) string {
+	return filepath.Join(k.dir, kid+".pem")
+}
+
+// generate makes a key and writes it to disk, the caller adds it to keys.
+func (k *Keyring) generate(now time.Time) (Key, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Key{}, err
+	}
+
+	key := Key{ID: hex.EncodeToString(id), Algorithm: k.alg, Created: now.UTC()}
+	var err error
+	switch k.alg {
+	case AlgRS256:
+		key.signer, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgEdDSA:
+		_, key.signer, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key.signer)
+	if err != nil {
+		return Key{}, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{"Created": key.Created.Format(time.RFC3339Nano)},
+		Bytes:   der,
+	})
+
+	// a key that is only half written would keep the server from starting
+	tmp := k.path(key.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return Key{}, err
+	}
+	return key, os.Rename(tmp, k.path(key.ID))
+}
+
+func readKey(path string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return Key{}, errors.New("no PKCS8 private key in PEM")
+	}
+
+	key := Key{ID: strings.TrimSuffix(filepath.Base(path), ".pem")}
+	key.Created, err = time.Parse(time.RFC3339Nano, block.Headers["Created"])
+	if err != nil {
+		return Key{}, fmt.Errorf("bad Created header: %w", err)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return Key{}, err
+	}
+	switch parsed := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm, key.signer = AlgRS256, parsed
+	case ed25519.PrivateKey:
+		key.Algorithm, key.signer = AlgEdDSA, parsed
+	default:
+		return Key{}, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	return key, nil
+}
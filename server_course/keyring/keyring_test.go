@@ -0,0 +1,125 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyring_SignAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	k, err := New(dir, AlgEdDSA)
+	assert.NoError(t, err)
+	first := k.Current()
+	assert.Equal(t, AlgEdDSA, first.Algorithm)
+
+	signed, err := k.Sign(jwt.RegisteredClaims{Subject: "1"})
+	assert.NoError(t, err)
+
+	// a young key is kept
+	rotated, dropped, err := k.Rotate(first.Created.Add(time.Hour), 24*time.Hour, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, rotated)
+	assert.Empty(t, dropped)
+
+	now := first.Created.Add(25 * time.Hour)
+	rotated, dropped, err = k.Rotate(now, 24*time.Hour, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	assert.Empty(t, dropped)
+	assert.NotEqual(t, first.ID, k.Current().ID)
+
+	// tokens of the old key keep verifying, new ones name the new key
+	var claims jwt.RegisteredClaims
+	_, err = jwt.ParseWithClaims(signed, &claims, k.Keyfunc)
+	assert.NoError(t, err)
+	signed, err = k.Sign(jwt.RegisteredClaims{Subject: "1"})
+	assert.NoError(t, err)
+	token, err := jwt.ParseWithClaims(signed, &claims, k.Keyfunc)
+	assert.NoError(t, err)
+	assert.Equal(t, k.Current().ID, token.Header["kid"])
+
+	// a reloaded keyring knows both keys
+	reloaded, err := New(dir, AlgEdDSA)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{first.ID, k.Current().ID}, []string{reloaded.Keys()[0].ID, reloaded.Keys()[1].ID})
+	assert.Equal(t, k.Current().Created, reloaded.Current().Created)
+
+	_, dropped, err = k.Rotate(now.Add(2*time.Hour), 24*time.Hour, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{first.ID}, []string{dropped[0].ID})
+	_, ok := k.Lookup(first.ID)
+	assert.False(t, ok)
+	_, err = os.Stat(filepath.Join(dir, first.ID+".pem"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestKeyring_Keyfunc(t *testing.T) {
+	k, err := New(t.TempDir(), AlgRS256)
+	assert.NoError(t, err)
+
+	// the right key but another algorithm
+	token := jwt.NewWithClaims(jwt.SigningMethodRS512, jwt.RegisteredClaims{})
+	token.Header["kid"] = k.Current().ID
+	signed, err := token.SignedString(k.Current().signer)
+	assert.NoError(t, err)
+	_, err = jwt.Parse(signed, k.Keyfunc)
+	assert.Error(t, err)
+
+	// a shared secret never verifies
+	token = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{})
+	token.Header["kid"] = k.Current().ID
+	signed, err = token.SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	_, err = jwt.Parse(signed, k.Keyfunc)
+	assert.Error(t, err)
+
+	token = jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.RegisteredClaims{})
+	token.Header["kid"] = "unknown"
+	signed, err = token.SignedString(k.Current().signer)
+	assert.NoError(t, err)
+	_, err = jwt.Parse(signed, k.Keyfunc)
+	assert.Error(t, err)
+
+	_, err = New(t.TempDir(), "HS256")
+	assert.Error(t, err)
+}
+
+func TestKeyring_SwitchAlgorithm(t *testing.T) {
+	dir := t.TempDir()
+	rsaKeys, err := New(dir, AlgRS256)
+	assert.NoError(t, err)
+
+	k, err := New(dir, AlgEdDSA)
+	assert.NoError(t, err)
+	assert.Equal(t, AlgRS256, k.Current().Algorithm)
+	rotated, _, err := k.Rotate(time.Now(), 24*time.Hour, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	assert.Equal(t, AlgEdDSA, k.Current().Algorithm)
+
+	set := k.JWKS()
+	assert.Len(t, set.Keys, 2)
+	rsaJWK, edJWK := set.Keys[0], set.Keys[1]
+
+	public := rsaKeys.Current().Public().(*rsa.PublicKey)
+	assert.Equal(t, "RSA", rsaJWK.KeyType)
+	assert.Equal(t, rsaKeys.Current().ID, rsaJWK.ID)
+	n, err := base64.RawURLEncoding.DecodeString(rsaJWK.N)
+	assert.NoError(t, err)
+	assert.Equal(t, public.N, new(big.Int).SetBytes(n))
+	assert.Equal(t, "AQAB", rsaJWK.E)
+
+	assert.Equal(t, JWK{KeyType: "OKP", ID: k.Current().ID, Use: "sig", Algorithm: AlgEdDSA, Curve: "Ed25519", X: edJWK.X}, edJWK)
+	x, err := base64.RawURLEncoding.DecodeString(edJWK.X)
+	assert.NoError(t, err)
+	assert.Equal(t, k.Current().Public(), ed25519.PublicKey(x))
+}
@@ -0,0 +1,104 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. Sending may block, so callers should bound ctx.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// LogMailer logs who messages would go to instead of sending them. Bodies
+// carry tokens and are never logged, use FileMailer to read them.
+type LogMailer struct {
+	logger *slog.Logger
+}
+
+func NewLogMailer(l *slog.Logger) *LogMailer {
+	return &LogMailer{logger: l.With("component", "mail")}
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	m.logger.Info("sent mail", slog.String("to", msg.To), slog.String("subject", msg.Subject))
+	return nil
+}
+
+// FileMailer writes every message to its own file in a directory, so tests
+// and developers can pick up the tokens they contain.
+type FileMailer struct {
+	dir string
+
+	mux sync.Mutex
+	// sent numbers the files, it keeps them apart and in order
+	sent int
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.sent++
+	name := fmt.Sprintf("%d-%04d-%s.eml", time.Now().UnixNano(), m.sent, fileSafe(msg.To))
+	data := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", msg.To, msg.Subject, msg.Body)
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(data), 0o600)
+}
+
+// Messages reads back what was sent to to, oldest first.
+func (m *FileMailer) Messages(to string) ([]Message, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(m.dir, "*-"+fileSafe(to)+".eml"))
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := []Message{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		header, body, _ := strings.Cut(string(data), "\r\n\r\n")
+		msg := Message{To: to, Body: strings.TrimSuffix(body, "\r\n")}
+		for _, line := range strings.Split(header, "\r\n") {
+			if subject, found := strings.CutPrefix(line, "Subject: "); found {
+				msg.Subject = subject
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\*?[]`, r) || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, strings.ToLower(s))
+}
@@ -0,0 +1,32 @@
+package mail
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileMailer(t *testing.T) {
+	m, err := NewFileMailer(t.TempDir())
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	first := Message{To: "walt@breakingbad.com", Subject: "Verify", Body: "token abc"}
+	second := Message{To: "walt@breakingbad.com", Subject: "Reset", Body: "token def\r\nline two"}
+	assert.NoError(t, m.Send(ctx, first))
+	assert.NoError(t, m.Send(ctx, Message{To: "jesse@breakingbad.com", Subject: "Verify", Body: "token ghi"}))
+	assert.NoError(t, m.Send(ctx, second))
+
+	msgs, err := m.Messages("Walt@BreakingBad.com")
+	assert.NoError(t, err)
+	second.To = "Walt@BreakingBad.com"
+	first.To = "Walt@BreakingBad.com"
+	assert.Equal(t, []Message{first, second}, msgs)
+
+	// a crafted address stays inside the directory
+	assert.NoError(t, m.Send(ctx, Message{To: "../../escape", Subject: "x"}))
+	msgs, err = m.Messages("../../escape")
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+}
@@ -0,0 +1,104 @@
+package moderation
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	RuleWords  = "words"
+	RuleRegexp = "regex"
+	RuleLinks  = "links"
+	RuleRepeat = "repeat"
+)
+
+// RuleConfig describes one rule, which fields are used depends on Type.
+type RuleConfig struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Action Action `json:"action"`
+	// Words and the lines of WordsFile, relative to the config file, are
+	// used by words rules.
+	Words     []string `json:"words,omitempty"`
+	WordsFile string   `json:"words_file,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Domains   []string `json:"domains,omitempty"`
+	MaxRepeat int      `json:"max_repeat,omitempty"`
+}
+
+type Config struct {
+	MaxLength int          `json:"max_length"`
+	Rules     []RuleConfig `json:"rules"`
+}
+
+// DefaultConfig is what chirps were always checked against.
+func DefaultConfig() Config {
+	return Config{
+		MaxLength: 140,
+		Rules: []RuleConfig{{
+			Name:   "profanity",
+			Type:   RuleWords,
+			Action: ActionMask,
+			Words:  []string{"kerfuffle", "sharbert", "fornax"},
+		}},
+	}
+}
+
+// LoadConfig reads the config at path and the word files it names into the
+// rules. It returns every file read so they can be watched for changes.
+func LoadConfig(path string) (Config, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, nil, fmt.Errorf("can not decode %s: %w", path, err)
+	}
+
+	files := []string{path}
+	for i, rule := range cfg.Rules {
+		if rule.WordsFile == "" {
+			continue
+		}
+
+		wordsPath := rule.WordsFile
+		if !filepath.IsAbs(wordsPath) {
+			wordsPath = filepath.Join(filepath.Dir(path), wordsPath)
+		}
+		words, err := readWords(wordsPath)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		cfg.Rules[i].Words = append(rule.Words, words...)
+		files = append(files, wordsPath)
+	}
+
+	return cfg, files, nil
+}
+
+// readWords reads one word per line, skipping blank lines and # comments.
+func readWords(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	words := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words = append(words, word)
+	}
+
+	return words, scanner.Err()
+}
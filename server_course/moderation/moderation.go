@@ -0,0 +1,218 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Firing is a rule that matched.
+type Firing struct {
+	Rule    string   `json:"rule"`
+	Action  Action   `json:"action"`
+	Matches []string `json:"matches"`
+}
+
+// Report is the outcome of checking a text.
+type Report struct {
+	// Body is the text with everything masked that mask rules matched.
+	Body     string   `json:"cleaned_body"`
+	Rejected bool     `json:"rejected"`
+	Flagged  bool     `json:"flagged"`
+	Fired    []Firing `json:"rules"`
+	// Problems explains why the text is not acceptable, it is empty if it is.
+	Problems map[string]string `json:"-"`
+}
+
+// Pipeline runs the rules of a config. Every rule sees the original text, so
+// masks never trigger other rules.
+type Pipeline struct {
+	maxLength int
+	rules     []Rule
+}
+
+func Compile(cfg Config) (*Pipeline, error) {
+	if cfg.MaxLength <= 0 {
+		return nil, errors.New("max_length has to be positive")
+	}
+
+	p := &Pipeline{maxLength: cfg.MaxLength}
+	names := map[string]bool{}
+	for _, rc := range cfg.Rules {
+		if rc.Name == "" || names[rc.Name] {
+			return nil, fmt.Errorf("rule names have to be set and unique, got %q", rc.Name)
+		}
+		names[rc.Name] = true
+
+		switch rc.Action {
+		case ActionMask, ActionReject, ActionFlag:
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q", rc.Name, rc.Action)
+		}
+
+		base := ruleBase{name: rc.Name, action: rc.Action}
+		var rule Rule
+		var err error
+		switch rc.Type {
+		case RuleWords:
+			rule, err = newWordsRule(base, rc.Words)
+		case RuleRegexp:
+			rule, err = newRegexpRule(base, rc.Pattern)
+		case RuleLinks:
+			if len(rc.Domains) == 0 {
+				err = fmt.Errorf("rule %s has no domains", rc.Name)
+			}
+			rule = linksRule{ruleBase: base, domains: rc.Domains}
+		case RuleRepeat:
+			if rc.MaxRepeat <= 0 {
+				err = fmt.Errorf("rule %s: max_repeat has to be positive", rc.Name)
+			}
+			rule = repeatRule{ruleBase: base, max: rc.MaxRepeat}
+		default:
+			err = fmt.Errorf("rule %s: unknown type %q", rc.Name, rc.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, rule)
+	}
+
+	return p, nil
+}
+
+func (p *Pipeline) Check(text string) Report {
+	return p.CheckLength(text, 0)
+}
+
+// CheckLength keeps the limit of the config if it is higher.
+func (p *Pipeline) CheckLength(text string, maxLength int) Report {
+	maxLength = max(maxLength, p.maxLength)
+
+	report := Report{Body: text, Fired: []Firing{}, Problems: map[string]string{}}
+	if length(text) > maxLength {
+		report.Problems["too long"] = fmt.Sprintf("message can only be up to and including %d chars", maxLength)
+	}
+
+	masked := []span{}
+	for _, rule := range p.rules {
+		spans := rule.Match(text)
+		if len(spans) == 0 {
+			continue
+		}
+
+		firing := Firing{Rule: rule.Name(), Action: rule.Action(), Matches: make([]string, len(spans))}
+		for i, s := range spans {
+			firing.Matches[i] = text[s.start:s.end]
+		}
+		report.Fired = append(report.Fired, firing)
+
+		switch rule.Action() {
+		case ActionMask:
+			masked = append(masked, spans...)
+		case ActionReject:
+			report.Rejected = true
+			report.Problems["rule "+rule.Name()] = "message is not allowed"
+		case ActionFlag:
+			report.Flagged = true
+		}
+	}
+	report.Body = mask(text, masked)
+
+	return report
+}
+
+// Moderator checks texts against the pipeline of its config file, which can
+// be swapped while it is in use.
+type Moderator struct {
+	path     string
+	pipeline atomic.Pointer[Pipeline]
+
+	mux   sync.Mutex
+	files []string
+	stamp string
+}
+
+// NewModerator loads the config at path.
+func NewModerator(path string) (*Moderator, error) {
+	m := &Moderator{path: path}
+	return m, m.Reload()
+}
+
+func (m *Moderator) Check(text string) Report {
+	return m.pipeline.Load().Check(text)
+}
+
+func (m *Moderator) CheckLength(text string, maxLength int) Report {
+	return m.pipeline.Load().CheckLength(text, maxLength)
+}
+
+// Reload reads the config again. A config that does not load or compile is
+// reported and the current pipeline stays in place.
+func (m *Moderator) Reload() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.reload()
+}
+
+func (m *Moderator) reload() error {
+	cfg, files, err := LoadConfig(m.path)
+	if err != nil {
+		return err
+	}
+	p, err := Compile(cfg)
+	if err != nil {
+		return err
+	}
+
+	m.pipeline.Store(p)
+	m.files = files
+	m.stamp = stamp(files)
+	return nil
+}
+
+// stamp changes whenever one of files is changed, created or removed.
+func stamp(files []string) string {
+	s := ""
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			s += f + ":missing;"
+			continue
+		}
+		s += fmt.Sprintf("%s:%d:%d;", f, info.ModTime().UnixNano(), info.Size())
+	}
+	return s
+}
+
+// Watch reloads the config whenever its files change until ctx is done.
+func (m *Moderator) Watch(ctx context.Context, l *slog.Logger, interval time.Duration) {
+	logger := l.With("component", "moderation")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.mux.Lock()
+		if stamp(m.files) != m.stamp {
+			if err := m.reload(); err != nil {
+				// try again once the files change again
+				m.stamp = stamp(m.files)
+				logger.Error("failed to reload moderation config, keeping the old one", slog.String("err", err.Error()))
+			} else {
+				logger.Info("reloaded moderation config", slog.String("path", m.path))
+			}
+		}
+		m.mux.Unlock()
+	}
+}
@@ -0,0 +1,92 @@
+package moderation
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline_Check(t *testing.T) {
+	p, err := Compile(Config{
+		MaxLength: 20,
+		Rules: []RuleConfig{
+			{Name: "profanity", Type: RuleWords, Action: ActionMask, Words: []string{"kerfuffle", "sharbert"}},
+			{Name: "links", Type: RuleLinks, Action: ActionReject, Domains: []string{"evil.com"}},
+			{Name: "digits", Type: RuleRegexp, Action: ActionFlag, Pattern: `\d+`},
+			{Name: "spam", Type: RuleRepeat, Action: ActionFlag, MaxRepeat: 3},
+		},
+	})
+	assert.NoError(t, err)
+
+	report := p.Check("Kerfuffle! no kerfuffles")
+	assert.Equal(t, "****! no ****s", report.Body)
+	assert.Equal(t, []Firing{{Rule: "profanity", Action: ActionMask, Matches: []string{"Kerfuffle", "kerfuffle"}}}, report.Fired)
+	assert.Equal(t, map[string]string{"too long": "message can only be up to and including 20 chars"}, report.Problems)
+	assert.Empty(t, p.CheckLength("Kerfuffle! no kerfuffles", 30).Problems)
+	assert.Contains(t, p.CheckLength("Kerfuffle! no kerfuffles", 10).Problems, "too long")
+
+	report = p.Check("see www.EVIL.com/x")
+	assert.True(t, report.Rejected)
+	assert.Contains(t, report.Problems, "rule links")
+	assert.Empty(t, p.Check("see notevil.com").Fired)
+
+	report = p.Check("sooooo 42")
+	assert.False(t, report.Rejected)
+	assert.True(t, report.Flagged)
+	assert.Equal(t, []Firing{
+		{Rule: "digits", Action: ActionFlag, Matches: []string{"42"}},
+		{Rule: "spam", Action: ActionFlag, Matches: []string{"ooooo"}},
+	}, report.Fired)
+	assert.Empty(t, report.Problems)
+
+	for _, cfg := range []Config{
+		{MaxLength: 0},
+		{MaxLength: 1, Rules: []RuleConfig{{Name: "x", Type: RuleWords, Action: "ban", Words: []string{"x"}}}},
+		{MaxLength: 1, Rules: []RuleConfig{{Name: "x", Type: RuleRegexp, Action: ActionFlag, Pattern: "("}}},
+		{MaxLength: 1, Rules: []RuleConfig{{Name: "x", Type: "magic", Action: ActionFlag}}},
+	} {
+		_, err := Compile(cfg)
+		assert.Error(t, err)
+	}
+}
+
+func TestModerator_Watch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "moderation.json")
+	words := filepath.Join(dir, "words.txt")
+	assert.NoError(t, os.WriteFile(words, []byte("# comment\nfornax\n"), 0644))
+	assert.NoError(t, os.WriteFile(path, []byte(`{"max_length": 140, "rules": [{"name": "words", "type": "words", "action": "mask", "words_file": "words.txt"}]}`), 0644))
+
+	m, err := NewModerator(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "**** sharbert", m.Check("fornax sharbert").Body)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Watch(ctx, slog.Default(), 10*time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(words, []byte("fornax\nsharbert\n"), 0644))
+	assert.Eventually(t, func() bool {
+		return m.Check("fornax sharbert").Body == "**** ****"
+	}, time.Second, 10*time.Millisecond)
+
+	// a broken config keeps the last good one in place
+	assert.NoError(t, os.WriteFile(path, []byte(`{"max_length": -1`), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "**** ****", m.Check("fornax sharbert").Body)
+}
+
+func TestDefaultConfig(t *testing.T) {
+	p, err := Compile(DefaultConfig())
+	assert.NoError(t, err)
+
+	assert.Equal(t, "no ****s, ****, ****!", p.Check("no kerfuffles, Sharbert, FORNAX!").Body)
+	assert.Contains(t, p.Check(strings.Repeat("a", 141)).Problems, "too long")
+	assert.Empty(t, p.Check(strings.Repeat("a", 140)).Problems)
+}
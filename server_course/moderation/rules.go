@@ -0,0 +1,160 @@
+package moderation
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type Action string
+
+const (
+	// ActionMask replaces what matched with ****.
+	ActionMask Action = "mask"
+	// ActionReject refuses the chirp.
+	ActionReject Action = "reject"
+	// ActionFlag lets the chirp through but marks it for review.
+	ActionFlag Action = "flag"
+)
+
+// span is the byte range [start, end) of a match.
+type span struct {
+	start, end int
+}
+
+// Rule finds what it objects to in a text.
+type Rule interface {
+	Name() string
+	Action() Action
+	Match(text string) []span
+}
+
+type ruleBase struct {
+	name   string
+	action Action
+}
+
+func (r ruleBase) Name() string {
+	return r.name
+}
+
+func (r ruleBase) Action() Action {
+	return r.action
+}
+
+type regexpRule struct {
+	ruleBase
+	re *regexp.Regexp
+}
+
+func (r regexpRule) Match(text string) []span {
+	spans := []span{}
+	for _, loc := range r.re.FindAllStringIndex(text, -1) {
+		spans = append(spans, span{loc[0], loc[1]})
+	}
+	return spans
+}
+
+// newWordsRule matches any of words anywhere in the text, ignoring case, so
+// words inside longer words are caught as well.
+func newWordsRule(base ruleBase, words []string) (Rule, error) {
+	if len(words) == 0 {
+		return nil, fmt.Errorf("rule %s has no words", base.name)
+	}
+
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	re, err := regexp.Compile(`(?i)(?:` + strings.Join(quoted, "|") + `)`)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", base.name, err)
+	}
+	return regexpRule{ruleBase: base, re: re}, nil
+}
+
+func newRegexpRule(base ruleBase, pattern string) (Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", base.name, err)
+	}
+	return regexpRule{ruleBase: base, re: re}, nil
+}
+
+var linkPattern = regexp.MustCompile(`(?i)(?:https?://)?((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})(?::\d+)?(?:/\S*)?`)
+
+// linksRule matches links to any of domains or their subdomains.
+type linksRule struct {
+	ruleBase
+	domains []string
+}
+
+func (r linksRule) Match(text string) []span {
+	spans := []span{}
+	for _, loc := range linkPattern.FindAllStringSubmatchIndex(text, -1) {
+		host := strings.ToLower(text[loc[2]:loc[3]])
+		for _, domain := range r.domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				spans = append(spans, span{loc[0], loc[1]})
+				break
+			}
+		}
+	}
+	return spans
+}
+
+// repeatRule matches runs of more than max times the same character, like
+// "sooooooo" or "!!!!!!!!".
+type repeatRule struct {
+	ruleBase
+	max int
+}
+
+func (r repeatRule) Match(text string) []span {
+	spans := []span{}
+	start, count := 0, 0
+	var last rune
+	for i, c := range text {
+		if c == last && count > 0 {
+			count++
+			continue
+		}
+		if count > r.max {
+			spans = append(spans, span{start, i})
+		}
+		start, count, last = i, 1, c
+	}
+	if count > r.max {
+		spans = append(spans, span{start, len(text)})
+	}
+	return spans
+}
+
+// mask replaces spans with ****, overlapping spans are masked as one.
+func mask(text string, spans []span) string {
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+
+	var b strings.Builder
+	last := 0
+	for _, s := range spans {
+		if s.end <= last {
+			continue
+		}
+		if s.start >= last {
+			b.WriteString(text[last:s.start])
+			b.WriteString("****")
+		}
+		last = s.end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// length is the length of text as users count it, in characters.
+func length(text string) int {
+	return utf8.RuneCountInString(text)
+}
@@ -0,0 +1,80 @@
+package notifications
+
+import (
+	"errors"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/events"
+)
+
+type notifier struct {
+	store db.Store
+}
+
+// Subscribe turns the events on bus into notifications for the users they
+// concern. A new kind of notification only needs another subscription here.
+func Subscribe(bus *events.Bus, store db.Store) {
+	n := &notifier{store: store}
+	bus.Subscribe(events.ChirpPosted, n.chirpPosted)
+	bus.Subscribe(events.ChirpLiked, n.chirpLiked)
+	bus.Subscribe(events.ChirpRechirped, n.chirpRechirped)
+	bus.Subscribe(events.UserFollowed, n.userFollowed)
+}
+
+// notify stores a notification for userID unless the actor is the user.
+func (n *notifier) notify(userID int, kind string, e events.Event) error {
+	if userID == 0 || userID == e.ActorID {
+		return nil
+	}
+
+	_, err := n.store.StoreNotification(entities.Notification{
+		UserID:  userID,
+		Kind:    kind,
+		ActorID: e.ActorID,
+		ChirpID: e.Chirp.ID,
+	})
+	return err
+}
+
+// chirpPosted notifies the author of the chirp replied to and everyone
+// mentioned, each user only once.
+func (n *notifier) chirpPosted(e events.Event) error {
+	notified := map[int]bool{}
+
+	if e.Chirp.InReplyTo != 0 {
+		parent, err := n.store.GetChirp(e.Chirp.InReplyTo)
+		if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+			return err
+		}
+		if err == nil {
+			if err := n.notify(parent.AuthorID, entities.NotificationReply, e); err != nil {
+				return err
+			}
+			notified[parent.AuthorID] = true
+		}
+	}
+
+	for _, m := range e.Chirp.Mentions {
+		if notified[m.UserID] {
+			continue
+		}
+		if err := n.notify(m.UserID, entities.NotificationMention, e); err != nil {
+			return err
+		}
+		notified[m.UserID] = true
+	}
+
+	return nil
+}
+
+func (n *notifier) chirpLiked(e events.Event) error {
+	return n.notify(e.Chirp.AuthorID, entities.NotificationLike, e)
+}
+
+func (n *notifier) chirpRechirped(e events.Event) error {
+	return n.notify(e.Chirp.AuthorID, entities.NotificationRechirp, e)
+}
+
+func (n *notifier) userFollowed(e events.Event) error {
+	return n.notify(e.UserID, entities.NotificationFollow, e)
+}
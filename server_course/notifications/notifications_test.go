@@ -0,0 +1,53 @@
+package notifications
+
+import (
+	"log/slog"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/events"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	store, err := db.NewDB(t.TempDir())
+	assert.NoError(t, err)
+	defer store.Close()
+
+	for _, email := range []string{"walt@breakingbad.com", "jesse@breakingbad.com", "skyler@breakingbad.com"} {
+		_, err := store.StoreUser(entities.User{Email: email, Password: "pw"})
+		assert.NoError(t, err)
+	}
+
+	bus := events.NewBus(slog.Default())
+	Subscribe(bus, store)
+
+	kinds := func(userID int) []string {
+		page, err := store.ListNotifications(db.NotificationQuery{UserID: userID})
+		assert.NoError(t, err)
+		kinds := []string{}
+		for _, n := range page.Notifications {
+			kinds = append(kinds, n.Kind)
+		}
+		return kinds
+	}
+
+	post := func(c entities.Chirp) entities.Chirp {
+		c, err := store.StoreChirp(c)
+		assert.NoError(t, err)
+		bus.Publish(events.Event{Kind: events.ChirpPosted, ActorID: c.AuthorID, Chirp: c})
+		return c
+	}
+
+	first := post(entities.Chirp{AuthorID: 1, Body: "cooking with @jesse and myself @walt"})
+	// the reply to walt also mentions him, he hears about it once
+	post(entities.Chirp{AuthorID: 2, Body: "yeah @walt @skyler", InReplyTo: first.ID})
+	bus.Publish(events.Event{Kind: events.ChirpLiked, ActorID: 3, Chirp: first})
+	bus.Publish(events.Event{Kind: events.ChirpRechirped, ActorID: 2, Chirp: first})
+	bus.Publish(events.Event{Kind: events.UserFollowed, ActorID: 3, UserID: 2})
+
+	assert.Equal(t, []string{entities.NotificationRechirp, entities.NotificationLike, entities.NotificationReply}, kinds(1))
+	assert.Equal(t, []string{entities.NotificationFollow, entities.NotificationMention}, kinds(2))
+	assert.Equal(t, []string{entities.NotificationMention}, kinds(3))
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type Policy struct {
+	Name  string
+	Burst int
+	Every time.Duration
+}
+
+// NewPolicy allows at least 1 request, a bucket has to hold one.
+func NewPolicy(name string, n int, window time.Duration) Policy {
+	n = max(n, 1)
+	return Policy{Name: name, Burst: n, Every: window / time.Duration(n)}
+}
+
+func (p Policy) Window() time.Duration {
+	return time.Duration(p.Burst) * p.Every
+}
+
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limiter only has to implement Take for a store shared between instances.
+type Limiter interface {
+	Take(ctx context.Context, key string, p Policy) (Result, error)
+}
+
+const pruneEvery = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+type Memory struct {
+	mux       sync.Mutex
+	buckets   map[string]bucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		buckets: make(map[string]bucket),
+		now:     time.Now,
+	}
+}
+
+func (m *Memory) Take(_ context.Context, key string, p Policy) (Result, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastPrune) >= pruneEvery {
+		m.prune(now)
+	}
+
+	key = p.Name + ":" + key
+	b, exists := m.buckets[key]
+	if !exists {
+		b = bucket{tokens: float64(p.Burst), last: now}
+	}
+
+	elapsed := now.Sub(b.last)
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(p.Burst), b.tokens+float64(elapsed)/float64(p.Every))
+		b.last = now
+	}
+
+	res := Result{Limit: p.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) * float64(p.Every))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((float64(p.Burst) - b.tokens) * float64(p.Every))
+
+	b.full = now.Add(res.Reset)
+	m.buckets[key] = b
+
+	return res, nil
+}
+
+// prune has to be called holding the lock.
+func (m *Memory) prune(now time.Time) {
+	for key, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+	m.lastPrune = now
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory_Take(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	p := NewPolicy("login", 3, time.Minute)
+	assert.Equal(t, 20*time.Second, p.Every)
+	assert.Equal(t, time.Minute, p.Window())
+
+	ctx := context.Background()
+	for i := 2; i >= 0; i-- {
+		res, err := m.Take(ctx, "1.2.3.4", p)
+		assert.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, 3, res.Limit)
+		assert.Equal(t, i, res.Remaining)
+	}
+
+	res, err := m.Take(ctx, "1.2.3.4", p)
+	assert.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assert.Equal(t, 20*time.Second, res.RetryAfter)
+	assert.Equal(t, time.Minute, res.Reset)
+
+	// other keys and other policies have their own buckets
+	res, _ = m.Take(ctx, "5.6.7.8", p)
+	assert.True(t, res.Allowed)
+	res, _ = m.Take(ctx, "1.2.3.4", NewPolicy("signup", 1, time.Hour))
+	assert.True(t, res.Allowed)
+
+	// a policy of no requests still holds one
+	assert.Equal(t, NewPolicy("none", 1, time.Hour), NewPolicy("none", 0, time.Hour))
+
+	// a token comes back every 20 seconds
+	now = now.Add(15 * time.Second)
+	res, _ = m.Take(ctx, "1.2.3.4", p)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 5*time.Second, res.RetryAfter)
+	now = now.Add(5 * time.Second)
+	res, _ = m.Take(ctx, "1.2.3.4", p)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	// it never holds more than the burst
+	now = now.Add(time.Hour)
+	res, _ = m.Take(ctx, "1.2.3.4", p)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 2, res.Remaining)
+	assert.Equal(t, 20*time.Second, res.Reset)
+}
+
+func TestMemory_Prune(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	p := NewPolicy("chirps", 2, time.Minute)
+	m.Take(context.Background(), "a", p)
+	m.Take(context.Background(), "b", p)
+	m.Take(context.Background(), "b", p)
+	assert.Len(t, m.buckets, 2)
+
+	// a is full again after 30 seconds, b only after a minute
+	now = now.Add(pruneEvery - time.Second)
+	m.prune(now)
+	assert.Len(t, m.buckets, 1)
+	assert.Contains(t, m.buckets, "chirps:b")
+
+	// Take prunes on its own once in a while
+	now = now.Add(pruneEvery)
+	m.Take(context.Background(), "c", p)
+	assert.Len(t, m.buckets, 1)
+	assert.Contains(t, m.buckets, "chirps:c")
+}
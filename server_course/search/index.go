@@ -0,0 +1,206 @@
+package search
+
+import (
+	"math"
+	"server_course/entities"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// posting maps a chirp id to the positions a term has in it.
+type posting map[int][]int
+
+type document struct {
+	terms     []string
+	length    int
+	createdAt time.Time
+}
+
+// Index is an inverted index over chirp bodies that is updated one chirp at a
+// time.
+type Index struct {
+	mux      sync.RWMutex
+	postings map[string]posting
+	// terms is kept sorted for prefix lookups
+	terms []string
+	docs  map[int]document
+}
+
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string]posting),
+		terms:    []string{},
+		docs:     make(map[int]document),
+	}
+}
+
+// Add indexes c, replacing whatever was indexed for its id before.
+func (idx *Index) Add(c entities.Chirp) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.remove(c.ID)
+	if c.Deleted {
+		return
+	}
+
+	doc := document{createdAt: c.CreatedAt}
+	for _, t := range tokenize(c.Body) {
+		p, exists := idx.postings[t.term]
+		if !exists {
+			p = posting{}
+			idx.postings[t.term] = p
+			i, _ := slices.BinarySearch(idx.terms, t.term)
+			idx.terms = slices.Insert(idx.terms, i, t.term)
+		}
+		if len(p[c.ID]) == 0 {
+			doc.terms = append(doc.terms, t.term)
+		}
+		p[c.ID] = append(p[c.ID], t.position)
+		doc.length = max(doc.length, t.position+1)
+	}
+
+	idx.docs[c.ID] = doc
+}
+
+func (idx *Index) Remove(chirpID int) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.remove(chirpID)
+}
+
+func (idx *Index) remove(chirpID int) {
+	doc, exists := idx.docs[chirpID]
+	if !exists {
+		return
+	}
+
+	for _, term := range doc.terms {
+		p := idx.postings[term]
+		delete(p, chirpID)
+		if len(p) == 0 {
+			delete(idx.postings, term)
+			if i, found := slices.BinarySearch(idx.terms, term); found {
+				idx.terms = slices.Delete(idx.terms, i, i+1)
+			}
+		}
+	}
+	delete(idx.docs, chirpID)
+}
+
+func (idx *Index) Clear() {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.postings = make(map[string]posting)
+	idx.terms = []string{}
+	idx.docs = make(map[int]document)
+}
+
+func (idx *Index) Len() int {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	return len(idx.docs)
+}
+
+// Search returns the ids of the requested page of matches and the total
+// number of matches.
+func (idx *Index) Search(q Query) ([]int, int) {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	var scores map[int]float64
+	for _, cl := range q.clauses {
+		matches := idx.match(cl)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id, score := range scores {
+			if m, found := matches[id]; found {
+				scores[id] = score + m
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		switch {
+		case q.Sort == SortRelevance && scores[a] != scores[b]:
+			return scores[a] > scores[b]
+		case q.Sort == SortRecent && !idx.docs[a].createdAt.Equal(idx.docs[b].createdAt):
+			return idx.docs[a].createdAt.After(idx.docs[b].createdAt)
+		default:
+			return a > b
+		}
+	})
+
+	total := len(ids)
+	ids = ids[min(q.Offset, total):]
+	if q.Limit > 0 && len(ids) > q.Limit {
+		ids = ids[:q.Limit]
+	}
+
+	return ids, total
+}
+
+// match scores every chirp matching cl with tf-idf, normalized by the length
+// of the chirp so short chirps about a term rank above long ones mentioning it.
+func (idx *Index) match(cl clause) map[int]float64 {
+	scores := map[int]float64{}
+	add := func(term string, id, tf int) {
+		idf := math.Log(1 + float64(len(idx.docs))/float64(len(idx.postings[term])))
+		scores[id] += float64(tf) * idf / math.Sqrt(float64(idx.docs[id].length))
+	}
+
+	switch {
+	case cl.prefix:
+		i, _ := slices.BinarySearch(idx.terms, cl.terms[0])
+		for ; i < len(idx.terms) && strings.HasPrefix(idx.terms[i], cl.terms[0]); i++ {
+			for id, positions := range idx.postings[idx.terms[i]] {
+				add(idx.terms[i], id, len(positions))
+			}
+		}
+	case len(cl.terms) == 1:
+		for id, positions := range idx.postings[cl.terms[0]] {
+			add(cl.terms[0], id, len(positions))
+		}
+	default:
+		for id, positions := range idx.postings[cl.terms[0]] {
+			tf := 0
+			for _, start := range positions {
+				if idx.phraseAt(cl.terms, id, start) {
+					tf++
+				}
+			}
+			if tf > 0 {
+				for _, term := range cl.terms {
+					add(term, id, tf)
+				}
+			}
+		}
+	}
+
+	return scores
+}
+
+func (idx *Index) phraseAt(terms []string, id, start int) bool {
+	for offset, term := range terms[1:] {
+		if !slices.Contains(idx.postings[term][id], start+offset+1) {
+			return false
+		}
+	}
+	return true
+}
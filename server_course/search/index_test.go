@@ -0,0 +1,58 @@
+package search
+
+import (
+	"server_course/entities"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex_Search(t *testing.T) {
+	start := time.Now()
+	index := NewIndex()
+	for i, body := range []string{
+		"Learning #golang with @walt today",
+		"golang golang golang",
+		"Breaking Bad is the best show",
+		"the best show is not Breaking Bad",
+		"going to the golf course",
+	} {
+		index.Add(entities.Chirp{ID: i + 1, Body: body, CreatedAt: start.Add(time.Duration(i) * time.Minute)})
+	}
+
+	search := func(q string, sort Sort) []int {
+		query, err := ParseQuery(q)
+		assert.NoError(t, err)
+		query.Sort = sort
+		ids, _ := index.Search(query)
+		return ids
+	}
+
+	assert.Equal(t, []int{2, 1}, search("golang", SortRelevance))
+	assert.Equal(t, []int{1}, search("#golang", SortRelevance))
+	assert.Equal(t, []int{1}, search("@walt", SortRelevance))
+	assert.Equal(t, []int{4, 3}, search("best show", SortRecent))
+	assert.Equal(t, []int{3}, search(`"breaking bad is"`, SortRelevance))
+	assert.Equal(t, []int{5, 2, 1}, search("go*", SortRecent))
+	assert.Empty(t, search("golang bad", SortRelevance))
+
+	// paging through the ranked matches
+	query, _ := ParseQuery("go*")
+	query.Sort = SortRecent
+	query.Offset, query.Limit = 1, 1
+	ids, total := index.Search(query)
+	assert.Equal(t, []int{2}, ids)
+	assert.Equal(t, 3, total)
+
+	// edits replace the indexed body, deletes drop it
+	index.Add(entities.Chirp{ID: 2, Body: "no longer about that", CreatedAt: start})
+	assert.Equal(t, []int{1}, search("golang", SortRelevance))
+	index.Remove(1)
+	assert.Empty(t, search("golang", SortRelevance))
+	assert.Equal(t, []int{5}, search("go*", SortRelevance))
+	assert.Equal(t, 4, index.Len())
+
+	_, err := ParseQuery(` "" * # `)
+	assert.ErrorIs(t, err, ErrEmptyQuery)
+}
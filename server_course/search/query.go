@@ -0,0 +1,62 @@
+package search
+
+import (
+	"errors"
+	"strings"
+)
+
+type Sort int
+
+const (
+	SortRelevance Sort = iota
+	SortRecent
+)
+
+// clause is one part of a query every match has to satisfy.
+type clause struct {
+	// terms holds one term, or several for a phrase that has to appear in
+	// this order.
+	terms  []string
+	prefix bool
+}
+
+type Query struct {
+	clauses []clause
+	Sort    Sort
+	Offset  int
+	Limit   int
+}
+
+var ErrEmptyQuery = errors.New("query has no terms")
+
+// ParseQuery understands plain terms, "quoted phrases", prefix* terms,
+// #hashtags and @mentions. Every part has to match.
+func ParseQuery(q string) (Query, error) {
+	query := Query{}
+
+	for i, part := range strings.Split(q, `"`) {
+		// every odd part was inside quotes
+		if i%2 == 1 {
+			if words := splitWords(part); len(words) > 0 {
+				query.clauses = append(query.clauses, clause{terms: words})
+			}
+			continue
+		}
+
+		for _, field := range strings.Fields(part) {
+			words := splitWords(field)
+			for _, word := range words {
+				query.clauses = append(query.clauses, clause{terms: []string{word}})
+			}
+			if len(words) > 0 && strings.HasSuffix(field, "*") {
+				query.clauses[len(query.clauses)-1].prefix = true
+			}
+		}
+	}
+
+	if len(query.clauses) == 0 {
+		return query, ErrEmptyQuery
+	}
+
+	return query, nil
+}
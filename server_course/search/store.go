@@ -0,0 +1,100 @@
+package search
+
+import (
+	"server_course/db"
+	"server_course/entities"
+)
+
+// IndexedStore keeps an Index in step with the chirps written through it.
+type IndexedStore struct {
+	db.Store
+	index *Index
+}
+
+var _ db.Store = (*IndexedStore)(nil)
+
+// NewIndexedStore wraps store and indexes the chirps it already holds.
+func NewIndexedStore(store db.Store) (*IndexedStore, error) {
+	chirps, err := store.GetChirpsSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	index := NewIndex()
+	for _, c := range chirps {
+		index.Add(c)
+	}
+
+	return &IndexedStore{Store: store, index: index}, nil
+}
+
+func (s *IndexedStore) Index() *Index {
+	return s.index
+}
+
+func (s *IndexedStore) StoreChirp(c entities.Chirp) (entities.Chirp, error) {
+	c, err := s.Store.StoreChirp(c)
+	if err != nil {
+		return c, err
+	}
+
+	s.index.Add(c)
+	return c, nil
+}
+
+func (s *IndexedStore) UpdateChirp(c entities.Chirp) (entities.Chirp, error) {
+	c, err := s.Store.UpdateChirp(c)
+	if err != nil {
+		return c, err
+	}
+
+	s.index.Add(c)
+	return c, nil
+}
+
+func (s *IndexedStore) DeleteChirp(chirpID int) error {
+	if err := s.Store.DeleteChirp(chirpID); err != nil {
+		return err
+	}
+
+	s.index.Remove(chirpID)
+	return nil
+}
+
+func (s *IndexedStore) Reset() error {
+	if err := s.Store.Reset(); err != nil {
+		return err
+	}
+
+	s.index.Clear()
+	return nil
+}
+
+func (s *IndexedStore) SetChirpHidden(chirpID int, hidden bool) (entities.Chirp, error) {
+	c, err := s.Store.SetChirpHidden(chirpID, hidden)
+	if err != nil {
+		return c, err
+	}
+
+	if hidden {
+		s.index.Remove(chirpID)
+	} else {
+		s.index.Add(c)
+	}
+	return c, nil
+}
+
+func (s *IndexedStore) ApplyModerationAction(a entities.ModerationAction) (entities.ModerationAction, int, error) {
+	a, resolved, err := s.Store.ApplyModerationAction(a)
+	if err != nil || a.TargetType != entities.ReportTargetChirp {
+		return a, resolved, err
+	}
+
+	// GetChirp only finds chirps that are shown
+	if c, err := s.Store.GetChirp(a.TargetID); err == nil {
+		s.index.Add(c)
+	} else {
+		s.index.Remove(a.TargetID)
+	}
+	return a, resolved, nil
+}
@@ -0,0 +1,55 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// token is a term at a word position in a text. Hashtags and mentions are
+// indexed twice at the same position, with their marker and as plain word.
+type token struct {
+	term     string
+	position int
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// splitWords splits text into lowercase words, keeping a leading # or @.
+func splitWords(text string) []string {
+	words := []string{}
+	var word strings.Builder
+	flush := func() {
+		w := word.String()
+		word.Reset()
+		if strings.TrimLeft(w, "#@") != "" {
+			words = append(words, w)
+		}
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isWordRune(r):
+			word.WriteRune(r)
+		case (r == '#' || r == '@') && word.Len() == 0:
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return words
+}
+
+func tokenize(text string) []token {
+	tokens := []token{}
+	for position, word := range splitWords(text) {
+		tokens = append(tokens, token{term: word, position: position})
+		if plain := strings.TrimLeft(word, "#@"); plain != word {
+			tokens = append(tokens, token{term: plain, position: position})
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,81 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook signatures go in a header like
+//
+//	t=1700000000,v1=5257a869...
+//
+// where v1 is the hex HMAC-SHA256 of the unix timestamp, a dot and the raw
+// body. There may be several v1 entries while a secret is being rotated.
+const scheme = "v1"
+
+var (
+	ErrMalformed = errors.New("malformed signature header")
+	ErrExpired   = errors.New("signature timestamp is outside the tolerance")
+	ErrMismatch  = errors.New("no signature matches")
+)
+
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+func Sign(secret []byte, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,%s=%s", timestamp, scheme, hex.EncodeToString(mac(secret, timestamp, body)))
+}
+
+// Verify rejects signatures older than tolerance so captured requests cannot
+// be replayed.
+func Verify(secret []byte, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			return ErrMalformed
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case scheme:
+			sig, err := hex.DecodeString(value)
+			if err != nil {
+				return ErrMalformed
+			}
+			signatures = append(signatures, sig)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return ErrMalformed
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+
+	expected := mac(secret, timestamp, body)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrMismatch
+}
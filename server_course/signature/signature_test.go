@@ -0,0 +1,34 @@
+package signature
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerify(t *testing.T) {
+	secret := []byte("not-the-polka-key")
+	body := []byte(`{"id":"evt_1","event":"user.upgraded","data":{"user_id":3}}`)
+	now := time.Unix(1700000000, 0)
+
+	header := Sign(secret, now, body)
+	assert.Regexp(t, `^t=1700000000,v1=[0-9a-f]{64}$`, header)
+
+	assert.NoError(t, Verify(secret, header, body, now, 5*time.Minute))
+	assert.NoError(t, Verify(secret, header, body, now.Add(5*time.Minute), 5*time.Minute))
+	// clocks may be ahead as well as behind
+	assert.NoError(t, Verify(secret, header, body, now.Add(-time.Minute), 5*time.Minute))
+
+	assert.ErrorIs(t, Verify(secret, header, body, now.Add(6*time.Minute), 5*time.Minute), ErrExpired)
+	assert.ErrorIs(t, Verify(secret, header, []byte(`{"id":"evt_1"}`), now, 5*time.Minute), ErrMismatch)
+	assert.ErrorIs(t, Verify([]byte("other"), header, body, now, 5*time.Minute), ErrMismatch)
+
+	// any of several signatures will do while secrets rotate
+	rotating := Sign([]byte("old"), now, body) + "," + header[len("t=1700000000,"):]
+	assert.NoError(t, Verify(secret, rotating, body, now, 5*time.Minute))
+
+	for _, bad := range []string{"", "v1=abcd", "t=1700000000", "t=abc,v1=abcd", "t=1700000000,v1=xyz", "nonsense"} {
+		assert.ErrorIs(t, Verify(secret, bad, body, now, 5*time.Minute), ErrMalformed, bad)
+	}
+}
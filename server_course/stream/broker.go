@@ -0,0 +1,179 @@
+package stream
+
+import (
+	"server_course/entities"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	ChirpCreated = "chirp.created"
+	ChirpDeleted = "chirp.deleted"
+)
+
+// Event is one change to the chirps. Chirp is only set for ChirpCreated.
+type Event struct {
+	ID       int64           `json:"id"`
+	Type     string          `json:"type"`
+	ChirpID  int             `json:"chirp_id"`
+	AuthorID int             `json:"author_id"`
+	Chirp    *entities.Chirp `json:"chirp,omitempty"`
+}
+
+// Broker fans chirp events out to subscribers and keeps the latest ones so a
+// subscriber can resume after a reconnect.
+type Broker struct {
+	mux         sync.Mutex
+	nextID      int64
+	history     []Event
+	historySize int
+	bufferSize  int
+	subs        map[*Subscription]struct{}
+	closed      bool
+}
+
+// NewBroker keeps historySize events for resuming and lets a subscriber fall
+// bufferSize events behind before it is dropped.
+func NewBroker(historySize, bufferSize int) *Broker {
+	return &Broker{
+		// ids keep growing across restarts so a stale Last-Event-ID is noticed
+		nextID:      time.Now().UnixNano(),
+		history:     []Event{},
+		historySize: historySize,
+		bufferSize:  bufferSize,
+		subs:        make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives the events of the authors it was created for, all
+// events if there are none. Events is closed once the subscription ends.
+type Subscription struct {
+	Events <-chan Event
+	// Gap is set if events after the requested Last-Event-ID were already
+	// dropped from the history and could not be replayed.
+	Gap bool
+
+	events    chan Event
+	authorIDs []int
+	broker    *Broker
+	dropped   bool
+}
+
+func (s *Subscription) wants(e Event) bool {
+	return len(s.authorIDs) == 0 || slices.Contains(s.authorIDs, e.AuthorID)
+}
+
+// Subscribe starts a subscription that first replays the events after
+// lastEventID, if it is not 0.
+func (b *Broker) Subscribe(authorIDs []int, lastEventID int64) *Subscription {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	replay := []Event{}
+	gap := false
+	if lastEventID != 0 {
+		oldest := b.nextID
+		if len(b.history) > 0 {
+			oldest = b.history[0].ID
+		}
+		gap = lastEventID < oldest-1 || lastEventID >= b.nextID
+
+		for _, e := range b.history {
+			if e.ID > lastEventID {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	events := make(chan Event, b.bufferSize+len(replay))
+	s := &Subscription{
+		Events:    events,
+		Gap:       gap,
+		events:    events,
+		authorIDs: authorIDs,
+		broker:    b,
+	}
+	for _, e := range replay {
+		if s.wants(e) {
+			events <- e
+		}
+	}
+
+	if b.closed {
+		close(events)
+		return s
+	}
+	b.subs[s] = struct{}{}
+
+	return s
+}
+
+// Close ends the subscription, closing it twice is fine.
+func (s *Subscription) Close() {
+	s.broker.mux.Lock()
+	defer s.broker.mux.Unlock()
+
+	s.broker.unsubscribe(s)
+}
+
+// Dropped reports whether the subscription was ended because it could not
+// keep up.
+func (s *Subscription) Dropped() bool {
+	s.broker.mux.Lock()
+	defer s.broker.mux.Unlock()
+
+	return s.dropped
+}
+
+// unsubscribe has to be called with the lock held.
+func (b *Broker) unsubscribe(s *Subscription) {
+	if _, subscribed := b.subs[s]; !subscribed {
+		return
+	}
+	delete(b.subs, s)
+	close(s.events)
+}
+
+// Publish assigns e the next id and hands it to every interested subscriber
+// without blocking. A subscriber whose buffer is full is dropped, it can
+// resume from the last event it got.
+func (b *Broker) Publish(e Event) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	e.ID = b.nextID
+	b.nextID++
+
+	b.history = append(b.history, e)
+	if len(b.history) > b.historySize {
+		b.history = slices.Delete(b.history, 0, len(b.history)-b.historySize)
+	}
+
+	for s := range b.subs {
+		if !s.wants(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			s.dropped = true
+			b.unsubscribe(s)
+		}
+	}
+}
+
+// Close ends all subscriptions, nothing is published afterwards.
+func (b *Broker) Close() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.closed = true
+	for s := range b.subs {
+		b.unsubscribe(s)
+	}
+}
@@ -0,0 +1,64 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func drain(sub *Subscription) []int {
+	chirpIDs := []int{}
+	for {
+		select {
+		case e, ok := <-sub.Events:
+			if !ok {
+				return chirpIDs
+			}
+			chirpIDs = append(chirpIDs, e.ChirpID)
+		default:
+			return chirpIDs
+		}
+	}
+}
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker(3, 2)
+
+	all := broker.Subscribe(nil, 0)
+	walt := broker.Subscribe([]int{1}, 0)
+
+	broker.Publish(Event{Type: ChirpCreated, ChirpID: 1, AuthorID: 1})
+	broker.Publish(Event{Type: ChirpCreated, ChirpID: 2, AuthorID: 2})
+	assert.Equal(t, []int{1, 2}, drain(all))
+	assert.Equal(t, []int{1}, drain(walt))
+
+	// a subscriber that does not keep up is dropped
+	for chirpID := 3; chirpID <= 5; chirpID++ {
+		broker.Publish(Event{Type: ChirpCreated, ChirpID: chirpID, AuthorID: 2})
+	}
+	assert.Equal(t, []int{3, 4}, drain(all))
+	_, open := <-all.Events
+	assert.False(t, open)
+	assert.True(t, all.Dropped())
+	assert.False(t, walt.Dropped())
+
+	// and resumes from the last event it got, the history holds 3, 4 and 5
+	history := broker.history
+	resumed := broker.Subscribe(nil, history[0].ID)
+	assert.False(t, resumed.Gap)
+	assert.Equal(t, []int{4, 5}, drain(resumed))
+
+	stale := broker.Subscribe(nil, history[0].ID-5)
+	assert.True(t, stale.Gap)
+	assert.Equal(t, []int{3, 4, 5}, drain(stale))
+
+	unknown := broker.Subscribe(nil, history[2].ID+1)
+	assert.True(t, unknown.Gap)
+
+	resumed.Close()
+	resumed.Close()
+	broker.Close()
+	_, open = <-walt.Events
+	assert.False(t, open)
+	assert.False(t, walt.Dropped())
+}
@@ -0,0 +1,93 @@
+package stream
+
+import (
+	"errors"
+	"server_course/db"
+	"server_course/entities"
+)
+
+// PublishingStore publishes the chirps stored and deleted through it.
+type PublishingStore struct {
+	db.Store
+	broker *Broker
+}
+
+var _ db.Store = (*PublishingStore)(nil)
+
+func NewPublishingStore(store db.Store, broker *Broker) *PublishingStore {
+	return &PublishingStore{Store: store, broker: broker}
+}
+
+func (s *PublishingStore) StoreChirp(c entities.Chirp) (entities.Chirp, error) {
+	c, err := s.Store.StoreChirp(c)
+	if err != nil {
+		return c, err
+	}
+
+	s.broker.Publish(Event{Type: ChirpCreated, ChirpID: c.ID, AuthorID: c.AuthorID, Chirp: &c})
+	return c, nil
+}
+
+func (s *PublishingStore) DeleteChirp(chirpID int) error {
+	// the author is needed to filter the event
+	c, err := s.Store.GetChirp(chirpID)
+	if err != nil {
+		if errors.Is(err, db.ErrDoesNotExist) {
+			return s.Store.DeleteChirp(chirpID)
+		}
+		return err
+	}
+
+	if err := s.Store.DeleteChirp(chirpID); err != nil {
+		return err
+	}
+
+	s.broker.Publish(Event{Type: ChirpDeleted, ChirpID: c.ID, AuthorID: c.AuthorID})
+	return nil
+}
+
+// SetChirpHidden tells subscribers a hidden chirp is gone and announces it
+// again once it is shown.
+func (s *PublishingStore) SetChirpHidden(chirpID int, hidden bool) (entities.Chirp, error) {
+	// GetChirp only finds chirps that are shown
+	_, err := s.Store.GetChirp(chirpID)
+	wasVisible := err == nil
+
+	c, err := s.Store.SetChirpHidden(chirpID, hidden)
+	if err != nil {
+		return c, err
+	}
+
+	switch {
+	case hidden && wasVisible:
+		s.broker.Publish(Event{Type: ChirpDeleted, ChirpID: c.ID, AuthorID: c.AuthorID})
+	case !hidden && !wasVisible:
+		s.broker.Publish(Event{Type: ChirpCreated, ChirpID: c.ID, AuthorID: c.AuthorID, Chirp: &c})
+	}
+	return c, nil
+}
+
+// ApplyModerationAction tells subscribers a chirp hidden or deleted by an
+// admin is gone and announces one that is shown again.
+func (s *PublishingStore) ApplyModerationAction(a entities.ModerationAction) (entities.ModerationAction, int, error) {
+	if a.TargetType != entities.ReportTargetChirp {
+		return s.Store.ApplyModerationAction(a)
+	}
+
+	before, err := s.Store.GetChirp(a.TargetID)
+	wasVisible := err == nil
+
+	a, resolved, err := s.Store.ApplyModerationAction(a)
+	if err != nil {
+		return a, resolved, err
+	}
+
+	after, err := s.Store.GetChirp(a.TargetID)
+	switch {
+	case wasVisible && err != nil:
+		s.broker.Publish(Event{Type: ChirpDeleted, ChirpID: before.ID, AuthorID: before.AuthorID})
+	case !wasVisible && err == nil:
+		s.broker.Publish(Event{Type: ChirpCreated, ChirpID: after.ID, AuthorID: after.AuthorID, Chirp: &after})
+	}
+	return a, resolved, nil
+}
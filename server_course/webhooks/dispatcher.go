@@ -0,0 +1,215 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/signature"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	SignatureHeader = "Chirpy-Signature"
+	EventHeader     = "Chirpy-Event"
+	DeliveryHeader  = "Chirpy-Delivery"
+
+	batchSize = 100
+	workers   = 4
+	// deliveryTimeout includes reading the answer
+	deliveryTimeout  = 10 * time.Second
+	maxResponseBytes = 64 << 10
+)
+
+var ErrPrivateAddress = errors.New("address is not public")
+
+// nonPublic are the special-purpose ranges of the IANA registries, cloud
+// providers run internal services in some of them.
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/127"),
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// NewClient only dials public addresses, checked after the name resolved, so
+// a webhook cannot reach services behind the server.
+func NewClient() *http.Client {
+	dialer := &net.Dialer{Control: publicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func publicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+
+	ip = ip.Unmap()
+	for _, prefix := range nonPublic {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("%w: %s", ErrPrivateAddress, ip)
+		}
+	}
+	return nil
+}
+
+// Dispatcher delivers at least once, receivers drop duplicates by event id.
+type Dispatcher struct {
+	logger *slog.Logger
+	store  db.Store
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewDispatcher(l *slog.Logger, store db.Store, client *http.Client) *Dispatcher {
+	return &Dispatcher{
+		logger: l.With("component", "webhooks"),
+		store:  store,
+		client: client,
+		now:    time.Now,
+	}
+}
+
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := d.DispatchDue(ctx); err != nil {
+			d.logger.Error("failed to dispatch webhooks", slog.String("err", err.Error()))
+		}
+	}
+}
+
+func (d *Dispatcher) DispatchDue(ctx context.Context) (int, error) {
+	due, err := d.store.DueWebhookDeliveries(d.now(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for _, delivery := range due {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			d.attempt(ctx, delivery)
+		}()
+	}
+	wg.Wait()
+
+	return len(due), nil
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, delivery entities.WebhookDelivery) {
+	logger := d.logger.With(slog.Int("delivery", delivery.ID), slog.Int("subscription", delivery.SubscriptionID))
+
+	sub, err := d.store.GetWebhookSubscription(delivery.SubscriptionID)
+	if err != nil {
+		if !errors.Is(err, db.ErrDoesNotExist) {
+			logger.Error("failed to GetWebhookSubscription", slog.String("err", err.Error()))
+		}
+		return
+	}
+
+	if !sub.Active {
+		// keep it around to be retried once the subscription is active again
+		delivery.Abandon("subscription is not active")
+	} else {
+		code, err := d.post(ctx, sub, delivery)
+		if err != nil {
+			logger.Debug("delivery failed", slog.Int("code", code), slog.String("err", err.Error()))
+			delivery.Failed(code, err.Error(), d.now().UTC())
+		} else {
+			delivery.Succeeded(code, d.now().UTC())
+		}
+	}
+
+	if delivery.Status == entities.DeliveryDead {
+		logger.Warn("delivery is dead", slog.String("event", delivery.Event), slog.String("err", delivery.Error))
+	}
+	if _, err := d.store.UpdateWebhookDelivery(delivery); err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+		logger.Error("failed to UpdateWebhookDelivery", slog.String("err", err.Error()))
+	}
+}
+
+func (d *Dispatcher) post(ctx context.Context, sub entities.WebhookSubscription, delivery entities.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(delivery.ID))
+	req.Header.Set(SignatureHeader, signature.Sign([]byte(sub.Secret), d.now(), delivery.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxResponseBytes))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver answered %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
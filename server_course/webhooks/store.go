@@ -0,0 +1,240 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"server_course/db"
+	"server_course/entities"
+	"time"
+)
+
+type Payload struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+type deletedChirp struct {
+	ID       int `json:"id"`
+	AuthorID int `json:"author_id"`
+}
+
+type planChange struct {
+	UserID int    `json:"user_id"`
+	Plan   string `json:"plan"`
+}
+
+// EmittingStore never fails a write because queueing failed.
+type EmittingStore struct {
+	db.Store
+	logger *slog.Logger
+}
+
+var _ db.Store = (*EmittingStore)(nil)
+
+func NewEmittingStore(l *slog.Logger, store db.Store) *EmittingStore {
+	return &EmittingStore{Store: store, logger: l.With("component", "webhooks")}
+}
+
+func newEventID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "evt_" + hex.EncodeToString(b), nil
+}
+
+// receives lets only the user and billing managers see private events.
+func (s *EmittingStore) receives(sub entities.WebhookSubscription, userID int) (bool, error) {
+	if sub.UserID == userID {
+		return true, nil
+	}
+	owner, err := s.Store.GetUser(sub.UserID)
+	if errors.Is(err, db.ErrDoesNotExist) {
+		return false, nil
+	}
+	return owner.Can(entities.PermManageBilling), err
+}
+
+func (s *EmittingStore) emit(event string, userID int, data any) {
+	if err := s.enqueue(event, userID, data); err != nil {
+		s.logger.Error("failed to queue webhooks", slog.String("event", event), slog.String("err", err.Error()))
+	}
+}
+
+func (s *EmittingStore) enqueue(event string, userID int, data any) error {
+	subscriptions, err := s.Store.ListWebhookSubscriptions(db.WebhookSubscriptionQuery{Event: event})
+	if err != nil || len(subscriptions) == 0 {
+		return err
+	}
+
+	id, err := newEventID()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(Payload{ID: id, Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subscriptions {
+		if entities.PrivateHookEvent(event) {
+			receives, err := s.receives(sub, userID)
+			if err != nil {
+				return err
+			}
+			if !receives {
+				continue
+			}
+		}
+
+		_, err := s.Store.EnqueueWebhookDelivery(entities.WebhookDelivery{
+			SubscriptionID: sub.ID,
+			EventID:        id,
+			Event:          event,
+			Payload:        payload,
+		})
+		// the subscription may have been deleted since it was listed
+		if err != nil && !errors.Is(err, db.ErrDoesNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *EmittingStore) StoreChirp(c entities.Chirp) (entities.Chirp, error) {
+	c, err := s.Store.StoreChirp(c)
+	if err != nil {
+		return c, err
+	}
+
+	s.emit(entities.HookChirpCreated, c.AuthorID, c)
+	return c, nil
+}
+
+func (s *EmittingStore) UpdateChirp(c entities.Chirp) (entities.Chirp, error) {
+	c, err := s.Store.UpdateChirp(c)
+	if err != nil {
+		return c, err
+	}
+
+	s.emit(entities.HookChirpUpdated, c.AuthorID, c)
+	return c, nil
+}
+
+func (s *EmittingStore) DeleteChirp(chirpID int) error {
+	// the author is part of the event
+	c, err := s.Store.GetChirp(chirpID)
+	if err != nil {
+		if errors.Is(err, db.ErrDoesNotExist) {
+			return s.Store.DeleteChirp(chirpID)
+		}
+		return err
+	}
+
+	if err := s.Store.DeleteChirp(chirpID); err != nil {
+		return err
+	}
+
+	s.emit(entities.HookChirpDeleted, c.AuthorID, deletedChirp{ID: c.ID, AuthorID: c.AuthorID})
+	return nil
+}
+
+func (s *EmittingStore) SetChirpHidden(chirpID int, hidden bool) (entities.Chirp, error) {
+	// GetChirp only finds chirps that are shown
+	_, err := s.Store.GetChirp(chirpID)
+	wasVisible := err == nil
+
+	c, err := s.Store.SetChirpHidden(chirpID, hidden)
+	if err != nil {
+		return c, err
+	}
+
+	switch {
+	case hidden && wasVisible:
+		s.emit(entities.HookChirpDeleted, c.AuthorID, deletedChirp{ID: c.ID, AuthorID: c.AuthorID})
+	case !hidden && !wasVisible:
+		s.emit(entities.HookChirpCreated, c.AuthorID, c)
+	}
+	return c, nil
+}
+
+// ApplyModerationAction tells subscriptions a chirp hidden or deleted by an
+// admin is gone and announces one that is shown again.
+func (s *EmittingStore) ApplyModerationAction(a entities.ModerationAction) (entities.ModerationAction, int, error) {
+	if a.TargetType != entities.ReportTargetChirp {
+		return s.Store.ApplyModerationAction(a)
+	}
+
+	before, err := s.Store.GetChirp(a.TargetID)
+	wasVisible := err == nil
+
+	a, resolved, err := s.Store.ApplyModerationAction(a)
+	if err != nil {
+		return a, resolved, err
+	}
+
+	after, err := s.Store.GetChirp(a.TargetID)
+	switch {
+	case wasVisible && err != nil:
+		s.emit(entities.HookChirpDeleted, before.AuthorID, deletedChirp{ID: before.ID, AuthorID: before.AuthorID})
+	case !wasVisible && err == nil:
+		s.emit(entities.HookChirpCreated, after.AuthorID, after)
+	}
+	return a, resolved, nil
+}
+
+func (s *EmittingStore) planChanged(userID int, before, after string) {
+	switch {
+	case before == after:
+	case after == entities.PlanFree:
+		s.emit(entities.HookUserDowngraded, userID, planChange{UserID: userID, Plan: after})
+	default:
+		s.emit(entities.HookUserUpgraded, userID, planChange{UserID: userID, Plan: after})
+	}
+}
+
+func (s *EmittingStore) UpdateSubscription(userID int, update func(sub *entities.Subscription) error) (entities.Subscription, error) {
+	var before string
+	sub, err := s.Store.UpdateSubscription(userID, func(sub *entities.Subscription) error {
+		before = sub.Entitlements(time.Now()).Plan
+		return update(sub)
+	})
+	if err != nil {
+		return sub, err
+	}
+
+	s.planChanged(userID, before, sub.Entitlements(time.Now()).Plan)
+	return sub, nil
+}
+
+func (s *EmittingStore) ProcessWebhookEvent(id, userID int, update func(sub *entities.Subscription) error) (entities.WebhookEvent, entities.Subscription, error) {
+	var before string
+	e, sub, err := s.Store.ProcessWebhookEvent(id, userID, func(sub *entities.Subscription) error {
+		before = sub.Entitlements(time.Now()).Plan
+		return update(sub)
+	})
+	if err != nil {
+		return e, sub, err
+	}
+
+	s.planChanged(userID, before, sub.Entitlements(time.Now()).Plan)
+	return e, sub, nil
+}
+
+func (s *EmittingStore) ExpireSubscriptions(now time.Time) ([]entities.Subscription, error) {
+	expired, err := s.Store.ExpireSubscriptions(now)
+	if err != nil {
+		return expired, err
+	}
+
+	// the plans had lapsed already, expiring makes it official
+	for _, sub := range expired {
+		s.planChanged(sub.UserID, sub.Plan, entities.PlanFree)
+	}
+	return expired, nil
+}
@@ -0,0 +1,200 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"server_course/db"
+	"server_course/entities"
+	"server_course/signature"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmittingStore(t *testing.T) {
+	inner, err := db.NewDB(t.TempDir())
+	assert.NoError(t, err)
+	defer inner.Close()
+	store := NewEmittingStore(slog.Default(), inner)
+
+	walt, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+	jesse, err := store.StoreUser(entities.User{Email: "jesse@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+
+	all := []string{entities.HookChirpCreated, entities.HookChirpDeleted, entities.HookUserUpgraded}
+	mine, err := store.CreateWebhookSubscription(entities.WebhookSubscription{UserID: walt.ID, URL: "https://walt.example", Events: all, Secret: "s", Active: true})
+	assert.NoError(t, err)
+	theirs, err := store.CreateWebhookSubscription(entities.WebhookSubscription{UserID: jesse.ID, URL: "https://jesse.example", Events: all, Secret: "s", Active: true})
+	assert.NoError(t, err)
+
+	events := func(subscriptionID int) []string {
+		page, err := store.ListWebhookDeliveries(db.WebhookDeliveryQuery{SubscriptionID: subscriptionID})
+		assert.NoError(t, err)
+		events := []string{}
+		for _, d := range page.Deliveries {
+			events = append(events, d.Event)
+		}
+		return events
+	}
+
+	c, err := store.StoreChirp(entities.Chirp{AuthorID: walt.ID, Body: "Say my name"})
+	assert.NoError(t, err)
+	_, err = store.SetChirpHidden(c.ID, true)
+	assert.NoError(t, err)
+	assert.NoError(t, store.DeleteChirp(c.ID))
+
+	// upgrades are private to the user and those managing billing
+	_, err = store.UpdateSubscription(walt.ID, func(s *entities.Subscription) error {
+		s.Start(entities.PlanRed, time.Time{}, time.Now())
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{entities.HookUserUpgraded, entities.HookChirpDeleted, entities.HookChirpCreated}, events(mine.ID))
+	assert.Equal(t, []string{entities.HookChirpDeleted, entities.HookChirpCreated}, events(theirs.ID), "deleting a hidden chirp is not news")
+
+	page, err := store.ListWebhookDeliveries(db.WebhookDeliveryQuery{SubscriptionID: mine.ID})
+	assert.NoError(t, err)
+	var payload struct {
+		Payload
+		Data planChange `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(page.Deliveries[0].Payload, &payload))
+	assert.Equal(t, entities.HookUserUpgraded, payload.Event)
+	assert.Equal(t, planChange{UserID: walt.ID, Plan: entities.PlanRed}, payload.Data)
+	assert.Equal(t, page.Deliveries[0].EventID, payload.ID)
+}
+
+func TestDispatcher(t *testing.T) {
+	store, err := db.NewDB(t.TempDir())
+	assert.NoError(t, err)
+	defer store.Close()
+
+	user, err := store.StoreUser(entities.User{Email: "walt@breakingbad.com", Password: "pw"})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	status := http.StatusOK
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.NoError(t, signature.Verify([]byte("secret"), r.Header.Get(SignatureHeader), body, now, time.Minute))
+		assert.Equal(t, entities.HookChirpCreated, r.Header.Get(EventHeader))
+		received++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sub, err := store.CreateWebhookSubscription(entities.WebhookSubscription{UserID: user.ID, URL: server.URL, Events: []string{entities.HookChirpCreated}, Secret: "secret", Active: true})
+	assert.NoError(t, err)
+	delivered, err := store.EnqueueWebhookDelivery(entities.WebhookDelivery{SubscriptionID: sub.ID, EventID: "evt_1", Event: entities.HookChirpCreated, Payload: json.RawMessage(`{"id":"evt_1"}`)})
+	assert.NoError(t, err)
+	now = time.Now()
+
+	d := NewDispatcher(slog.Default(), store, server.Client())
+	d.now = func() time.Time { return now }
+
+	attempted, err := d.DispatchDue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, attempted)
+	delivered, err = store.GetWebhookDelivery(delivered.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, entities.DeliveryDelivered, delivered.Status)
+	assert.Equal(t, http.StatusOK, delivered.ResponseCode)
+
+	status = http.StatusInternalServerError
+	failing, err := store.EnqueueWebhookDelivery(entities.WebhookDelivery{SubscriptionID: sub.ID, EventID: "evt_2", Event: entities.HookChirpCreated, Payload: json.RawMessage(`{"id":"evt_2"}`)})
+	assert.NoError(t, err)
+	now = time.Now()
+
+	// every attempt backs off further until the delivery is dead
+	for i := 1; i <= entities.MaxDeliveryAttempts; i++ {
+		attempted, err := d.DispatchDue(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, attempted)
+		failing, err = store.GetWebhookDelivery(failing.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, i, failing.Attempts)
+		assert.Equal(t, http.StatusInternalServerError, failing.ResponseCode)
+
+		attempted, err = d.DispatchDue(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, attempted, "attempt %d is not due yet", i+1)
+		now = now.Add(entities.DeliveryBackoff(i))
+	}
+	assert.Equal(t, entities.DeliveryDead, failing.Status)
+	assert.Equal(t, 1+entities.MaxDeliveryAttempts, received)
+
+	// a dead letter can be retried once the receiver is back
+	status = http.StatusNoContent
+	failing.Retry(now)
+	_, err = store.UpdateWebhookDelivery(failing)
+	assert.NoError(t, err)
+	_, err = d.DispatchDue(context.Background())
+	assert.NoError(t, err)
+	failing, err = store.GetWebhookDelivery(failing.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, entities.DeliveryDelivered, failing.Status)
+}
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a receiver on the loopback was reached")
+	}))
+	defer server.Close()
+
+	_, err := NewClient().Post(server.URL, "application/json", nil)
+	assert.ErrorIs(t, err, ErrPrivateAddress)
+
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.215.14:443", true},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.0.0.1:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"[::]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"100.128.0.1:80", true},
+		{"198.18.0.1:80", false},
+		{"198.19.255.254:80", false},
+		{"192.0.0.9:80", false},
+		{"192.0.2.1:80", false},
+		{"198.51.100.1:80", false},
+		{"203.0.113.1:80", false},
+		{"192.88.99.1:80", false},
+		{"224.0.0.1:80", false},
+		{"240.0.0.1:80", false},
+		{"255.255.255.255:80", false},
+		{"[64:ff9b::a00:1]:80", false},
+		{"[2001:db8::1]:80", false},
+		{"[2002:a00:1::1]:80", false},
+		{"[ff02::1]:80", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := publicOnly("tcp", tt.address, nil)
+			if tt.public {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrPrivateAddress)
+			}
+		})
+	}
+}